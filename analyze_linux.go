@@ -0,0 +1,346 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Space used by the tables and indexes of a database, like the
+// sqlite3_analyzer program of SQLite.
+//
+//	.analyze-space ?--sql?
+//
+// .analyze-space walks the b-trees of the main database file directly and
+// writes a report of the pages, entries, payload, unused bytes and overflow
+// pages of every table and index. Fragmentation is the percentage of the
+// pages of a b-tree which do not follow the page before them in the order
+// the b-tree is walked, a full scan of a fragmented b-tree seeks more.
+//
+// With --sql, .analyze-space writes an SQL script which creates and fills
+// the space_used table of sqlite3_analyzer instead, see spaceUsedSchema.
+//
+// The pages are read from the database file, changes still in the WAL file
+// are not seen.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:  "analyze-space",
+		usage: "?--sql?",
+		help:  "Report the space used by each table and index",
+		run:   analyzeCommand,
+	})
+}
+
+const spaceUsedSchema = `CREATE TABLE space_used(
+   name clob,        -- Name of a table or index in the database file
+   tblname clob,     -- Name of associated table
+   is_index boolean, -- TRUE if it is an index, false for a table
+   is_without_rowid boolean, -- TRUE if WITHOUT ROWID table
+   nentry int,       -- Number of entries in the BTree
+   leaf_entries int, -- Number of leaf entries
+   depth int,        -- Depth of the b-tree
+   payload int,      -- Total amount of data stored in this table or index
+   ovfl_payload int, -- Total amount of data stored on overflow pages
+   ovfl_cnt int,     -- Number of entries that use overflow
+   mx_payload int,   -- Maximum payload size
+   int_pages int,    -- Number of interior pages used
+   leaf_pages int,   -- Number of leaf pages used
+   ovfl_pages int,   -- Number of overflow pages used
+   int_unused int,   -- Number of unused bytes on interior pages
+   leaf_unused int,  -- Number of unused bytes on primary pages
+   ovfl_unused int,  -- Number of unused bytes on overflow pages
+   gap_cnt int,      -- Number of gaps in the page layout
+   compressed_size int  -- Total bytes stored on disk
+);`
+
+// spaceUsed is a row of the space_used table.
+type spaceUsed struct {
+	name         string
+	tblName      string
+	isIndex      bool
+	withoutRowid bool
+	nEntry       int
+	leafEntries  int
+	depth        int
+	payload      int
+	ovflPayload  int
+	ovflCnt      int
+	mxPayload    int
+	intPages     int
+	leafPages    int
+	ovflPages    int
+	intUnused    int
+	leafUnused   int
+	ovflUnused   int
+	gapCnt       int
+	children     int // Of the interior pages.
+	last         int // Page walked last.
+}
+
+func (u *spaceUsed) pages() int { return u.intPages + u.leafPages + u.ovflPages }
+
+type analyzer struct {
+	s      *shell
+	d      *dbFile
+	seen   map[int]bool
+	errors int
+}
+
+func analyzeCommand(s *shell, args []string) error {
+	sql := false
+	for _, v := range args {
+		switch v {
+		case "-sql", "--sql":
+			sql = true
+		default:
+			return errUsage
+		}
+	}
+
+	rows, err := s.conn().query("SELECT type, name, tbl_name, rootpage, sql FROM main.sqlite_master WHERE rootpage > 0 ORDER BY rowid")
+	if err != nil {
+		return err
+	}
+
+	d, err := mainDBFile(s, "analyze")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	a := &analyzer{s: s, d: d, seen: map[int]bool{}}
+	used := []*spaceUsed{a.btree(&spaceUsed{name: "sqlite_master", tblName: "sqlite_master"}, 1)}
+	for _, v := range rows {
+		u := &spaceUsed{name: v[1].(string), tblName: v[2].(string), isIndex: v[0] == "index"}
+		if sql, ok := v[4].(string); ok && !u.isIndex {
+			u.withoutRowid = withoutRowidRe.MatchString(sql)
+		}
+		used = append(used, a.btree(u, int(v[3].(int64))))
+	}
+	if sql {
+		a.sql(used)
+		return nil
+	}
+
+	a.report(goString(s.state().XzDbFilename), used)
+	return nil
+}
+
+// btree walks the b-tree rooted at page root and returns u with its
+// statistics.
+func (a *analyzer) btree(u *spaceUsed, root int) *spaceUsed {
+	a.walk(u, root, 1)
+	return u
+}
+
+func (a *analyzer) walk(u *spaceUsed, pgno, depth int) {
+	if a.seen[pgno] {
+		a.errors++
+		return
+	}
+
+	a.seen[pgno] = true
+	p, err := a.d.btreePage(pgno)
+	if err != nil {
+		a.errors++
+		return
+	}
+
+	a.page(u, pgno)
+	if depth > u.depth {
+		u.depth = depth
+	}
+	unused, err := a.d.unused(p)
+	if err != nil {
+		a.errors++
+	}
+	switch {
+	case p.isLeaf():
+		u.leafPages++
+		u.leafUnused += unused
+		u.leafEntries += len(p.cells)
+		u.nEntry += len(p.cells)
+	default:
+		u.intPages++
+		u.intUnused += unused
+		u.children += len(p.cells) + 1
+		if !p.isTable() {
+			u.nEntry += len(p.cells)
+		}
+	}
+	var children []int
+	for i := range p.cells {
+		c, err := a.d.cell(p, i)
+		if err != nil {
+			a.errors++
+		}
+		if c == nil {
+			continue
+		}
+
+		u.payload += len(c.payload)
+		u.mxPayload = max(u.mxPayload, len(c.payload))
+		if len(c.overflow) != 0 {
+			u.ovflCnt++
+			u.ovflPages += len(c.overflow)
+			u.ovflPayload += len(c.payload) - c.local
+			u.ovflUnused += len(c.overflow)*(a.d.usable-4) - (len(c.payload) - c.local)
+			for _, v := range c.overflow {
+				a.seen[v] = true
+				a.page(u, v)
+			}
+		}
+		if !p.isLeaf() {
+			children = append(children, c.child)
+		}
+	}
+	if !p.isLeaf() {
+		for _, v := range append(children, p.right) {
+			a.walk(u, v, depth+1)
+		}
+	}
+}
+
+// page counts a gap if pgno does not follow the page walked before it.
+func (a *analyzer) page(u *spaceUsed, pgno int) {
+	if u.last != 0 && pgno != u.last+1 {
+		u.gapCnt++
+	}
+	u.last = pgno
+}
+
+func (a *analyzer) sql(used []*spaceUsed) {
+	a.s.printf("BEGIN;\n%s\n", spaceUsedSchema)
+	for _, u := range used {
+		a.s.printf("INSERT INTO space_used VALUES(%s,%s,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d,%d);\n",
+			sqlQuote(u.name), sqlQuote(u.tblName), boolInt(u.isIndex), boolInt(u.withoutRowid),
+			u.nEntry, u.leafEntries, u.depth, u.payload, u.ovflPayload, u.ovflCnt, u.mxPayload,
+			u.intPages, u.leafPages, u.ovflPages, u.intUnused, u.leafUnused, u.ovflUnused,
+			u.gapCnt, u.pages()*a.d.pageSize)
+	}
+	a.s.printf("COMMIT;\n")
+	if a.errors != 0 {
+		a.s.printf("-- %d errors, the database may be corrupt\n", a.errors)
+	}
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// line writes a line of the report like the statline procedure of
+// sqlite3_analyzer: the title padded with dots, the value and, if any, a
+// percentage.
+func (a *analyzer) line(title string, value interface{}, pct ...float64) {
+	v := fmt.Sprint(value)
+	if f, ok := value.(float64); ok {
+		v = fmt.Sprintf("%.2f", f)
+	}
+	s := fmt.Sprintf("%s%s %s", title, strings.Repeat(".", max(50-len(title), 0)), v)
+	if len(pct) != 0 {
+		s += fmt.Sprintf("%s %5.1f%%", strings.Repeat(" ", max(10-len(v), 0)), pct[0])
+	}
+	a.s.printf("%s\n", s)
+}
+
+func (a *analyzer) title(s string) {
+	s = "*** " + s + " "
+	a.s.printf("\n%s%s\n\n", s, strings.Repeat("*", max(79-len(s), 4)))
+}
+
+func percent(a, b int) float64 {
+	if b <= 0 {
+		return 0
+	}
+
+	return 100 * float64(a) / float64(b)
+}
+
+func (a *analyzer) report(name string, used []*spaceUsed) {
+	d := a.d
+	free, err := d.freelist()
+	if err != nil {
+		a.errors++
+	}
+	ptrmap, data, tables, indexes := 0, 0, 0, 0
+	for n := 1; n <= d.nPage; n++ {
+		if d.isPtrmap(n) {
+			ptrmap++
+		}
+	}
+	for _, u := range used {
+		data += u.pages()
+		if u.isIndex {
+			indexes++
+			continue
+		}
+
+		tables++
+	}
+	a.s.printf("/** Disk-Space Utilization Report For %s\n\n", name)
+	a.line("Page size in bytes", d.pageSize)
+	a.line("Pages in the whole file (measured)", d.nPage)
+	a.line("Pages in the whole file (from header)", int(binary.BigEndian.Uint32(d.header[28:])))
+	a.line("Pages that store data", data, percent(data, d.nPage))
+	a.line("Pages on the freelist (per header)", int(binary.BigEndian.Uint32(d.header[36:])), percent(int(binary.BigEndian.Uint32(d.header[36:])), d.nPage))
+	a.line("Pages on the freelist (calculated)", len(free), percent(len(free), d.nPage))
+	a.line("Pages of auto-vacuum overhead", ptrmap, percent(ptrmap, d.nPage))
+	a.line("Number of tables in the database", tables)
+	a.line("Number of indexes", indexes)
+	a.line("Size of the file in bytes", d.nPage*d.pageSize)
+
+	sorted := append([]*spaceUsed(nil), used...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].pages() > sorted[j].pages() })
+	a.title("Page counts for all tables and indexes")
+	for _, u := range sorted {
+		a.line(strings.ToUpper(u.name), u.pages(), percent(u.pages(), d.nPage))
+	}
+	for _, u := range sorted {
+		switch {
+		case u.isIndex:
+			a.title(fmt.Sprintf("Index %s of table %s", strings.ToUpper(u.name), strings.ToUpper(u.tblName)))
+		default:
+			a.title(fmt.Sprintf("Table %s", strings.ToUpper(u.name)))
+		}
+		storage := u.pages() * d.pageSize
+		a.line("Percentage of total database", fmt.Sprintf("%.1f%%", percent(u.pages(), d.nPage)))
+		a.line("Number of entries", u.nEntry)
+		a.line("Bytes of storage consumed", storage)
+		a.line("Bytes of payload", u.payload, percent(u.payload, storage))
+		if u.ovflPayload != 0 {
+			a.line("Bytes of payload in overflow", u.ovflPayload, percent(u.ovflPayload, u.payload))
+		}
+		if u.nEntry != 0 {
+			a.line("Average payload per entry", float64(u.payload)/float64(u.nEntry))
+		}
+		a.line("Maximum payload size", u.mxPayload)
+		a.line("Entries that use overflow", u.ovflCnt, percent(u.ovflCnt, u.nEntry))
+		if u.intPages != 0 {
+			a.line("Average fanout", float64(u.children)/float64(u.intPages))
+		}
+		a.line("Tree depth", u.depth)
+		a.line("Interior pages used", u.intPages)
+		a.line("Leaf pages used", u.leafPages)
+		a.line("Overflow pages used", u.ovflPages)
+		a.line("Total pages used", u.pages())
+		if u.intPages != 0 {
+			a.line("Unused bytes on interior pages", u.intUnused, percent(u.intUnused, u.intPages*d.pageSize))
+		}
+		a.line("Unused bytes on leaf pages", u.leafUnused, percent(u.leafUnused, u.leafPages*d.pageSize))
+		if u.ovflPages != 0 {
+			a.line("Unused bytes on overflow pages", u.ovflUnused, percent(u.ovflUnused, u.ovflPages*d.pageSize))
+		}
+		unused := u.intUnused + u.leafUnused + u.ovflUnused
+		a.line("Unused bytes on all pages", unused, percent(unused, storage))
+		a.line("Fragmentation", fmt.Sprintf("%.1f%%", percent(u.gapCnt, u.pages()-1)))
+	}
+	if a.errors != 0 {
+		a.s.printf("\n%d errors, the database may be corrupt\n", a.errors)
+	}
+}
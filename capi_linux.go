@@ -0,0 +1,236 @@
+package main
+
+import (
+	"sync"
+	"unsafe"
+)
+
+// Helpers for the hand written parts of the shell. They talk to the
+// generated SQLite only through its public Xsqlite3_* API so they work with
+// both ports.
+
+const (
+	sqliteOK         = 0
+	sqliteError      = 1
+	sqliteBusy       = 5
+	sqliteNoMem      = 7
+	sqliteConstraint = 19
+	sqliteRow        = 100
+	sqliteDone       = 101
+)
+
+// Fundamental datatypes.
+const (
+	sqliteInteger = 1
+	sqliteFloat   = 2
+	sqliteText    = 3
+	sqliteBlob    = 4
+	sqliteNull    = 5
+)
+
+const (
+	sqliteUTF8          = 1
+	sqliteDeterministic = 0x800
+
+	sqliteIndexConstraintEQ = 2
+
+	// sqliteTransient is the SQLITE_TRANSIENT destructor.
+	sqliteTransient = ^uintptr(0)
+
+	ptrSize = unsafe.Sizeof(uintptr(0))
+)
+
+type rawmem [1 << 30]byte
+
+// goString returns a copy of the zero terminated C string at p.
+func goString(p uintptr) string {
+	if p == 0 {
+		return ""
+	}
+
+	n := 0
+	for (*rawmem)(unsafe.Pointer(p))[n] != 0 {
+		n++
+	}
+	return string((*rawmem)(unsafe.Pointer(p))[:n:n])
+}
+
+// goBytes returns a copy of the n bytes at p.
+func goBytes(p uintptr, n int) []byte {
+	if p == 0 || n <= 0 {
+		return nil
+	}
+
+	b := make([]byte, n)
+	copy(b, (*rawmem)(unsafe.Pointer(p))[:n:n])
+	return b
+}
+
+// cString returns a zero terminated copy of s allocated by sqlite3_malloc or
+// zero when out of memory.
+func cString(tls TLS, s string) uintptr {
+	p := Xsqlite3_malloc(tls, int32(len(s)+1))
+	if p == 0 {
+		return 0
+	}
+
+	copy((*rawmem)(unsafe.Pointer(p))[:len(s)], s)
+	(*rawmem)(unsafe.Pointer(p))[len(s)] = 0
+	return p
+}
+
+// cBytes returns a copy of b allocated by sqlite3_malloc or zero when out of
+// memory. The allocation is never empty so a zero result always means OOM.
+func cBytes(tls TLS, b []byte) uintptr {
+	p := Xsqlite3_malloc(tls, int32(len(b)+1))
+	if p == 0 {
+		return 0
+	}
+
+	copy((*rawmem)(unsafe.Pointer(p))[:len(b)], b)
+	return p
+}
+
+// cZero returns n zeroed bytes allocated by sqlite3_malloc or zero when out
+// of memory.
+func cZero(tls TLS, n uintptr) uintptr {
+	p := Xsqlite3_malloc(tls, int32(n))
+	if p == 0 {
+		return 0
+	}
+
+	b := (*rawmem)(unsafe.Pointer(p))[:n:n]
+	for i := range b {
+		b[i] = 0
+	}
+	return p
+}
+
+// argv returns the i-th element of the C pointer array at p.
+func argv(p uintptr, i int) uintptr {
+	return *(*uintptr)(unsafe.Pointer(p + uintptr(i)*ptrSize))
+}
+
+func valueText(tls TLS, v uintptr) string {
+	p := Xsqlite3_value_text(tls, v)
+	return string(goBytes(p, int(Xsqlite3_value_bytes(tls, v))))
+}
+
+func valueBlob(tls TLS, v uintptr) []byte {
+	p := Xsqlite3_value_blob(tls, v)
+	return goBytes(p, int(Xsqlite3_value_bytes(tls, v)))
+}
+
+func resultText(tls TLS, ctx uintptr, s string) {
+	p := cString(tls, s)
+	if p == 0 {
+		Xsqlite3_result_error_nomem(tls, ctx)
+		return
+	}
+
+	Xsqlite3_result_text(tls, ctx, p, int32(len(s)), cfnFinal(Xsqlite3_free))
+}
+
+func resultBlob(tls TLS, ctx uintptr, b []byte) {
+	p := cBytes(tls, b)
+	if p == 0 {
+		Xsqlite3_result_error_nomem(tls, ctx)
+		return
+	}
+
+	Xsqlite3_result_blob(tls, ctx, p, int32(len(b)), cfnFinal(Xsqlite3_free))
+}
+
+func resultError(tls TLS, ctx uintptr, msg string) {
+	p := cString(tls, msg)
+	if p == 0 {
+		Xsqlite3_result_error_nomem(tls, ctx)
+		return
+	}
+
+	Xsqlite3_result_error(tls, ctx, p, int32(len(msg)))
+	Xsqlite3_free(tls, p)
+}
+
+// vtabError replaces the error message of the virtual table tab with msg and
+// returns SQLITE_ERROR.
+func vtabError(tls TLS, tab uintptr, msg string) int32 {
+	t := (*Ssqlite3_vtab)(unsafe.Pointer(tab))
+	Xsqlite3_free(tls, t.XzErrMsg)
+	t.XzErrMsg = cString(tls, msg)
+	return sqliteError
+}
+
+func indexConstraint(info *Ssqlite3_index_info, i int) *Ssqlite3_index_constraint {
+	return (*Ssqlite3_index_constraint)(unsafe.Pointer(info.XaConstraint + uintptr(i)*unsafe.Sizeof(Ssqlite3_index_constraint{})))
+}
+
+func indexConstraintUsage(info *Ssqlite3_index_info, i int) *Ssqlite3_index_constraint_usage {
+	return (*Ssqlite3_index_constraint_usage)(unsafe.Pointer(info.XaConstraintUsage + uintptr(i)*unsafe.Sizeof(Ssqlite3_index_constraint_usage{})))
+}
+
+func indexOrderBy(info *Ssqlite3_index_info, i int) *Ssqlite3_index_orderby {
+	return (*Ssqlite3_index_orderby)(unsafe.Pointer(info.XaOrderBy + uintptr(i)*unsafe.Sizeof(Ssqlite3_index_orderby{})))
+}
+
+// objects maps the addresses of C allocated SQLite objects, like virtual
+// table cursors, to the Go values backing them.
+var objects = struct {
+	sync.Mutex
+	m map[uintptr]interface{}
+}{m: map[uintptr]interface{}{}}
+
+func putObject(p uintptr, v interface{}) {
+	objects.Lock()
+	objects.m[p] = v
+	objects.Unlock()
+}
+
+func getObject(p uintptr) interface{} {
+	objects.Lock()
+	v := objects.m[p]
+	objects.Unlock()
+	return v
+}
+
+func deleteObject(p uintptr) {
+	objects.Lock()
+	delete(objects.m, p)
+	objects.Unlock()
+}
+
+// The cfn* functions return the C function pointer representation, as used
+// by the generated code, of a top level Go function. They must not be used
+// with closures.
+
+func cfnFinal(f func(TLS, uintptr)) uintptr { return *(*uintptr)(unsafe.Pointer(&f)) }
+
+func cfnFunc(f func(TLS, uintptr, int32, uintptr)) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnConnect(f func(TLS, uintptr, uintptr, int32, uintptr, uintptr, uintptr) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnVtab(f func(TLS, uintptr) int32) uintptr { return *(*uintptr)(unsafe.Pointer(&f)) }
+
+func cfnVtab2(f func(TLS, uintptr, uintptr) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnFilter(f func(TLS, uintptr, int32, uintptr, int32, uintptr) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnColumn(f func(TLS, uintptr, uintptr, int32) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnUpdate(f func(TLS, uintptr, int32, uintptr, uintptr) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
+
+func cfnFindFunction(f func(TLS, uintptr, int32, uintptr, uintptr, uintptr) int32) uintptr {
+	return *(*uintptr)(unsafe.Pointer(&f))
+}
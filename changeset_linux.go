@@ -0,0 +1,803 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strings"
+)
+
+// Changesets and patchsets in the format of the session extension of
+// SQLite.
+//
+//	.changeset apply FILE ?--conflict omit|replace|abort?
+//	.changeset concat FILE1 FILE2 OUT
+//	.changeset invert FILE OUT
+//
+// A changeset is a sequence of tables, each followed by its changes:
+//
+//	'T' nCol PK[nCol] name\0          'P' for patchsets
+//	op indirect record...             op is INSERT 18, UPDATE 23 or DELETE 9
+//
+// An INSERT has the new record, a DELETE the old one and an UPDATE the old
+// and the new one. In patchsets a DELETE has only the PRIMARY KEY fields and
+// an UPDATE only the new record, with the PRIMARY KEY set. A record is nCol
+// values: a type byte followed by 8 bytes big endian for integers and reals
+// or a varint length and the bytes for text and blobs. Undefined values, of
+// the columns not changed by an UPDATE, and NULLs have only the type byte.
+//
+// apply handles the conflicts like sqlite3changeset_apply. A DELETE or an
+// UPDATE conflicts if the old values of the row are not those of the change,
+// or the row is not found, an INSERT if the PRIMARY KEY exists or a
+// constraint fails. The conflicts are omitted, replace the row or, by
+// default, abort the whole changeset.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:  "changeset",
+		usage: "apply|concat|invert ARGS...",
+		help: `Apply and edit changesets of .session
+apply FILE ?--conflict omit|replace|abort?
+  Apply the changeset FILE to the main database
+concat FILE1 FILE2 OUT
+  Write the changes of FILE1 and FILE2 to OUT
+invert FILE OUT
+  Write the changeset undoing FILE to OUT`,
+		run: changesetCommand,
+	})
+}
+
+// Operations of changes.
+const (
+	changeDelete = 9
+	changeInsert = 18
+	changeUpdate = 23
+)
+
+// Value types of records. The others are those of sqlite3_column_type.
+const changeUndefined = 0
+
+// undefined is the value of the columns an UPDATE does not change.
+type undefinedValue struct{}
+
+var undefined = undefinedValue{}
+
+var errChangesetCorrupt = errors.New("changeset is corrupt")
+
+// changeTable is a table of a changeset and its changes.
+type changeTable struct {
+	name    string
+	pk      []int // Position of the column in the PRIMARY KEY, 0 if none.
+	changes []*change
+}
+
+// change is a change of a row. The values are those of sqlStmt.column or
+// undefined.
+type change struct {
+	op       int
+	indirect bool
+	old, new []interface{}
+}
+
+type changeset struct {
+	patchset bool
+	tables   []*changeTable
+}
+
+func (t *changeTable) key(values []interface{}) string {
+	var b []byte
+	for i, v := range values {
+		if t.pk[i] != 0 {
+			b = putChangeValue(b, v)
+		}
+	}
+	return string(b)
+}
+
+// readChangeset reads the changeset or patchset file name.
+func readChangeset(name string) (*changeset, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cs, err := parseChangeset(b)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+
+	return cs, nil
+}
+
+func parseChangeset(b []byte) (*changeset, error) {
+	cs := &changeset{}
+	var t *changeTable
+	for len(b) != 0 {
+		switch c := b[0]; {
+		case c == 'T' || c == 'P':
+			if len(cs.tables) != 0 && (c == 'P') != cs.patchset {
+				return nil, errors.New("mixed changeset and patchset")
+			}
+
+			cs.patchset = c == 'P'
+			n, k := getVarint(b[1:])
+			if k == 0 || n > uint64(len(b)) || uint64(len(b)) < 1+uint64(k)+n {
+				return nil, errChangesetCorrupt
+			}
+
+			b = b[1+k:]
+			t = &changeTable{pk: make([]int, n)}
+			for i := range t.pk {
+				t.pk[i] = int(b[i])
+			}
+			b = b[n:]
+			i := bytes.IndexByte(b, 0)
+			if i < 0 {
+				return nil, errChangesetCorrupt
+			}
+
+			t.name = string(b[:i])
+			b = b[i+1:]
+			cs.tables = append(cs.tables, t)
+		case t == nil || len(b) < 2:
+			return nil, errChangesetCorrupt
+		default:
+			ch := &change{op: int(c), indirect: b[1] != 0}
+			b = b[2:]
+			var err error
+			switch {
+			case ch.op == changeDelete && cs.patchset:
+				ch.old, b, err = readChangeRecord(b, t.pk, true)
+			case ch.op == changeDelete:
+				ch.old, b, err = readChangeRecord(b, t.pk, false)
+			case ch.op == changeInsert:
+				ch.new, b, err = readChangeRecord(b, t.pk, false)
+			case ch.op == changeUpdate && cs.patchset:
+				ch.new, b, err = readChangeRecord(b, t.pk, false)
+			case ch.op == changeUpdate:
+				if ch.old, b, err = readChangeRecord(b, t.pk, false); err == nil {
+					ch.new, b, err = readChangeRecord(b, t.pk, false)
+				}
+			default:
+				err = errChangesetCorrupt
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			t.changes = append(t.changes, ch)
+		}
+	}
+	return cs, nil
+}
+
+// readChangeRecord reads a record of len(pk) values or, if pkOnly, of the
+// PRIMARY KEY values only.
+func readChangeRecord(b []byte, pk []int, pkOnly bool) ([]interface{}, []byte, error) {
+	r := make([]interface{}, len(pk))
+	for i := range r {
+		if pkOnly && pk[i] == 0 {
+			r[i] = undefined
+			continue
+		}
+
+		if len(b) == 0 {
+			return nil, nil, errChangesetCorrupt
+		}
+
+		typ := b[0]
+		b = b[1:]
+		switch typ {
+		case changeUndefined:
+			r[i] = undefined
+		case sqliteNull:
+			r[i] = nil
+		case sqliteInteger, sqliteFloat:
+			if len(b) < 8 {
+				return nil, nil, errChangesetCorrupt
+			}
+
+			v := binary.BigEndian.Uint64(b)
+			b = b[8:]
+			if typ == sqliteInteger {
+				r[i] = int64(v)
+				break
+			}
+
+			r[i] = math.Float64frombits(v)
+		case sqliteText, sqliteBlob:
+			n, k := getVarint(b)
+			if k == 0 || uint64(len(b)-k) < n {
+				return nil, nil, errChangesetCorrupt
+			}
+
+			v := append([]byte{}, b[k:k+int(n)]...)
+			b = b[k+int(n):]
+			if typ == sqliteText {
+				r[i] = string(v)
+				break
+			}
+
+			r[i] = v
+		default:
+			return nil, nil, errChangesetCorrupt
+		}
+	}
+	return r, b, nil
+}
+
+// bytes returns cs in the changeset format.
+func (cs *changeset) bytes() []byte {
+	var b []byte
+	for _, t := range cs.tables {
+		if len(t.changes) == 0 {
+			continue
+		}
+
+		c := byte('T')
+		if cs.patchset {
+			c = 'P'
+		}
+		b = append(b, c)
+		b = putVarint(b, uint64(len(t.pk)))
+		for _, v := range t.pk {
+			b = append(b, byte(v))
+		}
+		b = append(b, t.name...)
+		b = append(b, 0)
+		for _, ch := range t.changes {
+			b = append(b, byte(ch.op), 0)
+			if ch.indirect {
+				b[len(b)-1] = 1
+			}
+			switch {
+			case ch.op == changeDelete && cs.patchset:
+				for i, v := range ch.old {
+					if t.pk[i] != 0 {
+						b = putChangeValue(b, v)
+					}
+				}
+			case ch.op == changeDelete:
+				b = putChangeRecord(b, ch.old)
+			case ch.op == changeInsert:
+				b = putChangeRecord(b, ch.new)
+			case ch.op == changeUpdate && cs.patchset:
+				b = putChangeRecord(b, ch.new)
+			default:
+				b = putChangeRecord(b, ch.old)
+				b = putChangeRecord(b, ch.new)
+			}
+		}
+	}
+	return b
+}
+
+func putChangeRecord(b []byte, values []interface{}) []byte {
+	for _, v := range values {
+		b = putChangeValue(b, v)
+	}
+	return b
+}
+
+func putChangeValue(b []byte, v interface{}) []byte {
+	var buf [8]byte
+	switch x := v.(type) {
+	case int64:
+		binary.BigEndian.PutUint64(buf[:], uint64(x))
+		return append(append(b, sqliteInteger), buf[:]...)
+	case float64:
+		binary.BigEndian.PutUint64(buf[:], math.Float64bits(x))
+		return append(append(b, sqliteFloat), buf[:]...)
+	case string:
+		b = putVarint(append(b, sqliteText), uint64(len(x)))
+		return append(b, x...)
+	case []byte:
+		b = putVarint(append(b, sqliteBlob), uint64(len(x)))
+		return append(b, x...)
+	case nil:
+		return append(b, sqliteNull)
+	}
+	return append(b, changeUndefined)
+}
+
+// putVarint appends the varint v, see getVarint.
+func putVarint(b []byte, v uint64) []byte {
+	var buf [9]byte
+	if v>>56 != 0 {
+		buf[8] = byte(v)
+		v >>= 8
+		for i := 7; i >= 0; i-- {
+			buf[i] = byte(v) | 0x80
+			v >>= 7
+		}
+		return append(b, buf[:]...)
+	}
+
+	n := 0
+	for {
+		buf[n] = byte(v) | 0x80
+		n++
+		if v >>= 7; v == 0 {
+			break
+		}
+	}
+	buf[0] &= 0x7f
+	for i := n - 1; i >= 0; i-- {
+		b = append(b, buf[i])
+	}
+	return b
+}
+
+func changesetCommand(s *shell, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "apply":
+		policy := "abort"
+		switch {
+		case len(args) == 3 && (args[1] == "-conflict" || args[1] == "--conflict"):
+			policy = args[2]
+			if policy != "omit" && policy != "replace" && policy != "abort" {
+				return errUsage
+			}
+		case len(args) != 1:
+			return errUsage
+		}
+
+		cs, err := readChangeset(args[0])
+		if err != nil {
+			return err
+		}
+
+		return applyChangeset(s, cs, policy)
+	case "concat":
+		if len(args) != 3 {
+			return errUsage
+		}
+
+		a, err := readChangeset(args[0])
+		if err != nil {
+			return err
+		}
+
+		b, err := readChangeset(args[1])
+		if err != nil {
+			return err
+		}
+
+		cs, err := concatChangesets(a, b)
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(args[2], cs.bytes(), 0666)
+	case "invert":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		cs, err := readChangeset(args[0])
+		if err != nil {
+			return err
+		}
+
+		if cs.patchset {
+			return errors.New("cannot invert a patchset")
+		}
+
+		return ioutil.WriteFile(args[1], cs.invert().bytes(), 0666)
+	}
+	return errUsage
+}
+
+// invert returns the changeset undoing cs.
+func (cs *changeset) invert() *changeset {
+	r := &changeset{}
+	for _, t := range cs.tables {
+		u := &changeTable{name: t.name, pk: t.pk}
+		for _, ch := range t.changes {
+			v := &change{op: ch.op, indirect: ch.indirect}
+			switch ch.op {
+			case changeInsert:
+				v.op, v.old = changeDelete, ch.new
+			case changeDelete:
+				v.op, v.new = changeInsert, ch.old
+			default:
+				v.old = make([]interface{}, len(ch.old))
+				v.new = make([]interface{}, len(ch.new))
+				for i := range ch.old {
+					v.old[i], v.new[i] = ch.old[i], undefined
+					if ch.new[i] != undefined {
+						v.old[i], v.new[i] = ch.new[i], ch.old[i]
+					}
+				}
+			}
+			u.changes = append(u.changes, v)
+		}
+		r.tables = append(r.tables, u)
+	}
+	return r
+}
+
+// concatChangesets returns the changeset of the changes of a followed by
+// those of b, see sqlite3changeset_concat.
+func concatChangesets(a, b *changeset) (*changeset, error) {
+	if len(a.tables) != 0 && len(b.tables) != 0 && a.patchset != b.patchset {
+		return nil, errors.New("cannot concatenate a changeset and a patchset")
+	}
+
+	r := &changeset{patchset: a.patchset || b.patchset}
+	tables := map[string]*changeTable{}
+	rows := map[*changeTable]map[string]int{} // Key: index of the change.
+	for _, cs := range []*changeset{a, b} {
+		for _, t := range cs.tables {
+			u := tables[strings.ToLower(t.name)]
+			if u == nil {
+				u = &changeTable{name: t.name, pk: t.pk}
+				tables[strings.ToLower(t.name)] = u
+				rows[u] = map[string]int{}
+				r.tables = append(r.tables, u)
+			}
+			if len(u.pk) != len(t.pk) {
+				return nil, fmt.Errorf("table %s: different number of columns", t.name)
+			}
+
+			for i, v := range u.pk {
+				if v != t.pk[i] {
+					return nil, fmt.Errorf("table %s: different PRIMARY KEY", t.name)
+				}
+			}
+			for _, ch := range t.changes {
+				k := t.key(ch.values())
+				i, ok := rows[u][k]
+				if !ok {
+					rows[u][k] = len(u.changes)
+					u.changes = append(u.changes, ch)
+					continue
+				}
+
+				u.changes[i] = combineChanges(u.changes[i], ch, u.pk, r.patchset)
+			}
+		}
+	}
+	for _, t := range r.tables {
+		w := 0
+		for _, ch := range t.changes {
+			if ch != nil {
+				t.changes[w] = ch
+				w++
+			}
+		}
+		t.changes = t.changes[:w]
+	}
+	return r, nil
+}
+
+// values returns the values identifying the row of ch.
+func (ch *change) values() []interface{} {
+	if ch.op == changeDelete || ch.op == changeUpdate && ch.old != nil {
+		return ch.old
+	}
+
+	return ch.new
+}
+
+// combineChanges returns the change of a followed by b or nil if there is
+// none.
+func combineChanges(a, b *change, pk []int, patchset bool) *change {
+	if a == nil {
+		return b
+	}
+
+	r := &change{op: a.op, indirect: a.indirect && b.indirect}
+	switch {
+	case a.op == changeInsert && b.op == changeUpdate:
+		r.new = mergeValues(a.new, b.new)
+	case a.op == changeInsert && b.op == changeDelete:
+		return nil
+	case a.op == changeUpdate && b.op == changeUpdate:
+		r.new = mergeValues(a.new, b.new)
+		if !patchset {
+			// The second UPDATE may restore the values of the row.
+			r.old = mergeValues(b.old, a.old)
+			changed := false
+			for i, v := range r.new {
+				switch {
+				case pk[i] != 0:
+				case sameValue(r.old[i], v):
+					r.old[i], r.new[i] = undefined, undefined
+				default:
+					changed = true
+				}
+			}
+			if !changed {
+				return nil
+			}
+		}
+	case a.op == changeUpdate && b.op == changeDelete:
+		r.op = changeDelete
+		r.old = b.old
+		if !patchset {
+			r.old = mergeValues(b.old, a.old)
+		}
+	case a.op == changeDelete && b.op == changeInsert:
+		r.op = changeUpdate
+		r.new = append([]interface{}{}, b.new...)
+		if !patchset {
+			r.old = append([]interface{}{}, a.old...)
+		}
+		changed := false
+		for i, v := range b.new {
+			switch {
+			case pk[i] != 0 && !patchset:
+				r.new[i] = undefined
+			case pk[i] == 0 && sameValue(a.old[i], v):
+				if r.old != nil {
+					r.old[i] = undefined
+				}
+				r.new[i] = undefined
+			case pk[i] == 0:
+				changed = true
+			}
+		}
+		if !changed {
+			return nil
+		}
+	default:
+		// INSERT or UPDATE of an existing row, DELETE or UPDATE of a
+		// deleted one: the second change cannot apply.
+		return a
+	}
+	return r
+}
+
+// mergeValues returns a with the values of b that are defined.
+func mergeValues(a, b []interface{}) []interface{} {
+	r := append([]interface{}{}, a...)
+	for i, v := range b {
+		if v != undefined {
+			r[i] = v
+		}
+	}
+	return r
+}
+
+func sameValue(a, b interface{}) bool {
+	if x, ok := a.([]byte); ok {
+		y, ok := b.([]byte)
+		return ok && bytes.Equal(x, y)
+	}
+
+	if _, ok := b.([]byte); ok {
+		return false
+	}
+
+	return a == b
+}
+
+// applyChangeset applies cs to the main database of the shell s.
+func applyChangeset(s *shell, cs *changeset, policy string) error {
+	c := s.conn()
+	if err := c.exec("SAVEPOINT changeset"); err != nil {
+		return err
+	}
+
+	applied, conflicts, err := 0, 0, error(nil)
+	for _, t := range cs.tables {
+		var n, k int
+		if n, k, err = applyTable(c, t, policy); err != nil {
+			break
+		}
+
+		applied += n
+		conflicts += k
+	}
+	if err != nil {
+		c.exec("ROLLBACK TO changeset")
+		c.exec("RELEASE changeset")
+		return err
+	}
+
+	if err := c.exec("RELEASE changeset"); err != nil {
+		return err
+	}
+
+	s.printf("%d changes applied, %d conflicts\n", applied, conflicts)
+	return nil
+}
+
+func applyTable(c *sqlConn, t *changeTable, policy string) (applied, conflicts int, err error) {
+	rows, err := c.query("SELECT name, pk FROM pragma_table_info(?) ORDER BY cid", t.name)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	if len(rows) != len(t.pk) {
+		return 0, 0, fmt.Errorf("table %s: changeset has %d columns, the table has %d", t.name, len(t.pk), len(rows))
+	}
+
+	cols := make([]string, len(rows))
+	for i, v := range rows {
+		cols[i] = sqlQuoteID(v[0].(string))
+		if int(v[1].(int64)) != t.pk[i] {
+			return 0, 0, fmt.Errorf("table %s: the PRIMARY KEY does not match", t.name)
+		}
+	}
+	table := "main." + sqlQuoteID(t.name)
+	// where returns the condition selecting the row with the values of
+	// the PRIMARY KEY and, unless pkOnly, those of the other defined
+	// columns.
+	where := func(values []interface{}, pkOnly bool) (string, []interface{}) {
+		var a []string
+		var args []interface{}
+		for i, v := range values {
+			if v == undefined || pkOnly && t.pk[i] == 0 {
+				continue
+			}
+
+			a = append(a, cols[i]+" IS ?")
+			args = append(args, v)
+		}
+		return strings.Join(a, " AND "), args
+	}
+	exists := func(values []interface{}) (bool, error) {
+		w, args := where(values, true)
+		row, err := c.queryRow(fmt.Sprintf("SELECT 1 FROM %s WHERE %s", table, w), args...)
+		return row != nil, err
+	}
+	changes := func() int { return int(Xsqlite3_changes(c.tls, c.db)) }
+
+	for _, ch := range t.changes {
+		var conflict string
+		switch ch.op {
+		case changeDelete:
+			w, args := where(ch.old, false)
+			if err := c.exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, w), args...); err != nil {
+				return applied, conflicts, err
+			}
+
+			if changes() != 0 {
+				break
+			}
+
+			ok, err := exists(ch.old)
+			switch {
+			case err != nil:
+				return applied, conflicts, err
+			case !ok:
+				conflict = "NOTFOUND"
+			case policy == "replace":
+				w, args := where(ch.old, true)
+				if err := c.exec(fmt.Sprintf("DELETE FROM %s WHERE %s", table, w), args...); err != nil {
+					return applied, conflicts, err
+				}
+
+				conflicts++
+			default:
+				conflict = "DATA"
+			}
+		case changeInsert:
+			var names, params []string
+			var args []interface{}
+			for i, v := range ch.new {
+				if v != undefined {
+					names = append(names, cols[i])
+					params = append(params, "?")
+					args = append(args, v)
+				}
+			}
+			verb := "INSERT"
+			if policy == "replace" {
+				verb = "INSERT OR REPLACE"
+			}
+			ok, err := exists(ch.new)
+			if err != nil {
+				return applied, conflicts, err
+			}
+
+			if ok {
+				conflicts++
+				if policy != "replace" {
+					conflict = "CONFLICT"
+					break
+				}
+			}
+			if err := c.exec(fmt.Sprintf("%s INTO %s(%s) VALUES(%s)", verb, table, strings.Join(names, ","), strings.Join(params, ",")), args...); err != nil {
+				if Xsqlite3_errcode(c.tls, c.db)&0xff != sqliteConstraint {
+					return applied, conflicts, err
+				}
+
+				if !ok {
+					conflicts++
+				}
+				conflict = "CONSTRAINT"
+			}
+		case changeUpdate:
+			old := ch.old
+			if old == nil { // Patchset.
+				old = make([]interface{}, len(ch.new))
+				for i, v := range ch.new {
+					old[i] = undefined
+					if t.pk[i] != 0 {
+						old[i] = v
+					}
+				}
+			}
+			var set []string
+			var args []interface{}
+			for i, v := range ch.new {
+				if v != undefined && t.pk[i] == 0 {
+					set = append(set, cols[i]+" = ?")
+					args = append(args, v)
+				}
+			}
+			if len(set) == 0 {
+				break
+			}
+
+			w, wargs := where(old, false)
+			if err := c.exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(set, ", "), w), append(args, wargs...)...); err != nil {
+				if Xsqlite3_errcode(c.tls, c.db)&0xff != sqliteConstraint {
+					return applied, conflicts, err
+				}
+
+				conflicts++
+				conflict = "CONSTRAINT"
+				break
+			}
+
+			if changes() != 0 {
+				break
+			}
+
+			ok, err := exists(old)
+			switch {
+			case err != nil:
+				return applied, conflicts, err
+			case !ok:
+				conflict = "NOTFOUND"
+			case policy == "replace":
+				w, wargs := where(old, true)
+				if err := c.exec(fmt.Sprintf("UPDATE %s SET %s WHERE %s", table, strings.Join(set, ", "), w), append(args, wargs...)...); err != nil {
+					return applied, conflicts, err
+				}
+
+				conflicts++
+			default:
+				conflict = "DATA"
+			}
+		}
+		switch {
+		case conflict == "":
+			applied++
+		case conflict == "NOTFOUND":
+			conflicts++
+			if policy == "abort" {
+				return applied, conflicts, fmt.Errorf("table %s: %s conflict, row not found", t.name, opName(ch.op))
+			}
+		case conflict == "DATA":
+			conflicts++
+			if policy == "abort" {
+				return applied, conflicts, fmt.Errorf("table %s: %s conflict (%s)", t.name, opName(ch.op), conflict)
+			}
+		case policy == "abort":
+			return applied, conflicts, fmt.Errorf("table %s: %s conflict (%s)", t.name, opName(ch.op), conflict)
+		}
+	}
+	return applied, conflicts, nil
+}
+
+func opName(op int) string {
+	switch op {
+	case changeDelete:
+		return "DELETE"
+	case changeInsert:
+		return "INSERT"
+	}
+	return "UPDATE"
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+// The changesets below were written by the session extension of SQLite 3.40
+// for the database
+//
+//	CREATE TABLE t(a INTEGER PRIMARY KEY, b TEXT, c REAL, d BLOB);
+//	CREATE TABLE u(x TEXT, y INT, z, PRIMARY KEY(x, y));
+//	INSERT INTO t VALUES(1,'one',1.5,x'01'),(2,'two',NULL,NULL),(3,'three',-2.25,x'0203');
+//	INSERT INTO u VALUES('k',1,'v'),('k',2,300000);
+//
+// changeset and patchset record
+//
+//	INSERT INTO t VALUES(4,'four',4e100,x'');
+//	UPDATE t SET b='TWO', c=2.0 WHERE a=2;
+//	DELETE FROM t WHERE a=3;
+//	INSERT INTO u VALUES('m',-7,NULL);
+//	UPDATE u SET z=-1234567890123 WHERE x='k' AND y=2;
+//	DELETE FROM u WHERE x='k' AND y=1;
+//
+// and changeset2 records, after them,
+//
+//	UPDATE t SET b='FOUR' WHERE a=4;
+//	DELETE FROM t WHERE a=2;
+//	INSERT INTO t VALUES(5,'five',NULL,NULL);
+//
+// inverted is sqlite3changeset_invert(changeset) and concat is
+// sqlite3changeset_concat(changeset, changeset2). The concatenation of
+// changeset and inverted is empty.
+const (
+	testChangeset  = "54040100000074001700010000000000000002030374776f050000030354574f0240000000000000000009000100000000000000030305746872656502c0020000000000000402020312000100000000000000040304666f75720254d249ad2594c37d040054030102007500170003016b0100000000000000020100000000000493e0000001fffffee08e04fb35090003016b010000000000000001030176120003016d01fffffffffffffff905"
+	testPatchset   = "50040100000074001700010000000000000002030354574f02400000000000000000090001000000000000000312000100000000000000040304666f75720254d249ad2594c37d040050030102007500170003016b01000000000000000201fffffee08e04fb35090003016b010000000000000001120003016d01fffffffffffffff905"
+	testInverted   = "54040100000074001700010000000000000002030354574f0240000000000000000000030374776f050012000100000000000000030305746872656502c0020000000000000402020309000100000000000000040304666f75720254d249ad2594c37d040054030102007500170003016b01000000000000000201fffffee08e04fb3500000100000000000493e0120003016b010000000000000001030176090003016d01fffffffffffffff905"
+	testChangeset2 = "54040100000074000900010000000000000002030354574f0240000000000000000517000100000000000000040304666f75720000000304464f5552000012000100000000000000050304666976650505"
+	testConcat     = "54040100000074000900010000000000000002030374776f050509000100000000000000030305746872656502c0020000000000000402020312000100000000000000040304464f55520254d249ad2594c37d04001200010000000000000005030466697665050554030102007500170003016b0100000000000000020100000000000493e0000001fffffee08e04fb35090003016b010000000000000001030176120003016d01fffffffffffffff905"
+)
+
+func mustParseChangeset(t *testing.T, s string) *changeset {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cs, err := parseChangeset(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return cs
+}
+
+func TestVarint(t *testing.T) {
+	for _, test := range []struct {
+		v uint64
+		b string
+	}{
+		{0, "00"},
+		{1, "01"},
+		{127, "7f"},
+		{128, "8100"},
+		{300, "822c"},
+		{16383, "ff7f"},
+		{16384, "818000"},
+		{1<<56 - 1, "ffffffffffffff7f"},
+		{1 << 56, "80c080808080808000"},
+		{1<<64 - 1, "ffffffffffffffffff"},
+	} {
+		b := putVarint(nil, test.v)
+		if g, e := hex.EncodeToString(b), test.b; g != e {
+			t.Errorf("putVarint(%d) = %s, expected %s", test.v, g, e)
+		}
+
+		v, n := getVarint(append(b, 0xff))
+		if v != test.v || n != len(b) {
+			t.Errorf("getVarint(%s) = %d, %d, expected %d, %d", test.b, v, n, test.v, len(b))
+		}
+	}
+}
+
+func TestParseChangeset(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		s        string
+		patchset bool
+		tables   []string
+		changes  []int
+	}{
+		{"changeset", testChangeset, false, []string{"t", "u"}, []int{3, 3}},
+		{"patchset", testPatchset, true, []string{"t", "u"}, []int{3, 3}},
+		{"inverted", testInverted, false, []string{"t", "u"}, []int{3, 3}},
+		{"changeset2", testChangeset2, false, []string{"t"}, []int{3}},
+		{"concat", testConcat, false, []string{"t", "u"}, []int{4, 3}},
+	} {
+		cs := mustParseChangeset(t, test.s)
+		if cs.patchset != test.patchset {
+			t.Errorf("%s: patchset %v, expected %v", test.name, cs.patchset, test.patchset)
+		}
+
+		var tables []string
+		var changes []int
+		for _, v := range cs.tables {
+			tables = append(tables, v.name)
+			changes = append(changes, len(v.changes))
+		}
+		if !reflect.DeepEqual(tables, test.tables) || !reflect.DeepEqual(changes, test.changes) {
+			t.Errorf("%s: tables %v %v, expected %v %v", test.name, tables, changes, test.tables, test.changes)
+		}
+
+		if g, e := hex.EncodeToString(cs.bytes()), test.s; g != e {
+			t.Errorf("%s: round trip\ngot      %s\nexpected %s", test.name, g, e)
+		}
+	}
+}
+
+func TestParseChangesetValues(t *testing.T) {
+	cs := mustParseChangeset(t, testChangeset)
+	if g, e := cs.tables[1].pk, []int{1, 2, 0}; !reflect.DeepEqual(g, e) {
+		t.Errorf("PRIMARY KEY %v, expected %v", g, e)
+	}
+
+	for _, test := range []struct {
+		table, change int
+		op            int
+		old, new      []interface{}
+	}{
+		{0, 0, changeUpdate,
+			[]interface{}{int64(2), "two", nil, undefined},
+			[]interface{}{undefined, "TWO", 2.0, undefined}},
+		{0, 1, changeDelete,
+			[]interface{}{int64(3), "three", -2.25, []byte{2, 3}}, nil},
+		{0, 2, changeInsert, nil,
+			[]interface{}{int64(4), "four", 4e100, []byte{}}},
+		{1, 1, changeDelete,
+			[]interface{}{"k", int64(1), "v"}, nil},
+		{1, 2, changeInsert, nil,
+			[]interface{}{"m", int64(-7), nil}},
+	} {
+		ch := cs.tables[test.table].changes[test.change]
+		if ch.op != test.op || !reflect.DeepEqual(ch.old, test.old) || !reflect.DeepEqual(ch.new, test.new) {
+			t.Errorf("table %d change %d: %s %v %v, expected %s %v %v", test.table, test.change, opName(ch.op), ch.old, ch.new, opName(test.op), test.old, test.new)
+		}
+	}
+}
+
+func TestParseChangesetCorrupt(t *testing.T) {
+	b, err := hex.DecodeString(testChangeset)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for n := 1; n < len(b); n++ {
+		if cs, err := parseChangeset(b[:n]); err == nil && bytes.Equal(cs.bytes(), b) {
+			t.Errorf("%d of %d bytes: parsed the whole changeset", n, len(b))
+		}
+	}
+	for _, test := range []string{
+		"00",                             // No table.
+		"54",                             // No column count.
+		"540301",                         // Truncated PRIMARY KEY flags.
+		"54ffffffffffffffffff",           // Column count wrapping the length.
+		"54010174",                       // No NUL after the name.
+		"540101740012",                   // Truncated change.
+		"54010174001200",                 // Missing value.
+		"54010174000700",                 // Unknown operation.
+		"5401017400" + "50010174" + "00", // Mixed changeset and patchset.
+	} {
+		b, err := hex.DecodeString(test)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := parseChangeset(b); err == nil {
+			t.Errorf("%s: no error", test)
+		}
+	}
+}
+
+func TestInvert(t *testing.T) {
+	cs := mustParseChangeset(t, testChangeset)
+	if g, e := hex.EncodeToString(cs.invert().bytes()), testInverted; g != e {
+		t.Errorf("invert\ngot      %s\nexpected %s", g, e)
+	}
+
+	if g, e := hex.EncodeToString(cs.invert().invert().bytes()), testChangeset; g != e {
+		t.Errorf("invert twice\ngot      %s\nexpected %s", g, e)
+	}
+}
+
+func TestConcat(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		a, b string
+		e    string
+	}{
+		{"changesets", testChangeset, testChangeset2, testConcat},
+		{"undo", testChangeset, testInverted, ""},
+	} {
+		cs, err := concatChangesets(mustParseChangeset(t, test.a), mustParseChangeset(t, test.b))
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if g := hex.EncodeToString(cs.bytes()); g != test.e {
+			t.Errorf("%s\ngot      %s\nexpected %s", test.name, g, test.e)
+		}
+	}
+
+	if _, err := concatChangesets(mustParseChangeset(t, testChangeset), mustParseChangeset(t, testPatchset)); err == nil {
+		t.Error("concatenated a changeset and a patchset")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/cznic/sqlite3shell/internal/crt"
+)
+
+// TLS is the type of the C thread local storage handle threaded through the
+// generated code. The hand written parts of the shell use it so they compile
+// against either generated port.
+type TLS = *crt.TLS
+
+// csvReadOneField reads the next CSV field of the ImportCtx at p.
+func csvReadOneField(tls TLS, p uintptr) uintptr { return _61csv_read_one_field(tls, p) }
+
+// fopen opens a C stream or returns zero.
+func fopen(tls TLS, name, mode string) uintptr {
+	zName := crt.CString(name)
+	zMode := crt.CString(mode)
+	r := crt.Xfopen64(tls, zName, zMode)
+	crt.Free(zName)
+	crt.Free(zMode)
+	return r
+}
+
+func fclose(tls TLS, stream uintptr) { crt.Xfclose(tls, stream) }
+
+func ftell(tls TLS, stream uintptr) int64 { return int64(crt.Xftell(tls, stream)) }
+
+// fseek positions stream at off. Offsets past 2GB are not supported by the
+// 32 bit C runtime.
+func fseek(tls TLS, stream uintptr, off int64) bool {
+	return off == int64(int32(off)) && crt.Xfseek(tls, stream, int32(off), 0) == 0
+}
+
+// fputs writes s to the C stream.
+func fputs(tls TLS, s string, stream uintptr) {
+	zFormat := crt.CString("%s")
+	z := crt.CString(s)
+	crt.Xfprintf(tls, stream, zFormat, z)
+	crt.Free(z)
+	crt.Free(zFormat)
+}
+
+// fwrite writes the n bytes at p to the C stream and returns the number of
+// bytes written.
+func fwrite(tls TLS, p uintptr, n int, stream uintptr) int {
+	return int(crt.Xfwrite(tls, p, 1, uint32(n), stream))
+}
+
+// openDB opens the database of the ShellState at p, if not yet open.
+func openDB(tls TLS, p uintptr) { _10open_db(tls, p, 0) }
+
+// processInput runs the SQL and dot commands read from the C stream in, like
+// .read, and returns the number of errors.
+func processInput(tls TLS, p, in uintptr) int32 { return _20process_input(tls, p, in) }
+
+// shellExec runs the SQL zSQL on db and writes its rows in the output mode of
+// the ShellState at p, like SQL typed at the prompt.
+func shellExec(tls TLS, db, zSQL, p, pzErrMsg uintptr) int32 {
+	return _15shell_exec(tls, db, zSQL, fp3(_16shell_callback), p, pzErrMsg)
+}
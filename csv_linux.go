@@ -0,0 +1,743 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// The csv virtual table, a port of ext/misc/csv.c.
+//
+//	CREATE VIRTUAL TABLE temp.t USING csv(filename='x.csv', header=yes);
+//
+// The file is read in place, fields are split by the same code the .import
+// command uses. Arguments
+//
+//	filename=FILE	The CSV file, required.
+//	header=BOOL	The first row holds the column names. Default no.
+//	columns=N	Number of columns. Default is the number of fields of the
+//			first row.
+//	schema=SQL	CREATE TABLE statement declaring the columns.
+//	types=LIST	Comma separated declared column types, eg. 'INT,TEXT,REAL'.
+//
+// Fields are converted according to the affinity of the declared column
+// type, so numeric columns compare as numbers.
+//
+// The rowid is the row number, the header excluded. Constraints on the rowid
+// seek in the file using a sparse index of row offsets built while reading.
+
+// A row offset is remembered for every csvMarkEvery rows.
+const csvMarkEvery = 1024
+
+// Rowid constraint flags of idxNum.
+const (
+	csvRowidEQ = 1 << iota
+	csvRowidGT
+	csvRowidGE
+	csvRowidLT
+	csvRowidLE
+)
+
+const (
+	sqliteIndexConstraintGT = 4
+	sqliteIndexConstraintLE = 8
+	sqliteIndexConstraintLT = 16
+	sqliteIndexConstraintGE = 32
+)
+
+// Column affinities.
+const (
+	affinityBlob = iota
+	affinityText
+	affinityNumeric
+	affinityInteger
+	affinityReal
+)
+
+var csvModule = Ssqlite3_module{
+	XxCreate:     cfnConnect(csvConnect),
+	XxConnect:    cfnConnect(csvConnect),
+	XxBestIndex:  cfnVtab2(csvBestIndex),
+	XxDisconnect: cfnVtab(csvDisconnect),
+	XxDestroy:    cfnVtab(csvDisconnect),
+	XxOpen:       cfnVtab2(csvOpen),
+	XxClose:      cfnVtab(csvClose),
+	XxFilter:     cfnFilter(csvFilter),
+	XxNext:       cfnVtab(csvNext),
+	XxEof:        cfnVtab(csvEof),
+	XxColumn:     cfnColumn(csvColumn),
+	XxRowid:      cfnVtab2(csvRowid),
+}
+
+// Xsqlite3_csv_init registers the csv module with db.
+func Xsqlite3_csv_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	zName := cString(tls, "csv")
+	if zName == 0 {
+		return sqliteNoMem
+	}
+
+	defer Xsqlite3_free(tls, zName)
+	return Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(&csvModule)), 0)
+}
+
+type csvTable struct {
+	filename string
+	nCol     int
+	affinity []int
+	marks    []int64 // marks[i] is the offset of row i*csvMarkEvery+1.
+}
+
+type csvCursor struct {
+	t      *csvTable
+	reader csvReader
+	fields []string
+	rowid  int64 // Number of rows read.
+	limit  int64 // Last rowid to return.
+	eof    bool
+}
+
+// csvReader reads rows using the ImportCtx machinery of .import.
+type csvReader struct {
+	ctx uintptr // *SImportCtx
+}
+
+func (r *csvReader) open(tls TLS, filename string) error {
+	ctx := cZero(tls, unsafe.Sizeof(SImportCtx{}))
+	if ctx == 0 {
+		return fmt.Errorf("out of memory")
+	}
+
+	r.ctx = ctx
+	p := (*SImportCtx)(unsafe.Pointer(ctx))
+	p.XcColSep = ','
+	p.XcRowSep = '\n'
+	if p.XzFile = cString(tls, filename); p.XzFile == 0 {
+		return fmt.Errorf("out of memory")
+	}
+
+	// Preallocating the field buffer makes a nil field mean EOF.
+	if p.Xz = Xsqlite3_malloc(tls, 100); p.Xz == 0 {
+		return fmt.Errorf("out of memory")
+	}
+
+	p.XnAlloc = 100
+	if p.Xin = fopen(tls, filename, "rb"); p.Xin == 0 {
+		return fmt.Errorf("cannot open '%s' for reading", filename)
+	}
+
+	return nil
+}
+
+func (r *csvReader) close(tls TLS) {
+	if r.ctx == 0 {
+		return
+	}
+
+	p := (*SImportCtx)(unsafe.Pointer(r.ctx))
+	if p.Xin != 0 {
+		fclose(tls, p.Xin)
+	}
+	Xsqlite3_free(tls, p.XzFile)
+	Xsqlite3_free(tls, p.Xz)
+	Xsqlite3_free(tls, r.ctx)
+	r.ctx = 0
+}
+
+func (r *csvReader) tell(tls TLS) int64 {
+	return ftell(tls, (*SImportCtx)(unsafe.Pointer(r.ctx)).Xin)
+}
+
+func (r *csvReader) seek(tls TLS, off int64) bool {
+	p := (*SImportCtx)(unsafe.Pointer(r.ctx))
+	p.XbNotFirst = 1
+	if off == 0 {
+		p.XbNotFirst = 0 // Skip the BOM again.
+	}
+	return fseek(tls, p.Xin, off)
+}
+
+// row appends the fields of the next row to dst. It returns false at EOF.
+func (r *csvReader) row(tls TLS, dst []string) ([]string, bool) {
+	p := (*SImportCtx)(unsafe.Pointer(r.ctx))
+	n := len(dst)
+	for {
+		z := csvReadOneField(tls, r.ctx)
+		if z == 0 {
+			break
+		}
+
+		dst = append(dst, string(goBytes(z, int(p.Xn))))
+		if p.XcTerm != p.XcColSep {
+			break
+		}
+	}
+	return dst, len(dst) != n
+}
+
+// csvConnect implements both xCreate and xConnect.
+func csvConnect(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	var a []string
+	for i := 3; i < int(argc); i++ {
+		a = append(a, goString(argv(args, i)))
+	}
+	t, schema, err := newCSVTable(tls, a)
+	if err != nil {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, err.Error())
+		return sqliteError
+	}
+
+	zSchema := cString(tls, schema)
+	if zSchema == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, "bad schema: '"+schema+"' - "+goString(Xsqlite3_errmsg(tls, db)))
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, t)
+	return sqliteOK
+}
+
+// newCSVTable parses the module arguments a and reads the header, if any.
+func newCSVTable(tls TLS, a []string) (t *csvTable, schema string, err error) {
+	var filename, header, columns, types string
+	seen := map[string]bool{}
+	for _, v := range a {
+		i := strings.IndexByte(v, '=')
+		if i < 0 {
+			return nil, "", fmt.Errorf("bad parameter: '%s'", v)
+		}
+
+		key := strings.ToLower(strings.TrimSpace(v[:i]))
+		val := dequote(strings.TrimSpace(v[i+1:]))
+		if seen[key] {
+			return nil, "", fmt.Errorf("more than one '%s' parameter", key)
+		}
+
+		seen[key] = true
+		switch key {
+		case "filename":
+			filename = val
+		case "header":
+			header = val
+		case "columns":
+			columns = val
+		case "schema":
+			schema = val
+		case "types":
+			types = val
+		default:
+			return nil, "", fmt.Errorf("bad parameter: '%s'", v)
+		}
+	}
+	if filename == "" {
+		return nil, "", fmt.Errorf("must specify filename=")
+	}
+
+	t = &csvTable{filename: filename}
+	hasHeader := false
+	if header != "" {
+		if hasHeader, err = parseBool(header); err != nil {
+			return nil, "", fmt.Errorf("unrecognized argument to 'header': %s", header)
+		}
+	}
+	if columns != "" {
+		if t.nCol, err = strconv.Atoi(columns); err != nil || t.nCol <= 0 {
+			return nil, "", fmt.Errorf("must have at least one column")
+		}
+	}
+
+	var r csvReader
+	defer r.close(tls)
+
+	if err := r.open(tls, filename); err != nil {
+		return nil, "", err
+	}
+
+	var first []string
+	if hasHeader || t.nCol == 0 {
+		first, _ = r.row(tls, nil)
+	}
+	if t.nCol == 0 {
+		t.nCol = len(first)
+	}
+	if t.nCol == 0 {
+		return nil, "", fmt.Errorf("must have at least one column")
+	}
+
+	var off int64
+	if hasHeader {
+		off = r.tell(tls)
+	}
+	t.marks = []int64{off}
+
+	var decl []string
+	if types != "" {
+		decl = strings.Split(types, ",")
+		if len(decl) > t.nCol {
+			return nil, "", fmt.Errorf("more types than columns")
+		}
+	}
+	if schema == "" {
+		var b []string
+		for i := 0; i < t.nCol; i++ {
+			name := fmt.Sprintf("c%d", i)
+			if hasHeader && i < len(first) && first[i] != "" {
+				name = first[i]
+			}
+			typ := "TEXT"
+			if i < len(decl) {
+				typ = strings.TrimSpace(decl[i])
+			}
+			b = append(b, fmt.Sprintf(`"%s" %s`, strings.Replace(name, `"`, `""`, -1), typ))
+		}
+		schema = "CREATE TABLE x(" + strings.Join(b, ",") + ")"
+	} else if decl == nil {
+		decl = columnTypes(schema)
+	}
+	t.affinity = make([]int, t.nCol)
+	for i := range t.affinity {
+		t.affinity[i] = affinityText
+		if i < len(decl) {
+			t.affinity[i] = typeAffinity(decl[i])
+		}
+	}
+	return t, schema, nil
+}
+
+func csvDisconnect(tls TLS, tab uintptr) int32 {
+	deleteObject(tab)
+	Xsqlite3_free(tls, tab)
+	return sqliteOK
+}
+
+func csvBestIndex(tls TLS, tab, pIdxInfo uintptr) int32 {
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	var use [5]int // Constraint index of an idxNum bit.
+	idxNum := 0
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		if c.Xusable == 0 || c.XiColumn >= 0 {
+			continue
+		}
+
+		flag := csvConstraintFlag(c.Xop)
+		if flag == 0 || idxNum&flag != 0 {
+			continue
+		}
+
+		idxNum |= flag
+		for bit := uint(0); bit < uint(len(use)); bit++ {
+			if flag == 1<<bit {
+				use[bit] = i
+			}
+		}
+	}
+	// Arguments are passed in the order of the idxNum bits.
+	n := 0
+	for bit := uint(0); bit < uint(len(use)); bit++ {
+		if idxNum&(1<<bit) == 0 {
+			continue
+		}
+
+		n++
+		u := indexConstraintUsage(info, use[bit])
+		u.XargvIndex = int32(n)
+		u.Xomit = 1
+	}
+	info.XidxNum = int32(idxNum)
+	switch {
+	case idxNum&csvRowidEQ != 0:
+		info.XestimatedCost = 10
+		info.XestimatedRows = 1
+	case idxNum != 0:
+		info.XestimatedCost = 100000
+	default:
+		info.XestimatedCost = 1000000
+	}
+	return sqliteOK
+}
+
+func csvConstraintFlag(op uint8) int {
+	switch op {
+	case sqliteIndexConstraintEQ:
+		return csvRowidEQ
+	case sqliteIndexConstraintGT:
+		return csvRowidGT
+	case sqliteIndexConstraintGE:
+		return csvRowidGE
+	case sqliteIndexConstraintLT:
+		return csvRowidLT
+	case sqliteIndexConstraintLE:
+		return csvRowidLE
+	}
+	return 0
+}
+
+func csvOpen(tls TLS, tab, ppCursor uintptr) int32 {
+	t := getObject(tab).(*csvTable)
+	c := &csvCursor{t: t, eof: true}
+	if err := c.reader.open(tls, t.filename); err != nil {
+		c.reader.close(tls)
+		return vtabError(tls, tab, err.Error())
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		c.reader.close(tls)
+		return sqliteNoMem
+	}
+
+	putObject(p, c)
+	return sqliteOK
+}
+
+func csvClose(tls TLS, cur uintptr) int32 {
+	getObject(cur).(*csvCursor).reader.close(tls)
+	deleteObject(cur)
+	Xsqlite3_free(tls, cur)
+	return sqliteOK
+}
+
+func csvFilter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) int32 {
+	c := getObject(cur).(*csvCursor)
+	first, last := int64(1), int64(math.MaxInt64)
+	n := 0
+	for flag := csvRowidEQ; flag <= csvRowidLE; flag <<= 1 {
+		if int(idxNum)&flag == 0 {
+			continue
+		}
+
+		lo, hi := csvRowidRange(tls, argv(args, n), flag)
+		n++
+		first, last = max64(first, lo), min64(last, hi)
+	}
+	first = max64(first, 1)
+	c.limit = last
+	c.eof = true
+	if first > last {
+		return sqliteOK
+	}
+
+	if !c.seek(tls, first) {
+		return sqliteOK
+	}
+
+	return csvNext(tls, cur)
+}
+
+// csvRowidRange returns the rowids lo..hi satisfying the constraint flag with
+// the value v. v is compared like SQLite does: as a number if it looks like
+// one, integers are less than texts and blobs and nothing matches NULL.
+func csvRowidRange(tls TLS, v uintptr, flag int) (lo, hi int64) {
+	lo, hi = math.MinInt64, math.MaxInt64
+	var f float64
+	switch Xsqlite3_value_numeric_type(tls, v) {
+	case sqliteNull:
+		return 1, 0
+	case sqliteInteger:
+		i := Xsqlite3_value_int64(tls, v)
+		switch {
+		case flag == csvRowidEQ:
+			return i, i
+		case flag == csvRowidGT && i == math.MaxInt64, flag == csvRowidLT && i == math.MinInt64:
+			return 1, 0
+		case flag == csvRowidGT:
+			return i + 1, hi
+		case flag == csvRowidGE:
+			return i, hi
+		case flag == csvRowidLT:
+			return lo, i - 1
+		default:
+			return lo, i
+		}
+	case sqliteFloat:
+		f = Xsqlite3_value_double(tls, v)
+	default:
+		f = math.Inf(1)
+	}
+
+	const limit = 1 << 63 // -limit..limit-1 are the int64 values.
+	switch flag {
+	case csvRowidEQ:
+		if f != math.Trunc(f) || f < -limit || f >= limit {
+			return 1, 0
+		}
+
+		return int64(f), int64(f)
+	case csvRowidGT, csvRowidGE:
+		if flag == csvRowidGT {
+			f = math.Floor(f) + 1
+		}
+		switch f = math.Ceil(f); {
+		case f >= limit:
+			return 1, 0
+		case f >= -limit:
+			lo = int64(f)
+		}
+	default:
+		if flag == csvRowidLT {
+			f = math.Ceil(f) - 1
+		}
+		switch f = math.Floor(f); {
+		case f < -limit:
+			return 1, 0
+		case f < limit:
+			hi = int64(f)
+		}
+	}
+	return lo, hi
+}
+
+// seek positions c so the next row read is row. It returns false if the
+// file has less rows.
+func (c *csvCursor) seek(tls TLS, row int64) bool {
+	t := c.t
+	k := (row - 1) / csvMarkEvery
+	if k >= int64(len(t.marks)) {
+		k = int64(len(t.marks)) - 1
+	}
+	if !c.reader.seek(tls, t.marks[k]) {
+		return false
+	}
+
+	c.rowid = k * csvMarkEvery
+	for c.rowid < row-1 {
+		if !c.next(tls) {
+			return false
+		}
+	}
+	return true
+}
+
+// next reads the next row into c.fields and records its offset in the
+// sparse index when due.
+func (c *csvCursor) next(tls TLS) bool {
+	t := c.t
+	if c.rowid%csvMarkEvery == 0 && c.rowid/csvMarkEvery == int64(len(t.marks)) {
+		t.marks = append(t.marks, c.reader.tell(tls))
+	}
+	var ok bool
+	if c.fields, ok = c.reader.row(tls, c.fields[:0]); !ok {
+		return false
+	}
+
+	c.rowid++
+	return true
+}
+
+func csvNext(tls TLS, cur uintptr) int32 {
+	c := getObject(cur).(*csvCursor)
+	c.eof = c.rowid >= c.limit || !c.next(tls)
+	return sqliteOK
+}
+
+func csvEof(tls TLS, cur uintptr) int32 {
+	if getObject(cur).(*csvCursor).eof {
+		return 1
+	}
+
+	return 0
+}
+
+func csvColumn(tls TLS, cur, ctx uintptr, i int32) int32 {
+	c := getObject(cur).(*csvCursor)
+	if int(i) >= len(c.fields) || int(i) >= len(c.t.affinity) {
+		return sqliteOK
+	}
+
+	s := c.fields[i]
+	switch c.t.affinity[i] {
+	case affinityInteger, affinityNumeric:
+		if n, err := strconv.ParseInt(strings.TrimSpace(s), 10, 64); err == nil {
+			Xsqlite3_result_int64(tls, ctx, n)
+			return sqliteOK
+		}
+
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			if f == math.Trunc(f) && math.Abs(f) < 1<<63 {
+				Xsqlite3_result_int64(tls, ctx, int64(f))
+				return sqliteOK
+			}
+
+			Xsqlite3_result_double(tls, ctx, f)
+			return sqliteOK
+		}
+	case affinityReal:
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			Xsqlite3_result_double(tls, ctx, f)
+			return sqliteOK
+		}
+	}
+	resultText(tls, ctx, s)
+	return sqliteOK
+}
+
+func csvRowid(tls TLS, cur, pRowid uintptr) int32 {
+	*(*int64)(unsafe.Pointer(pRowid)) = getObject(cur).(*csvCursor).rowid
+	return sqliteOK
+}
+
+// typeAffinity returns the affinity of the declared column type typ, using
+// the rules of section 3.1 of https://www.sqlite.org/datatype3.html.
+func typeAffinity(typ string) int {
+	typ = strings.ToUpper(typ)
+	switch {
+	case strings.Contains(typ, "INT"):
+		return affinityInteger
+	case strings.Contains(typ, "CHAR"), strings.Contains(typ, "CLOB"), strings.Contains(typ, "TEXT"):
+		return affinityText
+	case strings.Contains(typ, "BLOB"), strings.TrimSpace(typ) == "":
+		return affinityBlob
+	case strings.Contains(typ, "REAL"), strings.Contains(typ, "FLOA"), strings.Contains(typ, "DOUB"):
+		return affinityReal
+	}
+	return affinityNumeric
+}
+
+// columnTypes returns the declared types of the columns of a CREATE TABLE
+// statement. Table constraints are not recognized and are returned as types
+// of columns past the last one.
+func columnTypes(sql string) []string {
+	i := strings.IndexByte(sql, '(')
+	j := strings.LastIndexByte(sql, ')')
+	if i < 0 || j < i {
+		return nil
+	}
+
+	var r []string
+	for _, def := range splitTopLevel(sql[i+1:j], ',') {
+		def = strings.TrimSpace(def)
+		n := identLen(def)
+		r = append(r, strings.TrimSpace(def[n:]))
+	}
+	return r
+}
+
+// splitTopLevel splits s at sep characters outside of parentheses and
+// quotes.
+func splitTopLevel(s string, sep byte) []string {
+	var r []string
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			r = append(r, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(r, s[start:])
+}
+
+// identLen returns the length of the, possibly quoted, identifier s starts
+// with.
+func identLen(s string) int {
+	if s == "" {
+		return 0
+	}
+
+	var end byte
+	switch s[0] {
+	case '"', '\'', '`':
+		end = s[0]
+	case '[':
+		end = ']'
+	default:
+		for i := 0; i < len(s); i++ {
+			switch s[i] {
+			case ' ', '\t', '\n', '\r', '(':
+				return i
+			}
+		}
+		return len(s)
+	}
+
+	for i := 1; i < len(s); i++ {
+		if s[i] == end {
+			if end != ']' && i+1 < len(s) && s[i+1] == end {
+				i++
+				continue
+			}
+
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// dequote removes SQL quotes from s, if any.
+func dequote(s string) string {
+	if len(s) < 2 {
+		return s
+	}
+
+	q := s[0]
+	switch q {
+	case '\'', '"', '`':
+		if s[len(s)-1] != q {
+			return s
+		}
+
+		return strings.Replace(s[1:len(s)-1], string([]byte{q, q}), string(q), -1)
+	case '[':
+		if s[len(s)-1] == ']' {
+			return s[1 : len(s)-1]
+		}
+	}
+	return s
+}
+
+// parseBool parses the boolean spellings accepted by the shell.
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "1", "on", "yes", "true":
+		return true, nil
+	case "0", "off", "no", "false":
+		return false, nil
+	}
+	return false, fmt.Errorf("not a boolean: %s", s)
+}
+
+func max64(a, b int64) int64 {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+func min64(a, b int64) int64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"unicode/utf16"
+)
+
+// A reader of the SQLite file format for commands that look at the pages of
+// a database directly. It does not trust the file, every error is returned
+// and nothing panics on bad input. The WAL file, if any, is not read.
+
+// B-tree page types.
+const (
+	pageIndexInterior = 2
+	pageTableInterior = 5
+	pageIndexLeaf     = 10
+	pageTableLeaf     = 13
+)
+
+// Text encodings.
+const (
+	encUTF8    = 1
+	encUTF16le = 2
+	encUTF16be = 3
+)
+
+var errCorrupt = errors.New("database disk image is malformed")
+
+// dbFile is an SQLite database file.
+type dbFile struct {
+	f          *os.File
+	header     []byte
+	pageSize   int
+	usable     int // Page size less the reserved bytes.
+	nPage      int
+	encoding   int
+	autoVacuum bool
+}
+
+// openDBFile opens the database file name. If the header is damaged, a page
+// size of 4096 is assumed.
+func openDBFile(name string) (*dbFile, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	d := &dbFile{f: f, header: make([]byte, 100), pageSize: 4096, encoding: encUTF8}
+	if _, err := f.ReadAt(d.header, 0); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%s: not a database", name)
+	}
+
+	n := int(binary.BigEndian.Uint16(d.header[16:]))
+	if n == 1 {
+		n = 65536
+	}
+	if n >= 512 && n <= 65536 && n&(n-1) == 0 {
+		d.pageSize = n
+	}
+	d.usable = d.pageSize - int(d.header[20])
+	if d.usable < 480 {
+		d.usable = d.pageSize
+	}
+	if e := int(binary.BigEndian.Uint32(d.header[56:])); e >= encUTF8 && e <= encUTF16be {
+		d.encoding = e
+	}
+	d.autoVacuum = binary.BigEndian.Uint32(d.header[52:]) != 0
+	d.nPage = int(fi.Size() / int64(d.pageSize))
+	return d, nil
+}
+
+// mainDBFile opens the file of the main database of the shell s for the
+// command verb.
+func mainDBFile(s *shell, verb string) (*dbFile, error) {
+	name := goString(s.state().XzDbFilename)
+	if name == "" || name == ":memory:" {
+		return nil, fmt.Errorf("cannot %s a temporary or in-memory database", verb)
+	}
+
+	return openDBFile(name)
+}
+
+func (d *dbFile) close() error { return d.f.Close() }
+
+// page returns the page n, numbered from one.
+func (d *dbFile) page(n int) ([]byte, error) {
+	if n < 1 || n > d.nPage {
+		return nil, fmt.Errorf("page %d: out of range", n)
+	}
+
+	b := make([]byte, d.pageSize)
+	if _, err := d.f.ReadAt(b, int64(n-1)*int64(d.pageSize)); err != nil {
+		return nil, fmt.Errorf("page %d: %v", n, err)
+	}
+
+	return b, nil
+}
+
+// lockPage returns the page holding the lock bytes, which is never used.
+func (d *dbFile) lockPage() int { return 1<<30/d.pageSize + 1 }
+
+// isPtrmap reports whether page n is a pointer map page of an auto-vacuum
+// database.
+func (d *dbFile) isPtrmap(n int) bool {
+	if !d.autoVacuum || n < 2 {
+		return false
+	}
+
+	return (n-2)%(d.usable/5+1) == 0
+}
+
+// freelist returns the pages of the freelist, trunk pages included.
+func (d *dbFile) freelist() ([]int, error) {
+	var r []int
+	err := d.freelistTrunks(func(trunk, next int, leaves []int) {
+		r = append(append(r, trunk), leaves...)
+	})
+	return r, err
+}
+
+// freelistTrunks calls fn for each trunk page of the freelist with the next
+// trunk page and the leaf pages.
+func (d *dbFile) freelistTrunks(fn func(trunk, next int, leaves []int)) error {
+	seen := map[int]bool{}
+	for n := int(binary.BigEndian.Uint32(d.header[32:])); n != 0; {
+		if seen[n] {
+			return fmt.Errorf("page %d: freelist loop", n)
+		}
+
+		seen[n] = true
+		b, err := d.page(n)
+		if err != nil {
+			return err
+		}
+
+		k := int(binary.BigEndian.Uint32(b[4:]))
+		if k > (d.usable-8)/4 {
+			return fmt.Errorf("page %d: %v", n, errCorrupt)
+		}
+
+		leaves := make([]int, k)
+		for i := range leaves {
+			leaves[i] = int(binary.BigEndian.Uint32(b[8+4*i:]))
+		}
+		next := int(binary.BigEndian.Uint32(b))
+		fn(n, next, leaves)
+		n = next
+	}
+	return nil
+}
+
+// btreePage is a parsed b-tree page.
+type btreePage struct {
+	pgno  int
+	typ   int
+	data  []byte
+	hdr   int   // Offset of the page header, 100 on page 1.
+	cells []int // Offsets of the cells.
+	right int   // Right-most child of interior pages.
+}
+
+func (p *btreePage) isLeaf() bool  { return p.typ == pageTableLeaf || p.typ == pageIndexLeaf }
+func (p *btreePage) isTable() bool { return p.typ == pageTableLeaf || p.typ == pageTableInterior }
+
+// btreePage returns the b-tree page n.
+func (d *dbFile) btreePage(n int) (*btreePage, error) {
+	b, err := d.page(n)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &btreePage{pgno: n, data: b}
+	if n == 1 {
+		p.hdr = 100
+	}
+	p.typ = int(b[p.hdr])
+	ptrs := p.hdr + 8
+	switch p.typ {
+	case pageIndexInterior, pageTableInterior:
+		ptrs += 4
+		p.right = int(binary.BigEndian.Uint32(b[p.hdr+8:]))
+	case pageIndexLeaf, pageTableLeaf:
+	default:
+		return nil, fmt.Errorf("page %d: not a b-tree page", n)
+	}
+
+	k := int(binary.BigEndian.Uint16(b[p.hdr+3:]))
+	if ptrs+2*k > d.usable {
+		return nil, fmt.Errorf("page %d: %v", n, errCorrupt)
+	}
+
+	for i := 0; i < k; i++ {
+		off := int(binary.BigEndian.Uint16(b[ptrs+2*i:]))
+		if off < ptrs+2*k || off >= d.usable {
+			return nil, fmt.Errorf("page %d: %v", n, errCorrupt)
+		}
+
+		p.cells = append(p.cells, off)
+	}
+	return p, nil
+}
+
+// unused returns the bytes of p not used by the header, the cell pointers
+// and the cells: the gap before the cell content area, the freeblocks and
+// the fragmented bytes. The reserved bytes are not included.
+func (d *dbFile) unused(p *btreePage) (int, error) {
+	b := p.data[:d.usable]
+	end := p.hdr + 8 + 2*len(p.cells)
+	if !p.isLeaf() {
+		end += 4
+	}
+	content := int(binary.BigEndian.Uint16(b[p.hdr+5:]))
+	if content == 0 {
+		content = 65536
+	}
+	if content < end || content > len(b) {
+		return 0, fmt.Errorf("page %d: %v", p.pgno, errCorrupt)
+	}
+
+	n := content - end + int(b[p.hdr+7])
+	seen := map[int]bool{}
+	for off := int(binary.BigEndian.Uint16(b[p.hdr+1:])); off != 0; off = int(binary.BigEndian.Uint16(b[off:])) {
+		if seen[off] || off < content || off+4 > len(b) {
+			return n, fmt.Errorf("page %d: %v", p.pgno, errCorrupt)
+		}
+
+		seen[off] = true
+		n += int(binary.BigEndian.Uint16(b[off+2:]))
+	}
+	return n, nil
+}
+
+// btreeCell is a cell of a b-tree page.
+type btreeCell struct {
+	child    int   // Left child of interior cells.
+	rowid    int64 // Table b-trees only.
+	payload  []byte
+	local    int   // Bytes of the payload on the b-tree page.
+	size     int   // Bytes of the cell on the b-tree page.
+	overflow []int // Overflow pages.
+}
+
+// cell returns the i-th cell of p with its payload, overflow pages included.
+func (d *dbFile) cell(p *btreePage, i int) (*btreeCell, error) {
+	b := p.data[:d.usable]
+	off := p.cells[i]
+	c := &btreeCell{}
+	if !p.isLeaf() {
+		if off+4 > len(b) {
+			return nil, errCorrupt
+		}
+
+		c.child = int(binary.BigEndian.Uint32(b[off:]))
+		off += 4
+	}
+	if p.typ == pageTableInterior {
+		v, n := getVarint(b[off:])
+		if n == 0 {
+			return nil, errCorrupt
+		}
+
+		c.rowid = int64(v)
+		c.size = off + n - p.cells[i]
+		return c, nil
+	}
+
+	size, n := getVarint(b[off:])
+	if n == 0 || size > math.MaxInt32 {
+		return nil, errCorrupt
+	}
+
+	off += n
+	if p.typ == pageTableLeaf {
+		v, n := getVarint(b[off:])
+		if n == 0 {
+			return nil, errCorrupt
+		}
+
+		c.rowid = int64(v)
+		off += n
+	}
+
+	// Local payload size, see the file format documentation.
+	u := d.usable
+	x := u - 35
+	if !p.isTable() {
+		x = (u-12)*64/255 - 23
+	}
+	local := int(size)
+	if local > x {
+		m := (u-12)*32/255 - 23
+		local = m + (int(size)-m)%(u-4)
+		if local > x {
+			local = m
+		}
+	}
+	if off+local > len(b) {
+		return nil, errCorrupt
+	}
+
+	c.payload = append(c.payload, b[off:off+local]...)
+	c.local = local
+	c.size = off + local - p.cells[i]
+	if local == int(size) {
+		return c, nil
+	}
+
+	c.size += 4
+
+	if off+local+4 > len(b) {
+		return nil, errCorrupt
+	}
+
+	seen := map[int]bool{}
+	for next := int(binary.BigEndian.Uint32(b[off+local:])); len(c.payload) < int(size); {
+		if next == 0 || seen[next] {
+			return c, fmt.Errorf("page %d: bad overflow chain", p.pgno)
+		}
+
+		seen[next] = true
+		c.overflow = append(c.overflow, next)
+		o, err := d.page(next)
+		if err != nil {
+			return c, err
+		}
+
+		k := min(u-4, int(size)-len(c.payload))
+		c.payload = append(c.payload, o[4:4+k]...)
+		next = int(binary.BigEndian.Uint32(o))
+	}
+	return c, nil
+}
+
+// getVarint decodes the varint at the start of b. The length is zero if b is
+// too short.
+func getVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	panic("unreachable")
+}
+
+// decodeRecord returns the values of the record b as int64, float64,
+// string, []byte or nil. Text is returned as UTF-8.
+func (d *dbFile) decodeRecord(b []byte) ([]interface{}, error) {
+	h, n := getVarint(b)
+	if n == 0 || h > uint64(len(b)) || int(h) < n {
+		return nil, errCorrupt
+	}
+
+	var r []interface{}
+	hdr, body := b[n:h], b[h:]
+	for len(hdr) != 0 {
+		t, n := getVarint(hdr)
+		if n == 0 {
+			return nil, errCorrupt
+		}
+
+		hdr = hdr[n:]
+		size := serialTypeSize(t)
+		if size < 0 || size > len(body) {
+			return nil, errCorrupt
+		}
+
+		v := body[:size]
+		body = body[size:]
+		switch {
+		case t == 0:
+			r = append(r, nil)
+		case t <= 6:
+			x := int64(int8(v[0]))
+			for _, c := range v[1:] {
+				x = x<<8 | int64(c)
+			}
+			r = append(r, x)
+		case t == 7:
+			r = append(r, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case t == 8, t == 9:
+			r = append(r, int64(t-8))
+		case t%2 == 0:
+			r = append(r, append([]byte{}, v...))
+		default:
+			r = append(r, d.text(v))
+		}
+	}
+	return r, nil
+}
+
+// serialTypeSize returns the size of the value of serial type t or -1 for
+// the reserved types.
+func serialTypeSize(t uint64) int {
+	switch {
+	case t <= 4:
+		return int(t)
+	case t == 5:
+		return 6
+	case t == 6, t == 7:
+		return 8
+	case t == 8, t == 9:
+		return 0
+	case t == 10, t == 11, t > math.MaxInt32:
+		return -1
+	}
+	return int(t-12) / 2
+}
+
+func (d *dbFile) text(b []byte) string {
+	if d.encoding == encUTF8 {
+		return string(b)
+	}
+
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		if d.encoding == encUTF16le {
+			u[i] = binary.LittleEndian.Uint16(b[2*i:])
+			continue
+		}
+
+		u[i] = binary.BigEndian.Uint16(b[2*i:])
+	}
+	return string(utf16.Decode(u))
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Description of a table.
+//
+//	.describe ?--json? ?SCHEMA.?TABLE
+//
+// .describe writes, in the current output mode, the type of the table or
+// view TABLE and its row count estimated by sqlite_stat1, its columns with
+// their declared type, affinity, nullability, default value, position in the
+// primary key and the foreign keys referencing other tables, its indexes and
+// its triggers. .de is short for .describe, like \d of psql. .echo, .eqp,
+// .stats, .scanstats and .profile do not apply to these sections.
+//
+// With --json, .describe writes the description as one JSON object.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "describe",
+		abbrev: 2,
+		usage:  "?--json? TABLE",
+		help:   "Show the columns, keys, indexes and triggers of TABLE",
+		run:    describeCommand,
+	})
+}
+
+const shflgEcho = 0x40 // SHFLG_Echo of ShellState.shellFlgs.
+
+// triggerEventRe matches the event following the, possibly quoted and
+// qualified, name of a trigger.
+var triggerEventRe = regexp.MustCompile(`(?is)^\s*CREATE\s+(?:TEMP(?:ORARY)?\s+)?TRIGGER\s+(?:IF\s+NOT\s+EXISTS\s+)?` +
+	sqlNamePart + `(?:\s*\.\s*` + sqlNamePart + `)?\s*((?:BEFORE|AFTER|INSTEAD\s+OF)\s+)?(INSERT|DELETE|UPDATE)\b`)
+
+// sqlNamePart matches a, possibly quoted, name.
+const sqlNamePart = `(?:"(?:[^"]|"")*"|'(?:[^']|'')*'|` + "`(?:[^`]|``)*`" + `|\[[^\]]*\]|[^\s.("'` + "`" + `\[]+)`
+
+var affinityNames = []string{
+	affinityBlob:    "BLOB",
+	affinityText:    "TEXT",
+	affinityNumeric: "NUMERIC",
+	affinityInteger: "INTEGER",
+	affinityReal:    "REAL",
+}
+
+type tableDescription struct {
+	Schema   string               `json:"schema"`
+	Name     string               `json:"name"`
+	Type     string               `json:"type"`
+	Rows     interface{}          `json:"estimated_rows"`
+	Columns  []columnDescription  `json:"columns"`
+	Indexes  []indexDescription   `json:"indexes"`
+	Triggers []triggerDescription `json:"triggers"`
+}
+
+type columnDescription struct {
+	Name       string      `json:"name"`
+	Type       string      `json:"type"`
+	Affinity   string      `json:"affinity"`
+	NotNull    bool        `json:"not_null"`
+	Default    interface{} `json:"default"`
+	PK         int64       `json:"pk"`
+	References []string    `json:"references,omitempty"`
+}
+
+type indexDescription struct {
+	Name    string   `json:"name"`
+	Unique  bool     `json:"unique"`
+	Origin  string   `json:"origin"`
+	Partial bool     `json:"partial"`
+	Columns []string `json:"columns"`
+}
+
+type triggerDescription struct {
+	Name  string `json:"name"`
+	Event string `json:"event"`
+}
+
+func describeCommand(s *shell, args []string) error {
+	asJSON := false
+	table := ""
+	for _, v := range args {
+		switch {
+		case v == "-json" || v == "--json":
+			asJSON = true
+		case table == "" && !strings.HasPrefix(v, "-"):
+			table = v
+		default:
+			return errUsage
+		}
+	}
+	if table == "" {
+		return errUsage
+	}
+
+	d, err := describeTable(s.conn(), table)
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		b, err := json.Marshal(d)
+		if err != nil {
+			return err
+		}
+
+		s.printf("%s\n", b)
+		return nil
+	}
+
+	rows := [][]interface{}{{d.Schema, d.Name, d.Type, d.Rows}}
+	sections := []string{describeSQL([]string{"schema", "name", "type", "estimated_rows"}, rows)}
+	rows = nil
+	for _, v := range d.Columns {
+		var pk interface{}
+		if v.PK != 0 {
+			pk = v.PK
+		}
+		rows = append(rows, []interface{}{v.Name, v.Type, v.Affinity, yesNo(!v.NotNull), v.Default, pk, strings.Join(v.References, ", ")})
+	}
+	sections = append(sections, describeSQL([]string{"column", "type", "affinity", "nullable", "default", "pk", "references"}, rows))
+	rows = nil
+	for _, v := range d.Indexes {
+		rows = append(rows, []interface{}{v.Name, yesNo(v.Unique), v.Origin, yesNo(v.Partial), strings.Join(v.Columns, ", ")})
+	}
+	sections = append(sections, describeSQL([]string{"index", "unique", "origin", "partial", "columns"}, rows))
+	rows = nil
+	for _, v := range d.Triggers {
+		rows = append(rows, []interface{}{v.Name, v.Event})
+	}
+	sections = append(sections, describeSQL([]string{"trigger", "event"}, rows))
+
+	// The sections are not SQL of the user, they are not echoed, explained
+	// or profiled.
+	st := s.state()
+	echo, eqp, stats, scanstats := st.XshellFlgs&shflgEcho, st.XautoEQP, st.XstatsOn, st.XscanstatsOn
+	profile, profiling := profileOuts[s.p]
+	st.XshellFlgs &^= shflgEcho
+	st.XautoEQP, st.XstatsOn, st.XscanstatsOn = 0, 0, 0
+	delete(profileOuts, s.p)
+	defer func() {
+		st.XshellFlgs |= echo
+		st.XautoEQP, st.XstatsOn, st.XscanstatsOn = eqp, stats, scanstats
+		if profiling {
+			profileOuts[s.p] = profile
+		}
+	}()
+
+	first := true
+	for _, v := range sections {
+		if v == "" {
+			continue
+		}
+
+		if !first {
+			s.printf("\n")
+		}
+		first = false
+		if err := s.exec(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+
+	return "no"
+}
+
+// describeSQL returns a SELECT statement producing rows with the column
+// names cols, or "" if there are no rows.
+func describeSQL(cols []string, rows [][]interface{}) string {
+	if len(rows) == 0 {
+		return ""
+	}
+
+	a := make([]string, len(cols))
+	for i, v := range cols {
+		a[i] = fmt.Sprintf("column%d AS %s", i+1, sqlQuoteID(v))
+	}
+	values := make([]string, len(rows))
+	for i, row := range rows {
+		b := make([]string, len(row))
+		for j, v := range row {
+			b[j] = sqlLiteral(v)
+		}
+		values[i] = "(" + strings.Join(b, ", ") + ")"
+	}
+	return fmt.Sprintf("SELECT %s FROM (VALUES%s)", strings.Join(a, ", "), strings.Join(values, ", "))
+}
+
+// describeTable finds the table or view name, which may be qualified by the
+// schema, in the databases and returns its description.
+func describeTable(c *sqlConn, name string) (*tableDescription, error) {
+	dbs, err := c.query("SELECT name FROM pragma_database_list ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+
+	var d *tableDescription
+	var sql string
+	for _, qualified := range []bool{true, false} {
+		for _, db := range dbs {
+			schema, table := db[0].(string), name
+			if qualified {
+				if !strings.HasPrefix(strings.ToLower(name), strings.ToLower(schema)+".") {
+					continue
+				}
+
+				table = name[len(schema)+1:]
+			}
+			row, err := c.queryRow(fmt.Sprintf("SELECT name, type, sql FROM %s.sqlite_master WHERE name = ? COLLATE NOCASE AND type IN ('table', 'view')", sqlQuoteID(schema)), table)
+			if err != nil {
+				return nil, err
+			}
+
+			if row != nil {
+				d = &tableDescription{
+					Schema:   schema,
+					Name:     row[0].(string),
+					Type:     row[1].(string),
+					Columns:  []columnDescription{},
+					Indexes:  []indexDescription{},
+					Triggers: []triggerDescription{},
+				}
+				sql, _ = row[2].(string)
+				break
+			}
+		}
+		if d != nil {
+			break
+		}
+	}
+	if d == nil {
+		return nil, fmt.Errorf("no such table: %s", name)
+	}
+
+	switch {
+	case strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL"):
+		d.Type = "virtual table"
+	case d.Type == "table" && withoutRowidRe.MatchString(sql):
+		d.Type = "table without rowid"
+	}
+	if row, err := c.queryRow(fmt.Sprintf("SELECT 1 FROM %s.sqlite_master WHERE name = 'sqlite_stat1'", sqlQuoteID(d.Schema))); err != nil {
+		return nil, err
+	} else if row != nil {
+		if row, err = c.queryRow(fmt.Sprintf("SELECT max(CAST(stat AS INTEGER)) FROM %s.sqlite_stat1 WHERE tbl = ? COLLATE NOCASE", sqlQuoteID(d.Schema)), d.Name); err != nil {
+			return nil, err
+		}
+
+		d.Rows = row[0]
+	}
+
+	refs := map[string][]string{}
+	fkeys, err := c.query("SELECT \"from\", \"table\", \"to\" FROM pragma_foreign_key_list(?, ?) ORDER BY id, seq", d.Name, d.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range fkeys {
+		from := strings.ToLower(v[0].(string))
+		ref := v[1].(string)
+		if to, ok := v[2].(string); ok {
+			ref += "(" + to + ")"
+		}
+		refs[from] = append(refs[from], ref)
+	}
+	cols, err := c.query("SELECT name, type, \"notnull\", dflt_value, pk FROM pragma_table_info(?, ?) ORDER BY cid", d.Name, d.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range cols {
+		typ := fmt.Sprint(v[1])
+		d.Columns = append(d.Columns, columnDescription{
+			Name:       v[0].(string),
+			Type:       typ,
+			Affinity:   affinityNames[typeAffinity(typ)],
+			NotNull:    v[2] != int64(0),
+			Default:    v[3],
+			PK:         v[4].(int64),
+			References: refs[strings.ToLower(v[0].(string))],
+		})
+	}
+
+	indexes, err := c.query("SELECT name, \"unique\", origin, partial FROM pragma_index_list(?, ?) ORDER BY name", d.Name, d.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range indexes {
+		x := indexDescription{Name: v[0].(string), Unique: v[1] != int64(0), Origin: fmt.Sprint(v[2]), Partial: v[3] != int64(0)}
+		cols, err := c.query("SELECT name FROM pragma_index_info(?, ?) ORDER BY seqno", x.Name, d.Schema)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range cols {
+			name, ok := v[0].(string)
+			if !ok {
+				name = "<expr>"
+			}
+			x.Columns = append(x.Columns, name)
+		}
+		d.Indexes = append(d.Indexes, x)
+	}
+
+	triggers, err := c.query(fmt.Sprintf("SELECT name, sql FROM %s.sqlite_master WHERE type = 'trigger' AND tbl_name = ? COLLATE NOCASE ORDER BY name", sqlQuoteID(d.Schema)), d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, v := range triggers {
+		t := triggerDescription{Name: v[0].(string)}
+		if m := triggerEventRe.FindStringSubmatch(fmt.Sprint(v[1])); m != nil {
+			timing := strings.ToUpper(strings.Join(strings.Fields(m[1]), " "))
+			if timing == "" {
+				timing = "BEFORE"
+			}
+			t.Event = timing + " " + strings.ToUpper(m[2])
+		}
+		d.Triggers = append(d.Triggers, t)
+	}
+	return d, nil
+}
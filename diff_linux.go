@@ -0,0 +1,555 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Differences between two databases.
+//
+//	.diff ?--primarykey? ?--summary? OTHER ?TABLE?
+//
+// .diff attaches the database OTHER and writes an SQL script which changes
+// the main database into OTHER, like the sqldiff program of SQLite. Only
+// TABLE, its indexes and triggers are compared if given.
+//
+// Tables missing in OTHER are dropped, new tables are created and filled.
+// Columns appended to a table in OTHER are added with ALTER TABLE, other
+// changes of the columns of a table make it dropped and created again. The
+// rows are compared by rowid or, with --primarykey, by the PRIMARY KEY. Tables
+// without a rowid are always compared by their PRIMARY KEY and those without
+// a PRIMARY KEY always by rowid. Indexes, triggers and views whose SQL
+// differs are dropped and created again.
+//
+// Tables which have the same columns are hashed first, like by .sha3sum,
+// and skipped if the hashes are the same.
+//
+// With --summary, .diff writes the numbers of changed, inserted, deleted and
+// unchanged rows of every table instead of the script.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "diff",
+		abbrev: 3,
+		usage:  "?--primarykey? ?--summary? OTHER ?TABLE?",
+		help:   "Write the SQL changing the database into OTHER",
+		run:    diffCommand,
+	})
+}
+
+// diffSchema is the name OTHER is attached as.
+const diffSchema = "diff$other"
+
+type differ struct {
+	s          *shell
+	c          *sqlConn
+	primaryKey bool
+	summary    bool
+}
+
+type diffColumn struct {
+	name    string
+	typ     string
+	notNull bool
+	dflt    interface{}
+	pk      int64
+}
+
+type diffTable struct {
+	name string
+	sql  string
+	cols []diffColumn
+	key  []string // PRIMARY KEY columns or the name of the rowid.
+}
+
+// diffCounts are the row counts of --summary.
+type diffCounts struct {
+	changed, inserted, deleted, unchanged int64
+}
+
+func diffCommand(s *shell, args []string) error {
+	d := &differ{s: s}
+	var other, table string
+	for _, v := range args {
+		switch v {
+		case "-primarykey", "--primarykey":
+			d.primaryKey = true
+		case "-summary", "--summary":
+			d.summary = true
+		default:
+			switch {
+			case strings.HasPrefix(v, "-"):
+				return errUsage
+			case other == "":
+				other = v
+			case table == "":
+				table = v
+			default:
+				return errUsage
+			}
+		}
+	}
+	if other == "" {
+		return errUsage
+	}
+
+	if _, err := os.Stat(other); err != nil {
+		return err
+	}
+
+	d.c = s.conn()
+	if err := d.c.exec(fmt.Sprintf("ATTACH ? AS %s", sqlQuoteID(diffSchema)), other); err != nil {
+		return err
+	}
+
+	defer d.c.exec(fmt.Sprintf("DETACH %s", sqlQuoteID(diffSchema)))
+	return d.run(table)
+}
+
+func (d *differ) run(table string) error {
+	filter := ""
+	var args []interface{}
+	if table != "" {
+		filter = " AND tbl_name LIKE ?"
+		args = append(args, table)
+	}
+	names := map[string]bool{}
+	for _, schema := range []string{"main", diffSchema} {
+		rows, err := d.c.query(fmt.Sprintf("SELECT name FROM %s.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%%'%s", sqlQuoteID(schema), filter), args...)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range rows {
+			names[strings.ToLower(v[0].(string))] = true
+		}
+	}
+	var tables []string
+	for k := range names {
+		tables = append(tables, k)
+	}
+	sort.Strings(tables)
+
+	objects, err := d.objects(filter, args)
+	if err != nil {
+		return err
+	}
+
+	// Indexes, triggers and views go away with their tables and other tables
+	// can be used by triggers and views, so those are dropped first and
+	// created last.
+	recreated := map[string]bool{}
+	var creates []string
+	for _, name := range tables {
+		from, err := d.table("main", name)
+		if err != nil {
+			return err
+		}
+
+		to, err := d.table(diffSchema, name)
+		if err != nil {
+			return err
+		}
+
+		if from == nil || to == nil || !d.compatible(from, to) {
+			recreated[name] = true
+		}
+	}
+	if !d.summary {
+		for _, v := range objects {
+			if v.from != nil && (v.to == nil || v.from.sql != v.to.sql) && !recreated[strings.ToLower(v.from.tblName)] {
+				d.s.printf("DROP %s %s;\n", strings.ToUpper(v.from.typ), sqlID(v.from.name))
+			}
+			if v.to != nil && (v.from == nil || v.from.sql != v.to.sql || recreated[strings.ToLower(v.to.tblName)]) {
+				creates = append(creates, v.to.sql)
+			}
+		}
+	}
+	for _, name := range tables {
+		if err := d.diffTable(name); err != nil {
+			return err
+		}
+	}
+	for _, v := range creates {
+		d.s.printf("%s;\n", v)
+	}
+	return nil
+}
+
+// diffObject is an index, trigger or view in the main database, in OTHER or
+// in both.
+type diffObject struct {
+	from, to *schemaRow
+}
+
+func (d *differ) objects(filter string, args []interface{}) ([]*diffObject, error) {
+	m := map[string]*diffObject{}
+	var names []string
+	for i, schema := range []string{"main", diffSchema} {
+		rows, err := d.c.query(fmt.Sprintf("SELECT type, name, tbl_name, sql FROM %s.sqlite_master WHERE type IN ('index', 'trigger', 'view') AND sql NOT NULL%s", sqlQuoteID(schema), filter), args...)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range rows {
+			r := &schemaRow{typ: v[0].(string), name: v[1].(string), tblName: v[2].(string), sql: v[3].(string)}
+			k := r.typ + " " + strings.ToLower(r.name)
+			o := m[k]
+			if o == nil {
+				o = &diffObject{}
+				m[k] = o
+				names = append(names, k)
+			}
+			if i == 0 {
+				o.from = r
+				continue
+			}
+
+			o.to = r
+		}
+	}
+	sort.Strings(names)
+	r := make([]*diffObject, len(names))
+	for i, v := range names {
+		r[i] = m[v]
+	}
+	return r, nil
+}
+
+// table returns the table name of schema or nil if there is no such table.
+func (d *differ) table(schema, name string) (*diffTable, error) {
+	row, err := d.c.queryRow(fmt.Sprintf("SELECT name, sql FROM %s.sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE", sqlQuoteID(schema)), name)
+	if err != nil || row == nil {
+		return nil, err
+	}
+
+	t := &diffTable{name: row[0].(string)}
+	t.sql, _ = row[1].(string)
+	rows, err := d.c.query("SELECT name, type, \"notnull\", dflt_value, pk FROM pragma_table_info(?, ?) ORDER BY cid", t.name, schema)
+	if err != nil {
+		return nil, err
+	}
+
+	var pk []diffColumn
+	for _, v := range rows {
+		c := diffColumn{name: v[0].(string), dflt: v[3], pk: v[4].(int64)}
+		c.typ, _ = v[1].(string)
+		c.notNull = v[2].(int64) != 0
+		t.cols = append(t.cols, c)
+		if c.pk != 0 {
+			pk = append(pk, c)
+		}
+	}
+	sort.Slice(pk, func(i, j int) bool { return pk[i].pk < pk[j].pk })
+	if len(pk) != 0 && (d.primaryKey || withoutRowidRe.MatchString(t.sql)) {
+		for _, v := range pk {
+			t.key = append(t.key, v.name)
+		}
+		return t, nil
+	}
+
+outer:
+	for _, v := range []string{"rowid", "_rowid_", "oid"} {
+		for _, c := range t.cols {
+			if strings.EqualFold(c.name, v) {
+				continue outer
+			}
+		}
+
+		t.key = []string{v}
+		return t, nil
+	}
+	return nil, fmt.Errorf("%s: no column can be used as the key", t.name)
+}
+
+// compatible reports whether from can be changed into to without creating it
+// again: to has the same key and the columns of from, followed by the added
+// ones.
+func (d *differ) compatible(from, to *diffTable) bool {
+	if len(from.cols) > len(to.cols) || len(from.key) != len(to.key) || withoutRowidRe.MatchString(from.sql) != withoutRowidRe.MatchString(to.sql) {
+		return false
+	}
+
+	for i, v := range from.key {
+		if !strings.EqualFold(v, to.key[i]) {
+			return false
+		}
+	}
+	for i, v := range from.cols {
+		if w := to.cols[i]; !strings.EqualFold(v.name, w.name) || v.pk != w.pk {
+			return false
+		}
+	}
+	for _, v := range to.cols[len(from.cols):] {
+		// ALTER TABLE ADD COLUMN cannot add these.
+		if v.pk != 0 || v.notNull && v.dflt == nil {
+			return false
+		}
+	}
+	return true
+}
+
+func (d *differ) diffTable(name string) error {
+	from, err := d.table("main", name)
+	if err != nil {
+		return err
+	}
+
+	to, err := d.table(diffSchema, name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case to == nil:
+		if d.summary {
+			d.s.printf("%s: missing from second database\n", from.name)
+			return nil
+		}
+
+		d.s.printf("DROP TABLE %s;\n", sqlID(from.name))
+		return nil
+	case from == nil || !d.compatible(from, to):
+		if d.summary {
+			if from == nil {
+				d.s.printf("%s: missing from first database\n", to.name)
+				return nil
+			}
+
+			d.s.printf("%s: incompatible schema\n", to.name)
+			return nil
+		}
+
+		if from != nil {
+			d.s.printf("DROP TABLE %s;\n", sqlID(from.name))
+		}
+		// The table is recreated empty, every row of OTHER is inserted.
+		d.s.printf("%s;\n", to.sql)
+		return d.rows(nil, to)
+	}
+
+	if len(from.cols) == len(to.cols) {
+		same, err := d.sameRows(to)
+		if err != nil {
+			return err
+		}
+
+		if same {
+			if d.summary {
+				row, err := d.c.queryRow(fmt.Sprintf("SELECT count(*) FROM main.%s", sqlQuoteID(from.name)))
+				if err != nil {
+					return err
+				}
+
+				d.s.printf("%s: 0 changes, 0 inserts, 0 deletes, %d unchanged\n", from.name, row[0])
+			}
+			return nil
+		}
+	}
+
+	if !d.summary {
+		for _, v := range to.cols[len(from.cols):] {
+			def := sqlID(v.name)
+			if v.typ != "" {
+				def += " " + v.typ
+			}
+			if v.notNull {
+				def += " NOT NULL"
+			}
+			if v.dflt != nil {
+				def += fmt.Sprintf(" DEFAULT %v", v.dflt)
+			}
+			d.s.printf("ALTER TABLE %s ADD COLUMN %s;\n", sqlID(from.name), def)
+		}
+	}
+	return d.rows(from, to)
+}
+
+// sameRows reports whether the table t has the same rows in both databases.
+// The query hashed by sha3_query must be the same, so it selects from a
+// temporary view of either table. The view has the key columns too, the
+// rowid is not one of *.
+func (d *differ) sameRows(t *diffTable) (bool, error) {
+	const view = `temp."diff$hash"`
+	key := make([]string, len(t.key))
+	for i, v := range t.key {
+		key[i] = sqlQuoteID(v)
+	}
+	var hash [2]interface{}
+	for i, schema := range []string{"main", diffSchema} {
+		if err := d.c.exec(fmt.Sprintf("CREATE VIEW %s AS SELECT %s, * FROM %s.%s ORDER BY %[2]s",
+			view, strings.Join(key, ", "), sqlQuoteID(schema), sqlQuoteID(t.name))); err != nil {
+			return false, err
+		}
+
+		row, err := d.c.queryRow(fmt.Sprintf("SELECT sha3_query('SELECT * FROM %s', 256)", strings.Replace(view, "'", "''", -1)))
+		d.c.exec("DROP VIEW " + view)
+		if err != nil {
+			return false, err
+		}
+
+		hash[i] = row[0]
+	}
+	a, _ := hash[0].([]byte)
+	b, _ := hash[1].([]byte)
+	return a != nil && string(a) == string(b), nil
+}
+
+// rows writes the statements changing the rows of from, nil if the table is
+// new, into those of to.
+func (d *differ) rows(from, to *diffTable) error {
+	key := make([]string, len(to.key))
+	on := make([]string, len(to.key))
+	for i, v := range to.key {
+		key[i] = sqlQuoteID(v)
+		on[i] = fmt.Sprintf("A.%s IS B.%s", key[i], key[i])
+	}
+	var values []diffColumn // Columns not in the key.
+	for _, v := range to.cols {
+		if !containsFold(to.key, v.name) {
+			values = append(values, v)
+		}
+	}
+	into := make([]string, len(key))
+	for i, v := range to.key {
+		into[i] = sqlID(v)
+	}
+	var sel []string
+	for _, v := range values {
+		into = append(into, sqlID(v.name))
+		sel = append(sel, "B."+sqlQuoteID(v.name))
+	}
+	bKey := "B." + strings.Join(key, ", B.")
+	aKey := "A." + strings.Join(key, ", A.")
+	other := fmt.Sprintf("%s.%s", sqlQuoteID(diffSchema), sqlQuoteID(to.name))
+
+	var n diffCounts
+	inserts := fmt.Sprintf("SELECT %s FROM %s AS B ORDER BY %s", strings.Join(append([]string{bKey}, sel...), ", "), other, bKey)
+	if from != nil {
+		main := "main." + sqlQuoteID(from.name)
+		inserts = fmt.Sprintf("SELECT %s FROM %s AS B WHERE NOT EXISTS (SELECT 1 FROM %s AS A WHERE %s) ORDER BY %s",
+			strings.Join(append([]string{bKey}, sel...), ", "), other, main, strings.Join(on, " AND "), bKey)
+		deletes := fmt.Sprintf("SELECT %s FROM %s AS A WHERE NOT EXISTS (SELECT 1 FROM %s AS B WHERE %s) ORDER BY %s",
+			aKey, main, other, strings.Join(on, " AND "), aKey)
+		if err := d.each(deletes, func(row []interface{}) {
+			n.deleted++
+			if !d.summary {
+				d.s.printf("DELETE FROM %s WHERE %s;\n", sqlID(from.name), d.where(to.key, row))
+			}
+		}); err != nil {
+			return err
+		}
+
+		if len(values) != 0 {
+			var changed []string
+			for _, v := range values {
+				a := "A." + sqlQuoteID(v.name)
+				if !containsFold(colNames(from.cols), v.name) {
+					// Added by ALTER TABLE.
+					a = "NULL"
+					if v.dflt != nil {
+						a = fmt.Sprintf("(%v)", v.dflt)
+					}
+				}
+				x := fmt.Sprintf("%s IS NOT B.%s", a, sqlQuoteID(v.name))
+				changed = append(changed, x)
+			}
+			updates := fmt.Sprintf("SELECT %s, %s, %s FROM %s AS A JOIN %s AS B ON %s WHERE %s ORDER BY %s",
+				bKey, strings.Join(sel, ", "), strings.Join(changed, ", "), main, other, strings.Join(on, " AND "), strings.Join(changed, " OR "), bKey)
+			if err := d.each(updates, func(row []interface{}) {
+				n.changed++
+				if d.summary {
+					return
+				}
+
+				var set []string
+				k := len(key)
+				for i, v := range values {
+					if row[k+len(values)+i].(int64) != 0 {
+						set = append(set, fmt.Sprintf("%s=%s", sqlID(v.name), dumpLiteral(d.c.tls, row[k+i], false)))
+					}
+				}
+				d.s.printf("UPDATE %s SET %s WHERE %s;\n", sqlID(from.name), strings.Join(set, ", "), d.where(to.key, row))
+			}); err != nil {
+				return err
+			}
+		}
+	}
+	if err := d.each(inserts, func(row []interface{}) {
+		n.inserted++
+		if d.summary {
+			return
+		}
+
+		lits := make([]string, len(row))
+		for i, v := range row {
+			lits[i] = dumpLiteral(d.c.tls, v, false)
+		}
+		d.s.printf("INSERT INTO %s(%s) VALUES(%s);\n", sqlID(to.name), strings.Join(into, ","), strings.Join(lits, ","))
+	}); err != nil {
+		return err
+	}
+
+	if d.summary {
+		row, err := d.c.queryRow(fmt.Sprintf("SELECT count(*) FROM %s", other))
+		if err != nil {
+			return err
+		}
+
+		n.unchanged = row[0].(int64) - n.changed - n.inserted
+		d.s.printf("%s: %d changes, %d inserts, %d deletes, %d unchanged\n", to.name, n.changed, n.inserted, n.deleted, n.unchanged)
+	}
+	return nil
+}
+
+// where returns the condition selecting the row with the values of key at
+// the start of row.
+func (d *differ) where(key []string, row []interface{}) string {
+	a := make([]string, len(key))
+	for i, v := range key {
+		if row[i] == nil {
+			a[i] = sqlID(v) + " IS NULL"
+			continue
+		}
+
+		a[i] = fmt.Sprintf("%s=%s", sqlID(v), dumpLiteral(d.c.tls, row[i], false))
+	}
+	return strings.Join(a, " AND ")
+}
+
+// each calls fn for every row of query.
+func (d *differ) each(query string, fn func([]interface{})) error {
+	stmt, err := d.c.prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer stmt.close()
+	for {
+		ok, err := stmt.step()
+		if err != nil || !ok {
+			return err
+		}
+
+		fn(stmt.row())
+	}
+}
+
+func colNames(cols []diffColumn) []string {
+	r := make([]string, len(cols))
+	for i, v := range cols {
+		r[i] = v.name
+	}
+	return r
+}
+
+func containsFold(a []string, s string) bool {
+	for _, v := range a {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
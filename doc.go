@@ -14,6 +14,67 @@
 //
 // 2018-03-06: Initial release.
 //
+// 2026-10-19: The fileio extension provides the fsdir table-valued function.
+//
+// 2026-10-19: Add the csv virtual table.
+//
+// 2026-10-19: SQL functions can be written in Go, see RegisterFunction and
+// RegisterAggregate.
+//
+// 2026-10-19: Virtual table modules can be written in Go, see RegisterModule.
+//
+// 2026-10-19: Added the REGEXP operator and the regexp_replace, regexp_substr
+// and regexp_capture functions.
+//
+// 2026-10-19: Added the JSON1 functions and the json_each and json_tree
+// table-valued functions.
+//
+// 2026-10-19: Added the fts5 full-text search module, see RegisterTokenizer.
+//
+// 2026-10-19: Added the rtree and rtree_i32 modules and the point_in_polygon,
+// geojson_bbox and haversine functions.
+//
+// 2026-10-19: Added the generate_series, split, regexp_matches and
+// date_series table-valued functions.
+//
+// 2026-10-19: Added the .parameter command and the -param option. Statements
+// bind the parameters set with them.
+//
+// 2026-10-19: Added the .expert command.
+//
+// 2026-10-19: Added the .recover command.
+//
+// 2026-10-19: .scanstats works and prints the actual rows of each loop and a
+// guess of them, added the .profile command.
+//
+// 2026-10-19: .eqp tree and the -eqp option show the query plan as a tree,
+// .eqp full adds the annotated program.
+//
+// 2026-10-19: Added the --schema-only, --data-only, --exclude, --where,
+// --insert-batch and --gzip options of .dump.
+//
+// 2026-10-19: Added the .diff command.
+//
+// 2026-10-19: Added the .session and .changeset commands.
+//
+// 2026-10-19: Added the .analyze-space command.
+//
+// 2026-10-19: Added the .page, .btree, .freelist and .hexdump commands.
+//
+// 2026-10-19: Added the .wal command.
+//
+// 2026-10-19: .lint checks more rules, see .lint without arguments, and has
+// a --json option.
+//
+// 2026-10-19: Added the .migrate command.
+//
+// 2026-10-19: .schema writes Graphviz DOT or Mermaid entity-relationship
+// diagrams with the --dot and --mermaid options.
+//
+// 2026-10-19: Added the .describe command.
+//
+// 2026-10-19: Added the .generate command.
+//
 // Status
 //
 // This is an early technology preview of sqlite2go - a support-sqlite-only
@@ -67,6 +128,7 @@
 //       -stats               print memory stats before each finalize
 //       -version             show SQLite version
 //       -vfs NAME            use NAME as the default VFS
+//       -param NAME=VALUE    set parameter NAME to VALUE, see .parameter
 //    $ sqlite3shell db
 //    SQLite version 3.21.0 2017-10-24 18:55:49
 //    Enter ".help" for usage hints.
@@ -145,5 +207,59 @@
 //    .vfsname ?AUX?         Print the name of the VFS stack
 //    .width NUM1 NUM2 ...   Set column widths for "column" mode
 //                             Negative values right-justify
+//    .analyze-space ?--sql? Report the space used by each table and index
+//    .btree TABLE|INDEX|ROOT
+//                           Write the pages of a b-tree
+//    .changeset apply|concat|invert ARGS...
+//                           Apply and edit changesets of .session
+//                             apply FILE ?--conflict omit|replace|abort?
+//                               Apply the changeset FILE to the main database
+//                             concat FILE1 FILE2 OUT
+//                               Write the changes of FILE1 and FILE2 to OUT
+//                             invert FILE OUT
+//                               Write the changeset undoing FILE to OUT
+//    .describe ?--json? TABLE
+//                           Show the columns, keys, indexes and triggers of TABLE
+//    .diff ?--primarykey? ?--summary? OTHER ?TABLE?
+//                           Write the SQL changing the database into OTHER
+//    .expert ?--verbose?    Suggest indexes for the next SQL statement
+//    .freelist              List the pages of the freelist
+//    .generate TABLE N ?--seed S? ?--col COLUMN=GENERATOR ...?
+//                           Insert N rows of synthetic data into TABLE
+//    .hexdump PGNO ?OFFSET ?LENGTH??
+//                           Write an annotated hex dump of page PGNO
+//    .migrate ?--dry-run? DIR status|up|down|to ...
+//                           Apply the numbered .sql migration files of DIR
+//                             down ?N?              Revert the last N, by default 1, migrations
+//                             status                List the migrations and their state
+//                             to VERSION            Apply or revert migrations up to VERSION
+//                             up ?N?                Apply N, by default all, pending migrations
+//    .page PGNO             Decode page PGNO
+//    .parameter CMD ...     Manage SQL parameter bindings
+//                             clear            Remove all parameters
+//                             init             Create the parameter table
+//                             list             List the parameters
+//                             set NAME VALUE   Set parameter NAME to VALUE
+//                             unset NAME       Remove parameter NAME
+//    .profile on|off|FILE   Write the scanstats of each statement as JSON to stdout or FILE
+//    .recover ?--lost-and-found TABLE?
+//                           Recover as much data as possible from a corrupt database
+//    .session ?NAME? CMD ...
+//                           Create or control sessions
+//                             attach TABLE|*        Record the changes of TABLE or of all tables
+//                             changeset FILE        Write the changes as a changeset to FILE
+//                             close                 Close the session
+//                             enable ?BOOLEAN?      Set or query the enable flag
+//                             indirect ?BOOLEAN?    Set or query the indirect flag
+//                             isempty               Query whether the session has recorded changes
+//                             list                  List the sessions
+//                             open DB NAME          Open a session on the database DB
+//                             patchset FILE         Write the changes as a patchset to FILE
+//    .wal info|checkpoint|autocheckpoint ...
+//                           Inspect the WAL file and run checkpoints
+//                             autocheckpoint ?N?    Set or show the frames that trigger a checkpoint
+//                             checkpoint ?MODE? ?DB?
+//                               Run a checkpoint, MODE is passive, full, restart or truncate
+//                             info ?DB?             Decode the WAL file header and list its frames
 //    sqlite>
 package main
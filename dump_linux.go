@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Options of .dump written in Go.
+//
+//	.dump ?OPTIONS? ?LIKE-PATTERN?
+//
+//	--data-only          Write no schema, only the rows
+//	--exclude PATTERN    Skip the tables whose name is LIKE PATTERN, repeatable
+//	--gzip               Compress the output
+//	--insert-batch N     Insert N rows per INSERT statement
+//	--newlines           Write newlines in text as they are
+//	--preserve-rowids    Include the rowids
+//	--schema-only        Write only the schema, no rows
+//	--where TABLE=EXPR   Write only the rows of TABLE where EXPR is true,
+//	                     repeatable
+//
+// The C shell dumps the database if none of these options, other than
+// --newlines and --preserve-rowids, is used. The output is otherwise the
+// same. The rows are written while they are read, so big tables do not use
+// much memory, even with --gzip.
+
+// Options handled by the C shell.
+var dumpCOptions = map[string]bool{"newlines": true, "preserve-rowids": true}
+
+type dumper struct {
+	c              *sqlConn
+	w              *bufio.Writer
+	like           string
+	exclude        []string
+	where          map[string]string // Lower case table name: EXPR.
+	batch          int
+	dataOnly       bool
+	gzip           bool
+	newlines       bool
+	preserveRowids bool
+	schemaOnly     bool
+	nErr           int
+	writableSchema bool
+}
+
+// dumpCommand runs .dump if it uses an option the C shell does not know. It
+// returns the do_meta_command result and whether it did.
+func dumpCommand(tls TLS, p uintptr, argc int32, args uintptr) (int32, bool) {
+	a := make([]string, argc-1)
+	for i := range a {
+		a[i] = goString(argv(args, i+1))
+	}
+	ours := false
+	for _, v := range a {
+		if strings.HasPrefix(v, "-") && !dumpCOptions[strings.TrimLeft(v, "-")] {
+			ours = true
+			break
+		}
+	}
+	if !ours {
+		return 0, false
+	}
+
+	s := &shell{tls, p}
+	d := &dumper{batch: 1}
+	if err := d.parse(a); err != nil {
+		s.eprintf("%v\n", err)
+		return 1, true
+	}
+
+	for k := range d.where {
+		row, err := s.conn().queryRow("SELECT 1 FROM sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE", k)
+		if err == nil && row == nil {
+			err = fmt.Errorf("no such table: %s", k)
+		}
+		if err != nil {
+			s.eprintf("Error: --where: %v\n", err)
+			return 1, true
+		}
+	}
+
+	var w io.Writer = &cWriter{tls, s.state().Xout}
+	var zw *gzip.Writer
+	if d.gzip {
+		zw = gzip.NewWriter(w)
+		w = zw
+	}
+	d.w = bufio.NewWriter(w)
+	d.c = s.conn()
+	d.dump()
+	err := d.w.Flush()
+	if zw != nil {
+		if err2 := zw.Close(); err == nil {
+			err = err2
+		}
+	}
+	if err != nil {
+		s.eprintf("Error: %v\n", err)
+		return 1, true
+	}
+
+	return 0, true
+}
+
+func (d *dumper) parse(args []string) error {
+	for i := 0; i < len(args); i++ {
+		v := args[i]
+		if !strings.HasPrefix(v, "-") {
+			if d.like != "" {
+				return errors.New("Usage: .dump ?--preserve-rowids? ?--newlines? ?--schema-only|--data-only? ?--exclude PATTERN? ?--where TABLE=EXPR? ?--insert-batch N? ?--gzip? ?LIKE-PATTERN?")
+			}
+
+			d.like = v
+			continue
+		}
+
+		value := func() (string, error) {
+			if i+1 == len(args) {
+				return "", fmt.Errorf("Missing argument to %s on \".dump\"", v)
+			}
+
+			i++
+			return args[i], nil
+		}
+		var err error
+		switch opt := strings.TrimPrefix(v[1:], "-"); opt {
+		case "data-only":
+			d.dataOnly = true
+		case "exclude":
+			var s string
+			s, err = value()
+			d.exclude = append(d.exclude, s)
+		case "gzip":
+			d.gzip = true
+		case "insert-batch":
+			var s string
+			if s, err = value(); err == nil {
+				if d.batch, err = strconv.Atoi(s); err != nil || d.batch < 1 {
+					err = fmt.Errorf("Invalid batch size \"%s\" on \".dump\"", s)
+				}
+			}
+		case "newlines":
+			d.newlines = true
+		case "preserve-rowids":
+			d.preserveRowids = true
+		case "schema-only":
+			d.schemaOnly = true
+		case "where":
+			var s string
+			if s, err = value(); err == nil {
+				kv := strings.SplitN(s, "=", 2)
+				if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+					err = fmt.Errorf("Invalid filter \"%s\" on \".dump\", use --where TABLE=EXPR", s)
+					break
+				}
+
+				if d.where == nil {
+					d.where = map[string]string{}
+				}
+				d.where[strings.ToLower(strings.TrimSpace(kv[0]))] = kv[1]
+			}
+		default:
+			err = fmt.Errorf("Unknown option \"%s\" on \".dump\"", v)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if d.schemaOnly && d.dataOnly {
+		return errors.New("--schema-only and --data-only are mutually exclusive")
+	}
+
+	return nil
+}
+
+func (d *dumper) printf(format string, args ...interface{}) { fmt.Fprintf(d.w, format, args...) }
+
+// dump writes the database like the C shell, see the "dump" command in
+// do_meta_command.
+func (d *dumper) dump() {
+	d.printf("PRAGMA foreign_keys=OFF;\n")
+	d.printf("BEGIN TRANSACTION;\n")
+	d.c.exec("SAVEPOINT dump; PRAGMA writable_schema=ON")
+	filter, args := d.filter()
+	d.tables("SELECT name, type, sql FROM sqlite_master WHERE sql NOT NULL AND type=='table' AND name!='sqlite_sequence'"+filter, args)
+	d.tables("SELECT name, type, sql FROM sqlite_master WHERE name=='sqlite_sequence'"+filter, args)
+	if !d.dataOnly {
+		d.schema("SELECT sql FROM sqlite_master WHERE sql NOT NULL AND type IN ('index','trigger','view')"+filter, args)
+	}
+	if d.writableSchema {
+		d.printf("PRAGMA writable_schema=OFF;\n")
+	}
+	d.c.exec("PRAGMA writable_schema=OFF;")
+	d.c.exec("RELEASE dump;")
+	if d.nErr != 0 {
+		d.printf("ROLLBACK; -- due to errors\n")
+		return
+	}
+
+	d.printf("COMMIT;\n")
+}
+
+// filter returns the condition selecting the rows of sqlite_master to dump.
+func (d *dumper) filter() (string, []interface{}) {
+	var b bytes.Buffer
+	var args []interface{}
+	if d.like != "" {
+		b.WriteString(" AND tbl_name LIKE ?")
+		args = append(args, d.like)
+	}
+	for _, v := range d.exclude {
+		b.WriteString(" AND tbl_name NOT LIKE ?")
+		args = append(args, v)
+	}
+	return b.String(), args
+}
+
+// tables dumps the tables selected by query, see run_schema_dump_query and
+// dump_callback in shell.c.
+func (d *dumper) tables(query string, args []interface{}) {
+	rows, err := d.c.query(query, args...)
+	if err != nil {
+		d.printf("/****** ERROR: %v ******/\n", err)
+		d.nErr++
+		return
+	}
+
+	for _, v := range rows {
+		table, _ := v[0].(string)
+		typ, _ := v[1].(string)
+		sql, _ := v[2].(string)
+		switch {
+		case table == "sqlite_sequence":
+			if !d.schemaOnly {
+				d.printf("DELETE FROM sqlite_sequence;\n")
+			}
+		case strings.HasPrefix(table, "sqlite_stat") && len(table) == len("sqlite_stat")+1:
+			if !d.dataOnly {
+				d.printf("ANALYZE sqlite_master;\n")
+			}
+		case strings.HasPrefix(table, "sqlite_"):
+			continue
+		case strings.HasPrefix(sql, "CREATE VIRTUAL TABLE"):
+			if d.dataOnly {
+				continue
+			}
+
+			if !d.writableSchema {
+				d.printf("PRAGMA writable_schema=ON;\n")
+				d.writableSchema = true
+			}
+			d.printf("INSERT INTO sqlite_master(type,name,tbl_name,rootpage,sql)VALUES('table',%s,%s,0,%s);\n",
+				sqlQuote(table), sqlQuote(table), sqlQuote(sql))
+			continue
+		default:
+			if !d.dataOnly {
+				d.schemaLine(sql)
+			}
+		}
+		if typ == "table" && !d.schemaOnly {
+			if err := d.rows(table); err != nil {
+				d.printf("/****** ERROR: %v ******/\n", err)
+				d.nErr++
+			}
+		}
+	}
+}
+
+// schemaLine writes the CREATE statement sql, see printSchemaLine in
+// shell.c.
+func (d *dumper) schemaLine(sql string) {
+	if len(sql) > 13 && strings.HasPrefix(sql, "CREATE TABLE ") && (sql[13] == '\'' || sql[13] == '"') {
+		d.printf("CREATE TABLE IF NOT EXISTS %s;\n", sql[13:])
+		return
+	}
+
+	d.printf("%s;\n", sql)
+}
+
+// schema writes the statements selected by query, see run_table_dump_query
+// in shell.c.
+func (d *dumper) schema(query string, args []interface{}) {
+	rows, err := d.c.query(query, args...)
+	if err != nil {
+		d.printf("/**** ERROR: %v *****/\n", err)
+		d.nErr++
+		return
+	}
+
+	for _, v := range rows {
+		sql, _ := v[0].(string)
+		if strings.Contains(sql, "--") {
+			d.printf("%s\n;\n", sql)
+			continue
+		}
+
+		d.printf("%s;\n", sql)
+	}
+}
+
+// rows writes the INSERT statements of the rows of table.
+func (d *dumper) rows(table string) error {
+	rowid, cols, err := d.columns(table)
+	if err != nil {
+		return err
+	}
+
+	dest := sqlID(table)
+	sel := cols
+	if rowid != "" {
+		a := []string{rowid}
+		for _, v := range cols {
+			a = append(a, sqlID(v))
+		}
+		dest += "(" + strings.Join(a, ",") + ")"
+		sel = append([]string{rowid}, cols...)
+	}
+	for i, v := range sel {
+		sel[i] = sqlQuoteID(v)
+	}
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(sel, ","), sqlQuoteID(table))
+	if where, ok := d.where[strings.ToLower(table)]; ok {
+		query += " WHERE " + where
+	}
+	stmt, err := d.c.prepare(query)
+	if err != nil {
+		return err
+	}
+
+	defer stmt.close()
+	n := 0
+	for {
+		ok, err := stmt.step()
+		if err != nil {
+			if n != 0 {
+				d.printf(";\n")
+			}
+			return err
+		}
+
+		if !ok {
+			break
+		}
+
+		if n == 0 {
+			d.printf("INSERT INTO %s VALUES", dest)
+		} else {
+			d.printf(",")
+		}
+		d.printf("(")
+		for i, v := range stmt.row() {
+			if i != 0 {
+				d.printf(",")
+			}
+			d.printf("%s", dumpLiteral(d.c.tls, v, d.newlines))
+		}
+		d.printf(")")
+		if n++; n == d.batch {
+			d.printf(";\n")
+			n = 0
+		}
+	}
+	if n != 0 {
+		d.printf(";\n")
+	}
+	return nil
+}
+
+// columns returns the columns of table and, with --preserve-rowids, the name
+// of its rowid, if it has one, see tableColumnList in shell.c.
+func (d *dumper) columns(table string) (rowid string, cols []string, err error) {
+	rows, err := d.c.query("SELECT name, type, pk FROM pragma_table_info(?) ORDER BY cid", table)
+	if err != nil {
+		return "", nil, err
+	}
+
+	nPK, ipk := 0, false
+	for _, v := range rows {
+		name, _ := v[0].(string)
+		cols = append(cols, name)
+		if v[2].(int64) != 0 {
+			nPK++
+			typ, _ := v[1].(string)
+			ipk = nPK == 1 && strings.EqualFold(typ, "INTEGER")
+		}
+	}
+	if !d.preserveRowids {
+		return "", cols, nil
+	}
+
+	if ipk {
+		// A rowid alias, unless the table is WITHOUT ROWID or the column
+		// is INTEGER PRIMARY KEY DESC. Those have a "pk" index.
+		if row, err := d.c.queryRow("SELECT 1 FROM pragma_index_list(?) WHERE origin='pk'", table); err != nil || row == nil {
+			return "", cols, nil
+		}
+	}
+
+outer:
+	for _, v := range []string{"rowid", "_rowid_", "oid"} {
+		for _, c := range cols {
+			if strings.EqualFold(c, v) {
+				continue outer
+			}
+		}
+
+		if stmt, err := d.c.prepare(fmt.Sprintf("SELECT %s FROM %s", v, sqlQuoteID(table))); err == nil {
+			stmt.close()
+			rowid = v
+		}
+		break
+	}
+	return rowid, cols, nil
+}
+
+// dumpLiteral returns v, as returned by sqlStmt.column, as an SQL literal
+// like the insert mode of the C shell. Newlines and carriage returns in text
+// are escaped unless newlines is true.
+func dumpLiteral(tls TLS, v interface{}, newlines bool) string {
+	switch x := v.(type) {
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		return sqlFloat(tls, x)
+	case []byte:
+		return fmt.Sprintf("X'%x'", x)
+	case string:
+		if newlines {
+			return sqlQuote(x)
+		}
+
+		return sqlQuoteEscaped(x)
+	}
+	return "NULL"
+}
+
+// sqlFloat formats r like the C shell, with "%!.20g".
+func sqlFloat(tls TLS, r float64) string {
+	zFormat := cString(tls, "%!.20g")
+	z := Xsqlite3_mprintf(tls, zFormat, r)
+	s := goString(z)
+	Xsqlite3_free(tls, z)
+	Xsqlite3_free(tls, zFormat)
+	return s
+}
+
+// sqlQuoteEscaped returns s as an SQL literal with newlines and carriage
+// returns escaped, see output_quoted_escaped_string in shell.c.
+func sqlQuoteEscaped(s string) string {
+	if !strings.ContainsAny(s, "\n\r") {
+		return sqlQuote(s)
+	}
+
+	unused := func(a, b string) string {
+		if !strings.Contains(s, a) {
+			return a
+		}
+
+		if !strings.Contains(s, b) {
+			return b
+		}
+
+		for i := 0; ; i++ {
+			if r := fmt.Sprintf("(%s%d)", a, i); !strings.Contains(s, r) {
+				return r
+			}
+		}
+	}
+	var nl, cr string
+	var b bytes.Buffer
+	if strings.Contains(s, "\n") {
+		b.WriteString("replace(")
+		nl = unused(`\n`, `\012`)
+	}
+	if strings.Contains(s, "\r") {
+		b.WriteString("replace(")
+		cr = unused(`\r`, `\015`)
+	}
+	b.WriteString(sqlQuote(strings.NewReplacer("\n", nl, "\r", cr).Replace(s)))
+	if cr != "" {
+		fmt.Fprintf(&b, ",'%s',char(13))", cr)
+	}
+	if nl != "" {
+		fmt.Fprintf(&b, ",'%s',char(10))", nl)
+	}
+	return b.String()
+}
+
+// cWriter writes to a C stream.
+type cWriter struct {
+	tls    TLS
+	stream uintptr
+}
+
+func (w *cWriter) Write(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	p := cBytes(w.tls, b)
+	if p == 0 {
+		return 0, errors.New("out of memory")
+	}
+
+	n := fwrite(w.tls, p, len(b), w.stream)
+	Xsqlite3_free(w.tls, p)
+	if n != len(b) {
+		return n, io.ErrShortWrite
+	}
+
+	return n, nil
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Query plans of SQL statements.
+//
+//	.eqp on|off|full|tree
+//
+// .eqp on writes the rows of EXPLAIN QUERY PLAN as they are, like the C
+// shell. .eqp tree, and the -eqp option, write them as a tree: the rows of a
+// subquery are shown under the row that uses it. .eqp full writes the tree
+// followed by the program of the statement, with the bodies of its loops
+// indented and its opcodes annotated with the tables, indexes and registers
+// they use.
+
+// Values of ShellState.autoEQP. The C shell does not know eqpTree.
+const (
+	eqpOff = iota
+	eqpOn
+	eqpFull
+	eqpTree
+)
+
+var eqpNames = [...]string{eqpOff: "off", eqpOn: "on", eqpFull: "full", eqpTree: "tree"}
+
+// eqpRow is a row of EXPLAIN QUERY PLAN.
+type eqpRow struct {
+	selectID int64
+	order    int64
+	from     int64
+	detail   string
+}
+
+// String returns r in the format of .eqp on.
+func (r eqpRow) String() string {
+	return fmt.Sprintf("--EQP-- %d,%d,%d,%s", r.selectID, r.order, r.from, r.detail)
+}
+
+// queryPlan returns the EXPLAIN QUERY PLAN of the statement sql.
+func queryPlan(c *sqlConn, sql string) ([]eqpRow, error) {
+	rows, err := c.query("EXPLAIN QUERY PLAN " + sql)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]eqpRow, len(rows))
+	for i, v := range rows {
+		r[i] = eqpRow{v[0].(int64), v[1].(int64), v[2].(int64), v[3].(string)}
+	}
+	return r, nil
+}
+
+// eqpMode returns the autoEQP value of the .eqp argument z if the C shell
+// does not know it.
+func eqpMode(z uintptr) (int32, bool) {
+	if goString(z) == "tree" {
+		return eqpTree, true
+	}
+
+	return 0, false
+}
+
+// showEQP writes the eqp line of .show.
+func showEQP(tls TLS, p uintptr) {
+	s := &shell{tls, p}
+	name := "unk"
+	if v := s.state().XautoEQP; v >= 0 && int(v) < len(eqpNames) {
+		name = eqpNames[v]
+	}
+	s.printf("%12.12s: %s\n", "eqp", name)
+}
+
+// explainTree writes the query plan of the statement zSql run by the shell
+// p as a tree and, for .eqp full, its program. It reports whether it did, .eqp
+// on uses the C code.
+func explainTree(tls TLS, p, zSql uintptr) bool {
+	s := &shell{tls, p}
+	mode := s.state().XautoEQP
+	if mode != eqpTree && mode != eqpFull {
+		return false
+	}
+
+	c := &sqlConn{tls, s.state().Xdb}
+	sql := goString(zSql)
+	if plan, err := queryPlan(c, sql); err == nil {
+		s.printf("QUERY PLAN\n")
+		s.printPlan(planTree(plan, sqlCTEs(sql)), "")
+	}
+	if mode == eqpFull {
+		s.printProgram(c, sql)
+	}
+	return true
+}
+
+// eqpNode is a row of a query plan with the rows of the subqueries it uses.
+type eqpNode struct {
+	label    string
+	children []*eqpNode
+}
+
+var (
+	eqpSubqueryRe = regexp.MustCompile(`SUBQUER(?:Y|IES) (\d+)(?: AND (\d+))?`)
+	eqpSourceRe   = regexp.MustCompile(`^(?:SCAN|SEARCH) (?:TABLE (\S+)|SUBQUERY \d+)( AS \S+)?`)
+	sqlCTERe      = regexp.MustCompile(`(?i)(?:^\s*WITH(?:\s+RECURSIVE)?|,)\s*("(?:[^"]|"")+"|\[[^\]]+\]|` + "`[^`]+`" + `|\w+)\s*(?:\([^()]*\))?\s*AS\s*\(`)
+)
+
+// planTree returns the rows of plan as trees. Subqueries go under the first
+// row of another select that refers to them, the other selects are roots.
+// ctes are the common table expressions of the statement, by lower case
+// name.
+func planTree(plan []eqpRow, ctes map[string]bool) []*eqpNode {
+	var ids []int64
+	selects := map[int64][]eqpRow{}
+	for _, v := range plan {
+		if _, ok := selects[v.selectID]; !ok {
+			ids = append(ids, v.selectID)
+		}
+		selects[v.selectID] = append(selects[v.selectID], v)
+	}
+
+	subqueries := func(r eqpRow) (a []int64) {
+		for _, m := range eqpSubqueryRe.FindAllStringSubmatch(r.detail, -1) {
+			for _, v := range m[1:] {
+				if n, err := strconv.ParseInt(v, 10, 64); err == nil && n != r.selectID && selects[n] != nil {
+					a = append(a, n)
+				}
+			}
+		}
+		return a
+	}
+
+	referenced := map[int64]bool{}
+	for _, v := range plan {
+		for _, n := range subqueries(v) {
+			referenced[n] = true
+		}
+	}
+
+	var build func(id int64) []*eqpNode
+	build = func(id int64) []*eqpNode {
+		rows := selects[id]
+		delete(selects, id)
+		var r []*eqpNode
+		for _, v := range rows {
+			n := &eqpNode{label: v.detail + eqpMarkers(v.detail, ctes)}
+			for _, sub := range subqueries(v) {
+				n.children = append(n.children, build(sub)...)
+			}
+			r = append(r, n)
+		}
+		return r
+	}
+
+	var r []*eqpNode
+	for _, id := range ids {
+		if !referenced[id] {
+			r = append(r, build(id)...)
+		}
+	}
+	for _, id := range ids { // Cycles.
+		r = append(r, build(id)...)
+	}
+	return r
+}
+
+// eqpMarkers returns the markers of the query plan row detail.
+func eqpMarkers(detail string, ctes map[string]bool) string {
+	var a []string
+	if strings.Contains(detail, " CORRELATED ") {
+		a = append(a, "correlated")
+	}
+	if m := eqpSourceRe.FindStringSubmatch(detail); m != nil {
+		switch {
+		case m[1] != "" && ctes[strings.ToLower(m[1])]:
+			// The recursive reference of a recursive CTE.
+			a = append(a, "CTE "+m[1])
+		case m[1] == "" && m[2] == "" && len(ctes) != 0:
+			// Subqueries in FROM clauses need not be named but the
+			// references of CTEs do not show their name.
+			a = append(a, "CTE")
+		}
+	}
+	if len(a) == 0 {
+		return ""
+	}
+
+	return " [" + strings.Join(a, ", ") + "]"
+}
+
+// sqlCTEs returns the lower case names of the common table expressions of
+// the statement sql.
+func sqlCTEs(sql string) map[string]bool {
+	r := map[string]bool{}
+	ids := sqlIdentifiers(sql)
+	if len(ids) == 0 || !strings.EqualFold(ids[0], "WITH") {
+		return r
+	}
+
+	for _, m := range sqlCTERe.FindAllStringSubmatch(sql, -1) {
+		if ids := sqlIdentifiers(m[1]); len(ids) != 0 {
+			r[strings.ToLower(ids[0])] = true
+		}
+	}
+	return r
+}
+
+func (s *shell) printPlan(nodes []*eqpNode, indent string) {
+	for i, v := range nodes {
+		branch, next := "├──", "│  "
+		if i == len(nodes)-1 {
+			branch, next = "└──", "   "
+		}
+		s.printf("%s%s%s\n", indent, branch, v.label)
+		s.printPlan(v.children, indent+next)
+	}
+}
+
+// Opcodes, see mkopcodeh.tcl in the SQLite sources.
+var (
+	opNext  = map[string]bool{"Next": true, "Prev": true, "VPrev": true, "VNext": true, "SorterNext": true, "NextIfOpen": true, "PrevIfOpen": true}
+	opYield = map[string]bool{"Yield": true, "SeekLT": true, "SeekGT": true, "RowSetRead": true, "Rewind": true}
+)
+
+// printProgram writes the EXPLAIN listing of sql. Loop bodies are indented
+// like by the explain mode of the C shell and opcodes without a comment get
+// one.
+func (s *shell) printProgram(c *sqlConn, sql string) {
+	prog, err := c.query("EXPLAIN " + sql)
+	if err != nil {
+		return
+	}
+
+	// See explain_data_prepare in shell.c.
+	indent := make([]int, len(prog))
+	yield := make([]bool, len(prog))
+	for i, v := range prog {
+		op, p1, p2 := v[1].(string), v[2].(int64), int(v[3].(int64))
+		if opNext[op] && p2 >= 0 {
+			for j := p2; j < i; j++ {
+				indent[j] += 2
+			}
+		}
+		if op == "Goto" && p2 >= 0 && p2 < i && (yield[p2] || p1 != 0) {
+			for j := p2; j < i; j++ {
+				indent[j] += 2
+			}
+		}
+		yield[i] = opYield[op]
+	}
+
+	a := &opAnnotator{c: c, roots: newSchemaRoots(c), cursors: map[int64]*opCursor{}}
+	s.printf("addr  opcode         p1    p2    p3    p4             p5  comment      \n")
+	s.printf("----  -------------  ----  ----  ----  -------------  --  -------------\n")
+	for i, v := range prog {
+		p4 := ""
+		if v[5] != nil {
+			p4 = fmt.Sprint(v[5])
+		}
+		comment, _ := v[7].(string)
+		if comment == "" {
+			comment = a.annotate(v)
+		}
+		s.printf("%-4d  %-13s  %-4d  %-4d  %-4d  %-13s  %-2d  %s\n",
+			v[0], strings.Repeat(" ", indent[i])+v[1].(string), v[2], v[3], v[4], p4, v[6], comment)
+	}
+}
+
+// opCursor is a cursor of a program.
+type opCursor struct {
+	name    string
+	columns []string
+}
+
+// opAnnotator comments the opcodes of a program.
+type opAnnotator struct {
+	c       *sqlConn
+	roots   *schemaRoots
+	cursors map[int64]*opCursor
+}
+
+var opCursorKinds = map[string]string{
+	"OpenAutoindex": "autoindex", "OpenEphemeral": "ephemeral", "OpenPseudo": "pseudo",
+	"SorterOpen": "sorter", "VOpen": "vtab",
+}
+
+// Opcodes using the cursor P1.
+var opCursorOps = map[string]bool{
+	"Close": true, "Delete": true, "DeferredSeek": true, "Found": true, "IdxDelete": true,
+	"IdxGE": true, "IdxGT": true, "IdxInsert": true, "IdxLE": true, "IdxLT": true,
+	"Insert": true, "Last": true, "NoConflict": true, "NotExists": true, "NotFound": true,
+	"NullRow": true, "Rewind": true, "SeekGE": true, "SeekGT": true, "SeekLE": true,
+	"SeekLT": true, "SeekRowid": true, "Sequence": true, "SorterData": true,
+	"SorterSort": true, "Sort": true, "VFilter": true, "VColumn": true,
+}
+
+func (a *opAnnotator) annotate(op []interface{}) string {
+	name, p1, p2, p3 := op[1].(string), op[2].(int64), op[3].(int64), op[4].(int64)
+	switch name {
+	case "OpenRead", "OpenWrite", "ReopenIdx":
+		table, index := a.roots.lookup(p3, p2)
+		cur := &opCursor{name: table}
+		what := "table " + table
+		switch {
+		case table == "":
+			cur.name = fmt.Sprintf("root %d", p2)
+			what = cur.name
+		case index != "":
+			cur.name = index
+			what = fmt.Sprintf("index %s of %s", index, table)
+			cur.columns = a.columns(fmt.Sprintf("SELECT name FROM pragma_index_xinfo(%s) ORDER BY seqno", sqlQuote(index)))
+		default:
+			cur.columns = a.columns(fmt.Sprintf("SELECT name FROM pragma_table_info(%s) ORDER BY cid", sqlQuote(table)))
+		}
+		a.cursors[p1] = cur
+		return what
+	case "OpenAutoindex", "OpenEphemeral", "OpenPseudo", "SorterOpen", "VOpen":
+		a.cursors[p1] = &opCursor{name: opCursorKinds[name]}
+		return opCursorKinds[name]
+	case "Column":
+		return fmt.Sprintf("r[%d]=%s", p3, a.column(p1, p2))
+	case "Rowid", "IdxRowid":
+		return fmt.Sprintf("r[%d]=%s.rowid", p2, a.cursor(p1).name)
+	case "Next", "Prev", "VNext", "SorterNext", "NextIfOpen", "PrevIfOpen":
+		return fmt.Sprintf("%s, loop at %d", a.cursor(p1).name, p2)
+	case "ResultRow":
+		if p2 == 1 {
+			return fmt.Sprintf("output=r[%d]", p1)
+		}
+
+		return fmt.Sprintf("output=r[%d..%d]", p1, p1+p2-1)
+	case "Integer":
+		return fmt.Sprintf("r[%d]=%d", p2, p1)
+	case "Null":
+		if p3 > p2 {
+			return fmt.Sprintf("r[%d..%d]=NULL", p2, p3)
+		}
+
+		return fmt.Sprintf("r[%d]=NULL", p2)
+	case "String8", "Real":
+		return fmt.Sprintf("r[%d]=%v", p2, op[5])
+	case "Copy", "SCopy":
+		return fmt.Sprintf("r[%d]=r[%d]", p2, p1)
+	case "Transaction":
+		if p2 != 0 {
+			return fmt.Sprintf("write db %d", p1)
+		}
+
+		return fmt.Sprintf("read db %d", p1)
+	}
+	if opCursorOps[name] {
+		return a.cursor(p1).name
+	}
+
+	return ""
+}
+
+func (a *opAnnotator) cursor(n int64) *opCursor {
+	if c := a.cursors[n]; c != nil {
+		return c
+	}
+
+	return &opCursor{name: fmt.Sprintf("cursor %d", n)}
+}
+
+func (a *opAnnotator) column(cursor, i int64) string {
+	c := a.cursor(cursor)
+	if i >= 0 && i < int64(len(c.columns)) && c.columns[i] != "" {
+		return c.name + "." + c.columns[i]
+	}
+
+	return fmt.Sprintf("%s[%d]", c.name, i)
+}
+
+func (a *opAnnotator) columns(sql string) []string {
+	rows, err := a.c.query(sql)
+	if err != nil {
+		return nil
+	}
+
+	r := make([]string, len(rows))
+	for i, v := range rows {
+		r[i], _ = v[0].(string)
+		if v[0] == nil {
+			r[i] = "rowid"
+		}
+	}
+	return r
+}
+
+// schemaRoots maps the root pages of the databases of a connection to their
+// tables and indexes.
+type schemaRoots struct {
+	c  *sqlConn
+	db map[int64]map[int64][2]string // Database: root page: index, table.
+}
+
+func newSchemaRoots(c *sqlConn) *schemaRoots {
+	return &schemaRoots{c, map[int64]map[int64][2]string{}}
+}
+
+// lookup returns the table and, if the b-tree is an index, the index with
+// the root page of the database db. The table is "" if there is no such
+// b-tree.
+func (r *schemaRoots) lookup(db, root int64) (table, index string) {
+	m, ok := r.db[db]
+	if !ok {
+		m = map[int64][2]string{}
+		r.db[db] = m
+		if row, err := r.c.queryRow("SELECT name FROM pragma_database_list WHERE seq = ?", db); err == nil && row != nil {
+			rows, _ := r.c.query(fmt.Sprintf("SELECT rootpage, type, name, tbl_name FROM %s.sqlite_master WHERE rootpage > 0", sqlQuoteID(row[0].(string))))
+			for _, v := range rows {
+				name := ""
+				if v[1] == "index" {
+					name = v[2].(string)
+				}
+				m[v[0].(int64)] = [2]string{name, v[3].(string)}
+			}
+		}
+	}
+	v := m[root]
+	return v[1], v[0]
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"fmt"
+	"hash/crc32"
+	"regexp"
+	"strings"
+	"unsafe"
+)
+
+// Index recommendations.
+//
+//	.expert ?--verbose?
+//
+// The SQL statements of the next input line are analyzed instead of being
+// executed. The shell prints the CREATE INDEX statements it recommends and,
+// for every statement, the query plan with the recommended indexes.
+//
+// The analysis works on a shadow copy of the schema in an in-memory database.
+// Virtual tables are copied as ordinary tables with the same columns and the
+// content of sqlite_stat1, if any, is copied as well. Columns named in a
+// statement are the keys of candidate indexes on their tables, up to
+// expertMaxKeys of them in any order. All candidates are created at once and
+// the ones used by the EXPLAIN QUERY PLAN of the statements are recommended.
+// --verbose lists the candidates as well.
+
+const (
+	expertMaxColumns = 6 // Per table.
+	expertMaxKeys    = 3
+)
+
+// experts holds the pending .expert commands by ShellState.
+var experts = map[uintptr]*expert{}
+
+type expert struct {
+	verbose bool
+}
+
+type expertCandidate struct {
+	name  string
+	table string
+	cols  []string
+	used  bool
+}
+
+func (c *expertCandidate) sql() string {
+	a := make([]string, len(c.cols))
+	for i, v := range c.cols {
+		a[i] = sqlID(v)
+	}
+	return fmt.Sprintf("CREATE INDEX %s ON %s(%s);", sqlID(c.name), sqlID(c.table), strings.Join(a, ", "))
+}
+
+var expertIndexRe = regexp.MustCompile(`INDEX (\S+)`)
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "expert",
+		abbrev: 4,
+		usage:  "?--verbose?",
+		help:   "Suggest indexes for the next SQL statement",
+		run: func(s *shell, args []string) error {
+			e := &expert{}
+			for _, v := range args {
+				switch v {
+				case "-verbose", "--verbose":
+					e.verbose = true
+				default:
+					return errUsage
+				}
+			}
+			experts[s.p] = e
+			return nil
+		},
+	})
+}
+
+// expertExec analyzes zSql if .expert is pending for p. It reports whether
+// it did. Errors are returned in pzErrMsg like for shell_exec.
+func expertExec(tls TLS, p, zSql, pzErrMsg uintptr) (int32, bool) {
+	e := experts[p]
+	if e == nil {
+		return 0, false
+	}
+
+	delete(experts, p)
+	s := &shell{tls, p}
+	if err := e.run(s, goString(zSql)); err != nil {
+		*(*uintptr)(unsafe.Pointer(pzErrMsg)) = cString(tls, err.Error())
+		return sqliteError, true
+	}
+
+	return sqliteOK, true
+}
+
+func (e *expert) run(s *shell, sql string) error {
+	c := s.conn()
+	var stmts []string
+	for strings.TrimSpace(sql) != "" {
+		st, tail, err := c.prepareTail(sql)
+		if err != nil {
+			return err
+		}
+
+		if st != nil {
+			stmts = append(stmts, strings.TrimSpace(goString(Xsqlite3_sql(s.tls, st.p))))
+			st.close()
+		}
+		sql = tail
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	shadow, err := openMemory(s.tls)
+	if err != nil {
+		return err
+	}
+
+	defer shadow.close()
+	if err := expertSchema(c, shadow); err != nil {
+		return err
+	}
+
+	cands, err := expertCandidates(shadow, stmts)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range cands {
+		if err := shadow.exec(v.sql()); err != nil {
+			return err
+		}
+	}
+
+	for _, sql := range stmts {
+		plan, err := queryPlan(shadow, sql)
+		if err != nil {
+			return err
+		}
+
+		for _, r := range plan {
+			for _, m := range expertIndexRe.FindAllStringSubmatch(r.detail, -1) {
+				for _, v := range cands {
+					if v.name == m[1] {
+						v.used = true
+					}
+				}
+			}
+		}
+	}
+
+	// Drop the unused candidates so the plans show only the recommended
+	// indexes.
+	var used []*expertCandidate
+	for _, v := range cands {
+		if !v.used {
+			if err := shadow.exec("DROP INDEX " + sqlQuoteID(v.name)); err != nil {
+				return err
+			}
+
+			continue
+		}
+
+		used = append(used, v)
+	}
+
+	if e.verbose {
+		s.printf("-- Candidates -----------------------------\n")
+		for _, v := range cands {
+			s.printf("%s\n", v.sql())
+		}
+		s.printf("\n")
+	}
+	if len(used) == 0 {
+		s.printf("(no new indexes)\n")
+	}
+	for _, v := range used {
+		s.printf("%s\n", v.sql())
+	}
+	s.printf("\n")
+	for i, sql := range stmts {
+		plan, err := queryPlan(shadow, sql)
+		if err != nil {
+			return err
+		}
+
+		if len(stmts) > 1 {
+			s.printf("-- Query %d ----------------------------------\n%s\n\n", i+1, sql)
+		}
+		for _, r := range plan {
+			s.printf("%s\n", r)
+		}
+		if i < len(stmts)-1 {
+			s.printf("\n")
+		}
+	}
+	return nil
+}
+
+// expertSchema copies the schema of the main database of c to shadow.
+func expertSchema(c, shadow *sqlConn) error {
+	rows, err := c.query(`SELECT type, name, sql FROM main.sqlite_master
+		WHERE sql IS NOT NULL AND type IN ('table', 'index', 'view') AND name NOT LIKE 'sqlite!_%' ESCAPE '!'
+		ORDER BY CASE type WHEN 'table' THEN 0 WHEN 'index' THEN 1 ELSE 2 END, rowid`)
+	if err != nil {
+		return err
+	}
+
+	if err := shadow.exec("BEGIN"); err != nil {
+		return err
+	}
+
+	for _, v := range rows {
+		typ, name, sql := v[0].(string), v[1].(string), v[2].(string)
+		if typ == "table" && strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL") {
+			if sql, err = expertVirtualTable(c, name); err != nil {
+				shadow.exec("ROLLBACK")
+				return err
+			}
+		}
+		if err := shadow.exec(sql); err != nil && typ != "view" {
+			shadow.exec("ROLLBACK")
+			return fmt.Errorf("%s %s: %v", typ, name, err)
+		}
+	}
+	if err := shadow.exec("COMMIT"); err != nil {
+		return err
+	}
+
+	if row, err := c.queryRow("SELECT 1 FROM main.sqlite_master WHERE name = 'sqlite_stat1'"); err != nil || row == nil {
+		return err
+	}
+
+	stat, err := c.query("SELECT tbl, idx, stat FROM main.sqlite_stat1")
+	if err != nil {
+		return err
+	}
+
+	if err := shadow.exec("ANALYZE"); err != nil {
+		return err
+	}
+
+	for _, v := range stat {
+		if err := shadow.exec("INSERT INTO sqlite_stat1 VALUES(?, ?, ?)", v...); err != nil {
+			return err
+		}
+	}
+	return shadow.exec("ANALYZE sqlite_master")
+}
+
+// expertVirtualTable returns the CREATE TABLE statement of an ordinary table
+// with the columns of the virtual table name.
+func expertVirtualTable(c *sqlConn, name string) (string, error) {
+	rows, err := c.query(fmt.Sprintf("PRAGMA main.table_info(%s)", sqlQuoteID(name)))
+	if err != nil {
+		return "", err
+	}
+
+	a := make([]string, len(rows))
+	for i, v := range rows {
+		a[i] = strings.TrimSpace(sqlQuoteID(v[1].(string)) + " " + v[2].(string))
+	}
+	return fmt.Sprintf("CREATE TABLE %s(%s)", sqlQuoteID(name), strings.Join(a, ", ")), nil
+}
+
+// expertCandidates returns the candidate indexes for stmts on the tables of
+// shadow.
+func expertCandidates(shadow *sqlConn, stmts []string) ([]*expertCandidate, error) {
+	ids := map[string]int{} // Lower case identifier: first position.
+	for _, sql := range stmts {
+		for _, v := range sqlIdentifiers(sql) {
+			v = strings.ToLower(v)
+			if _, ok := ids[v]; !ok {
+				ids[v] = len(ids)
+			}
+		}
+	}
+
+	tables, err := shadow.query("SELECT name FROM sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite!_%' ESCAPE '!' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	var r []*expertCandidate
+	for _, v := range tables {
+		table := v[0].(string)
+		if _, ok := ids[strings.ToLower(table)]; !ok {
+			continue
+		}
+
+		rows, err := shadow.query(fmt.Sprintf("PRAGMA table_info(%s)", sqlQuoteID(table)))
+		if err != nil {
+			return nil, err
+		}
+
+		var cols []string
+		for _, v := range rows {
+			if _, ok := ids[strings.ToLower(v[1].(string))]; ok {
+				cols = append(cols, v[1].(string))
+			}
+		}
+		sortByPosition(cols, ids)
+		if len(cols) > expertMaxColumns {
+			cols = cols[:expertMaxColumns]
+		}
+
+		existing, err := expertIndexes(shadow, table)
+		if err != nil {
+			return nil, err
+		}
+
+		expertPermutations(cols, expertMaxKeys, func(keys []string) {
+			k := strings.ToLower(strings.Join(keys, "\x00"))
+			for _, v := range existing {
+				if strings.HasPrefix(v+"\x00", k+"\x00") {
+					return
+				}
+			}
+
+			r = append(r, &expertCandidate{
+				name:  fmt.Sprintf("%s_idx_%08x", table, crc32.ChecksumIEEE([]byte(k))),
+				table: table,
+				cols:  append([]string(nil), keys...),
+			})
+		})
+	}
+	return r, nil
+}
+
+// expertIndexes returns the lower case key columns of the existing indexes
+// of table, separated by zero bytes.
+func expertIndexes(shadow *sqlConn, table string) ([]string, error) {
+	list, err := shadow.query(fmt.Sprintf("PRAGMA index_list(%s)", sqlQuoteID(table)))
+	if err != nil {
+		return nil, err
+	}
+
+	var r []string
+	for _, v := range list {
+		info, err := shadow.query(fmt.Sprintf("PRAGMA index_info(%s)", sqlQuoteID(v[1].(string))))
+		if err != nil {
+			return nil, err
+		}
+
+		var a []string
+		for _, v := range info {
+			name, _ := v[2].(string) // NULL for expressions.
+			a = append(a, strings.ToLower(name))
+		}
+		r = append(r, strings.Join(a, "\x00"))
+	}
+	return r, nil
+}
+
+// sortByPosition sorts the identifiers a by their position in pos.
+func sortByPosition(a []string, pos map[string]int) {
+	for i := 1; i < len(a); i++ {
+		for j := i; j > 0 && pos[strings.ToLower(a[j])] < pos[strings.ToLower(a[j-1])]; j-- {
+			a[j], a[j-1] = a[j-1], a[j]
+		}
+	}
+}
+
+// expertPermutations calls fn for the permutations of up to n of the items
+// in a.
+func expertPermutations(a []string, n int, fn func([]string)) {
+	used := make([]bool, len(a))
+	var keys []string
+	var f func()
+	f = func() {
+		for i, v := range a {
+			if used[i] {
+				continue
+			}
+
+			used[i] = true
+			keys = append(keys, v)
+			fn(keys)
+			if len(keys) < n {
+				f()
+			}
+			keys = keys[:len(keys)-1]
+			used[i] = false
+		}
+	}
+	f()
+}
+
+// sqlKeywords are the keywords of SQLite.
+var sqlKeywords = map[string]bool{}
+
+func init() {
+	for _, v := range strings.Fields(`ABORT ACTION ADD AFTER ALL ALTER ANALYZE AND AS
+		ASC ATTACH AUTOINCREMENT BEFORE BEGIN BETWEEN BY CASCADE CASE CAST CHECK
+		COLLATE COLUMN COMMIT CONFLICT CONSTRAINT CREATE CROSS CURRENT_DATE
+		CURRENT_TIME CURRENT_TIMESTAMP DATABASE DEFAULT DEFERRABLE DEFERRED
+		DELETE DESC DETACH DISTINCT DROP EACH ELSE END ESCAPE EXCEPT EXCLUSIVE
+		EXISTS EXPLAIN FAIL FOR FOREIGN FROM FULL GLOB GROUP HAVING IF IGNORE
+		IMMEDIATE IN INDEX INDEXED INITIALLY INNER INSERT INSTEAD INTERSECT INTO
+		IS ISNULL JOIN KEY LEFT LIKE LIMIT MATCH NATURAL NO NOT NOTNULL NULL OF
+		OFFSET ON OR ORDER OUTER PLAN PRAGMA PRIMARY QUERY RAISE RECURSIVE
+		REFERENCES REGEXP REINDEX RELEASE RENAME REPLACE RESTRICT RIGHT ROLLBACK
+		ROW SAVEPOINT SELECT SET TABLE TEMP TEMPORARY THEN TO TRANSACTION TRIGGER
+		UNION UNIQUE UPDATE USING VACUUM VALUES VIEW VIRTUAL WHEN WHERE WITH
+		WITHOUT`) {
+		sqlKeywords[v] = true
+	}
+}
+
+// sqlID returns s as an SQL identifier, quoted only if necessary.
+func sqlID(s string) string {
+	if isBareWord(s) && (s[0] < '0' || s[0] > '9') && !sqlKeywords[strings.ToUpper(s)] {
+		return s
+	}
+
+	return sqlQuoteID(s)
+}
+
+// sqlIdentifiers returns the identifiers and keywords in sql, skipping
+// literals and comments.
+func sqlIdentifiers(sql string) []string {
+	var r []string
+	for i := 0; i < len(sql); {
+		switch c := sql[i]; {
+		case c == '\'':
+			i++
+			for i < len(sql) {
+				if sql[i] == '\'' {
+					if i+1 < len(sql) && sql[i+1] == '\'' {
+						i += 2
+						continue
+					}
+
+					break
+				}
+
+				i++
+			}
+			i++
+		case c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			var b []byte
+			for i++; i < len(sql); i++ {
+				if sql[i] == end {
+					if end != ']' && i+1 < len(sql) && sql[i+1] == end {
+						b = append(b, end)
+						i++
+						continue
+					}
+
+					break
+				}
+
+				b = append(b, sql[i])
+			}
+			r = append(r, string(b))
+			i++
+		case c == '-' && strings.HasPrefix(sql[i:], "--"):
+			for i < len(sql) && sql[i] != '\n' {
+				i++
+			}
+		case c == '/' && strings.HasPrefix(sql[i:], "/*"):
+			if j := strings.Index(sql[i+2:], "*/"); j >= 0 {
+				i += j + 4
+				break
+			}
+
+			i = len(sql)
+		case c >= '0' && c <= '9':
+			for i < len(sql) && expertIDChar(sql[i]) {
+				i++
+			}
+		case expertIDChar(c):
+			j := i
+			for i < len(sql) && expertIDChar(sql[i]) {
+				i++
+			}
+			r = append(r, sql[j:i])
+		default:
+			i++
+		}
+	}
+	return r
+}
+
+func expertIDChar(c byte) bool {
+	return c == '_' || c == '$' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c >= 0x80
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"syscall"
+	"unsafe"
+)
+
+// The fsdir eponymous virtual table of the fileio extension.
+//
+//	SELECT name, mode, mtime, data FROM fsdir($path [, $dir]);
+//
+// Lists $path and, if it is a directory, everything below it, depth first.
+// Symbolic links are reported, not followed. If $dir is given, $path is
+// relative to $dir and so are the reported names.
+//
+// The data column is read only when it is actually used by the query, so
+// listing large trees stays cheap. It is the content of regular files, the
+// target of symbolic links and NULL for directories.
+
+const fsdirSchema = "CREATE TABLE x(name,mode,mtime,data,path HIDDEN,dir HIDDEN)"
+
+const (
+	fsdirColumnName = iota
+	fsdirColumnMode
+	fsdirColumnMtime
+	fsdirColumnData
+	fsdirColumnPath
+	fsdirColumnDir
+)
+
+var fsdirModule = Ssqlite3_module{
+	XxConnect:    cfnConnect(fsdirConnect),
+	XxBestIndex:  cfnVtab2(fsdirBestIndex),
+	XxDisconnect: cfnVtab(fsdirDisconnect),
+	XxOpen:       cfnVtab2(fsdirOpen),
+	XxClose:      cfnVtab(fsdirClose),
+	XxFilter:     cfnFilter(fsdirFilter),
+	XxNext:       cfnVtab(fsdirNext),
+	XxEof:        cfnVtab(fsdirEof),
+	XxColumn:     cfnColumn(fsdirColumn),
+	XxRowid:      cfnVtab2(fsdirRowid),
+}
+
+type fsdirCursor struct {
+	base    string   // Prefix of all paths, "" if none.
+	pending []string // Paths still to visit, last one first.
+	path    string   // Current path.
+	name    string   // Current name, path relative to base.
+	fi      os.FileInfo
+	rowid   int64
+	eof     bool
+}
+
+// fsdirRegister registers the fsdir module with db.
+func fsdirRegister(tls TLS, db uintptr) int32 {
+	zName := cString(tls, "fsdir")
+	if zName == 0 {
+		return sqliteNoMem
+	}
+
+	defer Xsqlite3_free(tls, zName)
+	return Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(&fsdirModule)), 0)
+}
+
+func fsdirConnect(tls TLS, db, pAux uintptr, argc int32, argv, ppVtab, pzErr uintptr) int32 {
+	zSchema := cString(tls, fsdirSchema)
+	if zSchema == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	return sqliteOK
+}
+
+func fsdirDisconnect(tls TLS, tab uintptr) int32 {
+	Xsqlite3_free(tls, tab)
+	return sqliteOK
+}
+
+// fsdirBestIndex requires an equality constraint on the hidden path column.
+// An equality constraint on the hidden dir column is used when present.
+//
+//	idxNum	meaning
+//	0	no usable path constraint, the query cannot be satisfied
+//	1	argv[0] is path
+//	2	argv[0] is path, argv[1] is dir
+func fsdirBestIndex(tls TLS, tab, pIdxInfo uintptr) int32 {
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	iPath, iDir := -1, -1
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		if c.Xusable == 0 || c.Xop != sqliteIndexConstraintEQ {
+			continue
+		}
+
+		switch c.XiColumn {
+		case fsdirColumnPath:
+			iPath = i
+		case fsdirColumnDir:
+			iDir = i
+		}
+	}
+	if iPath < 0 {
+		info.XidxNum = 0
+		info.XestimatedCost = float64(int64(1) << 50)
+		return sqliteOK
+	}
+
+	u := indexConstraintUsage(info, iPath)
+	u.XargvIndex = 1
+	u.Xomit = 1
+	info.XidxNum = 1
+	info.XestimatedCost = 100
+	if iDir >= 0 {
+		u = indexConstraintUsage(info, iDir)
+		u.XargvIndex = 2
+		u.Xomit = 1
+		info.XidxNum = 2
+		info.XestimatedCost = 10
+	}
+	return sqliteOK
+}
+
+func fsdirOpen(tls TLS, tab, ppCursor uintptr) int32 {
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, &fsdirCursor{eof: true})
+	return sqliteOK
+}
+
+func fsdirClose(tls TLS, cur uintptr) int32 {
+	deleteObject(cur)
+	Xsqlite3_free(tls, cur)
+	return sqliteOK
+}
+
+func fsdirFilter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) int32 {
+	c := getObject(cur).(*fsdirCursor)
+	*c = fsdirCursor{eof: true}
+	tab := (*Ssqlite3_vtab_cursor)(unsafe.Pointer(cur)).XpVtab
+	if idxNum == 0 {
+		return vtabError(tls, tab, "table function fsdir requires an argument")
+	}
+
+	if Xsqlite3_value_type(tls, argv(args, 0)) == sqliteNull {
+		return vtabError(tls, tab, "table function fsdir requires a non-NULL argument")
+	}
+
+	path := valueText(tls, argv(args, 0))
+	if idxNum == 2 && Xsqlite3_value_type(tls, argv(args, 1)) != sqliteNull {
+		c.base = valueText(tls, argv(args, 1)) + "/"
+	}
+	c.pending = []string{c.base + path}
+	c.rowid = 0
+	return fsdirStep(tls, tab, c)
+}
+
+func fsdirNext(tls TLS, cur uintptr) int32 {
+	return fsdirStep(tls, (*Ssqlite3_vtab_cursor)(unsafe.Pointer(cur)).XpVtab, getObject(cur).(*fsdirCursor))
+}
+
+// fsdirStep moves c to the next pending path. Directories are expanded when
+// visited, so the walk never holds more than the names of the directories on
+// the current path.
+func fsdirStep(tls TLS, tab uintptr, c *fsdirCursor) int32 {
+	if c.fi != nil && c.fi.IsDir() {
+		f, err := os.Open(c.path)
+		if err != nil {
+			return vtabError(tls, tab, "cannot read directory: "+c.path)
+		}
+
+		names, err := f.Readdirnames(-1)
+		f.Close()
+		if err != nil {
+			return vtabError(tls, tab, "cannot read directory: "+c.path)
+		}
+
+		sort.Sort(sort.Reverse(sort.StringSlice(names)))
+		for _, v := range names {
+			c.pending = append(c.pending, c.path+"/"+v)
+		}
+	}
+
+	c.fi = nil
+	if len(c.pending) == 0 {
+		c.eof = true
+		return sqliteOK
+	}
+
+	n := len(c.pending) - 1
+	c.path = c.pending[n]
+	c.pending = c.pending[:n]
+	fi, err := os.Lstat(c.path)
+	if err != nil {
+		return vtabError(tls, tab, "cannot stat file: "+c.path)
+	}
+
+	c.fi = fi
+	c.name = c.path[len(c.base):]
+	c.rowid++
+	c.eof = false
+	return sqliteOK
+}
+
+func fsdirEof(tls TLS, cur uintptr) int32 {
+	if getObject(cur).(*fsdirCursor).eof {
+		return 1
+	}
+
+	return 0
+}
+
+func fsdirColumn(tls TLS, cur, ctx uintptr, i int32) int32 {
+	c := getObject(cur).(*fsdirCursor)
+	switch i {
+	case fsdirColumnName:
+		resultText(tls, ctx, c.name)
+	case fsdirColumnMode:
+		if st, ok := c.fi.Sys().(*syscall.Stat_t); ok {
+			Xsqlite3_result_int64(tls, ctx, int64(st.Mode))
+			break
+		}
+
+		Xsqlite3_result_int64(tls, ctx, int64(c.fi.Mode().Perm()))
+	case fsdirColumnMtime:
+		Xsqlite3_result_int64(tls, ctx, c.fi.ModTime().Unix())
+	case fsdirColumnData:
+		switch mode := c.fi.Mode(); {
+		case mode.IsDir():
+			// NULL
+		case mode&os.ModeSymlink != 0:
+			s, err := os.Readlink(c.path)
+			if err != nil {
+				resultError(tls, ctx, "cannot read symbolic link: "+c.path)
+				break
+			}
+
+			resultText(tls, ctx, s)
+		default:
+			b, err := ioutil.ReadFile(c.path)
+			if err != nil {
+				resultError(tls, ctx, "cannot read file: "+c.path)
+				break
+			}
+
+			resultBlob(tls, ctx, b)
+		}
+	}
+	return sqliteOK
+}
+
+func fsdirRowid(tls TLS, cur, pRowid uintptr) int32 {
+	*(*int64)(unsafe.Pointer(pRowid)) = getObject(cur).(*fsdirCursor).rowid
+	return sqliteOK
+}
@@ -0,0 +1,1199 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unsafe"
+)
+
+// The fts5 full-text search module.
+//
+//	CREATE VIRTUAL TABLE ft USING fts5(a, b UNINDEXED, tokenize='ascii');
+//	SELECT highlight(ft, 0, '[', ']') FROM ft WHERE ft MATCH 'one OR tw*' ORDER BY rank;
+//
+// The module accepts the SQL of upstream FTS5: MATCH queries, see
+// fts5expr_linux.go, on the table or on a single column, the rank column and
+// the bm25, highlight and snippet auxiliary functions. Tokenizers are
+// written in Go, see RegisterTokenizer. The prefix option is accepted, prefix
+// queries are always served by the term index. External content tables and
+// the detail and columnsize options are not supported.
+//
+// The index is kept in the shadow tables ft_content, ft_idx, ft_docsize and
+// ft_config. Their format is not the one of upstream FTS5, so databases with
+// fts5 tables written by this shell cannot be read by the FTS5 of upstream
+// SQLite and vice versa. Using an upstream fts5 table fails with "unsupported
+// fts5 format".
+
+// fts5Table is the Go part of a fts5 table.
+type fts5Table struct {
+	db      uintptr
+	schema  string // Database name.
+	name    string
+	cols    []string
+	indexed []bool
+	tok     Tokenizer
+}
+
+// Additional hidden columns following the declared ones.
+const (
+	fts5ColumnTable = iota // Named like the table, the cursor handle.
+	fts5ColumnRank
+)
+
+// idxNum flags.
+const (
+	fts5OrderRank      = 1
+	fts5OrderRowidDesc = 2
+)
+
+// fts5Version is the version of the shadow tables in ft_config.
+const fts5Version = 1
+
+var errFTS5Format = errors.New("unsupported fts5 format")
+
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+var fts5Module = Ssqlite3_module{
+	XxCreate:       cfnConnect(fts5Create),
+	XxConnect:      cfnConnect(fts5Connect),
+	XxBestIndex:    cfnVtab2(fts5BestIndex),
+	XxDisconnect:   cfnVtab(fts5Disconnect),
+	XxDestroy:      cfnVtab(fts5Destroy),
+	XxOpen:         cfnVtab2(fts5Open),
+	XxClose:        cfnVtab(fts5Close),
+	XxFilter:       cfnFilter(fts5Filter),
+	XxNext:         cfnVtab(fts5Next),
+	XxEof:          cfnVtab(fts5Eof),
+	XxColumn:       cfnColumn(fts5Column),
+	XxRowid:        cfnVtab2(fts5Rowid),
+	XxUpdate:       cfnUpdate(fts5Update),
+	XxFindFunction: cfnFindFunction(fts5FindFunction),
+	XxRename:       cfnVtab2(fts5Rename),
+}
+
+var fts5AuxFuncs = map[string]func(TLS, uintptr, int32, uintptr){
+	"bm25":      fts5Bm25Func,
+	"highlight": fts5HighlightFunc,
+	"snippet":   fts5SnippetFunc,
+}
+
+// Xsqlite3_fts5_init registers the fts5 module and its auxiliary functions
+// with db.
+func Xsqlite3_fts5_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	zName := cString(tls, "fts5")
+	if zName == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(&fts5Module)), 0)
+	Xsqlite3_free(tls, zName)
+	if rc != sqliteOK {
+		return rc
+	}
+
+	for k := range fts5AuxFuncs {
+		zName := cString(tls, k)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_overload_function(tls, db, zName, -1)
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+func (t *fts5Table) conn(tls TLS) *sqlConn { return &sqlConn{tls, t.db} }
+
+// shadow returns the qualified name of the shadow table ft_suffix.
+func (t *fts5Table) shadow(suffix string) string {
+	return sqlQuoteID(t.schema) + "." + sqlQuoteID(t.name+"_"+suffix)
+}
+
+func fts5Create(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return fts5Init(tls, db, argc, args, ppVtab, pzErr, true)
+}
+
+func fts5Connect(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return fts5Init(tls, db, argc, args, ppVtab, pzErr, false)
+}
+
+func fts5Init(tls TLS, db uintptr, argc int32, args, ppVtab, pzErr uintptr, create bool) int32 {
+	a := make([]string, argc)
+	for i := range a {
+		a[i] = goString(argv(args, i))
+	}
+	t, err := newFTS5Table(db, a)
+	switch {
+	case err == nil && create:
+		err = t.create(t.conn(tls))
+	case err == nil:
+		err = t.check(t.conn(tls))
+	}
+	if err != nil {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, err.Error())
+		return sqliteError
+	}
+
+	var b []string
+	for _, v := range append(t.cols, t.name) {
+		b = append(b, sqlQuoteID(v))
+	}
+	b[len(b)-1] += " HIDDEN"
+	zSchema := cString(tls, "CREATE TABLE x("+strings.Join(b, ",")+",rank HIDDEN)")
+	if zSchema == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, t)
+	return sqliteOK
+}
+
+// newFTS5Table parses the module arguments a.
+func newFTS5Table(db uintptr, a []string) (*fts5Table, error) {
+	t := &fts5Table{db: db, schema: a[1], name: a[2]}
+	var tokenize []string
+	seen := map[string]bool{}
+	for _, v := range a[3:] {
+		v = strings.TrimSpace(v)
+		if i := strings.IndexByte(v, '='); i >= 0 && isBareWord(strings.TrimSpace(v[:i])) {
+			key := strings.ToLower(strings.TrimSpace(v[:i]))
+			val := dequote(strings.TrimSpace(v[i+1:]))
+			if seen[key] {
+				return nil, fmt.Errorf("multiple %s=... directives", key)
+			}
+
+			seen[key] = true
+			switch key {
+			case "tokenize":
+				for _, w := range splitTopLevel(val, ' ') {
+					if w != "" {
+						tokenize = append(tokenize, dequote(w))
+					}
+				}
+			case "prefix":
+				for _, w := range strings.Fields(strings.Replace(val, ",", " ", -1)) {
+					if n, err := strconv.Atoi(w); err != nil || n <= 0 || n > 999 {
+						return nil, fmt.Errorf("malformed prefix=... directive")
+					}
+				}
+			case "detail":
+				if strings.ToLower(val) != "full" {
+					return nil, fmt.Errorf("unsupported detail=... directive: %s", val)
+				}
+			case "columnsize":
+				if val != "1" {
+					return nil, fmt.Errorf("unsupported columnsize=... directive: %s", val)
+				}
+			case "content", "content_rowid":
+				return nil, fmt.Errorf("unsupported %s=... directive", key)
+			default:
+				return nil, fmt.Errorf("unrecognized option: \"%s\"", key)
+			}
+			continue
+		}
+
+		n := identLen(v)
+		name := dequote(v[:n])
+		switch opt := strings.TrimSpace(v[n:]); {
+		case name == "":
+			return nil, fmt.Errorf("parse error in \"%s\"", v)
+		case strings.EqualFold(name, "rank"), strings.EqualFold(name, "rowid"), strings.EqualFold(name, t.name):
+			return nil, fmt.Errorf("reserved fts5 column name: %s", name)
+		case opt == "":
+			t.indexed = append(t.indexed, true)
+		case strings.EqualFold(opt, "unindexed"):
+			t.indexed = append(t.indexed, false)
+		default:
+			return nil, fmt.Errorf("unrecognized column option: %s", opt)
+		}
+		t.cols = append(t.cols, name)
+	}
+	if len(t.cols) == 0 {
+		return nil, fmt.Errorf("fts5: no columns")
+	}
+
+	var err error
+	if t.tok, err = newTokenizer(tokenize); err != nil {
+		return nil, fmt.Errorf("error in tokenizer constructor: %v", err)
+	}
+
+	return t, nil
+}
+
+// isBareWord reports whether s is a non empty run of ASCII letters, digits
+// and underscores.
+func isBareWord(s string) bool {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			// ok
+		default:
+			return false
+		}
+	}
+	return s != ""
+}
+
+func (t *fts5Table) create(c *sqlConn) error {
+	var cols []string
+	for i := range t.cols {
+		cols = append(cols, fmt.Sprintf(", c%d", i))
+	}
+	return c.exec(fmt.Sprintf(`
+CREATE TABLE %s(id INTEGER PRIMARY KEY%s);
+CREATE TABLE %s(term, id, col, pos, PRIMARY KEY(term, id, col)) WITHOUT ROWID;
+CREATE TABLE %s(id INTEGER PRIMARY KEY, sz BLOB);
+CREATE TABLE %s(k PRIMARY KEY, v) WITHOUT ROWID;
+INSERT INTO %[5]s VALUES('version', %d);`,
+		t.shadow("content"), strings.Join(cols, ""), t.shadow("idx"), t.shadow("docsize"), t.shadow("config"), fts5Version,
+	))
+}
+
+// check returns errFTS5Format if the shadow tables of t are not the ones of
+// this module, like those of an upstream FTS5 table.
+func (t *fts5Table) check(c *sqlConn) error {
+	row, err := c.queryRow("SELECT v FROM " + t.shadow("config") + " WHERE k = 'version'")
+	if err != nil {
+		return err
+	}
+
+	if row == nil || row[0] != int64(fts5Version) {
+		return errFTS5Format
+	}
+
+	rows, err := c.query("SELECT name FROM pragma_table_info(?, ?) ORDER BY cid", t.name+"_idx", t.schema)
+	if err != nil {
+		return err
+	}
+
+	var cols []string
+	for _, v := range rows {
+		cols = append(cols, strings.ToLower(fmt.Sprint(v[0])))
+	}
+	if strings.Join(cols, ",") != "term,id,col,pos" {
+		return errFTS5Format
+	}
+
+	return nil
+}
+
+func fts5Disconnect(tls TLS, tab uintptr) int32 {
+	deleteObject(tab)
+	Xsqlite3_free(tls, tab)
+	return sqliteOK
+}
+
+func fts5Destroy(tls TLS, tab uintptr) int32 {
+	t := getObject(tab).(*fts5Table)
+	var b []string
+	for _, v := range []string{"content", "idx", "docsize", "config"} {
+		b = append(b, "DROP TABLE IF EXISTS "+t.shadow(v)+";")
+	}
+	if err := t.conn(tls).exec(strings.Join(b, "\n")); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	return fts5Disconnect(tls, tab)
+}
+
+func fts5Rename(tls TLS, tab, zNew uintptr) int32 {
+	t := getObject(tab).(*fts5Table)
+	name := goString(zNew)
+	var b []string
+	for _, v := range []string{"content", "idx", "docsize", "config"} {
+		b = append(b, fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", t.shadow(v), sqlQuoteID(name+"_"+v)))
+	}
+	if err := t.conn(tls).exec(strings.Join(b, "\n")); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	t.name = name
+	return sqliteOK
+}
+
+// fts5BestIndex uses MATCH constraints, and equality constraints on the
+// hidden table column, as full-text queries and equality constraints on the
+// rowid. idxStr has a word for every used constraint:
+//
+//	m	argv[i] is a query of the table
+//	mN	argv[i] is a query of column N
+//	=	argv[i] is the rowid
+//
+// ORDER BY rank and ORDER BY rowid are consumed, see the fts5Order*
+// idxNum flags.
+func fts5BestIndex(tls TLS, tab, pIdxInfo uintptr) int32 {
+	t := getObject(tab).(*fts5Table)
+	nCol := int32(len(t.cols))
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	var words []string
+	match, rowid := false, false
+	cost := 1e6
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		if c.Xusable == 0 {
+			continue
+		}
+
+		var w string
+		switch {
+		case c.XiColumn == nCol+fts5ColumnTable && (c.Xop == IndexConstraintMatch || c.Xop == sqliteIndexConstraintEQ):
+			w = "m"
+		case c.XiColumn >= 0 && c.XiColumn < nCol && c.Xop == IndexConstraintMatch:
+			w = fmt.Sprintf("m%d", c.XiColumn)
+		case c.XiColumn < 0 && c.Xop == sqliteIndexConstraintEQ && !rowid:
+			// SQLite checks any other rowid constraint.
+			w = "="
+			rowid = true
+		default:
+			continue
+		}
+
+		words = append(words, w)
+		u := indexConstraintUsage(info, i)
+		u.XargvIndex = int32(len(words))
+		u.Xomit = 1
+		switch w {
+		case "=":
+			cost = 10
+		default:
+			match = true
+			if cost > 1000 {
+				cost = 1000
+			}
+		}
+	}
+	if n := int(info.XnOrderBy); n == 1 {
+		o := indexOrderBy(info, 0)
+		switch {
+		case o.XiColumn == nCol+fts5ColumnRank && o.Xdesc == 0 && match:
+			info.XidxNum |= fts5OrderRank
+			info.XorderByConsumed = 1
+		case o.XiColumn < 0:
+			if o.Xdesc != 0 {
+				info.XidxNum |= fts5OrderRowidDesc
+			}
+			info.XorderByConsumed = 1
+		}
+	}
+	if len(words) != 0 {
+		if info.XidxStr = cString(tls, strings.Join(words, " ")); info.XidxStr == 0 {
+			return sqliteNoMem
+		}
+
+		info.XneedToFreeIdxStr = 1
+	}
+	info.XestimatedCost = cost
+	return sqliteOK
+}
+
+type fts5Cursor struct {
+	t       *fts5Table
+	ids     []int64
+	i       int
+	expr    *fts5Expr // nil if there is no full-text query.
+	phrases []*fts5Phrase
+	totals  []int64 // Number of rows, number of tokens in every column.
+
+	// The current row, loaded when used.
+	row   []interface{}
+	sizes []int64
+}
+
+func fts5Open(tls TLS, tab, ppCursor uintptr) int32 {
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, &fts5Cursor{t: getObject(tab).(*fts5Table)})
+	return sqliteOK
+}
+
+func fts5Close(tls TLS, cur uintptr) int32 {
+	deleteObject(cur)
+	Xsqlite3_free(tls, cur)
+	return sqliteOK
+}
+
+func fts5Filter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) int32 {
+	c := getObject(cur).(*fts5Cursor)
+	*c = fts5Cursor{t: c.t}
+	tab := (*Ssqlite3_vtab_cursor)(unsafe.Pointer(cur)).XpVtab
+	if err := c.filter(tls, idxNum, strings.Fields(goString(idxStr)), args); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	return sqliteOK
+}
+
+func (c *fts5Cursor) filter(tls TLS, idxNum int32, words []string, args uintptr) error {
+	t := c.t
+	conn := t.conn(tls)
+	var rowid interface{}
+	for i, w := range words {
+		v := argv(args, i)
+		if w == "=" {
+			rowid = goValue(tls, v)
+			continue
+		}
+
+		if Xsqlite3_value_type(tls, v) == sqliteNull {
+			return nil
+		}
+
+		e, phrases, err := fts5Parse(valueText(tls, v), t.cols, t.tok)
+		if err != nil {
+			return err
+		}
+
+		if len(w) > 1 {
+			col, _ := strconv.Atoi(w[1:])
+			cols := make([]bool, len(t.cols))
+			cols[col] = true
+			e.filter(cols)
+		}
+		if c.expr != nil {
+			e = &fts5Expr{op: fts5ExprAnd, left: c.expr, right: e}
+		}
+		c.expr = e
+		c.phrases = append(c.phrases, phrases...)
+	}
+
+	if c.expr == nil {
+		q := "SELECT id FROM " + t.shadow("content")
+		var a []interface{}
+		if rowid != nil {
+			q += " WHERE id = ?"
+			a = append(a, rowid)
+		}
+		rows, err := conn.query(q+" ORDER BY id", a...)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range rows {
+			c.ids = append(c.ids, v[0].(int64))
+		}
+	} else {
+		src := t.postings(conn)
+		for _, v := range c.phrases {
+			if err := v.eval(src); err != nil {
+				return err
+			}
+		}
+
+		for k := range c.expr.docs() {
+			if rowid == nil || rowid == interface{}(k) {
+				c.ids = append(c.ids, k)
+			}
+		}
+		sort.Slice(c.ids, func(i, j int) bool { return c.ids[i] < c.ids[j] })
+		var err error
+		if c.totals, err = t.totals(conn); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case idxNum&fts5OrderRank != 0 && c.expr != nil:
+		rank := map[int64]float64{}
+		for _, id := range c.ids {
+			sizes, err := t.docsize(conn, id)
+			if err != nil {
+				return err
+			}
+
+			rank[id] = c.bm25(id, sizes, nil)
+		}
+		sort.SliceStable(c.ids, func(i, j int) bool { return rank[c.ids[i]] < rank[c.ids[j]] })
+	case idxNum&fts5OrderRowidDesc != 0:
+		for i, j := 0, len(c.ids)-1; i < j; i, j = i+1, j-1 {
+			c.ids[i], c.ids[j] = c.ids[j], c.ids[i]
+		}
+	}
+	return nil
+}
+
+// postings returns the source of term positions of t.
+func (t *fts5Table) postings(c *sqlConn) fts5Source {
+	return func(term string, prefix bool) (fts5Postings, error) {
+		q := "SELECT id, col, pos FROM " + t.shadow("idx") + " WHERE term = ?"
+		a := []interface{}{term}
+		if prefix {
+			q = "SELECT id, col, pos FROM " + t.shadow("idx") + " WHERE term >= ? AND term < ?"
+			a = append(a, term+"\xff")
+		}
+		rows, err := c.query(q, a...)
+		if err != nil {
+			return nil, err
+		}
+
+		m := fts5Postings{}
+		for _, v := range rows {
+			k := fts5DocCol{v[0].(int64), int(v[1].(int64))}
+			b, _ := v[2].([]byte)
+			m[k] = append(m[k], decodePositions(b)...)
+		}
+		if prefix {
+			for _, v := range m {
+				sort.Ints(v)
+			}
+		}
+		return m, nil
+	}
+}
+
+func encodeVarints(a []int64) []byte {
+	b := make([]byte, 0, len(a))
+	var buf [binary.MaxVarintLen64]byte
+	for _, v := range a {
+		b = append(b, buf[:binary.PutUvarint(buf[:], uint64(v))]...)
+	}
+	return b
+}
+
+func decodeVarints(b []byte) []int64 {
+	var r []int64
+	for len(b) != 0 {
+		v, n := binary.Uvarint(b)
+		if n <= 0 {
+			break
+		}
+
+		r = append(r, int64(v))
+		b = b[n:]
+	}
+	return r
+}
+
+// encodePositions encodes the ascending positions a as deltas.
+func encodePositions(a []int) []byte {
+	d := make([]int64, len(a))
+	prev := 0
+	for i, v := range a {
+		d[i] = int64(v - prev)
+		prev = v
+	}
+	return encodeVarints(d)
+}
+
+func decodePositions(b []byte) []int {
+	var r []int
+	pos := 0
+	for _, v := range decodeVarints(b) {
+		pos += int(v)
+		r = append(r, pos)
+	}
+	return r
+}
+
+// totals returns the number of rows and the number of tokens in every
+// column of t.
+func (t *fts5Table) totals(c *sqlConn) ([]int64, error) {
+	row, err := c.queryRow("SELECT v FROM " + t.shadow("config") + " WHERE k = 'totals'")
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]int64, len(t.cols)+1)
+	if row != nil {
+		b, _ := row[0].([]byte)
+		copy(r, decodeVarints(b))
+	}
+	return r, nil
+}
+
+// addTotals adds sign times the row with the column sizes to the totals.
+func (t *fts5Table) addTotals(c *sqlConn, sizes []int64, sign int64) error {
+	r, err := t.totals(c)
+	if err != nil {
+		return err
+	}
+
+	r[0] += sign
+	for i, v := range sizes {
+		r[i+1] += sign * v
+	}
+	return c.exec("INSERT OR REPLACE INTO "+t.shadow("config")+" VALUES('totals', ?)", encodeVarints(r))
+}
+
+// docsize returns the number of tokens in the columns of row id.
+func (t *fts5Table) docsize(c *sqlConn, id int64) ([]int64, error) {
+	row, err := c.queryRow("SELECT sz FROM "+t.shadow("docsize")+" WHERE id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+
+	r := make([]int64, len(t.cols))
+	if row != nil {
+		b, _ := row[0].([]byte)
+		copy(r, decodeVarints(b))
+	}
+	return r, nil
+}
+
+// fts5Text returns the text of the column value v.
+func fts5Text(v interface{}) (string, bool) {
+	switch x := v.(type) {
+	case string:
+		return x, true
+	case []byte:
+		return string(x), true
+	case int64:
+		return strconv.FormatInt(x, 10), true
+	case float64:
+		return strconv.FormatFloat(x, 'g', 15, 64), true
+	}
+	return "", false
+}
+
+// index adds, or removes, the terms of the row id with the column values vals
+// to the index and returns the number of tokens in every column.
+func (t *fts5Table) index(c *sqlConn, id int64, vals []interface{}, add bool) ([]int64, error) {
+	q := "INSERT INTO " + t.shadow("idx") + " VALUES(?, ?, ?, ?)"
+	if !add {
+		q = "DELETE FROM " + t.shadow("idx") + " WHERE term = ? AND id = ? AND col = ?"
+	}
+	s, err := c.prepare(q)
+	if err != nil {
+		return nil, err
+	}
+
+	defer s.close()
+	sizes := make([]int64, len(t.cols))
+	for col, v := range vals {
+		text, ok := fts5Text(v)
+		if !ok || !t.indexed[col] {
+			continue
+		}
+
+		terms := map[string][]int{}
+		var order []string
+		pos := 0
+		if err := t.tok.Tokenize(text, func(token string, start, end int) error {
+			if terms[token] == nil {
+				order = append(order, token)
+			}
+			terms[token] = append(terms[token], pos)
+			pos++
+			return nil
+		}); err != nil {
+			return nil, err
+		}
+
+		sizes[col] = int64(pos)
+		for _, term := range order {
+			a := []interface{}{term, id, col, encodePositions(terms[term])}
+			if !add {
+				a = a[:3]
+			}
+			if err := s.bind(a...); err != nil {
+				return nil, err
+			}
+
+			if _, err := s.step(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return sizes, nil
+}
+
+func (t *fts5Table) insert(c *sqlConn, rowid interface{}, vals []interface{}) (int64, error) {
+	q := "INSERT INTO " + t.shadow("content") + " VALUES(?" + strings.Repeat(", ?", len(t.cols)) + ")"
+	if err := c.exec(q, append([]interface{}{rowid}, vals...)...); err != nil {
+		return 0, err
+	}
+
+	id := Xsqlite3_last_insert_rowid(c.tls, c.db)
+	sizes, err := t.index(c, id, vals, true)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := c.exec("INSERT INTO "+t.shadow("docsize")+" VALUES(?, ?)", id, encodeVarints(sizes)); err != nil {
+		return 0, err
+	}
+
+	return id, t.addTotals(c, sizes, 1)
+}
+
+func (t *fts5Table) delete(c *sqlConn, id int64) error {
+	vals, err := t.content(c, id)
+	if err != nil || vals == nil {
+		return err
+	}
+
+	sizes, err := t.index(c, id, vals, false)
+	if err != nil {
+		return err
+	}
+
+	if err := c.exec("DELETE FROM "+t.shadow("content")+" WHERE id = ?; DELETE FROM "+t.shadow("docsize")+" WHERE id = ?", id); err != nil {
+		return err
+	}
+
+	return t.addTotals(c, sizes, -1)
+}
+
+// content returns the column values of row id or nil if there is no such
+// row.
+func (t *fts5Table) content(c *sqlConn, id int64) ([]interface{}, error) {
+	var cols []string
+	for i := range t.cols {
+		cols = append(cols, fmt.Sprintf("c%d", i))
+	}
+	return c.queryRow("SELECT "+strings.Join(cols, ", ")+" FROM "+t.shadow("content")+" WHERE id = ?", id)
+}
+
+// command executes a special INSERT, like
+//
+//	INSERT INTO ft(ft) VALUES('rebuild');
+func (t *fts5Table) command(c *sqlConn, cmd string) error {
+	switch cmd {
+	case "delete-all":
+		return c.exec(fmt.Sprintf("DELETE FROM %s; DELETE FROM %s; DELETE FROM %s; DELETE FROM %s WHERE k = 'totals';",
+			t.shadow("content"), t.shadow("idx"), t.shadow("docsize"), t.shadow("config")))
+	case "rebuild":
+		if err := c.exec(fmt.Sprintf("DELETE FROM %s; DELETE FROM %s; DELETE FROM %s WHERE k = 'totals';",
+			t.shadow("idx"), t.shadow("docsize"), t.shadow("config"))); err != nil {
+			return err
+		}
+
+		rows, err := c.query("SELECT id FROM " + t.shadow("content"))
+		if err != nil {
+			return err
+		}
+
+		for _, v := range rows {
+			id := v[0].(int64)
+			vals, err := t.content(c, id)
+			if err != nil {
+				return err
+			}
+
+			sizes, err := t.index(c, id, vals, true)
+			if err != nil {
+				return err
+			}
+
+			if err := c.exec("INSERT INTO "+t.shadow("docsize")+" VALUES(?, ?)", id, encodeVarints(sizes)); err != nil {
+				return err
+			}
+
+			if err := t.addTotals(c, sizes, 1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "optimize", "merge", "automerge", "crisismerge", "usermerge", "pgsz", "integrity-check":
+		// The index is always optimal.
+		return nil
+	}
+	return fmt.Errorf("unknown special query: %s", cmd)
+}
+
+func fts5Update(tls TLS, tab uintptr, argc int32, args, pRowid uintptr) int32 {
+	t := getObject(tab).(*fts5Table)
+	c := t.conn(tls)
+	if argc == 1 {
+		return vtabResult(tls, tab, t.delete(c, Xsqlite3_value_int64(tls, argv(args, 0))))
+	}
+
+	nCol := len(t.cols)
+	if v := argv(args, 2+nCol+fts5ColumnTable); Xsqlite3_value_type(tls, v) != sqliteNull {
+		return vtabResult(tls, tab, t.command(c, valueText(tls, v)))
+	}
+
+	if v := argv(args, 0); Xsqlite3_value_type(tls, v) != sqliteNull {
+		if err := t.delete(c, Xsqlite3_value_int64(tls, v)); err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+	}
+
+	rowid := goValue(tls, argv(args, 1))
+	vals := make([]interface{}, nCol)
+	for i := range vals {
+		vals[i] = goValue(tls, argv(args, 2+i))
+	}
+	id, err := t.insert(c, rowid, vals)
+	if err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	*(*int64)(unsafe.Pointer(pRowid)) = id
+	return sqliteOK
+}
+
+func fts5Next(tls TLS, cur uintptr) int32 {
+	c := getObject(cur).(*fts5Cursor)
+	c.i++
+	c.row = nil
+	c.sizes = nil
+	return sqliteOK
+}
+
+func fts5Eof(tls TLS, cur uintptr) int32 {
+	if c := getObject(cur).(*fts5Cursor); c.i >= len(c.ids) {
+		return 1
+	}
+
+	return 0
+}
+
+// load reads the current row.
+func (c *fts5Cursor) load(tls TLS) error {
+	if c.row != nil {
+		return nil
+	}
+
+	conn := c.t.conn(tls)
+	row, err := c.t.content(conn, c.ids[c.i])
+	if err != nil {
+		return err
+	}
+
+	if c.sizes, err = c.t.docsize(conn, c.ids[c.i]); err != nil {
+		return err
+	}
+
+	c.row = row
+	if row == nil {
+		c.row = make([]interface{}, len(c.t.cols))
+	}
+	return nil
+}
+
+func fts5Column(tls TLS, cur, ctx uintptr, i int32) int32 {
+	c := getObject(cur).(*fts5Cursor)
+	nCol := int32(len(c.t.cols))
+	switch i {
+	case nCol + fts5ColumnTable:
+		Xsqlite3_result_int64(tls, ctx, int64(cur))
+		return sqliteOK
+	case nCol + fts5ColumnRank:
+		if c.expr == nil {
+			return sqliteOK
+		}
+	}
+
+	if err := c.load(tls); err != nil {
+		resultError(tls, ctx, err.Error())
+		return sqliteError
+	}
+
+	switch {
+	case i < nCol:
+		resultValue(tls, ctx, c.row[i])
+	default:
+		Xsqlite3_result_double(tls, ctx, c.bm25(c.ids[c.i], c.sizes, nil))
+	}
+	return sqliteOK
+}
+
+func fts5Rowid(tls TLS, cur, pRowid uintptr) int32 {
+	c := getObject(cur).(*fts5Cursor)
+	*(*int64)(unsafe.Pointer(pRowid)) = c.ids[c.i]
+	return sqliteOK
+}
+
+// bm25 returns the bm25 score of the row id with the column sizes. Better
+// matches have lower scores. weights are the column weights, missing ones
+// default to 1.
+func (c *fts5Cursor) bm25(id int64, sizes []int64, weights []float64) float64 {
+	n := float64(c.totals[0])
+	if n < 1 {
+		n = 1
+	}
+	var total, size float64
+	for _, v := range c.totals[1:] {
+		total += float64(v)
+	}
+	for _, v := range sizes {
+		size += float64(v)
+	}
+	avg := total / n
+	if avg <= 0 {
+		avg = 1
+	}
+	score := 0.0
+	for _, ph := range c.phrases {
+		hits := float64(len(ph.hits))
+		idf := math.Log((n - hits + 0.5) / (hits + 0.5))
+		if idf <= 0 {
+			idf = 1e-6
+		}
+		freq := 0.0
+		for _, h := range ph.hits[id] {
+			w := 1.0
+			if h.col < len(weights) {
+				w = weights[h.col]
+			}
+			freq += w
+		}
+		score += idf * freq * (bm25K1 + 1) / (freq + bm25K1*(1-bm25B+bm25B*size/avg))
+	}
+	return -score
+}
+
+func fts5FindFunction(tls TLS, tab uintptr, nArg int32, zName, pxFunc, ppArg uintptr) int32 {
+	f := fts5AuxFuncs[strings.ToLower(goString(zName))]
+	if f == nil {
+		return 0
+	}
+
+	*(*uintptr)(unsafe.Pointer(pxFunc)) = cfnFunc(f)
+	*(*uintptr)(unsafe.Pointer(ppArg)) = 0
+	return 1
+}
+
+// fts5AuxCursor returns the cursor identified by the first argument of an
+// auxiliary function, loaded with the current row.
+func fts5AuxCursor(tls TLS, ctx uintptr, argc int32, args uintptr) *fts5Cursor {
+	if argc > 0 {
+		h := Xsqlite3_value_int64(tls, argv(args, 0))
+		if c, ok := getObject(uintptr(h)).(*fts5Cursor); ok && c.i < len(c.ids) {
+			if err := c.load(tls); err != nil {
+				resultError(tls, ctx, err.Error())
+				return nil
+			}
+
+			return c
+		}
+
+		resultError(tls, ctx, fmt.Sprintf("no such cursor: %d", h))
+		return nil
+	}
+
+	resultError(tls, ctx, "no such cursor")
+	return nil
+}
+
+// bm25(ft [, weight...])
+func fts5Bm25Func(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	c := fts5AuxCursor(tls, ctx, argc, args)
+	if c == nil {
+		return
+	}
+
+	if c.expr == nil {
+		Xsqlite3_result_double(tls, ctx, 0)
+		return
+	}
+
+	var weights []float64
+	for i := 1; i < int(argc); i++ {
+		weights = append(weights, Xsqlite3_value_double(tls, argv(args, i)))
+	}
+	Xsqlite3_result_double(tls, ctx, c.bm25(c.ids[c.i], c.sizes, weights))
+}
+
+// fts5Match is a phrase match in a column of the current row.
+type fts5Match struct {
+	phrase   int
+	pos, end int // Token range.
+}
+
+// matches returns the matches in column col of the current row ordered by
+// position.
+func (c *fts5Cursor) matches(col int) []fts5Match {
+	var r []fts5Match
+	for i, ph := range c.phrases {
+		for _, h := range ph.hits[c.ids[c.i]] {
+			if h.col == col {
+				r = append(r, fts5Match{i, h.pos, h.pos + len(ph.terms)})
+			}
+		}
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].pos < r[j].pos })
+	return r
+}
+
+type fts5Span struct{ start, end int } // Byte offsets.
+
+// tokens returns the byte offsets of the tokens of text.
+func (c *fts5Cursor) tokens(text string) []fts5Span {
+	var r []fts5Span
+	c.t.tok.Tokenize(text, func(token string, start, end int) error {
+		r = append(r, fts5Span{start, end})
+		return nil
+	})
+	return r
+}
+
+// highlight returns text[from:to] with the tokens of matches within the
+// token range [lo, hi) enclosed in open and close.
+func highlight(text string, toks []fts5Span, matches []fts5Match, lo, hi, from, to int, open, close string) string {
+	var b []byte
+	at := from
+	for i := 0; i < len(matches); i++ {
+		m := matches[i]
+		for i+1 < len(matches) && matches[i+1].pos < m.end { // Merge overlapping matches.
+			i++
+			if matches[i].end > m.end {
+				m.end = matches[i].end
+			}
+		}
+		if m.pos < lo {
+			m.pos = lo
+		}
+		if m.end > hi {
+			m.end = hi
+		}
+		if m.pos >= m.end || m.end > len(toks) {
+			continue
+		}
+
+		start, end := toks[m.pos].start, toks[m.end-1].end
+		b = append(b, text[at:start]...)
+		b = append(b, open...)
+		b = append(b, text[start:end]...)
+		b = append(b, close...)
+		at = end
+	}
+	b = append(b, text[at:to]...)
+	return string(b)
+}
+
+// highlight(ft, col, open, close)
+func fts5HighlightFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if argc != 4 {
+		resultError(tls, ctx, "wrong number of arguments to function highlight()")
+		return
+	}
+
+	c := fts5AuxCursor(tls, ctx, argc, args)
+	if c == nil {
+		return
+	}
+
+	col := int(Xsqlite3_value_int64(tls, argv(args, 1)))
+	if col < 0 || col >= len(c.t.cols) {
+		resultError(tls, ctx, "column index out of range")
+		return
+	}
+
+	text, ok := fts5Text(c.row[col])
+	if !ok {
+		return
+	}
+
+	toks := c.tokens(text)
+	open, close := valueText(tls, argv(args, 2)), valueText(tls, argv(args, 3))
+	resultText(tls, ctx, highlight(text, toks, c.matches(col), 0, len(toks), 0, len(text), open, close))
+}
+
+// snippet(ft, col, open, close, ellipsis, ntokens)
+//
+// The snippet is a fragment of at most ntokens, 1 to 64, tokens of column col
+// or, if col is negative, of the column with the best fragment. The best
+// fragment contains the most different phrases, then the most matches.
+func fts5SnippetFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if argc != 6 {
+		resultError(tls, ctx, "wrong number of arguments to function snippet()")
+		return
+	}
+
+	c := fts5AuxCursor(tls, ctx, argc, args)
+	if c == nil {
+		return
+	}
+
+	col := int(Xsqlite3_value_int64(tls, argv(args, 1)))
+	open, close := valueText(tls, argv(args, 2)), valueText(tls, argv(args, 3))
+	ellipsis := valueText(tls, argv(args, 4))
+	n := int(Xsqlite3_value_int64(tls, argv(args, 5)))
+	if n < 1 {
+		n = 1
+	}
+	if n > 64 {
+		n = 64
+	}
+
+	cols := []int{col}
+	if col < 0 || col >= len(c.t.cols) {
+		cols = cols[:0]
+		for i := range c.t.cols {
+			cols = append(cols, i)
+		}
+	}
+	bestCol, bestStart, bestScore := -1, 0, -1
+	for _, i := range cols {
+		text, ok := fts5Text(c.row[i])
+		if !ok {
+			continue
+		}
+
+		if bestCol < 0 {
+			bestCol = i
+		}
+		matches := c.matches(i)
+		ntoks := len(c.tokens(text))
+		for _, m := range matches {
+			start := m.pos - (n-(m.end-m.pos))/2
+			if start > ntoks-n {
+				start = ntoks - n
+			}
+			if start < 0 {
+				start = 0
+			}
+			seen := map[int]bool{}
+			hits := 0
+			for _, x := range matches {
+				if x.pos >= start && x.end <= start+n {
+					seen[x.phrase] = true
+					hits++
+				}
+			}
+			if score := 1000*len(seen) + hits; score > bestScore {
+				bestCol, bestStart, bestScore = i, start, score
+			}
+		}
+	}
+	if bestCol < 0 {
+		return
+	}
+
+	text, _ := fts5Text(c.row[bestCol])
+	toks := c.tokens(text)
+	end := bestStart + n
+	if end > len(toks) {
+		end = len(toks)
+	}
+	from, to := 0, len(text)
+	var prefix, suffix string
+	if bestStart > 0 {
+		from = toks[bestStart].start
+		prefix = ellipsis
+	}
+	if end < len(toks) {
+		to = toks[end-1].end
+		suffix = ellipsis
+	}
+	resultText(tls, ctx, prefix+highlight(text, toks, c.matches(bestCol), bestStart, end, from, to, open, close)+suffix)
+}
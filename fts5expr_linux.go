@@ -0,0 +1,537 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Full-text query expressions of the fts5 module.
+//
+//	one two			rows containing both one and two
+//	one AND two		the same
+//	one OR two		rows containing one or two
+//	one NOT two		rows containing one but not two
+//	"one two"		the phrase "one two"
+//	one + two		the same
+//	one*			tokens starting with one
+//	^one			one as the first token of a column
+//	NEAR(one two, 5)	one and two separated by at most 5 tokens
+//	col : one		one in the column col
+//	{a b} : one		one in the columns a or b
+//	- col : one		one in any column except col
+//	(one OR two) three	grouping
+//
+// NOT binds tighter than AND, AND tighter than OR. Implicit AND binds tighter
+// than all of them.
+
+// Expression operators.
+const (
+	fts5ExprPhrase = iota
+	fts5ExprNear
+	fts5ExprAnd
+	fts5ExprOr
+	fts5ExprNot
+)
+
+const fts5DefaultNear = 10
+
+type fts5Expr struct {
+	op          int
+	left, right *fts5Expr
+	phrases     []*fts5Phrase // One for fts5ExprPhrase, all of a NEAR group for fts5ExprNear.
+	near        int
+}
+
+type fts5Term struct {
+	text   string
+	prefix bool
+}
+
+type fts5Phrase struct {
+	terms   []fts5Term
+	initial bool   // The phrase must be at the start of a column.
+	cols    []bool // Columns to search, nil for all.
+
+	// Set by eval: the matches of the phrase by document.
+	hits map[int64][]fts5Hit
+}
+
+// fts5Hit is the position of a phrase match.
+type fts5Hit struct {
+	col int
+	pos int // Index of the first token.
+}
+
+// fts5DocCol identifies a column of a row.
+type fts5DocCol struct {
+	id  int64
+	col int
+}
+
+// fts5Postings are the token positions of a term by row and column.
+type fts5Postings map[fts5DocCol][]int
+
+// fts5Source returns the postings of term or, if prefix is true, of all
+// terms starting with term.
+type fts5Source func(term string, prefix bool) (fts5Postings, error)
+
+// Query lexer tokens.
+const (
+	fts5TokEOF = iota
+	fts5TokString
+	fts5TokAnd
+	fts5TokOr
+	fts5TokNot
+	fts5TokNear
+	fts5TokPunct
+)
+
+type fts5Tok struct {
+	kind int
+	text string // Value of strings, the character of punctuation.
+	raw  string // Input text of the token.
+	end  int
+}
+
+type fts5Parser struct {
+	s       string
+	pos     int
+	cols    []string
+	tok     Tokenizer
+	phrases []*fts5Phrase
+	err     error
+}
+
+// fts5Parse parses the query s of a table with the columns cols.
+func fts5Parse(s string, cols []string, tok Tokenizer) (*fts5Expr, []*fts5Phrase, error) {
+	p := &fts5Parser{s: s, cols: cols, tok: tok}
+	e := p.or()
+	if t := p.peek(); p.err == nil && t.kind != fts5TokEOF {
+		p.syntaxError(t)
+	}
+	if p.err != nil {
+		return nil, nil, p.err
+	}
+
+	return e, p.phrases, nil
+}
+
+func (p *fts5Parser) syntaxError(t fts5Tok) {
+	if p.err == nil {
+		p.err = fmt.Errorf("fts5: syntax error near \"%s\"", t.raw)
+	}
+}
+
+func isFTS5Bareword(c byte) bool {
+	return c >= 0x80 || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == 0x1a
+}
+
+// peek returns the next token without consuming it.
+func (p *fts5Parser) peek() fts5Tok {
+	i := p.pos
+	for i < len(p.s) && strings.IndexByte(" \t\n\r\f\v", p.s[i]) >= 0 {
+		i++
+	}
+	if i == len(p.s) {
+		return fts5Tok{kind: fts5TokEOF, end: i}
+	}
+
+	start := i
+	switch c := p.s[i]; {
+	case c == '"':
+		var b []byte
+		for i++; ; i++ {
+			if i == len(p.s) {
+				return fts5Tok{kind: fts5TokPunct, raw: p.s[start:], end: i}
+			}
+
+			if p.s[i] == '"' {
+				if i+1 < len(p.s) && p.s[i+1] == '"' {
+					b = append(b, '"')
+					i++
+					continue
+				}
+
+				return fts5Tok{kind: fts5TokString, text: string(b), raw: p.s[start : i+1], end: i + 1}
+			}
+
+			b = append(b, p.s[i])
+		}
+	case isFTS5Bareword(c):
+		for i < len(p.s) && isFTS5Bareword(p.s[i]) {
+			i++
+		}
+		t := fts5Tok{kind: fts5TokString, text: p.s[start:i], raw: p.s[start:i], end: i}
+		switch t.text {
+		case "AND":
+			t.kind = fts5TokAnd
+		case "OR":
+			t.kind = fts5TokOr
+		case "NOT":
+			t.kind = fts5TokNot
+		case "NEAR":
+			j := i
+			for j < len(p.s) && strings.IndexByte(" \t\n\r\f\v", p.s[j]) >= 0 {
+				j++
+			}
+			if j < len(p.s) && p.s[j] == '(' {
+				t.kind = fts5TokNear
+			}
+		}
+		return t
+	default:
+		return fts5Tok{kind: fts5TokPunct, text: p.s[i : i+1], raw: p.s[i : i+1], end: i + 1}
+	}
+}
+
+func (p *fts5Parser) next() fts5Tok {
+	t := p.peek()
+	p.pos = t.end
+	return t
+}
+
+func (p *fts5Parser) punct(c string) bool {
+	if t := p.peek(); t.kind == fts5TokPunct && t.text == c {
+		p.next()
+		return true
+	}
+
+	return false
+}
+
+func (p *fts5Parser) expect(c string) {
+	if !p.punct(c) {
+		p.syntaxError(p.peek())
+	}
+}
+
+func (p *fts5Parser) or() *fts5Expr {
+	e := p.and()
+	for p.err == nil && p.peek().kind == fts5TokOr {
+		p.next()
+		e = &fts5Expr{op: fts5ExprOr, left: e, right: p.and()}
+	}
+	return e
+}
+
+func (p *fts5Parser) and() *fts5Expr {
+	e := p.not()
+	for p.err == nil && p.peek().kind == fts5TokAnd {
+		p.next()
+		e = &fts5Expr{op: fts5ExprAnd, left: e, right: p.not()}
+	}
+	return e
+}
+
+func (p *fts5Parser) not() *fts5Expr {
+	e := p.seq()
+	for p.err == nil && p.peek().kind == fts5TokNot {
+		p.next()
+		e = &fts5Expr{op: fts5ExprNot, left: e, right: p.seq()}
+	}
+	return e
+}
+
+// seq parses primaries joined by implicit AND.
+func (p *fts5Parser) seq() *fts5Expr {
+	e := p.primary()
+	for p.err == nil && p.startsPrimary() {
+		e = &fts5Expr{op: fts5ExprAnd, left: e, right: p.primary()}
+	}
+	return e
+}
+
+func (p *fts5Parser) startsPrimary() bool {
+	switch t := p.peek(); t.kind {
+	case fts5TokString, fts5TokNear:
+		return true
+	case fts5TokPunct:
+		return strings.Contains("(^{-", t.text)
+	}
+	return false
+}
+
+func (p *fts5Parser) primary() *fts5Expr {
+	if p.err != nil {
+		return nil
+	}
+
+	switch t := p.peek(); {
+	case t.kind == fts5TokPunct && t.text == "(":
+		p.next()
+		e := p.or()
+		p.expect(")")
+		return e
+	case t.kind == fts5TokPunct && (t.text == "-" || t.text == "{"), t.kind == fts5TokString && p.isColumnFilter():
+		cols := p.colset()
+		p.expect(":")
+		e := p.primary()
+		if p.err == nil {
+			e.filter(cols)
+		}
+		return e
+	case t.kind == fts5TokNear:
+		return p.nearGroup()
+	}
+	return &fts5Expr{op: fts5ExprPhrase, phrases: []*fts5Phrase{p.phrase()}}
+}
+
+// isColumnFilter reports whether the next token is a column name followed
+// by a colon.
+func (p *fts5Parser) isColumnFilter() bool {
+	pos := p.pos
+	p.next()
+	r := p.peek()
+	p.pos = pos
+	return r.kind == fts5TokPunct && r.text == ":"
+}
+
+func (p *fts5Parser) colset() []bool {
+	if p.punct("-") {
+		cols := p.colset()
+		for i := range cols {
+			cols[i] = !cols[i]
+		}
+		return cols
+	}
+
+	cols := make([]bool, len(p.cols))
+	brace := p.punct("{")
+	for p.err == nil {
+		t := p.next()
+		if t.kind != fts5TokString {
+			p.syntaxError(t)
+			break
+		}
+
+		i := p.column(t.text)
+		if i < 0 {
+			p.err = fmt.Errorf("fts5: no such column: %s", t.text)
+			break
+		}
+
+		cols[i] = true
+		if !brace || p.punct("}") {
+			break
+		}
+	}
+	return cols
+}
+
+func (p *fts5Parser) column(name string) int {
+	for i, v := range p.cols {
+		if strings.EqualFold(v, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// filter restricts the phrases of e to the columns cols.
+func (e *fts5Expr) filter(cols []bool) {
+	if e.left != nil {
+		e.left.filter(cols)
+		e.right.filter(cols)
+	}
+	for _, v := range e.phrases {
+		switch {
+		case v.cols == nil:
+			v.cols = append([]bool(nil), cols...)
+		default:
+			for i := range v.cols {
+				v.cols[i] = v.cols[i] && cols[i]
+			}
+		}
+	}
+}
+
+func (p *fts5Parser) nearGroup() *fts5Expr {
+	p.next() // NEAR
+	p.expect("(")
+	e := &fts5Expr{op: fts5ExprNear, near: fts5DefaultNear}
+	for p.err == nil {
+		e.phrases = append(e.phrases, p.phrase())
+		if p.punct(",") {
+			t := p.next()
+			n, err := strconv.Atoi(t.text)
+			if t.kind != fts5TokString || err != nil || n < 0 {
+				p.syntaxError(t)
+				break
+			}
+
+			e.near = n
+			p.expect(")")
+			break
+		}
+
+		if p.punct(")") {
+			break
+		}
+	}
+	return e
+}
+
+func (p *fts5Parser) phrase() *fts5Phrase {
+	ph := &fts5Phrase{initial: p.punct("^")}
+	for p.err == nil {
+		t := p.next()
+		if t.kind != fts5TokString {
+			p.syntaxError(t)
+			break
+		}
+
+		n := len(ph.terms)
+		if err := p.tok.Tokenize(t.text, func(token string, start, end int) error {
+			ph.terms = append(ph.terms, fts5Term{text: token})
+			return nil
+		}); err != nil {
+			p.err = err
+			break
+		}
+
+		if p.punct("*") && len(ph.terms) > n {
+			ph.terms[len(ph.terms)-1].prefix = true
+		}
+		if !p.punct("+") {
+			break
+		}
+	}
+	p.phrases = append(p.phrases, ph)
+	return ph
+}
+
+// eval finds the matches of p.
+func (p *fts5Phrase) eval(src fts5Source) error {
+	p.hits = map[int64][]fts5Hit{}
+	var lists []fts5Postings
+	for _, v := range p.terms {
+		m, err := src(v.text, v.prefix)
+		if err != nil {
+			return err
+		}
+
+		for k := range m {
+			if p.cols != nil && !p.cols[k.col] {
+				delete(m, k)
+			}
+		}
+		lists = append(lists, m)
+	}
+	if len(lists) == 0 {
+		return nil
+	}
+
+	for k, v := range lists[0] {
+	next:
+		for _, pos := range v {
+			if p.initial && pos != 0 {
+				continue
+			}
+
+			for i, l := range lists[1:] {
+				x := l[k]
+				j := sort.SearchInts(x, pos+i+1)
+				if j == len(x) || x[j] != pos+i+1 {
+					continue next
+				}
+			}
+			p.hits[k.id] = append(p.hits[k.id], fts5Hit{k.col, pos})
+		}
+	}
+	for _, v := range p.hits {
+		sort.Slice(v, func(i, j int) bool {
+			if v[i].col != v[j].col {
+				return v[i].col < v[j].col
+			}
+
+			return v[i].pos < v[j].pos
+		})
+	}
+	return nil
+}
+
+// docs returns the rows matching e. The phrases of e must be evaluated.
+func (e *fts5Expr) docs() map[int64]bool {
+	r := map[int64]bool{}
+	switch e.op {
+	case fts5ExprPhrase:
+		for k := range e.phrases[0].hits {
+			r[k] = true
+		}
+	case fts5ExprNear:
+		for k := range e.phrases[0].hits {
+			if e.nearMatch(k) {
+				r[k] = true
+			}
+		}
+	case fts5ExprAnd:
+		l, rt := e.left.docs(), e.right.docs()
+		for k := range l {
+			if rt[k] {
+				r[k] = true
+			}
+		}
+	case fts5ExprOr:
+		r = e.left.docs()
+		for k := range e.right.docs() {
+			r[k] = true
+		}
+	case fts5ExprNot:
+		r = e.left.docs()
+		for k := range e.right.docs() {
+			delete(r, k)
+		}
+	}
+	return r
+}
+
+// nearMatch reports whether the phrases of the NEAR group e occur in a
+// column of the row id with at most e.near tokens between them.
+func (e *fts5Expr) nearMatch(id int64) bool {
+	byCol := map[int][][]int{} // Column: phrase: start positions.
+	total := 0
+	for i, ph := range e.phrases {
+		total += len(ph.terms)
+		for _, h := range ph.hits[id] {
+			l := byCol[h.col]
+			if l == nil {
+				l = make([][]int, len(e.phrases))
+				byCol[h.col] = l
+			}
+			l[i] = append(l[i], h.pos)
+		}
+	}
+	for _, l := range byCol {
+		for i, starts := range l {
+			for _, start := range starts {
+				if e.nearFrom(l, i, start, total) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// nearFrom reports whether the phrases, with positions l in a column, fit in
+// a window starting with phrase i at start.
+func (e *fts5Expr) nearFrom(l [][]int, i, start, total int) bool {
+	end := start + len(e.phrases[i].terms)
+	for j, starts := range l {
+		if j == i {
+			continue
+		}
+
+		k := sort.SearchInts(starts, start)
+		if k == len(starts) {
+			return false
+		}
+
+		if x := starts[k] + len(e.phrases[j].terms); x > end {
+			end = x
+		}
+	}
+	return end-start-total <= e.near
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Tokenizers of the fts5 module.
+//
+// The built-in tokenizers are
+//
+//	unicode61 [remove_diacritics 0|1|2] [tokenchars S] [separators S]
+//	ascii [tokenchars S] [separators S]
+//
+// unicode61, the default, treats letters, numbers, combining marks and private
+// use characters as token characters and folds them to lower case. With
+// remove_diacritics 1 or 2, the default being 1, accents are removed from
+// Latin letters. ascii folds only ASCII letters and treats all non ASCII
+// characters as token characters. tokenchars and separators add or remove
+// token characters.
+
+// Tokenizer splits text into the tokens of a fts5 table.
+type Tokenizer interface {
+	// Tokenize calls fn for every token of text. start and end are the
+	// byte offsets of the token in text. Tokenize stops and returns the
+	// error if fn fails.
+	Tokenize(text string, fn func(token string, start, end int) error) error
+}
+
+var tokenizers = map[string]func(args []string) (Tokenizer, error){
+	"ascii":     newASCIITokenizer,
+	"unicode61": newUnicode61Tokenizer,
+}
+
+// RegisterTokenizer adds the fts5 tokenizer name. new is called with the
+// words following the name in the tokenize option of CREATE VIRTUAL TABLE.
+func RegisterTokenizer(name string, new func(args []string) (Tokenizer, error)) {
+	tokenizers[name] = new
+}
+
+func newTokenizer(words []string) (Tokenizer, error) {
+	if len(words) == 0 {
+		words = []string{"unicode61"}
+	}
+	new := tokenizers[words[0]]
+	if new == nil {
+		return nil, fmt.Errorf("no such tokenizer: %s", words[0])
+	}
+
+	return new(words[1:])
+}
+
+// charTokenizer is a tokenizer based on a token character predicate and a
+// fold function.
+type charTokenizer struct {
+	isToken func(rune) bool
+	fold    func(rune) rune
+	extra   map[rune]bool // Overrides of isToken.
+}
+
+func (t *charTokenizer) Tokenize(text string, fn func(token string, start, end int) error) error {
+	var b []byte
+	start := -1
+	for i := 0; i <= len(text); {
+		r, n := utf8.DecodeRuneInString(text[i:])
+		isToken := false
+		if i < len(text) {
+			var ok bool
+			if isToken, ok = t.extra[r]; !ok {
+				isToken = t.isToken(r)
+			}
+		}
+		switch {
+		case isToken:
+			if start < 0 {
+				start = i
+			}
+			if r = t.fold(r); r >= 0 {
+				b = append(b, string(r)...)
+			}
+		case start >= 0:
+			if err := fn(string(b), start, i); err != nil {
+				return err
+			}
+
+			b = b[:0]
+			start = -1
+		}
+		if n == 0 {
+			break
+		}
+
+		i += n
+	}
+	return nil
+}
+
+// options parses the tokenchars and separators options. Other options are
+// passed to f.
+func (t *charTokenizer) options(args []string, f func(k, v string) error) error {
+	if len(args)%2 != 0 {
+		return fmt.Errorf("missing value of tokenizer option %s", args[len(args)-1])
+	}
+
+	t.extra = map[rune]bool{}
+	for i := 0; i < len(args); i += 2 {
+		switch k, v := args[i], args[i+1]; k {
+		case "tokenchars", "separators":
+			for _, r := range v {
+				t.extra[r] = k == "tokenchars"
+			}
+		default:
+			if f == nil {
+				return fmt.Errorf("unknown tokenizer option %s", k)
+			}
+
+			if err := f(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func newASCIITokenizer(args []string) (Tokenizer, error) {
+	t := &charTokenizer{
+		isToken: func(r rune) bool {
+			return r >= utf8.RuneSelf || r >= '0' && r <= '9' || r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z'
+		},
+		fold: func(r rune) rune {
+			if r >= 'A' && r <= 'Z' {
+				return r + 'a' - 'A'
+			}
+
+			return r
+		},
+	}
+	if err := t.options(args, nil); err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newUnicode61Tokenizer(args []string) (Tokenizer, error) {
+	diacritics := 1
+	t := &charTokenizer{
+		isToken: func(r rune) bool {
+			return unicode.IsLetter(r) || unicode.IsNumber(r) || unicode.In(r, unicode.Co, unicode.Mn)
+		},
+	}
+	if err := t.options(args, func(k, v string) error {
+		if k != "remove_diacritics" {
+			return fmt.Errorf("unknown tokenizer option %s", k)
+		}
+
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 || n > 2 {
+			return fmt.Errorf("invalid remove_diacritics value %s", v)
+		}
+
+		diacritics = n
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+
+	t.fold = func(r rune) rune {
+		r = unicode.ToLower(r)
+		if diacritics != 0 {
+			if unicode.Is(unicode.Mn, r) {
+				return -1
+			}
+
+			if b, ok := latinBase[r]; ok {
+				return b
+			}
+		}
+		return r
+	}
+	return t, nil
+}
+
+// latinBase maps lower case Latin letters with diacritics to their base
+// letter.
+var latinBase = func() map[rune]rune {
+	m := map[rune]rune{}
+	for _, v := range []string{
+		"aàáâãäåāăą",
+		"cçćĉċč",
+		"dď",
+		"eèéêëēĕėęě",
+		"gĝğġģ",
+		"hĥ",
+		"iìíîïĩīĭį",
+		"jĵ",
+		"kķ",
+		"lĺļľ",
+		"nñńņň",
+		"oòóôõöōŏő",
+		"rŕŗř",
+		"sśŝşš",
+		"tţť",
+		"uùúûüũūŭůűų",
+		"wŵ",
+		"yýÿŷ",
+		"zźżž",
+	} {
+		base, n := utf8.DecodeRuneInString(v)
+		for _, r := range v[n:] {
+			m[r] = base
+		}
+	}
+	return m
+}()
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// SQL functions written in Go.
+//
+// Functions registered by RegisterFunction or RegisterAggregate, typically
+// from an init function of a file compiled into the shell, are available on
+// every connection the shell opens.
+//
+// Arguments and results are converted between SQLite values and the Go types
+// int64, float64, string, []byte and nil. Parameters may also be declared as
+// any other integer or float type, bool or interface{}. An interface{}
+// parameter receives the value as its natural Go type, nil for NULL.
+
+var goFuncs []*goFunc
+
+type goFunc struct {
+	name          string
+	fn            reflect.Value // Scalar function or aggregate constructor.
+	hasCtx        bool          // The first parameter is *FuncContext.
+	args          []reflect.Type
+	variadic      reflect.Type // Element type of the variadic parameter or nil.
+	aggregate     bool
+	deterministic bool
+}
+
+// FuncContext is passed to Go SQL functions declaring it as their first
+// parameter.
+type FuncContext struct {
+	tls TLS
+	ctx uintptr // *Ssqlite3_context
+}
+
+var (
+	errorType       = reflect.TypeOf((*error)(nil)).Elem()
+	funcContextType = reflect.TypeOf((*FuncContext)(nil))
+)
+
+// RegisterFunction adds the scalar SQL function name implemented by the Go
+// function impl. The number of SQL arguments is the number of parameters of
+// impl, a variadic impl accepts any number of arguments. The first parameter
+// of impl may be a *FuncContext, it does not count as an SQL argument. impl
+// returns the result value, optionally followed by an error.
+//
+//	RegisterFunction("hypot", math.Hypot, true)
+//
+// Deterministic functions always return the same result for the same
+// arguments, which enables more optimizations. RegisterFunction panics if
+// impl is not a suitable function.
+func RegisterFunction(name string, impl interface{}, deterministic bool) {
+	f := &goFunc{name: name, fn: reflect.ValueOf(impl), deterministic: deterministic}
+	t := f.fn.Type()
+	if t.Kind() != reflect.Func {
+		panic(fmt.Errorf("RegisterFunction %s: not a function: %T", name, impl))
+	}
+
+	var in []reflect.Type
+	for i := 0; i < t.NumIn(); i++ {
+		in = append(in, t.In(i))
+	}
+	if len(in) != 0 && in[0] == funcContextType {
+		f.hasCtx = true
+		in = in[1:]
+	}
+	if err := f.setArgs(in, t.IsVariadic()); err != nil {
+		panic(fmt.Errorf("RegisterFunction %s: %v", name, err))
+	}
+
+	if err := checkResults(t); err != nil {
+		panic(fmt.Errorf("RegisterFunction %s: %v", name, err))
+	}
+
+	goFuncs = append(goFuncs, f)
+}
+
+// RegisterAggregate adds the aggregate SQL function name. The Go function
+// ctor returns a new aggregator for every group. The aggregator has the
+// methods
+//
+//	Step(args...)
+//	Done() result
+//
+// Step is called for every row of the group, its parameters are the SQL
+// arguments. Step may return an error. Done returns the result value,
+// optionally followed by an error.
+//
+// An aggregator with the additional methods
+//
+//	Inverse(args...)
+//	Value() result
+//
+// is a window function. Window functions need SQLite 3.25 or later, with the
+// SQLite of this port they are registered as ordinary aggregates and Inverse
+// and Value are not called. RegisterAggregate panics if ctor or the
+// aggregator is not suitable.
+func RegisterAggregate(name string, ctor interface{}, deterministic bool) {
+	f := &goFunc{name: name, fn: reflect.ValueOf(ctor), aggregate: true, deterministic: deterministic}
+	t := f.fn.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 0 || t.NumOut() != 1 {
+		panic(fmt.Errorf("RegisterAggregate %s: not a constructor: %T", name, ctor))
+	}
+
+	agg := t.Out(0)
+	step, ok := agg.MethodByName("Step")
+	if !ok {
+		panic(fmt.Errorf("RegisterAggregate %s: %v has no Step method", name, agg))
+	}
+
+	done, ok := agg.MethodByName("Done")
+	if !ok {
+		panic(fmt.Errorf("RegisterAggregate %s: %v has no Done method", name, agg))
+	}
+
+	recv := 1 // Method types of non interface types include the receiver.
+	if agg.Kind() == reflect.Interface {
+		recv = 0
+	}
+	var in []reflect.Type
+	for i := recv; i < step.Type.NumIn(); i++ {
+		in = append(in, step.Type.In(i))
+	}
+	if err := f.setArgs(in, step.Type.IsVariadic()); err != nil {
+		panic(fmt.Errorf("RegisterAggregate %s: Step: %v", name, err))
+	}
+
+	switch st := step.Type; {
+	case st.NumOut() > 1, st.NumOut() == 1 && st.Out(0) != errorType:
+		panic(fmt.Errorf("RegisterAggregate %s: Step may only return an error", name))
+	}
+
+	if done.Type.NumIn() != recv {
+		panic(fmt.Errorf("RegisterAggregate %s: Done has parameters", name))
+	}
+
+	if err := checkResults(done.Type); err != nil {
+		panic(fmt.Errorf("RegisterAggregate %s: Done: %v", name, err))
+	}
+
+	goFuncs = append(goFuncs, f)
+}
+
+func (f *goFunc) setArgs(in []reflect.Type, variadic bool) error {
+	if variadic {
+		f.variadic = in[len(in)-1].Elem()
+		in = in[:len(in)-1]
+	}
+	for _, v := range append(in, f.variadic) {
+		if v != nil && !isSQLType(v) {
+			return fmt.Errorf("unsupported parameter type %v", v)
+		}
+	}
+	f.args = in
+	return nil
+}
+
+func isSQLType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.String, reflect.Bool:
+		return true
+	case reflect.Slice:
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Interface:
+		return t.NumMethod() == 0
+	}
+	return false
+}
+
+func checkResults(t reflect.Type) error {
+	switch t.NumOut() {
+	case 1:
+		if t.Out(0) != errorType && isSQLType(t.Out(0)) {
+			return nil
+		}
+	case 2:
+		if isSQLType(t.Out(0)) && t.Out(1) == errorType {
+			return nil
+		}
+	}
+	return fmt.Errorf("must return a value and optionally an error")
+}
+
+func (f *goFunc) nArg() int32 {
+	if f.variadic != nil {
+		return -1
+	}
+
+	return int32(len(f.args))
+}
+
+// Xsqlite3_gofunc_init registers the Go SQL functions with db.
+func Xsqlite3_gofunc_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	for i, f := range goFuncs {
+		zName := cString(tls, f.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		flags := int32(sqliteUTF8)
+		if f.deterministic {
+			flags |= sqliteDeterministic
+		}
+		// The user data is the index of f in goFuncs plus one.
+		var rc int32
+		switch {
+		case f.aggregate:
+			rc = Xsqlite3_create_function_v2(tls, db, zName, f.nArg(), flags, uintptr(i+1), 0, cfnFunc(goFuncStep), cfnFinal(goFuncFinal), 0)
+		default:
+			rc = Xsqlite3_create_function_v2(tls, db, zName, f.nArg(), flags, uintptr(i+1), cfnFunc(goFuncScalar), 0, 0, 0)
+		}
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+func contextGoFunc(tls TLS, ctx uintptr) *goFunc {
+	return goFuncs[Xsqlite3_user_data(tls, ctx)-1]
+}
+
+// convertArgs converts the SQL arguments to the parameter types of f.
+func (f *goFunc) convertArgs(tls TLS, argc int32, args uintptr) []reflect.Value {
+	r := make([]reflect.Value, argc)
+	for i := range r {
+		t := f.variadic
+		if i < len(f.args) {
+			t = f.args[i]
+		}
+		r[i] = goArg(tls, argv(args, i), t)
+	}
+	return r
+}
+
+func goArg(tls TLS, v uintptr, t reflect.Type) reflect.Value {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return reflect.ValueOf(Xsqlite3_value_int64(tls, v)).Convert(t)
+	case reflect.Float32, reflect.Float64:
+		return reflect.ValueOf(Xsqlite3_value_double(tls, v)).Convert(t)
+	case reflect.String:
+		return reflect.ValueOf(valueText(tls, v)).Convert(t)
+	case reflect.Bool:
+		return reflect.ValueOf(Xsqlite3_value_int64(tls, v) != 0).Convert(t)
+	case reflect.Slice:
+		b := valueBlob(tls, v)
+		if b == nil {
+			b = []byte{}
+		}
+		return reflect.ValueOf(b).Convert(t)
+	}
+
+	if x := goValue(tls, v); x != nil {
+		return reflect.ValueOf(x)
+	}
+
+	return reflect.Zero(t)
+}
+
+// goValue returns the SQLite value v as int64, float64, string, []byte or
+// nil.
+func goValue(tls TLS, v uintptr) interface{} {
+	switch Xsqlite3_value_type(tls, v) {
+	case sqliteInteger:
+		return Xsqlite3_value_int64(tls, v)
+	case sqliteFloat:
+		return Xsqlite3_value_double(tls, v)
+	case sqliteText:
+		return valueText(tls, v)
+	case sqliteBlob:
+		if b := valueBlob(tls, v); b != nil {
+			return b
+		}
+
+		return []byte{}
+	}
+	return nil
+}
+
+// setResult sets the result of the SQL function context ctx to the
+// returned values out of a Go function.
+func setResult(tls TLS, ctx uintptr, out []reflect.Value) {
+	if n := len(out); n != 0 && out[n-1].Type() == errorType {
+		if err := out[n-1].Interface(); err != nil {
+			resultError(tls, ctx, err.(error).Error())
+			return
+		}
+
+		out = out[:n-1]
+	}
+	if len(out) == 0 {
+		Xsqlite3_result_null(tls, ctx)
+		return
+	}
+
+	resultValue(tls, ctx, out[0].Interface())
+}
+
+// resultValue sets the result of the SQL function context ctx to the Go
+// value v.
+func resultValue(tls TLS, ctx uintptr, v interface{}) {
+	if v == nil {
+		Xsqlite3_result_null(tls, ctx)
+		return
+	}
+
+	switch x := reflect.ValueOf(v); x.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		Xsqlite3_result_int64(tls, ctx, x.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		Xsqlite3_result_int64(tls, ctx, int64(x.Uint()))
+	case reflect.Float32, reflect.Float64:
+		Xsqlite3_result_double(tls, ctx, x.Float())
+	case reflect.String:
+		resultText(tls, ctx, x.String())
+	case reflect.Bool:
+		var n int64
+		if x.Bool() {
+			n = 1
+		}
+		Xsqlite3_result_int64(tls, ctx, n)
+	case reflect.Slice:
+		if x.Type().Elem().Kind() == reflect.Uint8 {
+			if x.IsNil() {
+				Xsqlite3_result_null(tls, ctx)
+				break
+			}
+
+			resultBlob(tls, ctx, x.Bytes())
+			break
+		}
+
+		fallthrough
+	default:
+		resultError(tls, ctx, fmt.Sprintf("unsupported result type %T", v))
+	}
+}
+
+// recoverResult turns a panic of a Go SQL function into an SQL error.
+func recoverResult(tls TLS, ctx uintptr, f *goFunc) {
+	if e := recover(); e != nil {
+		resultError(tls, ctx, fmt.Sprintf("%s: %v", f.name, e))
+	}
+}
+
+func goFuncScalar(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	f := contextGoFunc(tls, ctx)
+	defer recoverResult(tls, ctx, f)
+
+	in := f.convertArgs(tls, argc, args)
+	if f.hasCtx {
+		in = append([]reflect.Value{reflect.ValueOf(&FuncContext{tls, ctx})}, in...)
+	}
+	setResult(tls, ctx, f.fn.Call(in))
+}
+
+// aggregator returns the aggregator of ctx. The key of the aggregator in
+// objects is the address of the aggregate context.
+func aggregator(tls TLS, ctx uintptr, f *goFunc, create bool) (reflect.Value, uintptr) {
+	var n int32
+	if create {
+		n = int32(ptrSize)
+	}
+	p := Xsqlite3_aggregate_context(tls, ctx, n)
+	if p == 0 || *(*uintptr)(unsafe.Pointer(p)) == 0 {
+		if p == 0 && create {
+			return reflect.Value{}, 0
+		}
+
+		agg := f.fn.Call(nil)[0]
+		if p != 0 {
+			*(*uintptr)(unsafe.Pointer(p)) = 1
+			putObject(p, agg)
+		}
+		return agg, p
+	}
+
+	return getObject(p).(reflect.Value), p
+}
+
+func goFuncStep(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	f := contextGoFunc(tls, ctx)
+	defer recoverResult(tls, ctx, f)
+
+	agg, p := aggregator(tls, ctx, f, true)
+	if p == 0 {
+		Xsqlite3_result_error_nomem(tls, ctx)
+		return
+	}
+
+	out := agg.MethodByName("Step").Call(f.convertArgs(tls, argc, args))
+	if len(out) != 0 {
+		if err := out[0].Interface(); err != nil {
+			resultError(tls, ctx, err.(error).Error())
+		}
+	}
+}
+
+func goFuncFinal(tls TLS, ctx uintptr) {
+	f := contextGoFunc(tls, ctx)
+	defer recoverResult(tls, ctx, f)
+
+	agg, p := aggregator(tls, ctx, f, false)
+	if p != 0 {
+		deleteObject(p)
+	}
+	setResult(tls, ctx, agg.MethodByName("Done").Call(nil))
+}
+
+// AuxData returns the value associated with the arg-th argument by
+// SetAuxData or nil if there is none.
+func (c *FuncContext) AuxData(arg int) interface{} {
+	if p := Xsqlite3_get_auxdata(c.tls, c.ctx, int32(arg)); p != 0 {
+		return getObject(p)
+	}
+
+	return nil
+}
+
+// SetAuxData associates v with the arg-th argument. SQLite keeps v while the
+// argument is a constant of the statement being executed, allowing to cache
+// things like compiled patterns.
+func (c *FuncContext) SetAuxData(arg int, v interface{}) {
+	p := cZero(c.tls, 1)
+	if p == 0 {
+		return
+	}
+
+	putObject(p, v)
+	Xsqlite3_set_auxdata(c.tls, c.ctx, int32(arg), p, cfnFinal(auxDataDestroy))
+}
+
+func auxDataDestroy(tls TLS, p uintptr) {
+	deleteObject(p)
+	Xsqlite3_free(tls, p)
+}
@@ -0,0 +1,787 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Synthetic data.
+//
+//	.generate TABLE N ?--seed S? ?--col COLUMN=GENERATOR ...?
+//
+// .generate inserts N rows of plausible values into TABLE. The generator of
+// a column is chosen by its CHECK constraints, like x IN (...), x BETWEEN a
+// AND b, x >= a or length(x) <= n, its name, like email or created_at, and
+// its declared type. The columns of a foreign key get the values of a random
+// row of the parent table. An INTEGER PRIMARY KEY is left to SQLite and the
+// other single integer primary keys count up from the largest value. Columns
+// with a UNIQUE constraint of their own, which their CHECK constraints do not
+// bound, get unique values: integers count up from the largest value and
+// texts get a number appended. A row violating a UNIQUE or CHECK constraint
+// is generated again, up to 100 times.
+//
+// --col sets the generator of a column, GENERATOR is one of
+//
+//	blob:N           N random bytes, 16 by default
+//	bool             0 or 1
+//	date:Y1..Y2      A YYYY-MM-DD date, of the years 2000 to 2030 by default
+//	datetime:Y1..Y2  A YYYY-MM-DD HH:MM:SS time
+//	email            An e-mail address
+//	first_name       A first name
+//	int:A..B         An integer, 0 to 1000 by default
+//	last_name        A last name
+//	name             A first and a last name
+//	null             NULL
+//	phone            A phone number
+//	pick:A|B|...     One of the values
+//	real:A..B        A number with two decimals, 0 to 1000 by default
+//	sentence         A few words
+//	seq:START        START, START+1, ..., 1 by default
+//	text:N           Words of up to N characters, 40 by default
+//	url              A URL
+//	uuid             A random UUID
+//	word             A word
+//
+// The rows are the same for the same seed, S is by default the time and
+// .generate writes it.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:  "generate",
+		usage: "TABLE N ?--seed S? ?--col COLUMN=GENERATOR ...?",
+		help:  "Insert N rows of synthetic data into TABLE",
+		run:   generateCommand,
+	})
+}
+
+// generator returns the value of a column of the row i.
+type generator func(r *rand.Rand, i int) interface{}
+
+var (
+	genFirstNames = strings.Fields(`Alice Amelia Ava Benjamin Charlotte Daniel David Elijah Emma Ethan Grace
+		Hannah Henry Isabella Jack James Liam Lucas Mason Mia Noah Olivia Oliver Sofia William`)
+	genLastNames = strings.Fields(`Anderson Brown Clark Davis Garcia Harris Jackson Johnson Jones Lee Lewis
+		Martin Martinez Miller Moore Robinson Smith Taylor Thomas Thompson Walker White Williams Wilson Young`)
+	genWords = strings.Fields(`account action answer area audit balance basket board branch budget
+		channel chart client coffee company contract course credit data delivery design device
+		document energy event field garden group harbor income invoice island journal kitchen
+		letter market meeting member message method network office order paper partner payment
+		planet policy product project quality record report request river school season service
+		signal station status storage stream summary system ticket travel update value window`)
+	genDomains = strings.Fields(`example.com example.net example.org mail.example test.example`)
+)
+
+const genRetries = 100
+
+func generateCommand(s *shell, args []string) error {
+	var pos []string
+	var seed int64
+	seeded := false
+	overrides := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		switch v := args[i]; v {
+		case "-seed", "--seed", "-col", "--col":
+			if i+1 == len(args) {
+				return errUsage
+			}
+
+			i++
+			if strings.HasSuffix(v, "seed") {
+				n, err := strconv.ParseInt(args[i], 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s: not a seed", args[i])
+				}
+
+				seed, seeded = n, true
+				continue
+			}
+
+			kv := strings.SplitN(args[i], "=", 2)
+			if len(kv) != 2 || kv[0] == "" {
+				return fmt.Errorf("%s: not COLUMN=GENERATOR", args[i])
+			}
+
+			overrides[strings.ToLower(kv[0])] = kv[1]
+		default:
+			if strings.HasPrefix(v, "-") {
+				return errUsage
+			}
+
+			pos = append(pos, v)
+		}
+	}
+	if len(pos) != 2 {
+		return errUsage
+	}
+
+	n, err := strconv.Atoi(pos[1])
+	if err != nil || n < 0 {
+		return fmt.Errorf("%s: not a number of rows", pos[1])
+	}
+
+	if !seeded {
+		seed = time.Now().UnixNano()
+	}
+	c := s.conn()
+	g, err := newTableGenerator(c, pos[0], overrides)
+	if err != nil {
+		return err
+	}
+
+	if err := c.exec("SAVEPOINT generate"); err != nil {
+		return err
+	}
+
+	if err = g.insert(rand.New(rand.NewSource(seed)), n); err != nil {
+		c.exec("ROLLBACK TO generate")
+		c.exec("RELEASE generate")
+		return err
+	}
+
+	if err := c.exec("RELEASE generate"); err != nil {
+		return err
+	}
+
+	s.printf("inserted %d rows into %s, seed %d\n", n, g.name, seed)
+	return nil
+}
+
+// genForeignKey picks the columns cols of the row from a random row of the
+// parent table.
+type genForeignKey struct {
+	parent   string
+	cols     []int
+	rows     [][]interface{}
+	nullable bool
+}
+
+type tableGenerator struct {
+	c     *sqlConn
+	name  string // Qualified and quoted.
+	cols  []string
+	gens  []generator // nil for the columns of fkeys.
+	fkeys []*genForeignKey
+}
+
+func newTableGenerator(c *sqlConn, table string, overrides map[string]string) (*tableGenerator, error) {
+	d, err := describeTable(c, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if d.Type == "view" {
+		return nil, fmt.Errorf("%s is a view", d.Name)
+	}
+
+	row, err := c.queryRow(fmt.Sprintf("SELECT sql FROM %s.sqlite_master WHERE name = ?", sqlQuoteID(d.Schema)), d.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	sql := ""
+	if row != nil {
+		sql, _ = row[0].(string)
+	}
+	fkeys, err := c.query("SELECT id, \"table\", \"from\", \"to\" FROM pragma_foreign_key_list(?, ?) ORDER BY id, seq", d.Name, d.Schema)
+	if err != nil {
+		return nil, err
+	}
+
+	fkCols := map[string]bool{}
+	for _, v := range fkeys {
+		fkCols[strings.ToLower(v[2].(string))] = true
+	}
+	pks := 0
+	for _, v := range d.Columns {
+		if v.PK != 0 {
+			pks++
+		}
+	}
+	unique := map[string]bool{}
+	for _, v := range d.Indexes {
+		if v.Unique && !v.Partial && len(v.Columns) == 1 {
+			unique[strings.ToLower(v.Columns[0])] = true
+		}
+	}
+	g := &tableGenerator{c: c, name: sqlQuoteID(d.Schema) + "." + sqlQuoteID(d.Name)}
+	index := map[string]int{}
+	overridden := map[string]bool{}
+	var columns []columnDescription
+	for _, v := range d.Columns {
+		key := strings.ToLower(v.Name)
+		spec, ok := overrides[key]
+		var gen generator
+		switch {
+		case ok:
+			if gen, err = parseGenerator(spec); err != nil {
+				return nil, fmt.Errorf("column %s: %v", v.Name, err)
+			}
+
+			overridden[key] = true
+		case fkCols[key]:
+			// Set by the foreign key.
+		case pks == 1 && v.PK != 0 && strings.EqualFold(v.Type, "INTEGER") && d.Type == "table":
+			continue // An alias of the rowid.
+		case pks == 1 && v.PK != 0 && v.Affinity == "INTEGER":
+			row, err := c.queryRow(fmt.Sprintf("SELECT max(%s) FROM %s", sqlQuoteID(v.Name), g.name))
+			if err != nil {
+				return nil, err
+			}
+
+			start, _ := row[0].(int64)
+			gen = genSeq(start + 1)
+		case unique[key]:
+			next, err := uniqueStart(c, g.name, v.Name)
+			if err != nil {
+				return nil, err
+			}
+
+			gen = guessGenerator(v, sql, true, next)
+		default:
+			gen = guessGenerator(v, sql, false, 0)
+		}
+		index[key] = len(g.cols)
+		columns = append(columns, v)
+		g.cols = append(g.cols, v.Name)
+		g.gens = append(g.gens, gen)
+	}
+	for k := range overrides {
+		if !overridden[k] {
+			return nil, fmt.Errorf("no such column: %s", k)
+		}
+	}
+
+	var fk *genForeignKey
+	var to []string
+	for i, v := range fkeys {
+		if fk == nil {
+			fk = &genForeignKey{parent: v[1].(string)}
+		}
+		key := strings.ToLower(v[2].(string))
+		if overridden[key] {
+			fk.parent = "" // The foreign key is not used.
+		}
+		fk.cols = append(fk.cols, index[key])
+		if s, ok := v[3].(string); ok {
+			to = append(to, s)
+		}
+		for _, col := range d.Columns {
+			if strings.EqualFold(col.Name, key) && !col.NotNull {
+				fk.nullable = true
+			}
+		}
+		if i+1 < len(fkeys) && fkeys[i+1][0] == v[0] {
+			continue
+		}
+
+		if fk.parent != "" {
+			if err := fk.load(c, d.Schema, to); err != nil {
+				return nil, err
+			}
+
+			g.fkeys = append(g.fkeys, fk)
+		}
+		fk, to = nil, nil
+	}
+	// The other columns of foreign keys with an overridden column.
+	used := map[int]bool{}
+	for _, fk := range g.fkeys {
+		for _, j := range fk.cols {
+			used[j] = true
+		}
+	}
+	for i, v := range g.gens {
+		if v != nil || used[i] {
+			continue
+		}
+
+		next := int64(0)
+		isUnique := unique[strings.ToLower(columns[i].Name)]
+		if isUnique {
+			if next, err = uniqueStart(c, g.name, columns[i].Name); err != nil {
+				return nil, err
+			}
+		}
+		g.gens[i] = guessGenerator(columns[i], sql, isUnique, next)
+	}
+	return g, nil
+}
+
+// uniqueStart returns the first number making the values of the UNIQUE
+// column col of table unique: past the largest integer and the row count.
+func uniqueStart(c *sqlConn, table, col string) (int64, error) {
+	row, err := c.queryRow(fmt.Sprintf("SELECT max(CASE WHEN typeof(%[1]s) = 'integer' THEN %[1]s END), count(*) FROM %[2]s", sqlQuoteID(col), table))
+	if err != nil {
+		return 0, err
+	}
+
+	n, _ := row[0].(int64)
+	if m := row[1].(int64); m > n {
+		n = m
+	}
+	return n + 1, nil
+}
+
+// load reads the keys of up to 10000 rows of the parent table. to are the
+// parent columns, the primary key if empty.
+func (fk *genForeignKey) load(c *sqlConn, schema string, to []string) error {
+	if len(to) == 0 {
+		rows, err := c.query("SELECT name FROM pragma_table_info(?, ?) WHERE pk > 0 ORDER BY pk", fk.parent, schema)
+		if err != nil {
+			return err
+		}
+
+		for _, v := range rows {
+			to = append(to, v[0].(string))
+		}
+		if len(to) == 0 {
+			to = []string{"rowid"}
+		}
+	}
+	cols := make([]string, len(to))
+	var where []string
+	for i, v := range to {
+		cols[i] = sqlQuoteID(v)
+		where = append(where, cols[i]+" IS NOT NULL")
+	}
+	list := strings.Join(cols, ", ")
+	rows, err := c.query(fmt.Sprintf("SELECT DISTINCT %s FROM %s.%s WHERE %s ORDER BY %s LIMIT 10000", list, sqlQuoteID(schema), sqlQuoteID(fk.parent), strings.Join(where, " AND "), list))
+	if err != nil {
+		return err
+	}
+
+	if len(rows) == 0 && !fk.nullable {
+		return fmt.Errorf("the parent table %s has no rows", fk.parent)
+	}
+
+	fk.rows = rows
+	return nil
+}
+
+// insert inserts n rows.
+func (g *tableGenerator) insert(r *rand.Rand, n int) error {
+	marks := make([]string, len(g.cols))
+	names := make([]string, len(g.cols))
+	for i, v := range g.cols {
+		marks[i] = "?"
+		names[i] = sqlQuoteID(v)
+	}
+	sql := fmt.Sprintf("INSERT INTO %s DEFAULT VALUES", g.name)
+	if len(g.cols) != 0 {
+		sql = fmt.Sprintf("INSERT INTO %s(%s) VALUES(%s)", g.name, strings.Join(names, ", "), strings.Join(marks, ", "))
+	}
+	stmt, err := g.c.prepare(sql)
+	if err != nil {
+		return err
+	}
+
+	defer stmt.close()
+	row := make([]interface{}, len(g.cols))
+	for i := 0; i < n; i++ {
+		for try := 1; ; try++ {
+			for j, gen := range g.gens {
+				if gen != nil {
+					row[j] = gen(r, i)
+				}
+			}
+			for _, fk := range g.fkeys {
+				var parent []interface{}
+				if len(fk.rows) != 0 {
+					parent = fk.rows[r.Intn(len(fk.rows))]
+				}
+				for k, j := range fk.cols {
+					row[j] = nil
+					if parent != nil {
+						row[j] = parent[k]
+					}
+				}
+			}
+			if err := stmt.bind(row...); err != nil {
+				return err
+			}
+
+			_, err := stmt.step()
+			if err == nil {
+				break
+			}
+
+			if Xsqlite3_errcode(g.c.tls, g.c.db)&0xff != sqliteConstraint || try == genRetries {
+				return fmt.Errorf("row %d: %v", i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+var genRangeRe = regexp.MustCompile(`^(-?[0-9.]+)\.\.(-?[0-9.]+)$`)
+
+// parseGenerator returns the generator of the --col GENERATOR spec.
+func parseGenerator(spec string) (generator, error) {
+	kind, arg := spec, ""
+	if i := strings.IndexByte(spec, ':'); i >= 0 {
+		kind, arg = spec[:i], spec[i+1:]
+	}
+	rng := func(lo, hi float64) (float64, float64, error) {
+		if arg == "" {
+			return lo, hi, nil
+		}
+
+		m := genRangeRe.FindStringSubmatch(arg)
+		if m == nil {
+			return 0, 0, fmt.Errorf("%s: not a range A..B", arg)
+		}
+
+		a, err := strconv.ParseFloat(m[1], 64)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		b, err := strconv.ParseFloat(m[2], 64)
+		if err != nil || b < a {
+			return 0, 0, fmt.Errorf("%s: not a range A..B", arg)
+		}
+
+		return a, b, nil
+	}
+	num := func(def int) (int, error) {
+		if arg == "" {
+			return def, nil
+		}
+
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("%s: not a number", arg)
+		}
+
+		return n, nil
+	}
+	switch kind {
+	case "blob":
+		n, err := num(16)
+		return genBlob(n), err
+	case "bool":
+		return genInt(0, 1), nil
+	case "date", "datetime":
+		lo, hi, err := rng(2000, 2030)
+		return genTime(int(lo), int(hi), kind == "datetime"), err
+	case "email":
+		return genEmail, nil
+	case "first_name":
+		return genPick(genFirstNames), nil
+	case "int":
+		if _, _, err := rng(0, 0); err != nil || arg == "" {
+			return genInt(0, 1000), err
+		}
+
+		m := genRangeRe.FindStringSubmatch(arg)
+		lo, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a range of 64 bit integers", arg)
+		}
+
+		hi, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not a range of 64 bit integers", arg)
+		}
+
+		return genInt(lo, hi), nil
+	case "last_name":
+		return genPick(genLastNames), nil
+	case "name":
+		return genName, nil
+	case "null":
+		return func(*rand.Rand, int) interface{} { return nil }, nil
+	case "phone":
+		return genPhone, nil
+	case "pick":
+		if arg == "" {
+			return nil, errors.New("pick needs values A|B|...")
+		}
+
+		return genPick(strings.Split(arg, "|")), nil
+	case "real":
+		lo, hi, err := rng(0, 1000)
+		return genReal(lo, hi), err
+	case "sentence":
+		return genText(80), nil
+	case "seq":
+		n, err := num(1)
+		return genSeq(int64(n)), err
+	case "text":
+		n, err := num(40)
+		return genText(n), err
+	case "url":
+		return genURL, nil
+	case "uuid":
+		return genUUID, nil
+	case "word":
+		return genPick(genWords), nil
+	}
+	return nil, fmt.Errorf("%s: unknown generator", spec)
+}
+
+func genInt(lo, hi int64) generator {
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	span := uint64(hi-lo) + 1 // 0 for all of int64.
+	if span == 0 || span > math.MaxInt64 {
+		return func(r *rand.Rand, i int) interface{} {
+			v := r.Uint64()
+			if span != 0 {
+				v %= span
+			}
+			return lo + int64(v)
+		}
+	}
+
+	return func(r *rand.Rand, i int) interface{} { return lo + r.Int63n(int64(span)) }
+}
+
+// clampInt64 converts f to the nearest int64.
+func clampInt64(f float64) int64 {
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64
+	case f <= math.MinInt64:
+		return math.MinInt64
+	}
+	return int64(f)
+}
+
+func genReal(lo, hi float64) generator {
+	if hi < lo {
+		lo, hi = hi, lo
+	}
+	return func(r *rand.Rand, i int) interface{} {
+		v := lo + r.Float64()*(hi-lo)
+		return math.Trunc(v*100) / 100
+	}
+}
+
+func genSeq(start int64) generator {
+	return func(r *rand.Rand, i int) interface{} { return start + int64(i) }
+}
+
+// genUnique returns the values of gen made unique by the numbers next,
+// next+1, ...: integers are the numbers and texts get them appended, within
+// maxLen characters if maxLen is positive. E-mail addresses get them before
+// the @.
+func genUnique(gen generator, next int64, maxLen int) generator {
+	return func(r *rand.Rand, i int) interface{} {
+		switch x := gen(r, i).(type) {
+		case int64:
+			return next + int64(i)
+		case string:
+			n := strconv.FormatInt(next+int64(i), 10)
+			head, tail, sep := x, "", "-"
+			switch at := strings.LastIndexByte(x, '@'); {
+			case at >= 0:
+				head, tail, sep = x[:at], x[at:], "."
+			case strings.Contains(x, " "):
+				sep = " "
+			}
+			if maxLen > 0 {
+				if room := maxLen - len(tail) - len(sep) - len(n); room < len(head) {
+					head = head[:max(room, 0)]
+				}
+			}
+			return head + sep + n + tail
+		default:
+			return x
+		}
+	}
+}
+
+func genPick(values []string) generator {
+	return func(r *rand.Rand, i int) interface{} { return values[r.Intn(len(values))] }
+}
+
+func genBlob(n int) generator {
+	return func(r *rand.Rand, i int) interface{} {
+		b := make([]byte, n)
+		r.Read(b)
+		return b
+	}
+}
+
+// genText returns words of up to n characters.
+func genText(n int) generator {
+	return func(r *rand.Rand, i int) interface{} {
+		s := genWords[r.Intn(len(genWords))]
+		for w := 1 + r.Intn(8); w > 0; w-- {
+			next := genWords[r.Intn(len(genWords))]
+			if len(s)+1+len(next) > n {
+				break
+			}
+
+			s += " " + next
+		}
+		if len(s) > n {
+			s = s[:n]
+		}
+		return strings.ToUpper(s[:min(1, len(s))]) + s[min(1, len(s)):]
+	}
+}
+
+func genTime(lo, hi int, clock bool) generator {
+	return func(r *rand.Rand, i int) interface{} {
+		a := time.Date(lo, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		b := time.Date(hi+1, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+		t := time.Unix(a+r.Int63n(b-a), 0).UTC()
+		if clock {
+			return t.Format("2006-01-02 15:04:05")
+		}
+
+		return t.Format("2006-01-02")
+	}
+}
+
+func genName(r *rand.Rand, i int) interface{} {
+	return genFirstNames[r.Intn(len(genFirstNames))] + " " + genLastNames[r.Intn(len(genLastNames))]
+}
+
+func genEmail(r *rand.Rand, i int) interface{} {
+	return fmt.Sprintf("%s.%s%d@%s",
+		strings.ToLower(genFirstNames[r.Intn(len(genFirstNames))]),
+		strings.ToLower(genLastNames[r.Intn(len(genLastNames))]),
+		r.Intn(1000),
+		genDomains[r.Intn(len(genDomains))])
+}
+
+func genPhone(r *rand.Rand, i int) interface{} {
+	return fmt.Sprintf("+1-555-%03d-%04d", r.Intn(1000), r.Intn(10000))
+}
+
+func genURL(r *rand.Rand, i int) interface{} {
+	return fmt.Sprintf("https://www.%s/%s/%d", genDomains[r.Intn(len(genDomains))], genWords[r.Intn(len(genWords))], r.Intn(10000))
+}
+
+func genUUID(r *rand.Rand, i int) interface{} {
+	b := make([]byte, 16)
+	r.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// guessGenerator returns the generator of the column c of the table created
+// by sql. If unique and the CHECK constraints do not bound the column, its
+// values are made unique by genUnique, starting at next.
+func guessGenerator(c columnDescription, sql string, unique bool, next int64) generator {
+	q := regexp.QuoteMeta(c.Name)
+	col := `(?:"` + q + `"|\[` + q + `\]|` + "`" + q + "`" + `|\b` + q + `\b)`
+	const num = `(-?[0-9]+(?:\.[0-9]+)?)`
+	if m := regexp.MustCompile(`(?is)` + col + `\s+IN\s*\(([^()]*)\)`).FindStringSubmatch(sql); m != nil {
+		var values []string
+		for _, v := range regexp.MustCompile(`'(?:[^']|'')*'|-?[0-9]+(?:\.[0-9]+)?`).FindAllString(m[1], -1) {
+			if strings.HasPrefix(v, "'") {
+				v = strings.Replace(v[1:len(v)-1], "''", "'", -1)
+			}
+			values = append(values, v)
+		}
+		if len(values) != 0 {
+			return genPick(values)
+		}
+	}
+
+	lo, hi, bounded := 0.0, 1000.0, false
+	if m := regexp.MustCompile(`(?is)` + col + `\s+BETWEEN\s+` + num + `\s+AND\s+` + num).FindStringSubmatch(sql); m != nil {
+		lo, _ = strconv.ParseFloat(m[1], 64)
+		hi, _ = strconv.ParseFloat(m[2], 64)
+		bounded = true
+	}
+	for _, m := range regexp.MustCompile(`(?is)`+col+`\s*(>=|>|<=|<)\s*`+num).FindAllStringSubmatch(sql, -1) {
+		v, _ := strconv.ParseFloat(m[2], 64)
+		switch m[1] {
+		case ">":
+			v++
+			fallthrough
+		case ">=":
+			lo = v
+			if hi < lo {
+				hi = lo + 1000
+			}
+		case "<":
+			v--
+			fallthrough
+		case "<=":
+			hi = v
+			if lo > hi {
+				lo = hi - 1000
+			}
+		}
+		bounded = true
+	}
+	maxLen := 0
+	if m := regexp.MustCompile(`(?is)length\s*\(\s*` + col + `\s*\)\s*(<=|<)\s*([0-9]+)`).FindStringSubmatch(sql); m != nil {
+		maxLen, _ = strconv.Atoi(m[2])
+		if m[1] == "<" {
+			maxLen--
+		}
+	}
+
+	typ := strings.ToUpper(c.Type)
+	name := strings.ToLower(c.Name)
+	var gen generator
+	switch {
+	case bounded && c.Affinity == "REAL":
+		gen = genReal(lo, hi)
+	case bounded:
+		gen = genInt(clampInt64(lo), clampInt64(hi))
+	case strings.Contains(typ, "BOOL") || strings.HasPrefix(name, "is_") || strings.HasPrefix(name, "has_"):
+		gen = genInt(0, 1)
+	case strings.Contains(name, "email"):
+		gen = genEmail
+	case strings.Contains(name, "first") && strings.Contains(name, "name"):
+		gen = genPick(genFirstNames)
+	case strings.Contains(name, "last") && strings.Contains(name, "name") || strings.Contains(name, "surname"):
+		gen = genPick(genLastNames)
+	case strings.Contains(name, "name") && c.Affinity != "INTEGER":
+		gen = genName
+	case strings.Contains(name, "phone"):
+		gen = genPhone
+	case strings.Contains(name, "url") || strings.Contains(name, "website"):
+		gen = genURL
+	case strings.Contains(name, "uuid") || strings.Contains(name, "guid"):
+		gen = genUUID
+	case strings.Contains(typ, "DATETIME") || strings.Contains(typ, "TIMESTAMP") || strings.HasSuffix(name, "_at"):
+		gen = genTime(2000, 2030, true)
+	case strings.Contains(typ, "DATE") || strings.HasSuffix(name, "date"):
+		gen = genTime(2000, 2030, false)
+	case name == "age":
+		gen = genInt(18, 90)
+	case strings.Contains(name, "price") || strings.Contains(name, "amount") || strings.Contains(name, "total"):
+		gen = genReal(1, 1000)
+	case c.Affinity == "INTEGER":
+		gen = genInt(0, 1000)
+	case c.Affinity == "REAL" || c.Affinity == "NUMERIC":
+		gen = genReal(0, 1000)
+	case c.Affinity == "BLOB" && typ != "":
+		gen = genBlob(16)
+	default:
+		gen = genText(40)
+	}
+	if unique && !bounded {
+		return genUnique(gen, next, maxLen)
+	}
+
+	if maxLen <= 0 {
+		return gen
+	}
+
+	return func(r *rand.Rand, i int) interface{} {
+		v := gen(r, i)
+		if s, ok := v.(string); ok && len(s) > maxLen {
+			return s[:maxLen]
+		}
+
+		return v
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+// Geometry functions for use with the rtree module.
+//
+//	point_in_polygon(P, X, Y)	1 if the point X, Y is inside the polygon P,
+//					0 otherwise
+//	geojson_bbox(G)			the bounding box of the GeoJSON G as the JSON
+//					array [minX, minY, maxX, maxY]
+//	haversine(LAT1, LON1, LAT2, LON2)
+//					the great circle distance in meters between
+//					two points given in degrees
+//
+// P is a GeoJSON Polygon or MultiPolygon, a Feature or collection with such
+// geometries, or a bare array of rings or of positions. Holes are honored,
+// points on the boundary may test either way. G is any GeoJSON value. The
+// result of all functions is NULL if any argument is NULL.
+
+// geoEarthRadius is the mean radius of the Earth in meters.
+const geoEarthRadius = 6371008.8
+
+var errGeoJSON = errors.New("malformed GeoJSON")
+
+var geoFuncs = []struct {
+	name string
+	nArg int32
+	fn   func(TLS, uintptr, int32, uintptr)
+}{
+	{"geojson_bbox", 1, geoBboxFunc},
+	{"haversine", 4, haversineFunc},
+	{"point_in_polygon", 3, pointInPolygonFunc},
+}
+
+// geoRegister registers the geometry functions with db.
+func geoRegister(tls TLS, db uintptr) int32 {
+	for _, v := range geoFuncs {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_function(tls, db, zName, v.nArg, sqliteUTF8|sqliteDeterministic, 0, cfnFunc(v.fn), 0, 0)
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+type geoPoint [2]float64
+
+// geoRing is a closed line, the last point connects to the first one.
+type geoRing []geoPoint
+
+// member returns the value of the object member name or nil.
+func (n *jsonNode) member(name string) *jsonNode {
+	if n.typ != jsonObject {
+		return nil
+	}
+
+	for i, v := range n.keys {
+		if jsonUnquote(v) == name {
+			return n.elems[i]
+		}
+	}
+	return nil
+}
+
+func (n *jsonNode) isNumber() bool { return n.typ == jsonInt || n.typ == jsonReal }
+
+// geoPosition returns the GeoJSON position n.
+func geoPosition(n *jsonNode) (geoPoint, bool) {
+	if n.typ != jsonArray || len(n.elems) < 2 || !n.elems[0].isNumber() || !n.elems[1].isNumber() {
+		return geoPoint{}, false
+	}
+
+	x, _ := strconv.ParseFloat(n.elems[0].raw, 64)
+	y, _ := strconv.ParseFloat(n.elems[1].raw, 64)
+	return geoPoint{x, y}, true
+}
+
+// geoPoints calls fn for every position of the GeoJSON value n.
+func geoPoints(n *jsonNode, fn func(geoPoint)) {
+	switch n.typ {
+	case jsonObject:
+		for _, k := range []string{"coordinates", "geometry", "geometries", "features"} {
+			if v := n.member(k); v != nil {
+				geoPoints(v, fn)
+			}
+		}
+	case jsonArray:
+		if p, ok := geoPosition(n); ok {
+			fn(p)
+			break
+		}
+
+		for _, v := range n.elems {
+			geoPoints(v, fn)
+		}
+	}
+}
+
+// geoRings returns the rings of the polygons in n. The rings of a polygon
+// with holes are returned together, see geoInside.
+func geoRings(n *jsonNode) ([][]geoRing, error) {
+	switch n.typ {
+	case jsonObject:
+		typ := n.member("type")
+		if typ == nil || typ.typ != jsonString {
+			return nil, errGeoJSON
+		}
+
+		var key string
+		switch jsonUnquote(typ.raw) {
+		case "Polygon", "MultiPolygon":
+			key = "coordinates"
+		case "Feature":
+			key = "geometry"
+		case "FeatureCollection":
+			key = "features"
+		case "GeometryCollection":
+			key = "geometries"
+		default:
+			return nil, nil
+		}
+
+		v := n.member(key)
+		if v == nil {
+			return nil, errGeoJSON
+		}
+
+		if v.typ == jsonNull {
+			return nil, nil
+		}
+
+		if key == "features" || key == "geometries" {
+			var r [][]geoRing
+			for _, v := range v.elems {
+				a, err := geoRings(v)
+				if err != nil {
+					return nil, err
+				}
+
+				r = append(r, a...)
+			}
+			return r, nil
+		}
+
+		return geoRings(v)
+	case jsonArray:
+		if len(n.elems) == 0 {
+			return nil, nil
+		}
+
+		// A ring, a polygon or a multipolygon, told apart by nesting.
+		if _, ok := geoPosition(n.elems[0]); ok {
+			ring, err := geoRingOf(n)
+			if err != nil {
+				return nil, err
+			}
+
+			return [][]geoRing{{ring}}, nil
+		}
+
+		if e := n.elems[0]; e.typ == jsonArray && len(e.elems) != 0 {
+			if _, ok := geoPosition(e.elems[0]); ok {
+				var poly []geoRing
+				for _, v := range n.elems {
+					ring, err := geoRingOf(v)
+					if err != nil {
+						return nil, err
+					}
+
+					poly = append(poly, ring)
+				}
+				return [][]geoRing{poly}, nil
+			}
+		}
+
+		var r [][]geoRing
+		for _, v := range n.elems {
+			a, err := geoRings(v)
+			if err != nil {
+				return nil, err
+			}
+
+			r = append(r, a...)
+		}
+		return r, nil
+	}
+	return nil, errGeoJSON
+}
+
+func geoRingOf(n *jsonNode) (geoRing, error) {
+	if n.typ != jsonArray {
+		return nil, errGeoJSON
+	}
+
+	var r geoRing
+	for _, v := range n.elems {
+		p, ok := geoPosition(v)
+		if !ok {
+			return nil, errGeoJSON
+		}
+
+		r = append(r, p)
+	}
+	return r, nil
+}
+
+// geoInside reports whether p is inside the polygon with the rings poly. A
+// point inside an odd number of rings is inside the polygon, so holes work
+// regardless of the winding order.
+func geoInside(p geoPoint, poly []geoRing) bool {
+	in := false
+	for _, ring := range poly {
+		for i, j := 0, len(ring)-1; i < len(ring); j, i = i, i+1 {
+			a, b := ring[i], ring[j]
+			if (a[1] > p[1]) != (b[1] > p[1]) && p[0] < (b[0]-a[0])*(p[1]-a[1])/(b[1]-a[1])+a[0] {
+				in = !in
+			}
+		}
+	}
+	return in
+}
+
+// haversine returns the great circle distance in meters between two points
+// given in degrees.
+func haversine(lat1, lon1, lat2, lon2 float64) float64 {
+	rad := math.Pi / 180
+	dLat := (lat2 - lat1) * rad
+	dLon := (lon2 - lon1) * rad
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1*rad)*math.Cos(lat2*rad)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * geoEarthRadius * math.Asin(math.Min(1, math.Sqrt(a)))
+}
+
+// geoNullArg sets the result to NULL and reports whether any argument is
+// NULL.
+func geoNullArg(tls TLS, ctx uintptr, argc int32, args uintptr) bool {
+	for i := 0; i < int(argc); i++ {
+		if Xsqlite3_value_type(tls, argv(args, i)) == sqliteNull {
+			Xsqlite3_result_null(tls, ctx)
+			return true
+		}
+	}
+	return false
+}
+
+func pointInPolygonFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if geoNullArg(tls, ctx, argc, args) {
+		return
+	}
+
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	polys, err := geoRings(n)
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return
+	}
+
+	p := geoPoint{Xsqlite3_value_double(tls, argv(args, 1)), Xsqlite3_value_double(tls, argv(args, 2))}
+	var r int32
+	for _, v := range polys {
+		if geoInside(p, v) {
+			r = 1
+			break
+		}
+	}
+	Xsqlite3_result_int(tls, ctx, r)
+}
+
+func geoBboxFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	box := []float64{math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)}
+	geoPoints(n, func(p geoPoint) {
+		box[0] = math.Min(box[0], p[0])
+		box[1] = math.Min(box[1], p[1])
+		box[2] = math.Max(box[2], p[0])
+		box[3] = math.Max(box[3], p[1])
+	})
+	if box[0] > box[2] {
+		return
+	}
+
+	b := []byte{'['}
+	for i, v := range box {
+		if i != 0 {
+			b = append(b, ',')
+		}
+		b = strconv.AppendFloat(b, v, 'g', -1, 64)
+	}
+	jsonResult(tls, ctx, string(append(b, ']')))
+}
+
+func haversineFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if geoNullArg(tls, ctx, argc, args) {
+		return
+	}
+
+	var a [4]float64
+	for i := range a {
+		a[i] = Xsqlite3_value_double(tls, argv(args, i))
+	}
+	Xsqlite3_result_double(tls, ctx, haversine(a[0], a[1], a[2], a[3]))
+}
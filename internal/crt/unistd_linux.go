@@ -212,7 +212,14 @@ func Xwrite(tls *TLS, fd int32, buf uintptr, count size_t) ssize_t {
 
 // ssize_t readlink(const char *pathname, char *buf, size_t bufsiz);
 func Xreadlink(tls *TLS, pathname, buf uintptr, bufsiz size_t) ssize_t {
-	panic("TODO readlink")
+	r, _, err := syscall.Syscall(syscall.SYS_READLINK, pathname, buf, uintptr(bufsiz))
+	if strace {
+		fmt.Fprintf(os.Stderr, "readlink(%q, %#x, %v) %v %v\n", GoString(pathname), buf, bufsiz, r, err)
+	}
+	if err != 0 {
+		tls.setErrno(err)
+	}
+	return ssize_t(r)
 }
 
 // long sysconf(int name);
@@ -0,0 +1,1069 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+	"unsafe"
+)
+
+// The JSON1 extension.
+//
+// Scalar functions
+//
+//	json(X)
+//	json_array(V...)
+//	json_array_length(X [, P])
+//	json_extract(X, P...)
+//	json_insert(X, P, V, ...)
+//	json_object(K, V, ...)
+//	json_patch(T, P)
+//	json_quote(V)
+//	json_remove(X, P...)
+//	json_replace(X, P, V, ...)
+//	json_set(X, P, V, ...)
+//	json_type(X [, P])
+//	json_valid(X)
+//
+// aggregate functions
+//
+//	json_group_array(V)
+//	json_group_object(K, V)
+//
+// and the json_each and json_tree table-valued functions behave like those of
+// upstream SQLite. Paths are of the form $.key, $."key", $[N], $[#] and
+// $[#-N]. JSON produced by one of the functions is marked with the JSON
+// subtype, so it is embedded, not quoted, when passed to another one.
+
+const (
+	jsonNull = iota
+	jsonTrue
+	jsonFalse
+	jsonInt
+	jsonReal
+	jsonString
+	jsonArray
+	jsonObject
+)
+
+const (
+	jsonSubtype  = 'J'
+	jsonMaxDepth = 2000
+)
+
+var jsonTypeNames = [...]string{
+	jsonNull:   "null",
+	jsonTrue:   "true",
+	jsonFalse:  "false",
+	jsonInt:    "integer",
+	jsonReal:   "real",
+	jsonString: "text",
+	jsonArray:  "array",
+	jsonObject: "object",
+}
+
+var (
+	errJSONMalformed = errors.New("malformed JSON")
+	errJSONBlob      = errors.New("JSON cannot hold BLOB values")
+)
+
+// jsonNode is a parsed JSON value. Numbers and strings keep their JSON text
+// so rendering a parsed value reproduces the input, minus the white space.
+type jsonNode struct {
+	typ   int
+	raw   string      // JSON text of numbers and strings.
+	keys  []string    // JSON text of the object member names.
+	elems []*jsonNode // Array elements or object member values.
+	id    int         // Position in the parsed text, see jsonParser.
+}
+
+type jsonParser struct {
+	s   string
+	pos int
+	id  int // Number of nodes seen, member names count as nodes.
+}
+
+// jsonParse parses s. The ids of the nodes are assigned in document order,
+// member names included, like the node numbers of upstream SQLite.
+func jsonParse(s string) (*jsonNode, error) {
+	p := &jsonParser{s: s}
+	p.space()
+	n := p.value(0)
+	p.space()
+	if n == nil || p.pos != len(p.s) {
+		return nil, errJSONMalformed
+	}
+
+	return n, nil
+}
+
+func (p *jsonParser) space() {
+	for p.pos < len(p.s) {
+		switch p.s[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *jsonParser) literal(s string) bool {
+	if !strings.HasPrefix(p.s[p.pos:], s) {
+		return false
+	}
+
+	p.pos += len(s)
+	return true
+}
+
+func (p *jsonParser) value(depth int) *jsonNode {
+	if p.pos == len(p.s) || depth > jsonMaxDepth {
+		return nil
+	}
+
+	n := &jsonNode{id: p.id}
+	p.id++
+	switch c := p.s[p.pos]; {
+	case c == '{':
+		n.typ = jsonObject
+		p.pos++
+		p.space()
+		if p.literal("}") {
+			return n
+		}
+
+		for {
+			p.id++ // The member name.
+			k := p.string()
+			if k == "" {
+				return nil
+			}
+
+			p.space()
+			if !p.literal(":") {
+				return nil
+			}
+
+			p.space()
+			v := p.value(depth + 1)
+			if v == nil {
+				return nil
+			}
+
+			n.keys = append(n.keys, k)
+			n.elems = append(n.elems, v)
+			p.space()
+			if p.literal("}") {
+				return n
+			}
+
+			if !p.literal(",") {
+				return nil
+			}
+
+			p.space()
+		}
+	case c == '[':
+		n.typ = jsonArray
+		p.pos++
+		p.space()
+		if p.literal("]") {
+			return n
+		}
+
+		for {
+			v := p.value(depth + 1)
+			if v == nil {
+				return nil
+			}
+
+			n.elems = append(n.elems, v)
+			p.space()
+			if p.literal("]") {
+				return n
+			}
+
+			if !p.literal(",") {
+				return nil
+			}
+
+			p.space()
+		}
+	case c == '"':
+		n.typ = jsonString
+		if n.raw = p.string(); n.raw == "" {
+			return nil
+		}
+	case c == 'n' && p.literal("null"):
+		n.typ = jsonNull
+	case c == 't' && p.literal("true"):
+		n.typ = jsonTrue
+	case c == 'f' && p.literal("false"):
+		n.typ = jsonFalse
+	case c == '-' || c >= '0' && c <= '9':
+		if n.typ, n.raw = p.number(); n.raw == "" {
+			return nil
+		}
+	default:
+		return nil
+	}
+	return n
+}
+
+// string scans a string and returns its JSON text or "" if it is malformed.
+func (p *jsonParser) string() string {
+	start := p.pos
+	if !p.literal(`"`) {
+		return ""
+	}
+
+	for p.pos < len(p.s) {
+		c := p.s[p.pos]
+		p.pos++
+		switch {
+		case c == '"':
+			return p.s[start:p.pos]
+		case c < 0x20:
+			return ""
+		case c == '\\':
+			if p.pos == len(p.s) {
+				return ""
+			}
+
+			c = p.s[p.pos]
+			p.pos++
+			switch c {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				// ok
+			case 'u':
+				if p.pos+4 > len(p.s) {
+					return ""
+				}
+
+				if _, err := strconv.ParseUint(p.s[p.pos:p.pos+4], 16, 16); err != nil {
+					return ""
+				}
+
+				p.pos += 4
+			default:
+				return ""
+			}
+		}
+	}
+	return ""
+}
+
+// number scans a number and returns its type and JSON text or "" if it is
+// malformed.
+func (p *jsonParser) number() (int, string) {
+	start := p.pos
+	digits := func() int {
+		n := 0
+		for p.pos < len(p.s) && p.s[p.pos] >= '0' && p.s[p.pos] <= '9' {
+			p.pos++
+			n++
+		}
+		return n
+	}
+
+	typ := jsonInt
+	p.literal("-")
+	switch {
+	case p.literal("0"):
+		// Leading zeros are not allowed.
+	case digits() == 0:
+		return 0, ""
+	}
+
+	if p.literal(".") {
+		typ = jsonReal
+		if digits() == 0 {
+			return 0, ""
+		}
+	}
+
+	if p.literal("e") || p.literal("E") {
+		typ = jsonReal
+		if !p.literal("+") {
+			p.literal("-")
+		}
+		if digits() == 0 {
+			return 0, ""
+		}
+	}
+
+	return typ, p.s[start:p.pos]
+}
+
+var jsonEscapes = [0x20]byte{'\b': 'b', '\t': 't', '\n': 'n', '\f': 'f', '\r': 'r'}
+
+// jsonQuote returns s as a JSON string.
+func jsonQuote(s string) string {
+	var b bytes.Buffer
+	b.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20:
+			if e := jsonEscapes[c]; e != 0 {
+				b.WriteByte('\\')
+				b.WriteByte(e)
+				break
+			}
+
+			fmt.Fprintf(&b, "\\u%04x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// jsonUnquote returns the value of the JSON string s.
+func jsonUnquote(s string) string {
+	s = s[1 : len(s)-1]
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c != '\\' {
+			b = append(b, c)
+			continue
+		}
+
+		i++
+		switch c = s[i]; c {
+		case 'b':
+			b = append(b, '\b')
+		case 'f':
+			b = append(b, '\f')
+		case 'n':
+			b = append(b, '\n')
+		case 'r':
+			b = append(b, '\r')
+		case 't':
+			b = append(b, '\t')
+		case 'u':
+			r, _ := strconv.ParseUint(s[i+1:i+5], 16, 16)
+			i += 4
+			if utf16.IsSurrogate(rune(r)) && i+6 < len(s) && s[i+1] == '\\' && s[i+2] == 'u' {
+				if r2, err := strconv.ParseUint(s[i+3:i+7], 16, 16); err == nil {
+					if x := utf16.DecodeRune(rune(r), rune(r2)); x != utf8.RuneError {
+						r = uint64(x)
+						i += 6
+					}
+				}
+			}
+			var buf [utf8.UTFMax]byte
+			b = append(b, buf[:utf8.EncodeRune(buf[:], rune(r))]...)
+		default:
+			b = append(b, c)
+		}
+	}
+	return string(b)
+}
+
+func (n *jsonNode) render(b *bytes.Buffer) {
+	switch n.typ {
+	case jsonNull, jsonTrue, jsonFalse:
+		b.WriteString(jsonTypeNames[n.typ])
+	case jsonInt, jsonReal, jsonString:
+		b.WriteString(n.raw)
+	case jsonArray:
+		b.WriteByte('[')
+		for i, v := range n.elems {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			v.render(b)
+		}
+		b.WriteByte(']')
+	case jsonObject:
+		b.WriteByte('{')
+		for i, v := range n.elems {
+			if i != 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(n.keys[i])
+			b.WriteByte(':')
+			v.render(b)
+		}
+		b.WriteByte('}')
+	}
+}
+
+func (n *jsonNode) String() string {
+	var b bytes.Buffer
+	n.render(&b)
+	return b.String()
+}
+
+// jsonPathStep is a component of a JSON path.
+type jsonPathStep struct {
+	key     string // Member name if isKey.
+	isKey   bool
+	index   int  // Array index, counted from the end if fromEnd.
+	fromEnd bool // [#-index]
+}
+
+// jsonParsePath parses the JSON path s.
+func jsonParsePath(s string) ([]jsonPathStep, error) {
+	if !strings.HasPrefix(s, "$") {
+		return nil, jsonPathError(s)
+	}
+
+	var r []jsonPathStep
+	for i := 1; i < len(s); {
+		start := i
+		switch s[i] {
+		case '.':
+			i++
+			var key string
+			switch {
+			case i < len(s) && s[i] == '"':
+				j := strings.IndexByte(s[i+1:], '"')
+				if j < 0 {
+					return nil, jsonPathError(s[start:])
+				}
+
+				key = s[i+1 : i+1+j]
+				i += j + 2
+			default:
+				j := i
+				for j < len(s) && s[j] != '.' && s[j] != '[' {
+					j++
+				}
+				if j == i {
+					return nil, jsonPathError(s[start:])
+				}
+
+				key = s[i:j]
+				i = j
+			}
+			r = append(r, jsonPathStep{key: key, isKey: true})
+		case '[':
+			i++
+			var step jsonPathStep
+			digits := true
+			if i < len(s) && s[i] == '#' {
+				step.fromEnd = true
+				i++
+				digits = i < len(s) && s[i] == '-'
+				if digits {
+					i++
+				}
+			}
+			j := i
+			for j < len(s) && s[j] >= '0' && s[j] <= '9' {
+				j++
+			}
+			if digits != (j != i) || j == len(s) || s[j] != ']' {
+				return nil, jsonPathError(s[start:])
+			}
+
+			if j != i {
+				n, err := strconv.Atoi(s[i:j])
+				if err != nil {
+					return nil, jsonPathError(s[start:])
+				}
+
+				step.index = n
+			}
+			r = append(r, step)
+			i = j + 1
+		default:
+			return nil, jsonPathError(s[start:])
+		}
+	}
+	return r, nil
+}
+
+func jsonPathError(near string) error { return fmt.Errorf("JSON path error near '%s'", near) }
+
+// position returns the array index addressed by s in the array n.
+func (s *jsonPathStep) position(n *jsonNode) int {
+	if s.fromEnd {
+		return len(n.elems) - s.index
+	}
+
+	return s.index
+}
+
+// child returns the index of the child of n addressed by s or -1 if there is
+// none.
+func (n *jsonNode) child(s *jsonPathStep) int {
+	switch {
+	case s.isKey && n.typ == jsonObject:
+		for i, v := range n.keys {
+			if jsonUnquote(v) == s.key {
+				return i
+			}
+		}
+	case !s.isKey && n.typ == jsonArray:
+		if i := s.position(n); i >= 0 && i < len(n.elems) {
+			return i
+		}
+	}
+	return -1
+}
+
+// lookup returns the node at path below n or nil if there is none.
+func (n *jsonNode) lookup(path []jsonPathStep) *jsonNode {
+	for i := range path {
+		j := n.child(&path[i])
+		if j < 0 {
+			return nil
+		}
+
+		n = n.elems[j]
+	}
+	return n
+}
+
+// Edit operations.
+const (
+	jsonEditInsert = iota
+	jsonEditRemove
+	jsonEditReplace
+	jsonEditSet
+)
+
+// jsonEdit applies op with the value v to the node at path below *pn.
+// Removing the root sets *pn to nil.
+func jsonEdit(pn **jsonNode, path []jsonPathStep, op int, v *jsonNode) {
+	n := *pn
+	if len(path) == 0 {
+		switch op {
+		case jsonEditRemove:
+			*pn = nil
+		case jsonEditReplace, jsonEditSet:
+			*pn = v
+		}
+		return
+	}
+
+	s := &path[0]
+	if i := n.child(s); i >= 0 {
+		if op == jsonEditRemove && len(path) == 1 {
+			n.elems = append(n.elems[:i], n.elems[i+1:]...)
+			if n.typ == jsonObject {
+				n.keys = append(n.keys[:i], n.keys[i+1:]...)
+			}
+			return
+		}
+
+		jsonEdit(&n.elems[i], path[1:], op, v)
+		return
+	}
+
+	if op != jsonEditInsert && op != jsonEditSet {
+		return
+	}
+
+	c := jsonCreate(path[1:], v)
+	switch {
+	case c == nil:
+		// Cannot create the missing path.
+	case s.isKey && n.typ == jsonObject:
+		n.keys = append(n.keys, jsonQuote(s.key))
+		n.elems = append(n.elems, c)
+	case !s.isKey && n.typ == jsonArray && s.position(n) == len(n.elems):
+		n.elems = append(n.elems, c)
+	}
+}
+
+// jsonCreate returns v nested in new containers such that it is at path or
+// nil if path cannot be created.
+func jsonCreate(path []jsonPathStep, v *jsonNode) *jsonNode {
+	if len(path) == 0 {
+		return v
+	}
+
+	c := jsonCreate(path[1:], v)
+	switch s := path[0]; {
+	case c == nil:
+		return nil
+	case s.isKey:
+		return &jsonNode{typ: jsonObject, keys: []string{jsonQuote(s.key)}, elems: []*jsonNode{c}}
+	case s.index == 0:
+		return &jsonNode{typ: jsonArray, elems: []*jsonNode{c}}
+	}
+	return nil
+}
+
+// jsonPatch applies the RFC 7396 merge patch p to t.
+func jsonPatch(t, p *jsonNode) *jsonNode {
+	if p.typ != jsonObject {
+		return p
+	}
+
+	if t.typ != jsonObject {
+		t = &jsonNode{typ: jsonObject}
+	}
+	for i, k := range p.keys {
+		v := p.elems[i]
+		j := t.child(&jsonPathStep{key: jsonUnquote(k), isKey: true})
+		switch {
+		case v.typ == jsonNull:
+			if j >= 0 {
+				t.keys = append(t.keys[:j], t.keys[j+1:]...)
+				t.elems = append(t.elems[:j], t.elems[j+1:]...)
+			}
+		case j >= 0:
+			t.elems[j] = jsonPatch(t.elems[j], v)
+		default:
+			t.keys = append(t.keys, k)
+			t.elems = append(t.elems, jsonPatch(&jsonNode{typ: jsonNull}, v))
+		}
+	}
+	return t
+}
+
+// jsonValue returns the JSON representation of the SQL value v. Text marked
+// as JSON is parsed, other text becomes a JSON string.
+func jsonValue(tls TLS, v uintptr) (*jsonNode, error) {
+	switch Xsqlite3_value_type(tls, v) {
+	case sqliteInteger:
+		return &jsonNode{typ: jsonInt, raw: goString(Xsqlite3_value_text(tls, v))}, nil
+	case sqliteFloat:
+		return &jsonNode{typ: jsonReal, raw: goString(Xsqlite3_value_text(tls, v))}, nil
+	case sqliteText:
+		s := valueText(tls, v)
+		if Xsqlite3_value_subtype(tls, v) == jsonSubtype {
+			if n, err := jsonParse(s); err == nil {
+				return n, nil
+			}
+		}
+
+		return &jsonNode{typ: jsonString, raw: jsonQuote(s)}, nil
+	case sqliteBlob:
+		return nil, errJSONBlob
+	}
+	return &jsonNode{typ: jsonNull}, nil
+}
+
+// jsonResult sets the result of ctx to s marked as JSON.
+func jsonResult(tls TLS, ctx uintptr, s string) {
+	resultText(tls, ctx, s)
+	Xsqlite3_result_subtype(tls, ctx, jsonSubtype)
+}
+
+// jsonResultNode sets the result of ctx to the SQL value of n. Arrays and
+// objects are returned as JSON.
+func jsonResultNode(tls TLS, ctx uintptr, n *jsonNode) {
+	switch n.typ {
+	case jsonNull:
+		Xsqlite3_result_null(tls, ctx)
+	case jsonTrue:
+		Xsqlite3_result_int(tls, ctx, 1)
+	case jsonFalse:
+		Xsqlite3_result_int(tls, ctx, 0)
+	case jsonInt:
+		if i, err := strconv.ParseInt(n.raw, 10, 64); err == nil {
+			Xsqlite3_result_int64(tls, ctx, i)
+			break
+		}
+
+		fallthrough
+	case jsonReal:
+		f, _ := strconv.ParseFloat(n.raw, 64)
+		Xsqlite3_result_double(tls, ctx, f)
+	case jsonString:
+		resultText(tls, ctx, jsonUnquote(n.raw))
+	default:
+		jsonResult(tls, ctx, n.String())
+	}
+}
+
+var jsonFuncs = []struct {
+	name string
+	nArg int32
+	fn   func(TLS, uintptr, int32, uintptr)
+}{
+	{"json", 1, jsonFunc},
+	{"json_array", -1, jsonArrayFunc},
+	{"json_array_length", 1, jsonArrayLengthFunc},
+	{"json_array_length", 2, jsonArrayLengthFunc},
+	{"json_extract", -1, jsonExtractFunc},
+	{"json_insert", -1, jsonInsertFunc},
+	{"json_object", -1, jsonObjectFunc},
+	{"json_patch", 2, jsonPatchFunc},
+	{"json_quote", 1, jsonQuoteFunc},
+	{"json_remove", -1, jsonRemoveFunc},
+	{"json_replace", -1, jsonReplaceFunc},
+	{"json_set", -1, jsonSetFunc},
+	{"json_type", 1, jsonTypeFunc},
+	{"json_type", 2, jsonTypeFunc},
+	{"json_valid", 1, jsonValidFunc},
+}
+
+// Xsqlite3_json_init registers the JSON functions and the json_each and
+// json_tree modules with db.
+func Xsqlite3_json_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	for _, v := range jsonFuncs {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_function(tls, db, zName, v.nArg, sqliteUTF8|sqliteDeterministic, 0, cfnFunc(v.fn), 0, 0)
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	for _, v := range []struct {
+		name string
+		nArg int32
+	}{
+		{"json_group_array", 1},
+		{"json_group_object", 2},
+	} {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_function(tls, db, zName, v.nArg, sqliteUTF8|sqliteDeterministic, uintptr(v.nArg), 0, cfnFunc(jsonGroupStep), cfnFinal(jsonGroupFinal))
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return jsonEachRegister(tls, db)
+}
+
+// jsonArg returns the parsed i-th argument. If it is NULL or malformed, the
+// result of ctx is set to NULL or to the error and jsonArg returns nil.
+func jsonArg(tls TLS, ctx uintptr, args uintptr, i int) *jsonNode {
+	v := argv(args, i)
+	if Xsqlite3_value_type(tls, v) == sqliteNull {
+		Xsqlite3_result_null(tls, ctx)
+		return nil
+	}
+
+	n, err := jsonParse(valueText(tls, v))
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return nil
+	}
+
+	return n
+}
+
+// jsonPathArg returns the parsed i-th argument as a path. On error the result
+// of ctx is set to the error and ok is false.
+func jsonPathArg(tls TLS, ctx uintptr, args uintptr, i int) (path []jsonPathStep, ok bool) {
+	path, err := jsonParsePath(valueText(tls, argv(args, i)))
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return nil, false
+	}
+
+	return path, true
+}
+
+func jsonFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if n := jsonArg(tls, ctx, args, 0); n != nil {
+		jsonResult(tls, ctx, n.String())
+	}
+}
+
+func jsonArrayFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	a := &jsonNode{typ: jsonArray}
+	for i := 0; i < int(argc); i++ {
+		v, err := jsonValue(tls, argv(args, i))
+		if err != nil {
+			resultError(tls, ctx, err.Error())
+			return
+		}
+
+		a.elems = append(a.elems, v)
+	}
+	jsonResult(tls, ctx, a.String())
+}
+
+func jsonArrayLengthFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	if argc > 1 {
+		path, ok := jsonPathArg(tls, ctx, args, 1)
+		if !ok {
+			return
+		}
+
+		if n = n.lookup(path); n == nil {
+			Xsqlite3_result_null(tls, ctx)
+			return
+		}
+	}
+
+	var r int64
+	if n.typ == jsonArray {
+		r = int64(len(n.elems))
+	}
+	Xsqlite3_result_int64(tls, ctx, r)
+}
+
+func jsonExtractFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if argc < 2 {
+		return
+	}
+
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	a := &jsonNode{typ: jsonArray}
+	for i := 1; i < int(argc); i++ {
+		path, ok := jsonPathArg(tls, ctx, args, i)
+		if !ok {
+			return
+		}
+
+		v := n.lookup(path)
+		if argc == 2 {
+			if v == nil {
+				Xsqlite3_result_null(tls, ctx)
+				return
+			}
+
+			jsonResultNode(tls, ctx, v)
+			return
+		}
+
+		if v == nil {
+			v = &jsonNode{typ: jsonNull}
+		}
+		a.elems = append(a.elems, v)
+	}
+	jsonResult(tls, ctx, a.String())
+}
+
+func jsonObjectFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if argc&1 != 0 {
+		resultError(tls, ctx, "json_object() requires an even number of arguments")
+		return
+	}
+
+	o := &jsonNode{typ: jsonObject}
+	for i := 0; i < int(argc); i += 2 {
+		if Xsqlite3_value_type(tls, argv(args, i)) != sqliteText {
+			resultError(tls, ctx, "json_object() labels must be TEXT")
+			return
+		}
+
+		v, err := jsonValue(tls, argv(args, i+1))
+		if err != nil {
+			resultError(tls, ctx, err.Error())
+			return
+		}
+
+		o.keys = append(o.keys, jsonQuote(valueText(tls, argv(args, i))))
+		o.elems = append(o.elems, v)
+	}
+	jsonResult(tls, ctx, o.String())
+}
+
+func jsonPatchFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	t := jsonArg(tls, ctx, args, 0)
+	if t == nil {
+		return
+	}
+
+	p := jsonArg(tls, ctx, args, 1)
+	if p == nil {
+		return
+	}
+
+	jsonResult(tls, ctx, jsonPatch(t, p).String())
+}
+
+func jsonQuoteFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	v, err := jsonValue(tls, argv(args, 0))
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return
+	}
+
+	jsonResult(tls, ctx, v.String())
+}
+
+func jsonRemoveFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	if argc < 1 {
+		return
+	}
+
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	for i := 1; i < int(argc); i++ {
+		path, ok := jsonPathArg(tls, ctx, args, i)
+		if !ok {
+			return
+		}
+
+		if jsonEdit(&n, path, jsonEditRemove, nil); n == nil {
+			Xsqlite3_result_null(tls, ctx)
+			return
+		}
+	}
+	jsonResult(tls, ctx, n.String())
+}
+
+func jsonInsertFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	jsonEditFunc(tls, ctx, argc, args, "insert", jsonEditInsert)
+}
+
+func jsonReplaceFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	jsonEditFunc(tls, ctx, argc, args, "replace", jsonEditReplace)
+}
+
+func jsonSetFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	jsonEditFunc(tls, ctx, argc, args, "set", jsonEditSet)
+}
+
+func jsonEditFunc(tls TLS, ctx uintptr, argc int32, args uintptr, name string, op int) {
+	if argc < 1 {
+		return
+	}
+
+	if argc&1 == 0 {
+		resultError(tls, ctx, fmt.Sprintf("json_%s() needs an odd number of arguments", name))
+		return
+	}
+
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	for i := 1; i < int(argc); i += 2 {
+		path, ok := jsonPathArg(tls, ctx, args, i)
+		if !ok {
+			return
+		}
+
+		v, err := jsonValue(tls, argv(args, i+1))
+		if err != nil {
+			resultError(tls, ctx, err.Error())
+			return
+		}
+
+		jsonEdit(&n, path, op, v)
+	}
+	jsonResult(tls, ctx, n.String())
+}
+
+func jsonTypeFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	n := jsonArg(tls, ctx, args, 0)
+	if n == nil {
+		return
+	}
+
+	if argc > 1 {
+		path, ok := jsonPathArg(tls, ctx, args, 1)
+		if !ok {
+			return
+		}
+
+		if n = n.lookup(path); n == nil {
+			Xsqlite3_result_null(tls, ctx)
+			return
+		}
+	}
+
+	resultText(tls, ctx, jsonTypeNames[n.typ])
+}
+
+func jsonValidFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	v := argv(args, 0)
+	if Xsqlite3_value_type(tls, v) == sqliteNull {
+		Xsqlite3_result_null(tls, ctx)
+		return
+	}
+
+	var r int32
+	if _, err := jsonParse(valueText(tls, v)); err == nil {
+		r = 1
+	}
+	Xsqlite3_result_int(tls, ctx, r)
+}
+
+// jsonGroup is the state of json_group_array and json_group_object. The
+// user data of the functions is their number of arguments.
+type jsonGroup struct {
+	b   bytes.Buffer
+	err error
+}
+
+func jsonGroupStep(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	p := Xsqlite3_aggregate_context(tls, ctx, int32(ptrSize))
+	if p == 0 {
+		Xsqlite3_result_error_nomem(tls, ctx)
+		return
+	}
+
+	var g *jsonGroup
+	switch {
+	case *(*uintptr)(unsafe.Pointer(p)) == 0:
+		*(*uintptr)(unsafe.Pointer(p)) = 1
+		g = &jsonGroup{}
+		putObject(p, g)
+	default:
+		g = getObject(p).(*jsonGroup)
+		g.b.WriteByte(',')
+	}
+	if g.err != nil {
+		return
+	}
+
+	if argc == 2 {
+		g.b.WriteString(jsonQuote(valueText(tls, argv(args, 0))))
+		g.b.WriteByte(':')
+	}
+	v, err := jsonValue(tls, argv(args, int(argc-1)))
+	if err != nil {
+		g.err = err
+		return
+	}
+
+	v.render(&g.b)
+}
+
+func jsonGroupFinal(tls TLS, ctx uintptr) {
+	lb, rb := "[", "]"
+	if Xsqlite3_user_data(tls, ctx) == 2 {
+		lb, rb = "{", "}"
+	}
+	var g *jsonGroup
+	if p := Xsqlite3_aggregate_context(tls, ctx, 0); p != 0 {
+		g, _ = getObject(p).(*jsonGroup)
+		deleteObject(p)
+	}
+	switch {
+	case g == nil:
+		jsonResult(tls, ctx, lb+rb)
+	case g.err != nil:
+		resultError(tls, ctx, g.err.Error())
+	default:
+		jsonResult(tls, ctx, lb+g.b.String()+rb)
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// The json_each and json_tree table-valued functions.
+//
+//	SELECT key, value, type, atom, id, parent, fullkey, path
+//	FROM json_each($json [, $root]);
+//
+// json_each lists the elements of the array or object at $root, default '$',
+// json_tree walks the value at $root and everything below it, depth first.
+
+const jsonEachSchema = "CREATE TABLE x(key,value,type,atom,id,parent,fullkey,path,json HIDDEN,root HIDDEN)"
+
+const (
+	jsonEachColumnKey = iota
+	jsonEachColumnValue
+	jsonEachColumnType
+	jsonEachColumnAtom
+	jsonEachColumnID
+	jsonEachColumnParent
+	jsonEachColumnFullkey
+	jsonEachColumnPath
+	jsonEachColumnJSON
+	jsonEachColumnRoot
+)
+
+var jsonEachModule = Ssqlite3_module{
+	XxConnect:    cfnConnect(jsonEachConnect),
+	XxBestIndex:  cfnVtab2(jsonEachBestIndex),
+	XxDisconnect: cfnVtab(jsonEachDisconnect),
+	XxOpen:       cfnVtab2(jsonEachOpen),
+	XxClose:      cfnVtab(jsonEachClose),
+	XxFilter:     cfnFilter(jsonEachFilter),
+	XxNext:       cfnVtab(jsonEachNext),
+	XxEof:        cfnVtab(jsonEachEof),
+	XxColumn:     cfnColumn(jsonEachColumn),
+	XxRowid:      cfnVtab2(jsonEachRowid),
+}
+
+// jsonEachRow is a row of json_each or json_tree.
+type jsonEachRow struct {
+	n       *jsonNode
+	key     interface{} // Member name, array index or nil.
+	parent  int         // Id of the container, -1 if none.
+	fullkey string
+	path    string
+}
+
+type jsonEachCursor struct {
+	recursive bool
+	json      string
+	root      string
+	rows      []jsonEachRow
+	i         int
+}
+
+// jsonEachRegister registers the json_each and json_tree modules with db. The
+// client data of json_tree is 1.
+func jsonEachRegister(tls TLS, db uintptr) int32 {
+	for i, v := range []string{"json_each", "json_tree"} {
+		zName := cString(tls, v)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(&jsonEachModule)), uintptr(i))
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+func jsonEachConnect(tls TLS, db, pAux uintptr, argc int32, argv, ppVtab, pzErr uintptr) int32 {
+	zSchema := cString(tls, jsonEachSchema)
+	if zSchema == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, pAux != 0)
+	return sqliteOK
+}
+
+func jsonEachDisconnect(tls TLS, tab uintptr) int32 {
+	deleteObject(tab)
+	Xsqlite3_free(tls, tab)
+	return sqliteOK
+}
+
+// jsonEachBestIndex uses equality constraints on the hidden json and root
+// columns.
+//
+//	idxNum	meaning
+//	0	no usable json constraint, the result is empty
+//	1	argv[0] is json
+//	2	argv[0] is json, argv[1] is root
+func jsonEachBestIndex(tls TLS, tab, pIdxInfo uintptr) int32 {
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	iJSON, iRoot := -1, -1
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		if c.Xusable == 0 || c.Xop != sqliteIndexConstraintEQ {
+			continue
+		}
+
+		switch c.XiColumn {
+		case jsonEachColumnJSON:
+			iJSON = i
+		case jsonEachColumnRoot:
+			iRoot = i
+		}
+	}
+	if iJSON < 0 {
+		info.XidxNum = 0
+		info.XestimatedCost = 1e99
+		return sqliteOK
+	}
+
+	u := indexConstraintUsage(info, iJSON)
+	u.XargvIndex = 1
+	u.Xomit = 1
+	info.XidxNum = 1
+	info.XestimatedCost = 1
+	if iRoot >= 0 {
+		u = indexConstraintUsage(info, iRoot)
+		u.XargvIndex = 2
+		u.Xomit = 1
+		info.XidxNum = 2
+	}
+	return sqliteOK
+}
+
+func jsonEachOpen(tls TLS, tab, ppCursor uintptr) int32 {
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, &jsonEachCursor{recursive: getObject(tab).(bool)})
+	return sqliteOK
+}
+
+func jsonEachClose(tls TLS, cur uintptr) int32 {
+	deleteObject(cur)
+	Xsqlite3_free(tls, cur)
+	return sqliteOK
+}
+
+func jsonEachFilter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) int32 {
+	c := getObject(cur).(*jsonEachCursor)
+	*c = jsonEachCursor{recursive: c.recursive, root: "$"}
+	if idxNum == 0 || Xsqlite3_value_type(tls, argv(args, 0)) == sqliteNull {
+		return sqliteOK
+	}
+
+	tab := (*Ssqlite3_vtab_cursor)(unsafe.Pointer(cur)).XpVtab
+	c.json = valueText(tls, argv(args, 0))
+	n, err := jsonParse(c.json)
+	if err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	var path []jsonPathStep
+	if idxNum == 2 && Xsqlite3_value_type(tls, argv(args, 1)) != sqliteNull {
+		c.root = valueText(tls, argv(args, 1))
+		if path, err = jsonParsePath(c.root); err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+	}
+	doc := n
+	if n = n.lookup(path); n == nil {
+		return sqliteOK
+	}
+
+	if !c.recursive {
+		if n.typ != jsonArray && n.typ != jsonObject {
+			c.rows = append(c.rows, jsonEachRow{n: n, parent: -1, fullkey: c.root, path: c.root})
+			return sqliteOK
+		}
+
+		c.children(n, c.root, -1)
+		return sqliteOK
+	}
+
+	// The root row of json_tree.
+	row := jsonEachRow{n: n, parent: -1, fullkey: c.root, path: "$"}
+	if k := len(path) - 1; k >= 0 {
+		for _, v := range path[:k] {
+			row.path += jsonPathText(v)
+		}
+		switch s := path[k]; {
+		case s.isKey:
+			row.key = s.key
+		default:
+			row.key = int64(s.position(doc.lookup(path[:k])))
+		}
+	}
+	c.rows = append(c.rows, row)
+	c.children(n, c.root, -1)
+	return sqliteOK
+}
+
+// children appends the rows of the elements of the container n at path. The
+// elements of json_tree are followed by their descendants.
+func (c *jsonEachCursor) children(n *jsonNode, path string, parent int) {
+	if c.recursive {
+		parent = n.id
+	}
+	for i, v := range n.elems {
+		row := jsonEachRow{n: v, parent: parent, path: path}
+		switch n.typ {
+		case jsonObject:
+			k := jsonUnquote(n.keys[i])
+			row.key = k
+			row.fullkey = path + jsonPathText(jsonPathStep{key: k, isKey: true})
+		default:
+			row.key = int64(i)
+			row.fullkey = path + jsonPathText(jsonPathStep{index: i})
+		}
+		c.rows = append(c.rows, row)
+		if c.recursive && (v.typ == jsonArray || v.typ == jsonObject) {
+			c.children(v, row.fullkey, parent)
+		}
+	}
+}
+
+// jsonPathText returns the text of a path step. Member names which are not
+// simple identifiers are quoted.
+func jsonPathText(s jsonPathStep) string {
+	switch {
+	case !s.isKey && s.fromEnd:
+		if s.index == 0 {
+			return "[#]"
+		}
+
+		return fmt.Sprintf("[#-%d]", s.index)
+	case !s.isKey:
+		return fmt.Sprintf("[%d]", s.index)
+	}
+
+	for i := 0; i < len(s.key); i++ {
+		switch c := s.key[i]; {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c == '_', c >= '0' && c <= '9' && i != 0:
+			// ok
+		default:
+			return `."` + s.key + `"`
+		}
+	}
+	if s.key == "" {
+		return `.""`
+	}
+
+	return "." + s.key
+}
+
+func jsonEachNext(tls TLS, cur uintptr) int32 {
+	getObject(cur).(*jsonEachCursor).i++
+	return sqliteOK
+}
+
+func jsonEachEof(tls TLS, cur uintptr) int32 {
+	if c := getObject(cur).(*jsonEachCursor); c.i >= len(c.rows) {
+		return 1
+	}
+
+	return 0
+}
+
+func jsonEachColumn(tls TLS, cur, ctx uintptr, i int32) int32 {
+	c := getObject(cur).(*jsonEachCursor)
+	row := &c.rows[c.i]
+	switch i {
+	case jsonEachColumnKey:
+		resultValue(tls, ctx, row.key)
+	case jsonEachColumnValue:
+		jsonResultNode(tls, ctx, row.n)
+	case jsonEachColumnType:
+		resultText(tls, ctx, jsonTypeNames[row.n.typ])
+	case jsonEachColumnAtom:
+		if row.n.typ != jsonArray && row.n.typ != jsonObject {
+			jsonResultNode(tls, ctx, row.n)
+		}
+	case jsonEachColumnID:
+		Xsqlite3_result_int64(tls, ctx, int64(row.n.id))
+	case jsonEachColumnParent:
+		if row.parent >= 0 {
+			Xsqlite3_result_int64(tls, ctx, int64(row.parent))
+		}
+	case jsonEachColumnFullkey:
+		resultText(tls, ctx, row.fullkey)
+	case jsonEachColumnPath:
+		resultText(tls, ctx, row.path)
+	case jsonEachColumnJSON:
+		resultText(tls, ctx, c.json)
+	case jsonEachColumnRoot:
+		resultText(tls, ctx, c.root)
+	}
+	return sqliteOK
+}
+
+func jsonEachRowid(tls TLS, cur, pRowid uintptr) int32 {
+	*(*int64)(unsafe.Pointer(pRowid)) = int64(getObject(cur).(*jsonEachCursor).i)
+	return sqliteOK
+}
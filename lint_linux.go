@@ -0,0 +1,652 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Schema lint rules.
+//
+//	.lint ?--json? ?--sample N? all|RULE ...
+//
+//	all               All the rules below
+//	autoincrement     Tables using AUTOINCREMENT, sqlite_sequence out of step
+//	column-type       Columns without a type or with a type of odd affinity
+//	fkey-indexes      Foreign keys without an index on the child columns
+//	fkey-parent       Foreign keys whose parent key is not PRIMARY or UNIQUE
+//	mixed-types       Columns holding text and values of other types
+//	no-primary-key    Tables without a PRIMARY KEY
+//	redundant-index   Indexes made redundant by another index
+//
+// mixed-types samples the first N rows of each table, 1000 by default or all
+// of them if N is zero. Columns of TEXT affinity hold numbers as text, so it
+// is mostly about columns of other affinities, like STRING, which keep what
+// does not look like a number as text.
+//
+// Every issue has a severity: an error breaks statements, a warning is likely
+// a mistake and an info is worth a look. .lint fails if it finds an error or
+// a warning, so a script run with -bail stops. With --json, every issue is
+// written as a JSON object on a line of its own.
+//
+// .lint fkey-indexes with no options but --verbose and --groupbyparent is
+// run by the C shell, which writes the CREATE INDEX statements. With any
+// other option or rule, fkey-indexes is the rule above.
+
+type lintRule struct {
+	name string
+	help string
+	run  func(l *linter, t *lintTable) error
+}
+
+var lintRules = []*lintRule{
+	{"autoincrement", "Tables using AUTOINCREMENT, sqlite_sequence out of step", (*linter).autoincrement},
+	{"column-type", "Columns without a type or with a type of odd affinity", (*linter).columnType},
+	{"fkey-indexes", "Foreign keys without an index on the child columns", (*linter).fkeyIndexes},
+	{"fkey-parent", "Foreign keys whose parent key is not PRIMARY or UNIQUE", (*linter).fkeyParent},
+	{"mixed-types", "Columns holding text and values of other types", (*linter).mixedTypes},
+	{"no-primary-key", "Tables without a PRIMARY KEY", (*linter).noPrimaryKey},
+	{"redundant-index", "Indexes made redundant by another index", (*linter).redundantIndex},
+}
+
+// Issue severities.
+const (
+	lintError   = "error"
+	lintWarning = "warning"
+	lintInfo    = "info"
+)
+
+type lintIssue struct {
+	Rule     string `json:"rule"`
+	Severity string `json:"severity"`
+	Table    string `json:"table"`
+	Column   string `json:"column,omitempty"`
+	Index    string `json:"index,omitempty"`
+	Message  string `json:"message"`
+	Fix      string `json:"fix,omitempty"`
+}
+
+type lintColumn struct {
+	name string
+	typ  string
+	pk   int
+}
+
+type lintTable struct {
+	name         string
+	sql          string
+	withoutRowid bool
+	cols         []lintColumn
+}
+
+// pk returns the PRIMARY KEY columns of t in order.
+func (t *lintTable) pk() []string {
+	var r []string
+	for k := 1; ; k++ {
+		n := len(r)
+		for _, v := range t.cols {
+			if v.pk == k {
+				r = append(r, v.name)
+			}
+		}
+		if len(r) == n {
+			return r
+		}
+	}
+}
+
+// rowidAlias returns the INTEGER PRIMARY KEY column of t, if any.
+func (t *lintTable) rowidAlias() string {
+	if pk := t.pk(); len(pk) == 1 && !t.withoutRowid {
+		for _, v := range t.cols {
+			if v.pk == 1 && strings.EqualFold(v.typ, "INTEGER") {
+				return v.name
+			}
+		}
+	}
+	return ""
+}
+
+type linter struct {
+	s      *shell
+	c      *sqlConn
+	rule   *lintRule
+	sample int
+	issues []lintIssue
+}
+
+func (l *linter) report(severity, table, format string, args ...interface{}) *lintIssue {
+	l.issues = append(l.issues, lintIssue{Rule: l.rule.name, Severity: severity, Table: table, Message: fmt.Sprintf(format, args...)})
+	return &l.issues[len(l.issues)-1]
+}
+
+// lintCommand runs .lint unless it is the fkey-indexes command of the C
+// shell, with no options but those of the C shell. It returns the
+// do_meta_command result and whether it did.
+func lintCommand(tls TLS, p uintptr, argc int32, args uintptr) (int32, bool) {
+	a := make([]string, argc-1)
+	for i := range a {
+		a[i] = goString(argv(args, i+1))
+	}
+	if len(a) != 0 && strings.HasPrefix("fkey-indexes", strings.ToLower(a[0])) {
+		c := true
+		for _, v := range a[1:] {
+			c = c && lintCOption(v)
+		}
+		if c {
+			return 0, false
+		}
+	}
+
+	s := &shell{tls, p}
+	l := &linter{s: s, sample: 1000}
+	asJSON := false
+	var rules []*lintRule
+	for i := 0; i < len(a); i++ {
+		switch v := a[i]; v {
+		case "-json", "--json":
+			asJSON = true
+		case "-sample", "--sample":
+			if i+1 == len(a) {
+				return lintUsage(s), true
+			}
+
+			i++
+			n, err := strconv.Atoi(a[i])
+			if err != nil || n < 0 {
+				return lintUsage(s), true
+			}
+
+			l.sample = n
+		case "all":
+			rules = append(rules, lintRules...)
+		default:
+			found := false
+			for _, r := range lintRules {
+				if strings.EqualFold(r.name, v) {
+					rules = append(rules, r)
+					found = true
+				}
+			}
+			if !found {
+				return lintUsage(s), true
+			}
+		}
+	}
+	if len(rules) == 0 {
+		return lintUsage(s), true
+	}
+
+	l.c = s.conn()
+	tables, err := l.tables()
+	if err != nil {
+		s.eprintf("Error: %v\n", err)
+		return 1, true
+	}
+
+	seen := map[*lintRule]bool{}
+	for _, r := range rules {
+		if seen[r] {
+			continue
+		}
+
+		seen[r] = true
+		l.rule = r
+		for _, t := range tables {
+			if err := r.run(l, t); err != nil {
+				s.eprintf("Error: %s: %v\n", t.name, err)
+				return 1, true
+			}
+		}
+	}
+
+	rc := int32(0)
+	for _, v := range l.issues {
+		if v.Severity != lintInfo {
+			rc = 1
+		}
+		if asJSON {
+			b, err := json.Marshal(v)
+			if err != nil {
+				s.eprintf("Error: %v\n", err)
+				return 1, true
+			}
+
+			s.printf("%s\n", b)
+			continue
+		}
+
+		object := v.Table
+		switch {
+		case v.Column != "":
+			object += "." + v.Column
+		case v.Index != "":
+			object = fmt.Sprintf("index %s on %s", v.Index, v.Table)
+		}
+		s.printf("%s: %s: %s [%s]\n", v.Severity, object, v.Message, v.Rule)
+		if v.Fix != "" {
+			s.printf("    %s\n", v.Fix)
+		}
+	}
+	if !asJSON {
+		s.printf("%d issues\n", len(l.issues))
+	}
+	return rc, true
+}
+
+// lintCOption reports whether v is an option of .lint fkey-indexes of the C
+// shell, which accepts --verbose and --groupbyparent and their prefixes.
+func lintCOption(v string) bool {
+	if strings.HasPrefix(v, "--") {
+		v = v[1:]
+	}
+	v = strings.ToLower(v)
+	return len(v) > 1 && (strings.HasPrefix("-verbose", v) || strings.HasPrefix("-groupbyparent", v))
+}
+
+func lintUsage(s *shell) int32 {
+	s.eprintf("Usage: .lint ?--json? ?--sample N? all|RULE ...\nWhere RULE is one of:\n")
+	for _, r := range lintRules {
+		s.eprintf("    %-18s%s\n", r.name, r.help)
+	}
+	s.eprintf(".lint fkey-indexes ?--verbose? ?--groupbyparent? writes the missing indexes\n")
+	return 1
+}
+
+// tables returns the ordinary tables of the main database.
+func (l *linter) tables() ([]*lintTable, error) {
+	rows, err := l.c.query("SELECT name, sql FROM main.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+
+	var virtual []string
+	for _, v := range rows {
+		if sql, _ := v[1].(string); strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL") {
+			virtual = append(virtual, strings.ToLower(v[0].(string))+"_")
+		}
+	}
+	var r []*lintTable
+	for _, v := range rows {
+		name := v[0].(string)
+		sql, _ := v[1].(string)
+		shadow := strings.HasPrefix(strings.ToUpper(sql), "CREATE VIRTUAL")
+		for _, prefix := range virtual {
+			shadow = shadow || strings.HasPrefix(strings.ToLower(name), prefix)
+		}
+		if shadow {
+			continue
+		}
+
+		t := &lintTable{name: name, sql: sql, withoutRowid: withoutRowidRe.MatchString(sql)}
+		cols, err := l.c.query("SELECT name, type, pk FROM pragma_table_info(?, 'main') ORDER BY cid", name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, c := range cols {
+			t.cols = append(t.cols, lintColumn{c[0].(string), c[1].(string), int(c[2].(int64))})
+		}
+		r = append(r, t)
+	}
+	return r, nil
+}
+
+func (l *linter) noPrimaryKey(t *lintTable) error {
+	if len(t.pk()) == 0 {
+		l.report(lintWarning, t.name, "table has no PRIMARY KEY")
+	}
+	return nil
+}
+
+// lintIndex is an index with its key columns as name, collation and order.
+type lintIndex struct {
+	name   string
+	unique bool
+	auto   bool
+	keys   []string
+}
+
+// indexes returns the indexes of table, those that are partial or on
+// expressions excluded.
+func (l *linter) indexes(table string) ([]*lintIndex, error) {
+	rows, err := l.c.query("SELECT name, \"unique\", origin FROM pragma_index_list(?, 'main') WHERE NOT partial ORDER BY name", table)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []*lintIndex
+next:
+	for _, v := range rows {
+		x := &lintIndex{name: v[0].(string), unique: v[1].(int64) != 0, auto: v[2] != "c"}
+		keys, err := l.c.query("SELECT cid, name, coll, desc FROM pragma_index_xinfo(?, 'main') WHERE key ORDER BY seqno", x.name)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, k := range keys {
+			if k[0].(int64) == -2 {
+				continue next
+			}
+
+			name, _ := k[1].(string)
+			x.keys = append(x.keys, fmt.Sprintf("%s\x00%s\x00%v", strings.ToLower(name), strings.ToUpper(k[2].(string)), k[3]))
+		}
+		r = append(r, x)
+	}
+	return r, nil
+}
+
+// keyName returns the column name of an index key.
+func keyName(key string) string { return key[:strings.IndexByte(key, 0)] }
+
+func (l *linter) redundantIndex(t *lintTable) error {
+	a, err := l.indexes(t.name)
+	if err != nil {
+		return err
+	}
+
+	alias := t.rowidAlias()
+	for i, x := range a {
+		if x.auto {
+			continue
+		}
+
+		if alias != "" && keyName(x.keys[0]) == strings.ToLower(alias) {
+			l.report(lintWarning, t.name, "the first column %s is the INTEGER PRIMARY KEY, the rowid is searched instead", alias).fix(x.name)
+			continue
+		}
+
+		for j, y := range a {
+			if i == j || len(x.keys) > len(y.keys) || x.unique && !(y.unique && len(x.keys) == len(y.keys)) {
+				continue
+			}
+
+			same := true
+			for k, v := range x.keys {
+				same = same && v == y.keys[k]
+			}
+			// Of two identical indexes, the second one by name is
+			// reported, unless the first one is automatic.
+			if !same || len(x.keys) == len(y.keys) && x.unique == y.unique && j > i && !y.auto {
+				continue
+			}
+
+			if len(x.keys) == len(y.keys) {
+				l.report(lintWarning, t.name, "duplicate of index %s", y.name).fix(x.name)
+				break
+			}
+
+			l.report(lintWarning, t.name, "its columns are a prefix of index %s", y.name).fix(x.name)
+			break
+		}
+	}
+	return nil
+}
+
+// fix sets the index and the DROP INDEX fix of an issue about index name.
+func (v *lintIssue) fix(name string) {
+	v.Index = name
+	v.Fix = fmt.Sprintf("DROP INDEX %s;", sqlQuoteID(name))
+}
+
+// Declared types of integer and numeric affinity in the documentation of
+// SQLite and common ones of other databases, without the UNSIGNED and
+// ZEROFILL modifiers of MySQL. Other types with this affinity are likely
+// mistakes, like STRING or FLOATING POINT.
+var lintKnownTypes = map[string]bool{
+	"INT": true, "INTEGER": true, "TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "BIGINT": true,
+	"UNSIGNED BIG INT": true, "INT2": true, "INT4": true, "INT8": true, "INTERVAL": true,
+	"SERIAL": true, "SMALLSERIAL": true, "BIGSERIAL": true, "BIT": true, "YEAR": true,
+	"NUMERIC": true, "DECIMAL": true, "DEC": true, "NUMBER": true, "MONEY": true, "BOOLEAN": true, "BOOL": true,
+	"DATE": true, "DATETIME": true, "TIME": true, "TIMESTAMP": true, "TIMESTAMPTZ": true, "TIMETZ": true,
+	"TIME WITH TIME ZONE": true, "TIME WITHOUT TIME ZONE": true,
+	"TIMESTAMP WITH TIME ZONE": true, "TIMESTAMP WITHOUT TIME ZONE": true,
+}
+
+var (
+	lintSpaceRe    = regexp.MustCompile(`\s+`)
+	lintModifierRe = regexp.MustCompile(`( UNSIGNED| ZEROFILL)+$`)
+)
+
+func (l *linter) columnType(t *lintTable) error {
+	for _, v := range t.cols {
+		if v.typ == "" {
+			l.report(lintWarning, t.name, "column has no declared type, its affinity is BLOB").Column = v.name
+			continue
+		}
+
+		base := v.typ
+		if i := strings.IndexByte(base, '('); i >= 0 {
+			base = base[:i]
+		}
+		base = strings.ToUpper(strings.TrimSpace(lintSpaceRe.ReplaceAllString(base, " ")))
+		base = lintModifierRe.ReplaceAllString(base, "")
+		aff := typeAffinity(v.typ)
+		if (aff == affinityInteger || aff == affinityNumeric) && !lintKnownTypes[base] {
+			name := "NUMERIC"
+			if aff == affinityInteger {
+				name = "INTEGER"
+			}
+			l.report(lintWarning, t.name, "the declared type %s has %s affinity", v.typ, name).Column = v.name
+		}
+	}
+	return nil
+}
+
+// foreignKeys returns the foreign keys of table as child and parent
+// columns, a parent column is nil if the parent PRIMARY KEY is implied.
+func (l *linter) foreignKeys(table string) ([]lintForeignKey, error) {
+	rows, err := l.c.query("SELECT id, \"table\", \"from\", \"to\" FROM pragma_foreign_key_list(?, 'main') ORDER BY id, seq", table)
+	if err != nil {
+		return nil, err
+	}
+
+	var r []lintForeignKey
+	for i, v := range rows {
+		if i == 0 || v[0] != rows[i-1][0] {
+			r = append(r, lintForeignKey{parent: v[1].(string)})
+		}
+		fk := &r[len(r)-1]
+		fk.from = append(fk.from, v[2].(string))
+		to, _ := v[3].(string)
+		fk.to = append(fk.to, to)
+	}
+	return r, nil
+}
+
+type lintForeignKey struct {
+	parent string
+	from   []string
+	to     []string
+}
+
+// sameColumns reports whether a and b are the same columns in any order.
+func sameColumns(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	x := make([]string, len(a))
+	y := make([]string, len(b))
+	for i := range a {
+		x[i], y[i] = strings.ToLower(a[i]), strings.ToLower(b[i])
+	}
+	sort.Strings(x)
+	sort.Strings(y)
+	for i := range x {
+		if x[i] != y[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (l *linter) fkeyParent(t *lintTable) error {
+	fks, err := l.foreignKeys(t.name)
+	if err != nil {
+		return err
+	}
+
+	for _, fk := range fks {
+		row, err := l.c.queryRow("SELECT name, sql FROM main.sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE", fk.parent)
+		if err != nil {
+			return err
+		}
+
+		if row == nil {
+			l.report(lintError, t.name, "the parent table %s of the foreign key (%s) does not exist", fk.parent, strings.Join(fk.from, ", "))
+			continue
+		}
+
+		sql, _ := row[1].(string)
+		parent := &lintTable{name: row[0].(string), withoutRowid: withoutRowidRe.MatchString(sql)}
+		cols, err := l.c.query("SELECT name, type, pk FROM pragma_table_info(?, 'main') ORDER BY cid", parent.name)
+		if err != nil {
+			return err
+		}
+
+		for _, c := range cols {
+			parent.cols = append(parent.cols, lintColumn{c[0].(string), c[1].(string), int(c[2].(int64))})
+		}
+		key := fk.to
+		if key[0] == "" {
+			if key = parent.pk(); len(key) == 0 {
+				l.report(lintError, t.name, "the foreign key (%s) refers to the PRIMARY KEY of %s, which has none", strings.Join(fk.from, ", "), parent.name)
+				continue
+			}
+		}
+
+		ok := sameColumns(key, parent.pk())
+		if !ok {
+			indexes, err := l.indexes(parent.name)
+			if err != nil {
+				return err
+			}
+
+			for _, x := range indexes {
+				if !x.unique {
+					continue
+				}
+
+				names := make([]string, len(x.keys))
+				for i, v := range x.keys {
+					names[i] = keyName(v)
+				}
+				ok = ok || sameColumns(key, names)
+			}
+		}
+		if ok {
+			continue
+		}
+
+		quoted := make([]string, len(key))
+		for i, v := range key {
+			quoted[i] = sqlQuoteID(v)
+		}
+		v := l.report(lintError, t.name, "the parent key %s(%s) is not the PRIMARY KEY or UNIQUE, changes fail with a foreign key mismatch", parent.name, strings.Join(key, ", "))
+		v.Fix = fmt.Sprintf("CREATE UNIQUE INDEX %s ON %s(%s);", sqlQuoteID(parent.name+"_"+strings.Join(key, "_")), sqlQuoteID(parent.name), strings.Join(quoted, ", "))
+	}
+	return nil
+}
+
+func (l *linter) fkeyIndexes(t *lintTable) error {
+	fks, err := l.foreignKeys(t.name)
+	if err != nil {
+		return err
+	}
+
+	if len(fks) == 0 {
+		return nil
+	}
+
+	indexes, err := l.indexes(t.name)
+	if err != nil {
+		return err
+	}
+
+	var prefixes [][]string // Leading columns of the indexes and the PRIMARY KEY.
+	for _, x := range indexes {
+		var names []string
+		for _, v := range x.keys {
+			names = append(names, keyName(v))
+		}
+		prefixes = append(prefixes, names)
+	}
+	if alias := t.rowidAlias(); alias != "" {
+		prefixes = append(prefixes, []string{alias})
+	}
+	for _, fk := range fks {
+		found := false
+		for _, v := range prefixes {
+			found = found || len(v) >= len(fk.from) && sameColumns(fk.from, v[:len(fk.from)])
+		}
+		if found {
+			continue
+		}
+
+		quoted := make([]string, len(fk.from))
+		for i, v := range fk.from {
+			quoted[i] = sqlQuoteID(v)
+		}
+		v := l.report(lintWarning, t.name, "no index on the foreign key (%s), changes of %s scan %[3]s", strings.Join(fk.from, ", "), fk.parent, t.name)
+		v.Fix = fmt.Sprintf("CREATE INDEX %s ON %s(%s);", sqlQuoteID(t.name+"_"+strings.Join(fk.from, "_")), sqlQuoteID(t.name), strings.Join(quoted, ", "))
+	}
+	return nil
+}
+
+var autoincrementRe = regexp.MustCompile(`(?i)\bAUTOINCREMENT\b`)
+
+func (l *linter) autoincrement(t *lintTable) error {
+	if !autoincrementRe.MatchString(t.sql) {
+		return nil
+	}
+
+	l.report(lintInfo, t.name, "AUTOINCREMENT costs an update of sqlite_sequence per insert, INTEGER PRIMARY KEY alone reuses only the rowids of deleted last rows")
+	row, err := l.c.queryRow("SELECT seq FROM main.sqlite_sequence WHERE name = ?", t.name)
+	if err != nil || row == nil {
+		return err
+	}
+
+	last, err := l.c.queryRow(fmt.Sprintf("SELECT max(rowid) FROM main.%s", sqlQuoteID(t.name)))
+	if err != nil {
+		return err
+	}
+
+	if seq, ok := row[0].(int64); ok && last[0] != nil && seq < last[0].(int64) {
+		l.report(lintError, t.name, "sqlite_sequence has %d, less than the largest rowid %d", seq, last[0])
+	}
+	return nil
+}
+
+func (l *linter) mixedTypes(t *lintTable) error {
+	for _, v := range t.cols {
+		limit := ""
+		if l.sample != 0 {
+			limit = fmt.Sprintf(" LIMIT %d", l.sample)
+		}
+		rows, err := l.c.query(fmt.Sprintf("SELECT typeof(c), count(*) FROM (SELECT %s AS c FROM main.%s%s) WHERE c IS NOT NULL GROUP BY 1 ORDER BY 2 DESC, 1",
+			sqlQuoteID(v.name), sqlQuoteID(t.name), limit))
+		if err != nil {
+			return err
+		}
+
+		text := false
+		for _, r := range rows {
+			text = text || r[0] == "text"
+		}
+		if !text || len(rows) < 2 {
+			continue
+		}
+
+		a := make([]string, len(rows))
+		for i, r := range rows {
+			a[i] = fmt.Sprintf("%d %s", r[1], r[0])
+		}
+		l.report(lintWarning, t.name, "column holding %s values in the rows sampled", strings.Join(a, ", ")).Column = v.name
+	}
+	return nil
+}
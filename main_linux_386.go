@@ -156,6 +156,11 @@ _5:
 
 	_z++
 _9:
+	if isCmdlineOption(_z) {
+		_8cmdline_option_value(tls, _argc, _argv, preinc2(&_i))
+		goto _11
+	}
+
 	if crt.Xstrcmp(tls, _z, ts+262 /* "-separator" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+273 /* "-nullvalue" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+284 /* "-newline" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+293 /* "-cmd" */) != int32(0) {
 		goto _10
 	}
@@ -444,7 +449,7 @@ _65:
 		goto _67
 	}
 
-	*(*int32)(unsafe.Pointer(_data + 8)) = int32(1)
+	*(*int32)(unsafe.Pointer(_data + 8)) = eqpTree
 	goto _68
 
 _67:
@@ -635,6 +640,14 @@ _101:
 	goto _98
 
 _97:
+	if isCmdlineOption(_4z) {
+		if _rc = doCmdlineOption(tls, _data, _4z, _8cmdline_option_value(tls, _argc, _argv, preinc2(&_i))); _rc != 0 && _12bail_on_error != 0 {
+			return _rc
+		}
+
+		goto _98
+	}
+
 	crt.Xfprintf(tls, Xstderr, ts+586 /* "%s: Error: unknown option: %s\n" */, _6Argv0, _4z)
 	crt.Xfprintf(tls, Xstderr, ts+617 /* "Use -help for a list of options...." */)
 	return int32(1)
@@ -1315,6 +1328,13 @@ _2:
 	Xsqlite3_fileio_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_shathree_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_completion_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_regexp_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_json_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_fts5_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_rtree_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_csv_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_gofunc_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_govtab_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_create_function(tls, *(*uintptr)(unsafe.Pointer(_p)), ts+963 /* "shell_add_schema" */, int32(2), int32(1), null, fp6(_39shellAddSchemaName), null, null)
 _1:
 }
@@ -1393,6 +1413,7 @@ func _13usage(tls *crt.TLS, _showDetail int32) {
 	}
 
 	crt.Xfprintf(tls, Xstderr, ts+1236 /* "OPTIONS include:\n%s" */, _40zOptions)
+	cmdlineUsage(tls)
 	goto _2
 
 _1:
@@ -1644,6 +1665,11 @@ _2:
 	return int32(0)
 
 _16:
+	if rc, ok := doMetaCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	_n = _19strlen30(tls, *(*uintptr)(unsafe.Pointer(_azArg)))
 	_c = int32(*(*int8)(unsafe.Pointer(*(*uintptr)(unsafe.Pointer(_azArg)))))
 	if _c != int32('a') || crt.Xstrncmp(tls, *(*uintptr)(unsafe.Pointer(_azArg)), ts+1305 /* "auth" */, uint32(_n)) != int32(0) {
@@ -1980,6 +2006,11 @@ _79:
 		goto _81
 	}
 
+	if rc, ok := dumpCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	_zLike = 0
 	_savedShowHeader = *(*int32)(unsafe.Pointer(_p + 56))
 	{
@@ -2129,12 +2160,17 @@ _98:
 	goto _107
 
 _106:
+	if v, ok := eqpMode(*(*uintptr)(unsafe.Pointer(_azArg + 4))); ok {
+		*(*int32)(unsafe.Pointer(_p + 8)) = v
+		goto _107
+	}
+
 	*(*int32)(unsafe.Pointer(_p + 8)) = _46booleanValue(tls, *(*uintptr)(unsafe.Pointer(_azArg + 4)))
 _107:
 	goto _105
 
 _104:
-	crt.Xfprintf(tls, Xstderr, ts+2705 /* "Usage: .eqp on|off|full\n" */)
+	fputs(tls, "Usage: .eqp on|off|full|tree\n", Xstderr)
 	_rc = int32(1)
 _105:
 	goto _103
@@ -2295,6 +2331,7 @@ _130:
 	}
 
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 28)), ts+429 /* "%s" */, _59zHelp)
+	metaHelp(tls, _p)
 	goto _135
 
 _134:
@@ -3371,7 +3408,6 @@ _298:
 	}
 
 	*(*int32)(unsafe.Pointer(_p + 16)) = _46booleanValue(tls, *(*uintptr)(unsafe.Pointer(_azArg + 4)))
-	crt.Xfprintf(tls, Xstderr, ts+5044 /* "Warning: .scanstats not availabl..." */)
 	goto _317
 
 _316:
@@ -3385,6 +3421,11 @@ _314:
 		goto _318
 	}
 
+	if rc, ok := schemaCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	*(*uintptr)(unsafe.Pointer(_23zErrMsg)) = 0
 	_zDiv = 0
 	_iSchema = int32(0)
@@ -4038,7 +4079,7 @@ _417:
 
 _426:
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 28)), ts+7376 /* "%12.12s: %s\n" */, ts+2670 /* "echo" */, *(*uintptr)(unsafe.Pointer(_43azBool + 4*uintptr(bool2int(((*(*uint32)(unsafe.Pointer(_p + 64)))&uint32(0x40)) != uint32(0))))))
-	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 28)), ts+7376 /* "%12.12s: %s\n" */, ts+2696 /* "eqp" */, *(*uintptr)(unsafe.Pointer(_43azBool + 4*uintptr((*(*int32)(unsafe.Pointer(_p + 8)))&int32(3)))))
+	showEQP(tls, _p)
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 28)), ts+7376 /* "%12.12s: %s\n" */, ts+2735 /* "explain" */, func() uintptr {
 		if (*(*int32)(unsafe.Pointer(_p + 40))) == int32(9) {
 			return ts + 7389 /* "on" */
@@ -4887,6 +4928,10 @@ _14:
 	}
 
 	_80disable_debug_trace_modes(tls)
+	if explainTree(tls, _pArg, _78zStmtSql) {
+		goto _19
+	}
+
 	_zEQP = Xsqlite3_mprintf(tls, ts+8561 /* "EXPLAIN QUERY PLAN %s" */, _78zStmtSql)
 	_rc = Xsqlite3_prepare_v2(tls, _db, _zEQP, int32(-1), _pExplain, null)
 	if _rc != int32(0) {
@@ -4954,7 +4999,7 @@ _21:
 
 	_73display_stats(tls, _db, _pArg, int32(0))
 _24:
-	if _pArg == 0 || (*(*int32)(unsafe.Pointer(_pArg + 16))) == 0 {
+	if _pArg == 0 || !scanstatsEnabled(_pArg) {
 		goto _25
 	}
 
@@ -6967,6 +7012,11 @@ func Xsqlite3_fileio_init(tls *crt.TLS, _db uintptr /* *Tsqlite3 */, _pzErrMsg u
 	}
 
 	_rc = Xsqlite3_create_function(tls, _db, ts+8966 /* "writefile" */, int32(2), int32(1), null, fp6(_127writefileFunc), null, null)
+	if _rc != int32(0) {
+		goto _1
+	}
+
+	_rc = fsdirRegister(tls, _db)
 _1:
 	return _rc
 }
@@ -9673,6 +9723,10 @@ _5:
 func _63lintDotCommand(tls *crt.TLS, _pState uintptr /* *TShellState */, _azArg uintptr /* **int8 */, _nArg int32) (r int32) {
 	var _n int32
 
+	if rc, ok := lintCommand(tls, _pState, _nArg, _azArg); ok {
+		return rc
+	}
+
 	_n = func() int32 {
 		if _nArg >= int32(2) {
 			return int32(crt.Xstrlen(tls, *(*uintptr)(unsafe.Pointer(_azArg + 4))))
@@ -10668,6 +10722,8 @@ func _82exec_prepared_stmt(tls *crt.TLS, _pArg uintptr /* *TShellState */, _pStm
 		_i       int32
 		_x       int32
 	)
+	bindParameters(tls, _pArg, _pStmt)
+	scanstatsBegin(_pArg)
 	_rc = Xsqlite3_step(tls, _pStmt)
 	if int32(100) != _rc {
 		goto _1
@@ -10780,6 +10836,7 @@ func _84restore_debug_trace_modes(tls *crt.TLS) {
 
 // _85display_scanstats is defined at shell.c:3338:13
 func _85display_scanstats(tls *crt.TLS, _db uintptr /* *Tsqlite3 */, _pArg uintptr /* *TShellState */) {
+	displayScanstats(tls, _db, _pArg)
 }
 
 // _86__func__ array 15 of char, escapes: true, shell.c:2657:2
@@ -11975,7 +12032,11 @@ func _106runOneSqlLine(tls *crt.TLS, _p uintptr /* *TShellState */, _zSql uintpt
 	_45resolve_backslashes(tls, _zSql)
 _1:
 	_246beginTimer(tls)
-	_rc = _15shell_exec(tls, *(*uintptr)(unsafe.Pointer(_p)), _zSql, fp3(_16shell_callback), _p, _zErrMsg)
+	if rc, ok := expertExec(tls, _p, _zSql, _zErrMsg); ok {
+		_rc = rc
+	} else {
+		_rc = _15shell_exec(tls, *(*uintptr)(unsafe.Pointer(_p)), _zSql, fp3(_16shell_callback), _p, _zErrMsg)
+	}
 	_247endTimer(tls)
 	if _rc == 0 && (*(*uintptr)(unsafe.Pointer(_zErrMsg))) == 0 {
 		goto _2
@@ -26091,12 +26152,18 @@ _3:
 	_nProgressLimit = uint32(0xffffffff)
 _4:
 	_pOp = _aOp + 20*uintptr(*(*int32)(unsafe.Pointer(_p + 36)))
+	if vdbeProfiling {
+		vdbeProfileEnter()
+	}
 _5:
 	if 1 == 0 {
 		goto _7
 	}
 
 	_nVmStep++
+	if vdbeProfiling {
+		vdbeProfileOp(_aOp, _pOp)
+	}
 	switch int32(*(*Tu8)(unsafe.Pointer(_pOp))) {
 	case int32(13):
 		goto _9
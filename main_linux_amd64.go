@@ -167,6 +167,11 @@ _5:
 
 	_z++
 _9:
+	if isCmdlineOption(_z) {
+		_7cmdline_option_value(tls, _argc, _argv, preinc2(&_i))
+		goto _11
+	}
+
 	if crt.Xstrcmp(tls, _z, ts+262 /* "-separator" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+273 /* "-nullvalue" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+284 /* "-newline" */) != int32(0) && crt.Xstrcmp(tls, _z, ts+293 /* "-cmd" */) != int32(0) {
 		goto _10
 	}
@@ -455,7 +460,7 @@ _65:
 		goto _67
 	}
 
-	*(*int32)(unsafe.Pointer(_data + 12)) = int32(1)
+	*(*int32)(unsafe.Pointer(_data + 12)) = eqpTree
 	goto _68
 
 _67:
@@ -646,6 +651,14 @@ _101:
 	goto _98
 
 _97:
+	if isCmdlineOption(_4z) {
+		if _rc = doCmdlineOption(tls, _data, _4z, _7cmdline_option_value(tls, _argc, _argv, preinc2(&_i))); _rc != 0 && _11bail_on_error != 0 {
+			return _rc
+		}
+
+		goto _98
+	}
+
 	crt.Xfprintf(tls, Xstderr, ts+586 /* "%s: Error: unknown option: %s\n" */, _5Argv0, _4z)
 	crt.Xfprintf(tls, Xstderr, ts+617 /* "Use -help for a list of options...." */)
 	return int32(1)
@@ -1323,6 +1336,13 @@ _2:
 	Xsqlite3_fileio_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_shathree_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_completion_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_regexp_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_json_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_fts5_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_rtree_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_csv_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_gofunc_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
+	Xsqlite3_govtab_init(tls, *(*uintptr)(unsafe.Pointer(_p)), null, null)
 	Xsqlite3_create_function(tls, *(*uintptr)(unsafe.Pointer(_p)), ts+963 /* "shell_add_schema" */, int32(2), int32(1), null, fp6(_38shellAddSchemaName), null, null)
 _1:
 }
@@ -1404,6 +1424,7 @@ func _12usage(tls crt.TLS, _showDetail int32) {
 	}
 
 	crt.Xfprintf(tls, Xstderr, ts+1236 /* "OPTIONS include:\n%s" */, _39zOptions)
+	cmdlineUsage(tls)
 	goto _2
 
 _1:
@@ -1655,6 +1676,11 @@ _2:
 	return int32(0)
 
 _16:
+	if rc, ok := doMetaCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	_n = _18strlen30(tls, *(*uintptr)(unsafe.Pointer(_azArg)))
 	_c = int32(*(*int8)(unsafe.Pointer(*(*uintptr)(unsafe.Pointer(_azArg)))))
 	if _c != int32('a') || crt.Xstrncmp(tls, *(*uintptr)(unsafe.Pointer(_azArg)), ts+1305 /* "auth" */, uint64(_n)) != int32(0) {
@@ -1991,6 +2017,11 @@ _79:
 		goto _81
 	}
 
+	if rc, ok := dumpCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	_zLike = 0
 	_savedShowHeader = *(*int32)(unsafe.Pointer(_p + 68))
 	{
@@ -2140,12 +2171,17 @@ _98:
 	goto _107
 
 _106:
+	if v, ok := eqpMode(*(*uintptr)(unsafe.Pointer(_azArg + 8))); ok {
+		*(*int32)(unsafe.Pointer(_p + 12)) = v
+		goto _107
+	}
+
 	*(*int32)(unsafe.Pointer(_p + 12)) = _45booleanValue(tls, *(*uintptr)(unsafe.Pointer(_azArg + 8)))
 _107:
 	goto _105
 
 _104:
-	crt.Xfprintf(tls, Xstderr, ts+2705 /* "Usage: .eqp on|off|full\n" */)
+	fputs(tls, "Usage: .eqp on|off|full|tree\n", Xstderr)
 	_rc = int32(1)
 _105:
 	goto _103
@@ -2306,6 +2342,7 @@ _130:
 	}
 
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 32)), ts+429 /* "%s" */, _58zHelp)
+	metaHelp(tls, _p)
 	goto _135
 
 _134:
@@ -3382,7 +3419,6 @@ _298:
 	}
 
 	*(*int32)(unsafe.Pointer(_p + 20)) = _45booleanValue(tls, *(*uintptr)(unsafe.Pointer(_azArg + 8)))
-	crt.Xfprintf(tls, Xstderr, ts+5044 /* "Warning: .scanstats not availabl..." */)
 	goto _317
 
 _316:
@@ -3396,6 +3432,11 @@ _314:
 		goto _318
 	}
 
+	if rc, ok := schemaCommand(tls, _p, _nArg, _azArg); ok {
+		_rc = rc
+		goto _meta_command_exit
+	}
+
 	*(*uintptr)(unsafe.Pointer(_23zErrMsg)) = 0
 	_zDiv = 0
 	_iSchema = int32(0)
@@ -4049,7 +4090,7 @@ _417:
 
 _426:
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 32)), ts+7376 /* "%12.12s: %s\n" */, ts+2670 /* "echo" */, *(*uintptr)(unsafe.Pointer(_42azBool + 8*uintptr(bool2int(((*(*uint32)(unsafe.Pointer(_p + 76)))&uint32(0x40)) != uint32(0))))))
-	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 32)), ts+7376 /* "%12.12s: %s\n" */, ts+2696 /* "eqp" */, *(*uintptr)(unsafe.Pointer(_42azBool + 8*uintptr((*(*int32)(unsafe.Pointer(_p + 12)))&int32(3)))))
+	showEQP(tls, _p)
 	crt.Xfprintf(tls, *(*uintptr)(unsafe.Pointer(_p + 32)), ts+7376 /* "%12.12s: %s\n" */, ts+2735 /* "explain" */, func() uintptr {
 		if (*(*int32)(unsafe.Pointer(_p + 52))) == int32(9) {
 			return ts + 7389 /* "on" */
@@ -4897,6 +4938,10 @@ _14:
 	}
 
 	_79disable_debug_trace_modes(tls)
+	if explainTree(tls, _pArg, _77zStmtSql) {
+		goto _19
+	}
+
 	_zEQP = Xsqlite3_mprintf(tls, ts+8538 /* "EXPLAIN QUERY PLAN %s" */, _77zStmtSql)
 	_rc = Xsqlite3_prepare_v2(tls, _db, _zEQP, int32(-1), _pExplain, null)
 	if _rc != int32(0) {
@@ -4964,7 +5009,7 @@ _21:
 
 	_72display_stats(tls, _db, _pArg, int32(0))
 _24:
-	if _pArg == 0 || (*(*int32)(unsafe.Pointer(_pArg + 20))) == 0 {
+	if _pArg == 0 || !scanstatsEnabled(_pArg) {
 		goto _25
 	}
 
@@ -6974,6 +7019,11 @@ func Xsqlite3_fileio_init(tls crt.TLS, _db uintptr /* *Tsqlite3 = Ssqlite3 */, _
 	}
 
 	_rc = Xsqlite3_create_function(tls, _db, ts+8943 /* "writefile" */, int32(2), int32(1), null, fp6(_125writefileFunc), null, null)
+	if _rc != int32(0) {
+		goto _1
+	}
+
+	_rc = fsdirRegister(tls, _db)
 _1:
 	return _rc
 }
@@ -9672,6 +9722,10 @@ _5:
 func _62lintDotCommand(tls crt.TLS, _pState uintptr /* *TShellState = SShellState */, _azArg uintptr /* **int8 */, _nArg int32) (r int32) {
 	var _n int32
 
+	if rc, ok := lintCommand(tls, _pState, _nArg, _azArg); ok {
+		return rc
+	}
+
 	_n = func() int32 {
 		if _nArg >= int32(2) {
 			return int32(crt.Xstrlen(tls, *(*uintptr)(unsafe.Pointer(_azArg + 8))))
@@ -10666,6 +10720,8 @@ func _81exec_prepared_stmt(tls crt.TLS, _pArg uintptr /* *TShellState = SShellSt
 		_i       int32
 		_x       int32
 	)
+	bindParameters(tls, _pArg, _pStmt)
+	scanstatsBegin(_pArg)
 	_rc = Xsqlite3_step(tls, _pStmt)
 	if int32(100) != _rc {
 		goto _1
@@ -10778,6 +10834,7 @@ func _83restore_debug_trace_modes(tls crt.TLS) {
 
 // _84display_scanstats is defined at shell.c:3338:13
 func _84display_scanstats(tls crt.TLS, _db uintptr /* *Tsqlite3 = Ssqlite3 */, _pArg uintptr /* *TShellState = SShellState */) {
+	displayScanstats(tls, _db, _pArg)
 }
 
 // _85__func__ [15]int8, escapes: true, shell.c:2657:2
@@ -11971,7 +12028,11 @@ func _105runOneSqlLine(tls crt.TLS, _p uintptr /* *TShellState = SShellState */,
 	_44resolve_backslashes(tls, _zSql)
 _1:
 	_244beginTimer(tls)
-	_rc = _14shell_exec(tls, *(*uintptr)(unsafe.Pointer(_p)), _zSql, fp3(_15shell_callback), _p, _zErrMsg)
+	if rc, ok := expertExec(tls, _p, _zSql, _zErrMsg); ok {
+		_rc = rc
+	} else {
+		_rc = _14shell_exec(tls, *(*uintptr)(unsafe.Pointer(_p)), _zSql, fp3(_15shell_callback), _p, _zErrMsg)
+	}
 	_245endTimer(tls)
 	if _rc == 0 && (*(*uintptr)(unsafe.Pointer(_zErrMsg))) == 0 {
 		goto _2
@@ -25678,12 +25739,18 @@ _3:
 	_nProgressLimit = uint32(0xffffffff)
 _4:
 	_pOp = _aOp + 24*uintptr(*(*int32)(unsafe.Pointer(_p + 52)))
+	if vdbeProfiling {
+		vdbeProfileEnter()
+	}
 _5:
 	if 1 == 0 {
 		goto _7
 	}
 
 	_nVmStep++
+	if vdbeProfiling {
+		vdbeProfileOp(_aOp, _pOp)
+	}
 	switch int32(*(*uint8)(unsafe.Pointer(_pOp))) {
 	case int32(13):
 		goto _9
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unsafe"
+)
+
+// Dot commands and command line options written in Go.
+//
+// do_meta_command tries the commands in metaCommands before the C ones, so
+// they must not take over the names, or the abbreviations, of existing
+// commands. .help lists them after the C ones and the -help option lists the
+// options in cmdlineOptions.
+
+// metaCommand is a dot command.
+type metaCommand struct {
+	name   string
+	abbrev int    // Length of the shortest accepted abbreviation, 0 if none.
+	usage  string // Arguments, like "?OPTIONS? FILE".
+	help   string // One or more lines.
+	run    func(s *shell, args []string) error
+}
+
+// cmdlineOption is a command line option with a value. Options are
+// processed in order with the other options after the database is opened.
+type cmdlineOption struct {
+	name  string // Including the leading dash.
+	value string // Value placeholder in the -help text.
+	help  string
+	run   func(s *shell, value string) error
+}
+
+var (
+	metaCommands   []*metaCommand
+	cmdlineOptions []*cmdlineOption
+)
+
+// errUsage makes the dot command print its usage.
+var errUsage = errors.New("usage")
+
+// shell gives dot commands access to the ShellState of the C shell.
+type shell struct {
+	tls TLS
+	p   uintptr // *SShellState
+}
+
+func (s *shell) state() *SShellState { return (*SShellState)(unsafe.Pointer(s.p)) }
+
+// conn opens the database, if not yet open, and returns the connection.
+func (s *shell) conn() *sqlConn {
+	openDB(s.tls, s.p)
+	return &sqlConn{s.tls, s.state().Xdb}
+}
+
+// printf writes to the output of the shell, set by .output or .once.
+func (s *shell) printf(format string, args ...interface{}) {
+	fputs(s.tls, fmt.Sprintf(format, args...), s.state().Xout)
+}
+
+func (s *shell) eprintf(format string, args ...interface{}) {
+	fputs(s.tls, fmt.Sprintf(format, args...), Xstderr)
+}
+
+// exec runs sql and writes its rows in the output mode of the shell, like SQL
+// typed at the prompt.
+func (s *shell) exec(sql string) error {
+	c := s.conn()
+	zSQL := cString(s.tls, sql)
+	pzErrMsg := cZero(s.tls, ptrSize)
+	defer func() {
+		Xsqlite3_free(s.tls, zSQL)
+		Xsqlite3_free(s.tls, pzErrMsg)
+	}()
+	if zSQL == 0 || pzErrMsg == 0 {
+		return errors.New("out of memory")
+	}
+
+	if shellExec(s.tls, c.db, zSQL, s.p, pzErrMsg) == sqliteOK {
+		return nil
+	}
+
+	if z := argv(pzErrMsg, 0); z != 0 {
+		defer Xsqlite3_free(s.tls, z)
+		return errors.New(goString(z))
+	}
+
+	return c.err()
+}
+
+func (c *metaCommand) matches(name string) bool {
+	if name == c.name {
+		return true
+	}
+
+	return c.abbrev != 0 && len(name) >= c.abbrev && strings.HasPrefix(c.name, name)
+}
+
+// doMetaCommand runs the Go dot command of the arguments args, if any. It
+// returns the do_meta_command result and whether the command was found.
+func doMetaCommand(tls TLS, p uintptr, argc int32, args uintptr) (int32, bool) {
+	a := make([]string, argc)
+	for i := range a {
+		a[i] = goString(argv(args, i))
+	}
+	for _, c := range metaCommands {
+		if !c.matches(a[0]) {
+			continue
+		}
+
+		s := &shell{tls, p}
+		switch err := c.run(s, a[1:]); {
+		case err == errUsage:
+			s.eprintf("Usage: .%s %s\n", c.name, c.usage)
+		case err != nil:
+			s.eprintf("Error: %v\n", err)
+		default:
+			return 0, true
+		}
+		return 1, true
+	}
+	return 0, false
+}
+
+// metaHelp writes the help of the Go dot commands, in the format of .help.
+func metaHelp(tls TLS, p uintptr) {
+	s := &shell{tls, p}
+	a := append([]*metaCommand(nil), metaCommands...)
+	sort.Slice(a, func(i, j int) bool { return a[i].name < a[j].name })
+	for _, c := range a {
+		s.printf("%s", helpText("."+strings.TrimSpace(c.name+" "+c.usage), c.help))
+	}
+}
+
+// helpText formats a .help entry. Lines after the first one are indented
+// like the details of the C commands.
+func helpText(head, help string) string {
+	const indent = 23
+	var b []byte
+	b = append(b, head...)
+	if len(head) >= indent {
+		b = append(b, '\n')
+		b = append(b, strings.Repeat(" ", indent)...)
+	} else {
+		b = append(b, strings.Repeat(" ", indent-len(head))...)
+	}
+	for i, v := range strings.Split(help, "\n") {
+		if i != 0 {
+			b = append(b, strings.Repeat(" ", indent+2)...)
+		}
+		b = append(b, v...)
+		b = append(b, '\n')
+	}
+	return string(b)
+}
+
+// isCmdlineOption reports whether z is a Go command line option.
+func isCmdlineOption(z uintptr) bool { return findCmdlineOption(goString(z)) != nil }
+
+func findCmdlineOption(name string) *cmdlineOption {
+	if strings.HasPrefix(name, "--") {
+		name = name[1:]
+	}
+	for _, v := range cmdlineOptions {
+		if v.name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+// doCmdlineOption runs the option z with the value zValue and returns zero
+// or, after writing the error, one.
+func doCmdlineOption(tls TLS, p, z, zValue uintptr) int32 {
+	s := &shell{tls, p}
+	if err := findCmdlineOption(goString(z)).run(s, goString(zValue)); err != nil {
+		s.eprintf("Error: %v\n", err)
+		return 1
+	}
+
+	return 0
+}
+
+// cmdlineUsage writes the help of the Go command line options, in the
+// format of -help.
+func cmdlineUsage(tls TLS) {
+	for _, v := range cmdlineOptions {
+		fputs(tls, fmt.Sprintf("   %-20s %s\n", v.name+" "+v.value, v.help), Xstderr)
+	}
+}
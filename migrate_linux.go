@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// Schema migrations.
+//
+//	.migrate ?--dry-run? DIR status|up ?N?|down ?N?|to VERSION
+//
+// The migrations are the .sql files of the directory DIR. The name of a
+// migration file starts with its version number, like 001_users.sql or
+// 001_users.up.sql, and the file reverting it has the same version and ends
+// with .down.sql, like 001_users.down.sql.
+//
+// .migrate records the applied migrations, and the SHA-256 checksum of their
+// files, in the schema_migrations table of the main database. status lists
+// the migrations, up applies the next N, by default all, pending migrations,
+// down reverts the last N, by default 1, applied migrations and to applies or
+// reverts migrations until VERSION is the last applied one, 0 reverts all.
+//
+// Every file runs in a transaction, like .read, and the transaction is
+// rolled back if any statement fails, so the files must not use BEGIN or
+// COMMIT. .migrate refuses to run if the file of an applied migration has
+// changed. With --dry-run, .migrate writes the migrations it would apply or
+// revert and does not run them.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:  "migrate",
+		usage: "?--dry-run? DIR status|up|down|to ...",
+		help: `Apply the numbered .sql migration files of DIR
+down ?N?              Revert the last N, by default 1, migrations
+status                List the migrations and their state
+to VERSION            Apply or revert migrations up to VERSION
+up ?N?                Apply N, by default all, pending migrations`,
+		run: migrateCommand,
+	})
+}
+
+const schemaMigrations = `CREATE TABLE IF NOT EXISTS main.schema_migrations(
+  version INTEGER PRIMARY KEY,
+  name TEXT NOT NULL,
+  checksum TEXT NOT NULL,
+  applied_at TEXT NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+var migrationRe = regexp.MustCompile(`^(\d+)[_\-.]?(.*?)(\.up|\.down)?\.sql$`)
+
+// migration is a migration of the directory or a row of schema_migrations.
+type migration struct {
+	version   int64
+	name      string
+	up        string // File name, "" if the migration is applied but the file is gone.
+	down      string // File name, "" if none.
+	checksum  string // Of the up file.
+	applied   bool
+	appliedAt string
+	recorded  string // Checksum recorded in schema_migrations.
+}
+
+func (m *migration) modified() bool { return m.applied && m.up != "" && m.checksum != m.recorded }
+
+func (m *migration) String() string { return fmt.Sprintf("%d %s", m.version, m.name) }
+
+func migrateCommand(s *shell, args []string) error {
+	dryRun := false
+	var a []string
+	for _, v := range args {
+		switch v {
+		case "-dry-run", "--dry-run":
+			dryRun = true
+		default:
+			a = append(a, v)
+		}
+	}
+	if len(a) < 2 {
+		return errUsage
+	}
+
+	ms, err := migrations(s.conn(), a[0])
+	if err != nil {
+		return err
+	}
+
+	var apply, revert []*migration
+	switch cmd, a := a[1], a[2:]; cmd {
+	case "status":
+		if len(a) != 0 {
+			return errUsage
+		}
+
+		migrateStatus(s, ms)
+		return nil
+	case "up", "down":
+		n := -1
+		if cmd == "down" {
+			n = 1
+		}
+		switch len(a) {
+		case 0:
+		case 1:
+			if n, err = strconv.Atoi(a[0]); err != nil || n < 0 {
+				return fmt.Errorf("%s: not a number of migrations", a[0])
+			}
+		default:
+			return errUsage
+		}
+
+		for i := range ms {
+			if cmd == "down" {
+				m := ms[len(ms)-1-i]
+				if m.applied && len(revert) != n {
+					revert = append(revert, m)
+				}
+				continue
+			}
+
+			if m := ms[i]; !m.applied && len(apply) != n {
+				apply = append(apply, m)
+			}
+		}
+	case "to":
+		if len(a) != 1 {
+			return errUsage
+		}
+
+		v, err := strconv.ParseInt(a[0], 10, 64)
+		if err != nil || v < 0 {
+			return fmt.Errorf("%s: not a version", a[0])
+		}
+
+		for i := range ms {
+			if m := ms[len(ms)-1-i]; m.applied && m.version > v {
+				revert = append(revert, m)
+			}
+			if m := ms[i]; !m.applied && m.version <= v {
+				apply = append(apply, m)
+			}
+		}
+	default:
+		return errUsage
+	}
+
+	for _, m := range ms {
+		if m.modified() {
+			return fmt.Errorf("migration %v: %s changed after it was applied", m, m.up)
+		}
+	}
+	for _, m := range revert {
+		if m.down == "" {
+			return fmt.Errorf("migration %v: no .down.sql file", m)
+		}
+	}
+	if len(apply)+len(revert) == 0 {
+		s.printf("no migrations to run\n")
+		return nil
+	}
+
+	if dryRun {
+		for _, m := range revert {
+			s.printf("revert %v (%s)\n", m, m.down)
+		}
+		for _, m := range apply {
+			s.printf("apply %v (%s)\n", m, m.up)
+		}
+		return nil
+	}
+
+	c := s.conn()
+	if Xsqlite3_get_autocommit(s.tls, c.db) == 0 {
+		return errors.New("cannot migrate within a transaction")
+	}
+
+	if err := c.exec(schemaMigrations); err != nil {
+		return err
+	}
+
+	for _, m := range revert {
+		s.printf("revert %v\n", m)
+		if err := runMigration(s, m.down, "DELETE FROM main.schema_migrations WHERE version = ?", m.version); err != nil {
+			return fmt.Errorf("migration %v: %v", m, err)
+		}
+	}
+	for _, m := range apply {
+		s.printf("apply %v\n", m)
+		if err := runMigration(s, m.up, "INSERT INTO main.schema_migrations(version, name, checksum) VALUES(?, ?, ?)", m.version, m.name, m.checksum); err != nil {
+			return fmt.Errorf("migration %v: %v", m, err)
+		}
+	}
+	return nil
+}
+
+// migrations returns the migrations of the directory dir and of the
+// schema_migrations table, ordered by version.
+func migrations(c *sqlConn, dir string) ([]*migration, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int64]*migration{}
+	get := func(v int64) *migration {
+		m := byVersion[v]
+		if m == nil {
+			m = &migration{version: v}
+			byVersion[v] = m
+		}
+		return m
+	}
+	for _, fi := range files {
+		sm := migrationRe.FindStringSubmatch(fi.Name())
+		if fi.IsDir() || sm == nil {
+			continue
+		}
+
+		v, err := strconv.ParseInt(sm[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: bad version number", fi.Name())
+		}
+
+		m := get(v)
+		name := filepath.Join(dir, fi.Name())
+		if sm[3] == ".down" {
+			if m.down != "" {
+				return nil, fmt.Errorf("%s and %s have the same version", m.down, name)
+			}
+
+			m.down = name
+			continue
+		}
+
+		if m.up != "" {
+			return nil, fmt.Errorf("%s and %s have the same version", m.up, name)
+		}
+
+		b, err := ioutil.ReadFile(name)
+		if err != nil {
+			return nil, err
+		}
+
+		sum := sha256.Sum256(b)
+		m.up, m.name, m.checksum = name, sm[2], hex.EncodeToString(sum[:])
+	}
+
+	row, err := c.queryRow("SELECT 1 FROM main.sqlite_master WHERE type = 'table' AND name = 'schema_migrations'")
+	if err != nil {
+		return nil, err
+	}
+
+	if row != nil {
+		rows, err := c.query("SELECT version, name, checksum, applied_at FROM main.schema_migrations")
+		if err != nil {
+			return nil, err
+		}
+
+		for _, v := range rows {
+			version, ok := v[0].(int64)
+			if !ok {
+				continue
+			}
+
+			m := get(version)
+			m.applied = true
+			m.recorded = fmt.Sprint(v[2])
+			m.appliedAt = fmt.Sprint(v[3])
+			if m.up == "" {
+				m.name = fmt.Sprint(v[1])
+			}
+		}
+	}
+
+	var r []*migration
+	for _, m := range byVersion {
+		if m.up == "" && !m.applied {
+			return nil, fmt.Errorf("%s: no migration for the down file", m.down)
+		}
+
+		r = append(r, m)
+	}
+	sort.Slice(r, func(i, j int) bool { return r[i].version < r[j].version })
+	return r, nil
+}
+
+func migrateStatus(s *shell, ms []*migration) {
+	var current int64
+	pending := 0
+	s.printf("%-10s %-9s %-20s %s\n", "version", "state", "applied at", "name")
+	for _, m := range ms {
+		state := "pending"
+		switch {
+		case m.up == "":
+			state = "missing"
+		case m.modified():
+			state = "modified"
+		case m.applied:
+			state = "applied"
+		default:
+			pending++
+		}
+		if m.applied {
+			current = m.version
+		}
+		s.printf("%-10d %-9s %-20s %s\n", m.version, state, m.appliedAt, m.name)
+	}
+	s.printf("version %d, %d pending\n", current, pending)
+}
+
+// runMigration runs the file name in a transaction and then executes the
+// statement sql, which records the migration, with args.
+func runMigration(s *shell, name string, sql string, args ...interface{}) error {
+	c := s.conn()
+	if err := c.exec("BEGIN"); err != nil {
+		return err
+	}
+
+	in := fopen(s.tls, name, "rb")
+	if in == 0 {
+		c.exec("ROLLBACK")
+		return fmt.Errorf("cannot open %q", name)
+	}
+
+	n := processInput(s.tls, s.p, in)
+	fclose(s.tls, in)
+	c = s.conn()
+	inTx := Xsqlite3_get_autocommit(s.tls, c.db) == 0
+	if n != 0 {
+		if inTx {
+			c.exec("ROLLBACK")
+		}
+		return fmt.Errorf("%s: %d errors, rolled back", name, n)
+	}
+
+	if !inTx {
+		return fmt.Errorf("%s ended the transaction, the migration was not recorded", name)
+	}
+
+	if err := c.exec(sql, args...); err != nil {
+		c.exec("ROLLBACK")
+		return err
+	}
+
+	return c.exec("COMMIT")
+}
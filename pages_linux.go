@@ -0,0 +1,591 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Inspecting the pages of a database file, like the showdb program of
+// SQLite.
+//
+//	.page PGNO
+//	.btree TABLE|INDEX|ROOT
+//	.freelist
+//	.hexdump PGNO ?OFFSET ?LENGTH??
+//
+// .page decodes the page PGNO: the header, the cell pointers, the cells with
+// their records and overflow chains and the freeblocks of b-tree pages, the
+// pointers of freelist trunk, overflow and pointer map pages. .btree walks
+// the b-tree of a table or an index, or the one rooted at page ROOT, and
+// writes a line for each page. .freelist lists the trunk and leaf pages of
+// the freelist. .hexdump writes the bytes of a page, or of the LENGTH bytes
+// at OFFSET in it, annotated with the structures they belong to.
+//
+// The pages are read from the main database file, see .analyze-space.
+
+func init() {
+	metaCommands = append(metaCommands,
+		&metaCommand{
+			name:  "btree",
+			usage: "TABLE|INDEX|ROOT",
+			help:  "Write the pages of a b-tree",
+			run:   btreeCommand,
+		},
+		&metaCommand{
+			name: "freelist",
+			help: "List the pages of the freelist",
+			run:  freelistCommand,
+		},
+		&metaCommand{
+			name:  "hexdump",
+			usage: "PGNO ?OFFSET ?LENGTH??",
+			help:  "Write an annotated hex dump of page PGNO",
+			run:   hexdumpCommand,
+		},
+		&metaCommand{
+			name:  "page",
+			usage: "PGNO",
+			help:  "Decode page PGNO",
+			run:   pageCommand,
+		},
+	)
+}
+
+var pageTypeNames = map[int]string{
+	pageIndexInterior: "index interior",
+	pageTableInterior: "table interior",
+	pageIndexLeaf:     "index leaf",
+	pageTableLeaf:     "table leaf",
+}
+
+// Pointer map entry types.
+var ptrmapTypeNames = map[byte]string{
+	1: "root page",
+	2: "freelist page",
+	3: "first overflow page",
+	4: "overflow page",
+	5: "b-tree page",
+}
+
+// pageUse describes what the pages of a database are used for.
+type pageUse map[int]string
+
+// pageUses walks the b-trees of the schema and the freelist of d.
+func pageUses(s *shell, d *dbFile) (pageUse, error) {
+	rows, err := s.conn().query("SELECT type, name, rootpage FROM main.sqlite_master WHERE rootpage > 0 ORDER BY rowid")
+	if err != nil {
+		return nil, err
+	}
+
+	u := pageUse{d.lockPage(): "lock-byte page"}
+	for n := 1; n <= d.nPage; n++ {
+		if d.isPtrmap(n) {
+			u[n] = "pointer map page"
+		}
+	}
+	d.freelistTrunks(func(trunk, next int, leaves []int) {
+		u[trunk] = "freelist trunk page"
+		for _, v := range leaves {
+			u[v] = "freelist leaf page"
+		}
+	})
+	u.walk(d, 1, "sqlite_master", map[int]bool{})
+	for _, v := range rows {
+		u.walk(d, int(v[2].(int64)), fmt.Sprintf("%s %s", v[0], v[1]), map[int]bool{})
+	}
+	return u, nil
+}
+
+func (u pageUse) walk(d *dbFile, pgno int, owner string, seen map[int]bool) {
+	if seen[pgno] {
+		return
+	}
+
+	seen[pgno] = true
+	p, err := d.btreePage(pgno)
+	if err != nil {
+		return
+	}
+
+	u[pgno] = fmt.Sprintf("%s page of %s", pageTypeNames[p.typ], owner)
+	for i := range p.cells {
+		c, _ := d.cell(p, i)
+		if c == nil {
+			continue
+		}
+
+		for _, v := range c.overflow {
+			u[v] = fmt.Sprintf("overflow page of %s", owner)
+		}
+		if !p.isLeaf() {
+			u.walk(d, c.child, owner, seen)
+		}
+	}
+	if !p.isLeaf() {
+		u.walk(d, p.right, owner, seen)
+	}
+}
+
+func (u pageUse) of(pgno int) string {
+	if v, ok := u[pgno]; ok {
+		return v
+	}
+
+	return "unused page"
+}
+
+func parsePgno(d *dbFile, s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > d.nPage {
+		return 0, fmt.Errorf("%s: not a page number, the database has %d pages", s, d.nPage)
+	}
+
+	return n, nil
+}
+
+func pageCommand(s *shell, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	d, err := mainDBFile(s, "inspect")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	pgno, err := parsePgno(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	use, err := pageUses(s, d)
+	if err != nil {
+		return err
+	}
+
+	b, err := d.page(pgno)
+	if err != nil {
+		return err
+	}
+
+	s.printf("Page %d: %s\n", pgno, use.of(pgno))
+	kind := use.of(pgno)
+	switch {
+	case strings.HasPrefix(kind, "freelist trunk"):
+		k := int(binary.BigEndian.Uint32(b[4:]))
+		s.printf("next trunk page %d\nleaf pages %d:", binary.BigEndian.Uint32(b), k)
+		for i := 0; i < k && 8+4*i+4 <= d.usable; i++ {
+			s.printf(" %d", binary.BigEndian.Uint32(b[8+4*i:]))
+		}
+		s.printf("\n")
+	case strings.HasPrefix(kind, "overflow"):
+		s.printf("next overflow page %d\n", binary.BigEndian.Uint32(b))
+	case strings.HasPrefix(kind, "pointer map"):
+		for i := 0; 5*i+5 <= d.usable; i++ {
+			if b[5*i] == 0 {
+				continue
+			}
+
+			s.printf("page %d: %s, parent %d\n", pgno+1+i, ptrmapTypeNames[b[5*i]], binary.BigEndian.Uint32(b[5*i+1:]))
+		}
+	default:
+		p, err := d.btreePage(pgno)
+		if err != nil {
+			if pgno == 1 || strings.Contains(kind, " page of ") {
+				return err
+			}
+
+			s.printf("not a b-tree page, see .hexdump\n")
+			return nil
+		}
+
+		pageBtree(s, d, p)
+	}
+	return nil
+}
+
+// pageBtree writes the decoded b-tree page p.
+func pageBtree(s *shell, d *dbFile, p *btreePage) {
+	b := p.data
+	h := p.hdr
+	s.printf("b-tree page header at offset %d:\n", h)
+	s.printf("  page type          %d (%s)\n", p.typ, pageTypeNames[p.typ])
+	s.printf("  first freeblock    %d\n", binary.BigEndian.Uint16(b[h+1:]))
+	s.printf("  cells              %d\n", len(p.cells))
+	s.printf("  cell content       %d\n", binary.BigEndian.Uint16(b[h+5:]))
+	s.printf("  fragmented bytes   %d\n", b[h+7])
+	if !p.isLeaf() {
+		s.printf("  right child        %d\n", p.right)
+	}
+	for i, off := range p.cells {
+		c, err := d.cell(p, i)
+		if c == nil {
+			s.printf("cell %d at offset %d: %v\n", i, off, err)
+			continue
+		}
+
+		s.printf("cell %d at offset %d, %d bytes:", i, off, c.size)
+		if !p.isLeaf() {
+			s.printf(" left child %d,", c.child)
+		}
+		if p.isTable() {
+			s.printf(" rowid %d", c.rowid)
+		}
+		if p.typ != pageTableInterior {
+			s.printf(" payload %d bytes, %d local", len(c.payload), c.local)
+		}
+		s.printf("\n")
+		if len(c.overflow) != 0 {
+			s.printf("  overflow pages %s\n", joinInts(c.overflow))
+		}
+		if err != nil {
+			s.printf("  %v\n", err)
+			continue
+		}
+
+		if p.typ == pageTableInterior {
+			continue
+		}
+
+		values, err := d.decodeRecord(c.payload)
+		if err != nil {
+			s.printf("  %v\n", err)
+			continue
+		}
+
+		a := make([]string, len(values))
+		for i, v := range values {
+			a[i] = shortLiteral(v)
+		}
+		s.printf("  record (%s)\n", strings.Join(a, ", "))
+	}
+	for _, v := range freeblocks(d, p) {
+		s.printf("freeblock at offset %d, %d bytes\n", v[0], v[1])
+	}
+	if n, err := d.unused(p); err == nil {
+		s.printf("%d unused bytes\n", n)
+	}
+}
+
+// freeblocks returns the offsets and sizes of the freeblocks of p.
+func freeblocks(d *dbFile, p *btreePage) [][2]int {
+	var r [][2]int
+	b := p.data[:d.usable]
+	seen := map[int]bool{}
+	for off := int(binary.BigEndian.Uint16(b[p.hdr+1:])); off != 0 && off+4 <= len(b) && !seen[off]; off = int(binary.BigEndian.Uint16(b[off:])) {
+		seen[off] = true
+		r = append(r, [2]int{off, int(binary.BigEndian.Uint16(b[off+2:]))})
+	}
+	return r
+}
+
+// shortLiteral returns v as an SQL literal of at most about 40 bytes.
+func shortLiteral(v interface{}) string {
+	s := sqlLiteral(v)
+	if len(s) > 40 {
+		s = s[:36] + "..." + s[len(s)-1:]
+	}
+	return s
+}
+
+func joinInts(a []int) string {
+	s := make([]string, len(a))
+	for i, v := range a {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, " ")
+}
+
+func btreeCommand(s *shell, args []string) error {
+	if len(args) != 1 {
+		return errUsage
+	}
+
+	d, err := mainDBFile(s, "inspect")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	root, err := strconv.Atoi(args[0])
+	if err != nil {
+		row, err := s.conn().queryRow("SELECT rootpage FROM main.sqlite_master WHERE name = ? COLLATE NOCASE AND rootpage > 0", args[0])
+		if err != nil {
+			return err
+		}
+
+		if row == nil {
+			return fmt.Errorf("no such table or index: %s", args[0])
+		}
+
+		root = int(row[0].(int64))
+	}
+	if root, err = parsePgno(d, strconv.Itoa(root)); err != nil {
+		return err
+	}
+
+	btreeWalk(s, d, root, 0, map[int]bool{})
+	return nil
+}
+
+// btreeWalk writes a line for the page pgno and its children, indented by
+// their depth.
+func btreeWalk(s *shell, d *dbFile, pgno, depth int, seen map[int]bool) {
+	indent := strings.Repeat("  ", depth)
+	if seen[pgno] {
+		s.printf("%spage %d: already seen, the b-tree has a loop\n", indent, pgno)
+		return
+	}
+
+	seen[pgno] = true
+	p, err := d.btreePage(pgno)
+	if err != nil {
+		s.printf("%spage %d: %v\n", indent, pgno, err)
+		return
+	}
+
+	var children, overflow []int
+	var first, last int64
+	for i := range p.cells {
+		c, err := d.cell(p, i)
+		if err != nil {
+			s.printf("%spage %d: cell %d: %v\n", indent, pgno, i, err)
+		}
+		if c == nil {
+			continue
+		}
+
+		if i == 0 {
+			first = c.rowid
+		}
+		last = c.rowid
+		overflow = append(overflow, c.overflow...)
+		children = append(children, c.child)
+	}
+	unused, _ := d.unused(p)
+	line := fmt.Sprintf("%spage %d: %s, %d cells", indent, pgno, pageTypeNames[p.typ], len(p.cells))
+	if p.isTable() && len(p.cells) != 0 {
+		line += fmt.Sprintf(", rowid %d..%d", first, last)
+	}
+	line += fmt.Sprintf(", %d bytes unused", unused)
+	if len(overflow) != 0 {
+		line += fmt.Sprintf(", overflow pages %s", joinInts(overflow))
+	}
+	s.printf("%s\n", line)
+	if !p.isLeaf() {
+		for _, v := range append(children, p.right) {
+			btreeWalk(s, d, v, depth+1, seen)
+		}
+	}
+}
+
+func freelistCommand(s *shell, args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+
+	d, err := mainDBFile(s, "inspect")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	n := 0
+	err = d.freelistTrunks(func(trunk, next int, leaves []int) {
+		s.printf("trunk page %d: %d leaf pages, next trunk page %d\n", trunk, len(leaves), next)
+		if len(leaves) != 0 {
+			s.printf("  %s\n", joinInts(leaves))
+		}
+		n += 1 + len(leaves)
+	})
+	if err != nil {
+		return err
+	}
+
+	s.printf("%d freelist pages, the header has %d\n", n, binary.BigEndian.Uint32(d.header[36:]))
+	return nil
+}
+
+// dbHeaderFields are the fields of the database header by offset.
+var dbHeaderFields = map[int]string{
+	0:  "magic string",
+	16: "page size",
+	18: "file format write version",
+	19: "file format read version",
+	20: "reserved bytes",
+	21: "max embedded payload fraction",
+	22: "min embedded payload fraction",
+	23: "leaf payload fraction",
+	24: "file change counter",
+	28: "database size in pages",
+	32: "first freelist trunk page",
+	36: "freelist pages",
+	40: "schema cookie",
+	44: "schema format",
+	48: "default cache size",
+	52: "largest root page",
+	56: "text encoding",
+	60: "user version",
+	64: "incremental vacuum",
+	68: "application id",
+	72: "reserved for expansion",
+	92: "version-valid-for",
+	96: "SQLite version number",
+}
+
+// pageRegions returns the labels of the structures of page pgno by the
+// offset they start at.
+func pageRegions(d *dbFile, pgno int, b []byte, use string) map[int][]string {
+	r := map[int][]string{}
+	add := func(off int, label string) { r[off] = append(r[off], label) }
+	if pgno == 1 {
+		for k, v := range dbHeaderFields {
+			add(k, v)
+		}
+	}
+	if d.usable < d.pageSize {
+		add(d.usable, "reserved bytes")
+	}
+	switch {
+	case strings.HasPrefix(use, "freelist trunk"):
+		add(0, "next trunk page")
+		add(4, "leaf count")
+		add(8, "leaf pages")
+		return r
+	case strings.HasPrefix(use, "overflow"):
+		add(0, "next overflow page")
+		add(4, "overflow content")
+		return r
+	case strings.HasPrefix(use, "pointer map"):
+		add(0, "pointer map entries")
+		return r
+	}
+
+	p, err := d.btreePage(pgno)
+	if err != nil {
+		return r
+	}
+
+	add(p.hdr, "b-tree page header")
+	ptrs := p.hdr + 8
+	if !p.isLeaf() {
+		add(p.hdr+8, "right child")
+		ptrs += 4
+	}
+	if len(p.cells) != 0 {
+		add(ptrs, "cell pointers")
+	}
+	if end := ptrs + 2*len(p.cells); end < int(binary.BigEndian.Uint16(b[p.hdr+5:])) {
+		add(end, "unallocated space")
+	}
+	for i, off := range p.cells {
+		label := fmt.Sprintf("cell %d", i)
+		if c, _ := d.cell(p, i); c != nil {
+			label += fmt.Sprintf(" (%d bytes)", c.size)
+		}
+		add(off, label)
+	}
+	for _, v := range freeblocks(d, p) {
+		add(v[0], fmt.Sprintf("freeblock (%d bytes)", v[1]))
+	}
+	return r
+}
+
+func hexdumpCommand(s *shell, args []string) error {
+	if len(args) < 1 || len(args) > 3 {
+		return errUsage
+	}
+
+	d, err := mainDBFile(s, "inspect")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	pgno, err := parsePgno(d, args[0])
+	if err != nil {
+		return err
+	}
+
+	start, end := 0, d.pageSize
+	if len(args) > 1 {
+		if start, err = strconv.Atoi(args[1]); err != nil || start < 0 || start >= d.pageSize {
+			return fmt.Errorf("%s: not an offset in the page", args[1])
+		}
+
+		end = min(start+16, d.pageSize)
+	}
+	if len(args) > 2 {
+		n, err := strconv.Atoi(args[2])
+		if err != nil || n < 0 {
+			return fmt.Errorf("%s: not a length", args[2])
+		}
+
+		end = min(start+n, d.pageSize)
+	}
+	use, err := pageUses(s, d)
+	if err != nil {
+		return err
+	}
+
+	b, err := d.page(pgno)
+	if err != nil {
+		return err
+	}
+
+	s.printf("Page %d: %s, offset %d in the file\n", pgno, use.of(pgno), int64(pgno-1)*int64(d.pageSize))
+	regions := pageRegions(d, pgno, b, use.of(pgno))
+	var offs []int
+	for k := range regions {
+		offs = append(offs, k)
+	}
+	sort.Ints(offs)
+	var prev []byte
+	skipped := false
+	for off := start &^ 15; off < end; off += 16 {
+		line := b[off:min(off+16, len(b))]
+		var labels []string
+		for _, k := range offs {
+			if k >= off && k < off+16 && k >= start && k < end {
+				labels = append(labels, regions[k]...)
+			}
+		}
+		// Runs of lines like the one before them, without annotations,
+		// are written as a single "*" like hexdump(1).
+		if len(labels) == 0 && bytes.Equal(line, prev) && off+16 < end {
+			if !skipped {
+				s.printf("*\n")
+				skipped = true
+			}
+			continue
+		}
+
+		skipped = false
+		prev = line
+		var hex, text bytes.Buffer
+		for i, v := range line {
+			if off+i < start || off+i >= end {
+				hex.WriteString("   ")
+				text.WriteByte(' ')
+				continue
+			}
+
+			fmt.Fprintf(&hex, "%02x ", v)
+			if v < ' ' || v > '~' {
+				v = '.'
+			}
+			text.WriteByte(v)
+		}
+		s.printf("%04x: %-48s %-16s", off, hex.String(), text.String())
+		if len(labels) != 0 {
+			s.printf("  %s", strings.Join(labels, ", "))
+		}
+		s.printf("\n")
+	}
+	return nil
+}
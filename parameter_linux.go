@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Values for the parameters of SQL statements run by the shell.
+//
+//	.parameter init			create the parameter table if it does not
+//					exist yet
+//	.parameter list			list the parameters and their values
+//	.parameter set NAME VALUE	set parameter NAME to VALUE
+//	.parameter unset NAME		remove parameter NAME
+//	.parameter clear		remove all parameters
+//
+// The parameters are kept in the temp.sqlite_parameters table, which can also
+// be changed with SQL. NAME includes the prefix of the parameter, like :a,
+// @b, $c or ?1. VALUE is an SQL expression, like 42, 'text' or x'00ff', or,
+// if it does not parse as one, a text. Statements run by the shell bind the
+// parameters found in the table before they are stepped, other parameters
+// are NULL. The command line option -param NAME=VALUE is the same as
+// .parameter set NAME VALUE.
+
+const paramTable = "temp.sqlite_parameters"
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "parameter",
+		abbrev: 4,
+		usage:  "CMD ...",
+		help: `Manage SQL parameter bindings
+clear            Remove all parameters
+init             Create the parameter table
+list             List the parameters
+set NAME VALUE   Set parameter NAME to VALUE
+unset NAME       Remove parameter NAME`,
+		run: parameterCommand,
+	})
+	cmdlineOptions = append(cmdlineOptions, &cmdlineOption{
+		name:  "-param",
+		value: "NAME=VALUE",
+		help:  "set parameter NAME to VALUE, see .parameter",
+		run: func(s *shell, value string) error {
+			i := strings.IndexByte(value, '=')
+			if i <= 0 {
+				return fmt.Errorf("-param %s: expected NAME=VALUE", value)
+			}
+
+			return paramSet(s.conn(), value[:i], value[i+1:])
+		},
+	})
+}
+
+func parameterCommand(s *shell, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	c := s.conn()
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "clear" && len(args) == 0:
+		if !paramExists(c) {
+			return nil
+		}
+
+		return c.exec("DELETE FROM " + paramTable)
+	case cmd == "init" && len(args) == 0:
+		return paramInit(c)
+	case cmd == "list" && len(args) == 0:
+		if !paramExists(c) {
+			return nil
+		}
+
+		// The table may hold keys of other types, inserted by SQL.
+		rows, err := c.query("SELECT CAST(key AS TEXT), quote(value) FROM " + paramTable + " ORDER BY key")
+		if err != nil {
+			return err
+		}
+
+		w := 0
+		for _, v := range rows {
+			if n := len(v[0].(string)); n > w {
+				w = n
+			}
+		}
+		for _, v := range rows {
+			s.printf("%-*s %s\n", w, v[0], v[1])
+		}
+		return nil
+	case cmd == "set" && len(args) == 2:
+		return paramSet(c, args[0], args[1])
+	case cmd == "unset" && len(args) == 1:
+		if !paramExists(c) {
+			return nil
+		}
+
+		return c.exec("DELETE FROM "+paramTable+" WHERE key = ?", args[0])
+	}
+	return errUsage
+}
+
+// paramExists reports whether the parameter table exists.
+func paramExists(c *sqlConn) bool {
+	row, err := c.queryRow("SELECT 1 FROM temp.sqlite_master WHERE type = 'table' AND name = 'sqlite_parameters'")
+	return err == nil && row != nil
+}
+
+// paramInit creates the parameter table. Names starting with sqlite_ are
+// reserved unless the schema is writable.
+func paramInit(c *sqlConn) error {
+	if paramExists(c) {
+		return nil
+	}
+
+	row, err := c.queryRow("PRAGMA writable_schema")
+	if err != nil {
+		return err
+	}
+
+	if err := c.exec("PRAGMA writable_schema = ON"); err != nil {
+		return err
+	}
+
+	err = c.exec("CREATE TABLE IF NOT EXISTS " + paramTable + "(key TEXT PRIMARY KEY, value) WITHOUT ROWID")
+	if e := c.exec(fmt.Sprintf("PRAGMA writable_schema = %d", row[0])); err == nil {
+		err = e
+	}
+	return err
+}
+
+// paramSet sets the parameter name to the value of the SQL expression value
+// or, if that does not compile, to value as text. Only the one statement
+// setting the parameter runs, value cannot append others.
+func paramSet(c *sqlConn, name, value string) error {
+	if err := paramInit(c); err != nil {
+		return err
+	}
+
+	stmt, tail, err := c.prepareTail("REPLACE INTO " + paramTable + "(key, value) VALUES(?, " + value + ")")
+	if err == nil && stmt != nil {
+		defer stmt.close()
+		if strings.TrimSpace(tail) != "" {
+			return fmt.Errorf("%s: not a single SQL expression", value)
+		}
+
+		if err := stmt.bind(name); err != nil {
+			return err
+		}
+
+		_, err := stmt.step()
+		return err
+	}
+
+	return c.exec("REPLACE INTO "+paramTable+"(key, value) VALUES(?, ?)", name, value)
+}
+
+// bindParameters binds the values in the parameter table to the parameters
+// of pStmt, see .parameter.
+func bindParameters(tls TLS, p, pStmt uintptr) {
+	n := int(Xsqlite3_bind_parameter_count(tls, pStmt))
+	if n == 0 {
+		return
+	}
+
+	c := &sqlConn{tls, Xsqlite3_db_handle(tls, pStmt)}
+	if !paramExists(c) {
+		return
+	}
+
+	q, err := c.prepare("SELECT value FROM " + paramTable + " WHERE key = ?")
+	if err != nil {
+		return
+	}
+
+	defer q.close()
+	for i := 1; i <= n; i++ {
+		name := goString(Xsqlite3_bind_parameter_name(tls, pStmt, int32(i)))
+		if name == "" {
+			name = fmt.Sprintf("?%d", i)
+		}
+		if err := q.bind(name); err != nil {
+			return
+		}
+
+		if ok, _ := q.step(); ok {
+			Xsqlite3_bind_value(tls, pStmt, int32(i), Xsqlite3_column_value(tls, q.p, 0))
+			continue
+		}
+
+		Xsqlite3_bind_null(tls, pStmt, int32(i))
+	}
+}
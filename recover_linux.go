@@ -0,0 +1,466 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Salvaging data from a corrupt database.
+//
+//	.recover ?--lost-and-found TABLE?
+//
+// .recover reads the b-tree pages of the database file directly, without the
+// help of SQLite, and writes an SQL script that rebuilds the schema and the
+// data it could read. The schema is read from sqlite_master or, when that is
+// unreadable, from the pages that look like parts of it. Rows of table leaf
+// pages which do not belong to any table, and rows which do not fit their
+// table, are written to the lost_and_found table:
+//
+//	CREATE TABLE lost_and_found(rootpgno INTEGER, pgno INTEGER, nfield INTEGER, id INTEGER, c0, c1, ...);
+//
+// rootpgno is the root of the b-tree the page seems to belong to, pgno the
+// page, nfield the number of fields of the row, id its rowid and c0, c1, ...
+// its fields. A different name can be set with --lost-and-found, a suffix is
+// added if the name is taken. The freelist, overflow and pointer map pages
+// are not searched for rows.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "recover",
+		abbrev: 4,
+		usage:  "?--lost-and-found TABLE?",
+		help:   "Recover as much data as possible from a corrupt database",
+		run:    recoverCommand,
+	})
+}
+
+var withoutRowidRe = regexp.MustCompile(`(?i)\bWITHOUT\s+ROWID\s*;?\s*$`)
+
+type schemaRow struct {
+	typ     string
+	name    string
+	tblName string
+	root    int
+	sql     string
+}
+
+type recoverTable struct {
+	schemaRow
+	cols  []string // In record order.
+	rowid string   // Name used for the rowid, "" if WITHOUT ROWID.
+	alias int      // Index of the rowid alias in cols or -1.
+}
+
+type lostRow struct {
+	root   int
+	pgno   int
+	rowid  interface{}
+	values []interface{}
+}
+
+type recoverer struct {
+	s      *shell
+	d      *dbFile
+	used   map[int]bool
+	lost   []lostRow
+	errors int
+}
+
+func recoverCommand(s *shell, args []string) error {
+	lostAndFound := "lost_and_found"
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "-lost-and-found", "--lost-and-found":
+			if i+1 == len(args) {
+				return errUsage
+			}
+
+			i++
+			lostAndFound = args[i]
+		default:
+			return errUsage
+		}
+	}
+
+	d, err := mainDBFile(s, "recover")
+	if err != nil {
+		return err
+	}
+
+	defer d.close()
+	r := &recoverer{s: s, d: d, used: map[int]bool{}}
+	return r.run(lostAndFound)
+}
+
+func (r *recoverer) run(lostAndFound string) error {
+	schema := r.schema()
+	shadow, err := openMemory(r.s.tls)
+	if err != nil {
+		return err
+	}
+
+	defer shadow.close()
+	names := map[string]bool{}
+	virtual := false
+	for _, v := range schema {
+		names[strings.ToLower(v.name)] = true
+		virtual = virtual || v.typ == "table" && v.root == 0
+	}
+	for i, base := 0, lostAndFound; names[strings.ToLower(lostAndFound)]; i++ {
+		lostAndFound = fmt.Sprintf("%s_%d", base, i)
+	}
+
+	r.s.printf("PRAGMA foreign_keys=OFF;\nBEGIN TRANSACTION;\n")
+	if virtual {
+		r.s.printf("PRAGMA writable_schema=ON;\n")
+	}
+
+	// Tables first, their indexes, triggers and views after the data.
+	var tables []*recoverTable
+	for _, v := range schema {
+		if v.typ != "table" {
+			continue
+		}
+
+		switch lname := strings.ToLower(v.name); {
+		case v.root == 0:
+			r.s.printf("INSERT INTO sqlite_master(type,name,tbl_name,rootpage,sql)VALUES('table',%s,%s,0,%s);\n",
+				sqlQuote(v.name), sqlQuote(v.tblName), sqlQuote(v.sql))
+		case lname == "sqlite_sequence":
+			r.s.printf("DELETE FROM sqlite_sequence;\n")
+			tables = append(tables, &recoverTable{v, []string{"name", "seq"}, "rowid", -1})
+		case lname == "sqlite_stat1":
+			r.s.printf("ANALYZE sqlite_master;\n")
+			tables = append(tables, &recoverTable{v, []string{"tbl", "idx", "stat"}, "rowid", -1})
+		case strings.HasPrefix(lname, "sqlite_"):
+			tables = append(tables, &recoverTable{schemaRow: v})
+		default:
+			r.s.printf("%s;\n", v.sql)
+			t, err := recoverColumns(shadow, v)
+			if err != nil {
+				r.errors++
+				t = &recoverTable{schemaRow: v}
+			}
+			tables = append(tables, t)
+		}
+	}
+
+	for _, t := range tables {
+		r.walk(t.root, func(p *btreePage, c *btreeCell) {
+			if !p.isLeaf() && p.isTable() {
+				return
+			}
+
+			values, err := r.d.decodeRecord(c.payload)
+			if err != nil {
+				r.errors++
+				return
+			}
+
+			var rowid interface{}
+			if p.isTable() {
+				rowid = c.rowid
+			}
+			if sql, ok := t.insert(rowid, values); ok {
+				r.s.printf("%s\n", sql)
+				return
+			}
+
+			if t.cols != nil || !strings.HasPrefix(strings.ToLower(t.name), "sqlite_") {
+				r.lost = append(r.lost, lostRow{t.root, p.pgno, rowid, values})
+			}
+		})
+	}
+	for _, v := range schema {
+		if v.typ == "index" && v.root > 0 {
+			r.walk(v.root, func(*btreePage, *btreeCell) {})
+		}
+	}
+	r.orphans()
+	r.lostAndFound(lostAndFound)
+	for _, v := range schema {
+		if v.typ != "table" && v.sql != "" {
+			r.s.printf("%s;\n", v.sql)
+		}
+	}
+	if virtual {
+		r.s.printf("PRAGMA writable_schema=OFF;\n")
+	}
+	r.s.printf("COMMIT;\n")
+	if r.errors != 0 {
+		r.s.printf("-- %d errors, some data could not be recovered\n", r.errors)
+	}
+	return nil
+}
+
+// walk calls fn for the cells of the b-tree rooted at page root, skipping
+// pages which are already used or cannot be read.
+func (r *recoverer) walk(root int, fn func(*btreePage, *btreeCell)) {
+	if r.used[root] {
+		return
+	}
+
+	r.used[root] = true
+	p, err := r.d.btreePage(root)
+	if err != nil {
+		r.errors++
+		return
+	}
+
+	for i := range p.cells {
+		c, err := r.d.cell(p, i)
+		if c != nil {
+			for _, v := range c.overflow {
+				r.used[v] = true
+			}
+		}
+		if err != nil {
+			r.errors++
+			continue
+		}
+
+		fn(p, c)
+		if !p.isLeaf() {
+			r.walk(c.child, fn)
+		}
+	}
+	if !p.isLeaf() {
+		r.walk(p.right, fn)
+	}
+}
+
+// schema returns the rows of sqlite_master, if readable, or the rows found
+// on any table leaf page that look like them.
+func (r *recoverer) schema() []schemaRow {
+	var a []schemaRow
+	seen := map[string]bool{}
+	add := func(values []interface{}) bool {
+		if len(values) != 5 {
+			return false
+		}
+
+		var v schemaRow
+		var ok [5]bool
+		v.typ, ok[0] = values[0].(string)
+		v.name, ok[1] = values[1].(string)
+		v.tblName, ok[2] = values[2].(string)
+		root, ok3 := values[3].(int64)
+		ok[3] = ok3 || values[3] == nil
+		v.sql, ok[4] = values[4].(string)
+		ok[4] = ok[4] || values[4] == nil
+		if ok != [5]bool{true, true, true, true, true} || root < 0 || root > int64(r.d.nPage) {
+			return false
+		}
+
+		switch v.typ {
+		case "table", "index", "view", "trigger":
+		default:
+			return false
+		}
+
+		if v.sql != "" && !strings.HasPrefix(strings.ToUpper(v.sql), "CREATE ") {
+			return false
+		}
+
+		v.root = int(root)
+		if k := v.typ + "\x00" + strings.ToLower(v.name); !seen[k] {
+			seen[k] = true
+			a = append(a, v)
+		}
+		return true
+	}
+
+	r.walk(1, func(p *btreePage, c *btreeCell) {
+		if p.typ != pageTableLeaf {
+			return
+		}
+
+		if values, err := r.d.decodeRecord(c.payload); err == nil {
+			add(values)
+		}
+	})
+	if len(a) != 0 {
+		return a
+	}
+
+	for n := 2; n <= r.d.nPage; n++ {
+		p, err := r.d.btreePage(n)
+		if err != nil || p.typ != pageTableLeaf {
+			continue
+		}
+
+		for i := range p.cells {
+			if c, err := r.d.cell(p, i); err == nil {
+				if values, err := r.d.decodeRecord(c.payload); err == nil && add(values) {
+					r.used[n] = true
+				}
+			}
+		}
+	}
+	return a
+}
+
+// recoverColumns returns the table v with its columns.
+func recoverColumns(shadow *sqlConn, v schemaRow) (*recoverTable, error) {
+	if err := shadow.exec(v.sql); err != nil {
+		return nil, err
+	}
+
+	rows, err := shadow.query(fmt.Sprintf("PRAGMA table_info(%s)", sqlQuoteID(v.name)))
+	if err != nil {
+		return nil, err
+	}
+
+	t := &recoverTable{schemaRow: v, alias: -1}
+	var pk, other []string
+	for _, v := range rows {
+		name, k := v[1].(string), int(v[5].(int64))
+		if k == 0 {
+			other = append(other, name)
+			continue
+		}
+
+		if k > len(pk) {
+			pk = append(pk, make([]string, k-len(pk))...)
+		}
+		pk[k-1] = name
+	}
+	if withoutRowidRe.MatchString(v.sql) {
+		t.cols = append(pk, other...)
+		return t, nil
+	}
+
+	for i, v := range rows {
+		t.cols = append(t.cols, v[1].(string))
+		if len(pk) == 1 && v[5].(int64) == 1 && strings.EqualFold(v[2].(string), "INTEGER") {
+			t.alias = i
+		}
+	}
+	t.rowid = "rowid"
+	for _, v := range []string{"rowid", "_rowid_", "oid"} {
+		t.rowid = v
+		found := false
+		for _, c := range t.cols {
+			found = found || strings.EqualFold(c, v)
+		}
+		if !found {
+			break
+		}
+	}
+	return t, nil
+}
+
+// insert returns the INSERT statement of the row. It fails if the row does
+// not fit the table.
+func (t *recoverTable) insert(rowid interface{}, values []interface{}) (string, bool) {
+	if t.cols == nil || len(values) > len(t.cols) || (rowid == nil) != (t.rowid == "") {
+		return "", false
+	}
+
+	var cols, vals []string
+	if rowid != nil && (t.alias < 0 || t.alias >= len(values)) {
+		cols = append(cols, t.rowid)
+		vals = append(vals, sqlLiteral(rowid))
+	}
+	for i, v := range values {
+		if i == t.alias && v == nil {
+			v = rowid
+		}
+		cols = append(cols, sqlQuoteID(t.cols[i]))
+		vals = append(vals, sqlLiteral(v))
+	}
+	return fmt.Sprintf("INSERT OR IGNORE INTO %s(%s) VALUES(%s);", sqlQuoteID(t.name), strings.Join(cols, ","), strings.Join(vals, ",")), true
+}
+
+// orphans adds the rows of the table leaf pages not used by any b-tree to
+// r.lost.
+func (r *recoverer) orphans() {
+	if a, err := r.d.freelist(); err != nil {
+		r.errors++
+	} else {
+		for _, v := range a {
+			r.used[v] = true
+		}
+	}
+	r.used[r.d.lockPage()] = true
+
+	parent := map[int]int{}
+	var leaves []*btreePage
+	for n := 1; n <= r.d.nPage; n++ {
+		if r.used[n] || r.d.isPtrmap(n) {
+			continue
+		}
+
+		p, err := r.d.btreePage(n)
+		if err != nil {
+			continue
+		}
+
+		switch p.typ {
+		case pageTableInterior:
+			for i := range p.cells {
+				if c, err := r.d.cell(p, i); err == nil {
+					parent[c.child] = n
+				}
+			}
+			parent[p.right] = n
+		case pageTableLeaf:
+			leaves = append(leaves, p)
+		}
+	}
+	for _, p := range leaves {
+		root := p.pgno
+		seen := map[int]bool{root: true}
+		for {
+			n, ok := parent[root]
+			if !ok || seen[n] {
+				break
+			}
+
+			seen[n] = true
+			root = n
+		}
+		for i := range p.cells {
+			c, err := r.d.cell(p, i)
+			if err != nil {
+				r.errors++
+				continue
+			}
+
+			values, err := r.d.decodeRecord(c.payload)
+			if err != nil {
+				r.errors++
+				continue
+			}
+
+			r.lost = append(r.lost, lostRow{root, p.pgno, c.rowid, values})
+		}
+	}
+}
+
+// lostAndFound writes the table name with the rows of r.lost.
+func (r *recoverer) lostAndFound(name string) {
+	if len(r.lost) == 0 {
+		return
+	}
+
+	n := 0
+	for _, v := range r.lost {
+		if len(v.values) > n {
+			n = len(v.values)
+		}
+	}
+	cols := []string{"rootpgno INTEGER", "pgno INTEGER", "nfield INTEGER", "id INTEGER"}
+	for i := 0; i < n; i++ {
+		cols = append(cols, fmt.Sprintf("c%d", i))
+	}
+	r.s.printf("CREATE TABLE %s(%s);\n", sqlQuoteID(name), strings.Join(cols, ", "))
+	for _, v := range r.lost {
+		vals := []string{sqlLiteral(int64(v.root)), sqlLiteral(int64(v.pgno)), sqlLiteral(int64(len(v.values))), sqlLiteral(v.rowid)}
+		for _, v := range v.values {
+			vals = append(vals, sqlLiteral(v))
+		}
+		r.s.printf("INSERT INTO %s VALUES(%s);\n", sqlQuoteID(name), strings.Join(vals, ","))
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import "regexp"
+
+// The regexp extension. Patterns use the RE2 syntax of the Go regexp package.
+//
+//	regexp(P, X)			1 if X matches P, 0 otherwise; X REGEXP P
+//	regexp_replace(X, P, R)		X with all matches of P replaced by R
+//	regexp_substr(X, P)		the first match of P in X or NULL
+//	regexp_capture(X, P [, N])	capture group N, default 0, of the first
+//					match of P in X or NULL
+//
+// R may refer to capture groups as $1 or ${name}. The result of all functions
+// is NULL if any argument is NULL. Compiled patterns are cached for as long as
+// the pattern is a constant of the statement.
+
+var regexpFuncs = []struct {
+	name string
+	nArg int32
+	fn   func(TLS, uintptr, int32, uintptr)
+}{
+	{"regexp", 2, regexpFunc},
+	{"regexp_replace", 3, regexpReplaceFunc},
+	{"regexp_substr", 2, regexpSubstrFunc},
+	{"regexp_capture", 2, regexpCaptureFunc},
+	{"regexp_capture", 3, regexpCaptureFunc},
+}
+
+// Xsqlite3_regexp_init registers the regexp functions with db.
+func Xsqlite3_regexp_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	for _, v := range regexpFuncs {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_function(tls, db, zName, v.nArg, sqliteUTF8|sqliteDeterministic, 0, cfnFunc(v.fn), 0, 0)
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+// regexpArgs returns the compiled pattern, the i-th argument, and reports
+// whether the function should proceed. It returns false after setting the
+// result to NULL, if any argument is NULL, or to the compile error.
+func regexpArgs(tls TLS, ctx uintptr, argc int32, args uintptr, i int) (*regexp.Regexp, bool) {
+	for j := 0; j < int(argc); j++ {
+		if Xsqlite3_value_type(tls, argv(args, j)) == sqliteNull {
+			Xsqlite3_result_null(tls, ctx)
+			return nil, false
+		}
+	}
+
+	c := &FuncContext{tls, ctx}
+	if re, ok := c.AuxData(i).(*regexp.Regexp); ok {
+		return re, true
+	}
+
+	re, err := regexp.Compile(valueText(tls, argv(args, i)))
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return nil, false
+	}
+
+	c.SetAuxData(i, re)
+	return re, true
+}
+
+func regexpFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	re, ok := regexpArgs(tls, ctx, argc, args, 0)
+	if !ok {
+		return
+	}
+
+	var r int32
+	if re.MatchString(valueText(tls, argv(args, 1))) {
+		r = 1
+	}
+	Xsqlite3_result_int(tls, ctx, r)
+}
+
+func regexpReplaceFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	re, ok := regexpArgs(tls, ctx, argc, args, 1)
+	if !ok {
+		return
+	}
+
+	resultText(tls, ctx, re.ReplaceAllString(valueText(tls, argv(args, 0)), valueText(tls, argv(args, 2))))
+}
+
+func regexpSubstrFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	re, ok := regexpArgs(tls, ctx, argc, args, 1)
+	if !ok {
+		return
+	}
+
+	s := valueText(tls, argv(args, 0))
+	loc := re.FindStringIndex(s)
+	if loc == nil {
+		Xsqlite3_result_null(tls, ctx)
+		return
+	}
+
+	resultText(tls, ctx, s[loc[0]:loc[1]])
+}
+
+func regexpCaptureFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	re, ok := regexpArgs(tls, ctx, argc, args, 1)
+	if !ok {
+		return
+	}
+
+	n := 0
+	if argc > 2 {
+		n = int(Xsqlite3_value_int64(tls, argv(args, 2)))
+	}
+	if n < 0 || n > re.NumSubexp() {
+		resultError(tls, ctx, "regexp_capture: no such capture group")
+		return
+	}
+
+	s := valueText(tls, argv(args, 0))
+	loc := re.FindStringSubmatchIndex(s)
+	if loc == nil || loc[2*n] < 0 {
+		Xsqlite3_result_null(tls, ctx)
+		return
+	}
+
+	resultText(tls, ctx, s[loc[2*n]:loc[2*n+1]])
+}
@@ -0,0 +1,997 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"unsafe"
+)
+
+// The rtree and rtree_i32 modules.
+//
+//	CREATE VIRTUAL TABLE rt USING rtree(id, minX, maxX, minY, maxY);
+//	SELECT id FROM rt WHERE minX <= 10 AND maxX >= 5 AND minY <= 20 AND maxY >= 15;
+//
+// A table has an integer id and one to five dimensions, each a pair of min
+// and max columns. rtree stores the coordinates as 32 bit floats, rounding
+// min down and max up, rtree_i32 as 32 bit integers. Range constraints on
+// the coordinates are served by the tree, equality on id by the id map.
+//
+// The tree is kept in the shadow tables rt_node, rt_rowid and rt_parent in
+// the format of upstream SQLite, so rtree tables of other SQLite
+// applications can be queried and modified. Auxiliary columns are not
+// supported.
+
+const (
+	rtreeMaxDimensions = 5
+	rtreeMaxCells      = 51 // Upper bound of the cells of a node.
+)
+
+// The letters of the constraint operators in idxStr, the same as upstream.
+const (
+	rtreeEQ = 'A'
+	rtreeLE = 'B'
+	rtreeLT = 'C'
+	rtreeGE = 'D'
+	rtreeGT = 'E'
+)
+
+// The SQLITE_INDEX_CONSTRAINT_* values of the operators above.
+var rtreeOps = map[byte]byte{2: rtreeEQ, 8: rtreeLE, 16: rtreeLT, 32: rtreeGE, 4: rtreeGT}
+
+const sqliteReplace = 5 // Conflict resolution mode of sqlite3_vtab_on_conflict.
+
+// rtreeTable is the Go part of a rtree table.
+type rtreeTable struct {
+	db       uintptr
+	schema   string // Database name.
+	name     string
+	cols     []string // Column names, id first.
+	nDim     int
+	i32      bool
+	nodeSize int // Size of the node blobs.
+}
+
+// rtreeCell is an entry of a node. id is the rowid in leaves and the child
+// node number otherwise. box has a min and max coordinate per dimension.
+type rtreeCell struct {
+	id  int64
+	box []float64
+}
+
+type rtreeNode struct {
+	no    int64 // Node number, 0 for new nodes, 1 is the root.
+	cells []rtreeCell
+}
+
+var rtreeModule = Ssqlite3_module{
+	XxCreate:     cfnConnect(rtreeCreate),
+	XxConnect:    cfnConnect(rtreeConnect),
+	XxBestIndex:  cfnVtab2(rtreeBestIndex),
+	XxDisconnect: cfnVtab(rtreeDisconnect),
+	XxDestroy:    cfnVtab(rtreeDestroy),
+	XxOpen:       cfnVtab2(rtreeOpen),
+	XxClose:      cfnVtab(rtreeClose),
+	XxFilter:     cfnFilter(rtreeFilter),
+	XxNext:       cfnVtab(rtreeNext),
+	XxEof:        cfnVtab(rtreeEof),
+	XxColumn:     cfnColumn(rtreeColumn),
+	XxRowid:      cfnVtab2(rtreeRowid),
+	XxUpdate:     cfnUpdate(rtreeUpdate),
+	XxRename:     cfnVtab2(rtreeRename),
+}
+
+// Xsqlite3_rtree_init registers the rtree and rtree_i32 modules, the
+// rtreenode and rtreedepth debugging functions and the geometry functions
+// with db. The client data of rtree_i32 is 1.
+func Xsqlite3_rtree_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	for i, v := range []string{"rtree", "rtree_i32"} {
+		zName := cString(tls, v)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(&rtreeModule)), uintptr(i))
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	for _, v := range []struct {
+		name string
+		nArg int32
+		fn   func(TLS, uintptr, int32, uintptr)
+	}{
+		{"rtreenode", 2, rtreenodeFunc},
+		{"rtreedepth", 1, rtreedepthFunc},
+	} {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		rc := Xsqlite3_create_function(tls, db, zName, v.nArg, sqliteUTF8, 0, cfnFunc(v.fn), 0, 0)
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return geoRegister(tls, db)
+}
+
+func (t *rtreeTable) conn(tls TLS) *sqlConn { return &sqlConn{tls, t.db} }
+
+// shadow returns the qualified name of the shadow table rt_suffix.
+func (t *rtreeTable) shadow(suffix string) string {
+	return sqlQuoteID(t.schema) + "." + sqlQuoteID(t.name+"_"+suffix)
+}
+
+func (t *rtreeTable) cellSize() int { return 8 + 8*t.nDim }
+
+func (t *rtreeTable) maxCells() int { return (t.nodeSize - 4) / t.cellSize() }
+
+func rtreeCreate(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return rtreeInit(tls, db, pAux, argc, args, ppVtab, pzErr, true)
+}
+
+func rtreeConnect(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return rtreeInit(tls, db, pAux, argc, args, ppVtab, pzErr, false)
+}
+
+func rtreeInit(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr, create bool) int32 {
+	a := make([]string, argc)
+	for i := range a {
+		a[i] = goString(argv(args, i))
+	}
+	t, err := newRtreeTable(db, a, pAux != 0)
+	if err == nil {
+		switch {
+		case create:
+			err = t.create(t.conn(tls))
+		default:
+			err = t.connect(t.conn(tls))
+		}
+	}
+	if err != nil {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, err.Error())
+		return sqliteError
+	}
+
+	zSchema := cString(tls, "CREATE TABLE x("+strings.Join(a[3:], ", ")+")")
+	if zSchema == 0 {
+		return sqliteNoMem
+	}
+
+	rc := Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, t)
+	return sqliteOK
+}
+
+// newRtreeTable parses the module arguments a.
+func newRtreeTable(db uintptr, a []string, i32 bool) (*rtreeTable, error) {
+	switch n := len(a) - 3; {
+	case n < 3:
+		return nil, fmt.Errorf("Too few columns for an rtree table")
+	case n > 2*rtreeMaxDimensions+1:
+		return nil, fmt.Errorf("Too many columns for an rtree table")
+	case n%2 == 0:
+		return nil, fmt.Errorf("Wrong number of columns for an rtree table")
+	}
+
+	t := &rtreeTable{db: db, schema: a[1], name: a[2], nDim: (len(a) - 4) / 2, i32: i32}
+	for _, v := range a[3:] {
+		v = strings.TrimSpace(v)
+		t.cols = append(t.cols, dequote(v[:identLen(v)]))
+	}
+	return t, nil
+}
+
+func (t *rtreeTable) create(c *sqlConn) error {
+	row, err := c.queryRow("PRAGMA " + sqlQuoteID(t.schema) + ".page_size")
+	if err != nil {
+		return err
+	}
+
+	t.nodeSize = int(row[0].(int64)) - 64
+	if n := 4 + t.cellSize()*rtreeMaxCells; n < t.nodeSize {
+		t.nodeSize = n
+	}
+	return c.exec(fmt.Sprintf(`
+CREATE TABLE %s(nodeno INTEGER PRIMARY KEY, data BLOB);
+CREATE TABLE %s(rowid INTEGER PRIMARY KEY, nodeno INTEGER);
+CREATE TABLE %s(nodeno INTEGER PRIMARY KEY, parentnode INTEGER);
+INSERT INTO %[1]s VALUES(1, zeroblob(%[4]d));`,
+		t.shadow("node"), t.shadow("rowid"), t.shadow("parent"), t.nodeSize,
+	))
+}
+
+func (t *rtreeTable) connect(c *sqlConn) error {
+	row, err := c.queryRow("SELECT length(data) FROM " + t.shadow("node") + " WHERE nodeno = 1")
+	if err != nil {
+		return err
+	}
+
+	if row != nil {
+		n, _ := row[0].(int64)
+		t.nodeSize = int(n)
+	}
+	if t.nodeSize < 4+t.cellSize() {
+		return fmt.Errorf("undersize RTree blobs in \"%s_node\"", t.name)
+	}
+
+	return nil
+}
+
+func rtreeDisconnect(tls TLS, tab uintptr) int32 {
+	deleteObject(tab)
+	Xsqlite3_free(tls, tab)
+	return sqliteOK
+}
+
+func rtreeDestroy(tls TLS, tab uintptr) int32 {
+	t := getObject(tab).(*rtreeTable)
+	var b []string
+	for _, v := range []string{"node", "rowid", "parent"} {
+		b = append(b, "DROP TABLE IF EXISTS "+t.shadow(v)+";")
+	}
+	if err := t.conn(tls).exec(strings.Join(b, "\n")); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	return rtreeDisconnect(tls, tab)
+}
+
+func rtreeRename(tls TLS, tab, zNew uintptr) int32 {
+	t := getObject(tab).(*rtreeTable)
+	name := goString(zNew)
+	var b []string
+	for _, v := range []string{"node", "rowid", "parent"} {
+		b = append(b, fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", t.shadow(v), sqlQuoteID(name+"_"+v)))
+	}
+	if err := t.conn(tls).exec(strings.Join(b, "\n")); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	t.name = name
+	return sqliteOK
+}
+
+// decodeNode returns the node no encoded in b and the tree depth stored in
+// the root.
+func (t *rtreeTable) decodeNode(no int64, b []byte) (*rtreeNode, int, error) {
+	if len(b) < 4 {
+		return nil, 0, fmt.Errorf("database disk image is malformed: rtree node %d", no)
+	}
+
+	n := &rtreeNode{no: no}
+	depth := int(binary.BigEndian.Uint16(b))
+	nCell := int(binary.BigEndian.Uint16(b[2:]))
+	if 4+nCell*t.cellSize() > len(b) {
+		return nil, 0, fmt.Errorf("database disk image is malformed: rtree node %d", no)
+	}
+
+	for i := 0; i < nCell; i++ {
+		p := b[4+i*t.cellSize():]
+		cell := rtreeCell{id: int64(binary.BigEndian.Uint64(p)), box: make([]float64, 2*t.nDim)}
+		for j := range cell.box {
+			u := binary.BigEndian.Uint32(p[8+4*j:])
+			switch {
+			case t.i32:
+				cell.box[j] = float64(int32(u))
+			default:
+				cell.box[j] = float64(math.Float32frombits(u))
+			}
+		}
+		n.cells = append(n.cells, cell)
+	}
+	return n, depth, nil
+}
+
+func (t *rtreeTable) encodeNode(n *rtreeNode, depth int) []byte {
+	b := make([]byte, t.nodeSize)
+	binary.BigEndian.PutUint16(b, uint16(depth))
+	binary.BigEndian.PutUint16(b[2:], uint16(len(n.cells)))
+	for i, cell := range n.cells {
+		p := b[4+i*t.cellSize():]
+		binary.BigEndian.PutUint64(p, uint64(cell.id))
+		for j, v := range cell.box {
+			switch {
+			case t.i32:
+				binary.BigEndian.PutUint32(p[8+4*j:], uint32(int32(v)))
+			default:
+				binary.BigEndian.PutUint32(p[8+4*j:], math.Float32bits(float32(v)))
+			}
+		}
+	}
+	return b
+}
+
+// readNode returns node no and, for the root, the depth of the tree.
+func (t *rtreeTable) readNode(c *sqlConn, no int64) (*rtreeNode, int, error) {
+	row, err := c.queryRow("SELECT data FROM "+t.shadow("node")+" WHERE nodeno = ?", no)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if row == nil {
+		return nil, 0, fmt.Errorf("database disk image is malformed: no rtree node %d", no)
+	}
+
+	b, _ := row[0].([]byte)
+	n, depth, err := t.decodeNode(no, b)
+	if no != 1 {
+		depth = 0
+	}
+	return n, depth, err
+}
+
+// writeNode stores n, a new node gets a node number. depth is stored only in
+// the root.
+func (t *rtreeTable) writeNode(c *sqlConn, n *rtreeNode, depth int) error {
+	if n.no != 1 {
+		depth = 0
+	}
+	var id interface{}
+	if n.no != 0 {
+		id = n.no
+	}
+	if err := c.exec("INSERT OR REPLACE INTO "+t.shadow("node")+" VALUES(?, ?)", id, t.encodeNode(n, depth)); err != nil {
+		return err
+	}
+
+	if n.no == 0 {
+		n.no = Xsqlite3_last_insert_rowid(c.tls, c.db)
+	}
+	return nil
+}
+
+// mapCells points the rowid map, for a leaf, or the parent map of the
+// children of n to n.
+func (t *rtreeTable) mapCells(c *sqlConn, n *rtreeNode, leaf bool) error {
+	q := "INSERT OR REPLACE INTO " + t.shadow("parent") + " VALUES(?, ?)"
+	if leaf {
+		q = "INSERT OR REPLACE INTO " + t.shadow("rowid") + " VALUES(?, ?)"
+	}
+	s, err := c.prepare(q)
+	if err != nil {
+		return err
+	}
+
+	defer s.close()
+	for _, cell := range n.cells {
+		if err := s.bind(cell.id, n.no); err != nil {
+			return err
+		}
+
+		if _, err := s.step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parentOf returns the node number of the parent of node no.
+func (t *rtreeTable) parentOf(c *sqlConn, no int64) (int64, error) {
+	row, err := c.queryRow("SELECT parentnode FROM "+t.shadow("parent")+" WHERE nodeno = ?", no)
+	if err != nil {
+		return 0, err
+	}
+
+	if row == nil {
+		return 0, fmt.Errorf("database disk image is malformed: no parent of rtree node %d", no)
+	}
+
+	p, _ := row[0].(int64)
+	return p, nil
+}
+
+func rtreeBox(cells []rtreeCell) []float64 {
+	box := append([]float64(nil), cells[0].box...)
+	for _, v := range cells[1:] {
+		for j := 0; j < len(box); j += 2 {
+			box[j] = math.Min(box[j], v.box[j])
+			box[j+1] = math.Max(box[j+1], v.box[j+1])
+		}
+	}
+	return box
+}
+
+func rtreeArea(box []float64) float64 {
+	a := 1.0
+	for j := 0; j < len(box); j += 2 {
+		a *= box[j+1] - box[j]
+	}
+	return a
+}
+
+func rtreeUnion(a, b []float64) []float64 {
+	return rtreeBox([]rtreeCell{{box: a}, {box: b}})
+}
+
+// insert adds cell to the leaves of the tree.
+func (t *rtreeTable) insert(c *sqlConn, cell rtreeCell) error {
+	root, depth, err := t.readNode(c, 1)
+	if err != nil {
+		return err
+	}
+
+	// Choose the leaf needing the least enlargement, nodes[0] is the root
+	// and idx[i] is the cell of nodes[i] pointing to nodes[i+1].
+	nodes := []*rtreeNode{root}
+	var idx []int
+	for n := root; len(nodes) <= depth; {
+		best := -1
+		var bestGrow, bestArea float64
+		for i, v := range n.cells {
+			area := rtreeArea(v.box)
+			grow := rtreeArea(rtreeUnion(v.box, cell.box)) - area
+			if best < 0 || grow < bestGrow || grow == bestGrow && area < bestArea {
+				best, bestGrow, bestArea = i, grow, area
+			}
+		}
+		if best < 0 {
+			return fmt.Errorf("database disk image is malformed: empty rtree node %d", n.no)
+		}
+
+		idx = append(idx, best)
+		if n, _, err = t.readNode(c, n.cells[best].id); err != nil {
+			return err
+		}
+
+		nodes = append(nodes, n)
+	}
+
+	leaf := nodes[len(nodes)-1]
+	leaf.cells = append(leaf.cells, cell)
+	if err := t.mapCells(c, &rtreeNode{leaf.no, []rtreeCell{cell}}, true); err != nil {
+		return err
+	}
+
+	for k := len(nodes) - 1; k >= 0; k-- {
+		n := nodes[k]
+		isLeaf := k == depth
+		if len(n.cells) <= t.maxCells() {
+			if err := t.writeNode(c, n, depth); err != nil {
+				return err
+			}
+
+			if k > 0 {
+				nodes[k-1].cells[idx[k-1]].box = rtreeBox(n.cells)
+			}
+			continue
+		}
+
+		a, b := rtreeSplit(n.cells, t.maxCells()/3)
+		if k == 0 {
+			// The root keeps node number 1 and gets two new children.
+			left, right := &rtreeNode{cells: a}, &rtreeNode{cells: b}
+			for _, v := range []*rtreeNode{left, right} {
+				if err := t.writeNode(c, v, 0); err != nil {
+					return err
+				}
+
+				if err := t.mapCells(c, v, isLeaf); err != nil {
+					return err
+				}
+			}
+			n.cells = []rtreeCell{{left.no, rtreeBox(a)}, {right.no, rtreeBox(b)}}
+			if err := t.mapCells(c, n, false); err != nil {
+				return err
+			}
+
+			return t.writeNode(c, n, depth+1)
+		}
+
+		n.cells = a
+		sibling := &rtreeNode{cells: b}
+		if err := t.writeNode(c, n, 0); err != nil {
+			return err
+		}
+
+		if err := t.writeNode(c, sibling, 0); err != nil {
+			return err
+		}
+
+		if err := t.mapCells(c, sibling, isLeaf); err != nil {
+			return err
+		}
+
+		parent := nodes[k-1]
+		parent.cells[idx[k-1]].box = rtreeBox(a)
+		parent.cells = append(parent.cells, rtreeCell{sibling.no, rtreeBox(b)})
+		if err := t.mapCells(c, &rtreeNode{parent.no, parent.cells[len(parent.cells)-1:]}, false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rtreeSplit divides cells into two groups of at least min cells using the
+// quadratic split of Guttman.
+func rtreeSplit(cells []rtreeCell, min int) (a, b []rtreeCell) {
+	if min < 1 {
+		min = 1
+	}
+	// Pick the two seeds wasting the most area when put together.
+	s1, s2 := 0, 1
+	worst := math.Inf(-1)
+	for i := range cells {
+		for j := i + 1; j < len(cells); j++ {
+			d := rtreeArea(rtreeUnion(cells[i].box, cells[j].box)) - rtreeArea(cells[i].box) - rtreeArea(cells[j].box)
+			if d > worst {
+				s1, s2, worst = i, j, d
+			}
+		}
+	}
+	a, b = []rtreeCell{cells[s1]}, []rtreeCell{cells[s2]}
+	boxA, boxB := cells[s1].box, cells[s2].box
+	var rest []rtreeCell
+	for i, v := range cells {
+		if i != s1 && i != s2 {
+			rest = append(rest, v)
+		}
+	}
+	for len(rest) != 0 {
+		switch {
+		case len(a)+len(rest) <= min:
+			return append(a, rest...), b
+		case len(b)+len(rest) <= min:
+			return a, append(b, rest...)
+		}
+
+		// Assign the cell with the strongest preference for a group.
+		best, bestDiff := 0, -1.0
+		var growA, growB float64
+		for i, v := range rest {
+			ga := rtreeArea(rtreeUnion(boxA, v.box)) - rtreeArea(boxA)
+			gb := rtreeArea(rtreeUnion(boxB, v.box)) - rtreeArea(boxB)
+			if d := math.Abs(ga - gb); d > bestDiff {
+				best, bestDiff, growA, growB = i, d, ga, gb
+			}
+		}
+		v := rest[best]
+		rest = append(rest[:best], rest[best+1:]...)
+		if growA < growB || growA == growB && len(a) <= len(b) {
+			a = append(a, v)
+			boxA = rtreeUnion(boxA, v.box)
+			continue
+		}
+
+		b = append(b, v)
+		boxB = rtreeUnion(boxB, v.box)
+	}
+	return a, b
+}
+
+// delete removes the row id from the tree. Nodes left empty are removed,
+// the bounding boxes of the ancestors shrink.
+func (t *rtreeTable) delete(c *sqlConn, id int64) error {
+	row, err := c.queryRow("SELECT nodeno FROM "+t.shadow("rowid")+" WHERE rowid = ?", id)
+	if err != nil || row == nil {
+		return err
+	}
+
+	_, depth, err := t.readNode(c, 1)
+	if err != nil {
+		return err
+	}
+
+	no, _ := row[0].(int64)
+	n, _, err := t.readNode(c, no)
+	if err != nil {
+		return err
+	}
+
+	n.remove(id)
+	if err := c.exec("DELETE FROM "+t.shadow("rowid")+" WHERE rowid = ?", id); err != nil {
+		return err
+	}
+
+	for n.no != 1 {
+		pno, err := t.parentOf(c, n.no)
+		if err != nil {
+			return err
+		}
+
+		p, _, err := t.readNode(c, pno)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case len(n.cells) == 0:
+			if err := c.exec("DELETE FROM "+t.shadow("node")+" WHERE nodeno = ?; DELETE FROM "+t.shadow("parent")+" WHERE nodeno = ?", n.no); err != nil {
+				return err
+			}
+
+			p.remove(n.no)
+		default:
+			if err := t.writeNode(c, n, 0); err != nil {
+				return err
+			}
+
+			for i := range p.cells {
+				if p.cells[i].id == n.no {
+					p.cells[i].box = rtreeBox(n.cells)
+				}
+			}
+		}
+		n = p
+	}
+	if len(n.cells) == 0 {
+		depth = 0
+	}
+	return t.writeNode(c, n, depth)
+}
+
+func (n *rtreeNode) remove(id int64) {
+	for i, v := range n.cells {
+		if v.id == id {
+			n.cells = append(n.cells[:i], n.cells[i+1:]...)
+			return
+		}
+	}
+}
+
+// rtreeBestIndex uses an equality constraint on id or the rowid or else the
+// constraints on the coordinates.
+//
+//	idxNum	meaning
+//	1	argv[0] is the id
+//	2	idxStr has an operator letter and a coordinate column digit for
+//		every argv[i]
+func rtreeBestIndex(tls TLS, tab, pIdxInfo uintptr) int32 {
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	var b []byte
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		if c.Xusable == 0 {
+			continue
+		}
+
+		if c.XiColumn <= 0 && c.Xop == sqliteIndexConstraintEQ {
+			u := indexConstraintUsage(info, i)
+			for j := 0; j < i; j++ {
+				indexConstraintUsage(info, j).XargvIndex = 0
+			}
+			u.XargvIndex = 1
+			u.Xomit = 1
+			info.XidxNum = 1
+			info.XestimatedCost = 30
+			info.XestimatedRows = 1
+			return sqliteOK
+		}
+
+		op := rtreeOps[c.Xop]
+		if c.XiColumn <= 0 || op == 0 {
+			continue
+		}
+
+		b = append(b, op, byte('0'+c.XiColumn-1))
+		indexConstraintUsage(info, i).XargvIndex = int32(len(b) / 2)
+	}
+	info.XidxNum = 2
+	info.XestimatedCost = 6e6 / float64(int(1)<<uint(len(b)/2))
+	if len(b) != 0 {
+		if info.XidxStr = cString(tls, string(b)); info.XidxStr == 0 {
+			return sqliteNoMem
+		}
+
+		info.XneedToFreeIdxStr = 1
+	}
+	return sqliteOK
+}
+
+type rtreeCursor struct {
+	t    *rtreeTable
+	rows []rtreeCell
+	i    int
+}
+
+func rtreeOpen(tls TLS, tab, ppCursor uintptr) int32 {
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		return sqliteNoMem
+	}
+
+	putObject(p, &rtreeCursor{t: getObject(tab).(*rtreeTable)})
+	return sqliteOK
+}
+
+func rtreeClose(tls TLS, cur uintptr) int32 {
+	deleteObject(cur)
+	Xsqlite3_free(tls, cur)
+	return sqliteOK
+}
+
+// rtreeConstraint is a constraint on coordinate col.
+type rtreeConstraint struct {
+	op  byte
+	col int
+	v   float64
+}
+
+// test reports whether a cell with box may satisfy the constraint. In leaves
+// the coordinate itself is tested, otherwise the range of the dimension.
+func (k *rtreeConstraint) test(box []float64, leaf bool) bool {
+	lo, hi := box[k.col&^1], box[k.col|1]
+	if leaf {
+		lo, hi = box[k.col], box[k.col]
+	}
+	switch k.op {
+	case rtreeEQ:
+		return lo <= k.v && k.v <= hi
+	case rtreeLE:
+		return lo <= k.v
+	case rtreeLT:
+		return lo < k.v
+	case rtreeGE:
+		return hi >= k.v
+	case rtreeGT:
+		return hi > k.v
+	}
+	return true
+}
+
+func rtreeFilter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) int32 {
+	c := getObject(cur).(*rtreeCursor)
+	*c = rtreeCursor{t: c.t}
+	tab := (*Ssqlite3_vtab_cursor)(unsafe.Pointer(cur)).XpVtab
+	conn := c.t.conn(tls)
+	if idxNum == 1 {
+		v := argv(args, 0)
+		if t := Xsqlite3_value_type(tls, v); t != sqliteInteger && t != sqliteFloat {
+			return sqliteOK
+		}
+
+		id := Xsqlite3_value_int64(tls, v)
+		row, err := conn.queryRow("SELECT nodeno FROM "+c.t.shadow("rowid")+" WHERE rowid = ?", id)
+		if err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+
+		if row == nil {
+			return sqliteOK
+		}
+
+		no, _ := row[0].(int64)
+		n, _, err := c.t.readNode(conn, no)
+		if err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+
+		for _, v := range n.cells {
+			if v.id == id {
+				c.rows = append(c.rows, v)
+			}
+		}
+		return sqliteOK
+	}
+
+	s := goString(idxStr)
+	var constraints []rtreeConstraint
+	for i := 0; i+1 < len(s); i += 2 {
+		v := argv(args, i/2)
+		if Xsqlite3_value_type(tls, v) == sqliteNull {
+			return sqliteOK
+		}
+
+		constraints = append(constraints, rtreeConstraint{s[i], int(s[i+1] - '0'), Xsqlite3_value_double(tls, v)})
+	}
+	if err := c.search(conn, constraints); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	return sqliteOK
+}
+
+// search collects the rows satisfying constraints, walking the tree depth
+// first.
+func (c *rtreeCursor) search(conn *sqlConn, constraints []rtreeConstraint) error {
+	root, depth, err := c.t.readNode(conn, 1)
+	if err != nil {
+		return err
+	}
+
+	var walk func(n *rtreeNode, level int) error
+	walk = func(n *rtreeNode, level int) error {
+	next:
+		for _, cell := range n.cells {
+			for i := range constraints {
+				if !constraints[i].test(cell.box, level == 0) {
+					continue next
+				}
+			}
+
+			if level == 0 {
+				c.rows = append(c.rows, cell)
+				continue
+			}
+
+			child, _, err := c.t.readNode(conn, cell.id)
+			if err != nil {
+				return err
+			}
+
+			if err := walk(child, level-1); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return walk(root, depth)
+}
+
+func rtreeNext(tls TLS, cur uintptr) int32 {
+	getObject(cur).(*rtreeCursor).i++
+	return sqliteOK
+}
+
+func rtreeEof(tls TLS, cur uintptr) int32 {
+	if c := getObject(cur).(*rtreeCursor); c.i >= len(c.rows) {
+		return 1
+	}
+
+	return 0
+}
+
+func rtreeColumn(tls TLS, cur, ctx uintptr, i int32) int32 {
+	c := getObject(cur).(*rtreeCursor)
+	row := &c.rows[c.i]
+	switch {
+	case i == 0:
+		Xsqlite3_result_int64(tls, ctx, row.id)
+	case c.t.i32:
+		Xsqlite3_result_int64(tls, ctx, int64(row.box[i-1]))
+	default:
+		Xsqlite3_result_double(tls, ctx, row.box[i-1])
+	}
+	return sqliteOK
+}
+
+func rtreeRowid(tls TLS, cur, pRowid uintptr) int32 {
+	c := getObject(cur).(*rtreeCursor)
+	*(*int64)(unsafe.Pointer(pRowid)) = c.rows[c.i].id
+	return sqliteOK
+}
+
+// rtreeValueDown returns the largest 32 bit float not greater than v.
+func rtreeValueDown(v float64) float64 {
+	f := float32(v)
+	if float64(f) > v {
+		f = math.Nextafter32(f, float32(math.Inf(-1)))
+	}
+	return float64(f)
+}
+
+// rtreeValueUp returns the smallest 32 bit float not less than v.
+func rtreeValueUp(v float64) float64 {
+	f := float32(v)
+	if float64(f) < v {
+		f = math.Nextafter32(f, float32(math.Inf(1)))
+	}
+	return float64(f)
+}
+
+func rtreeUpdate(tls TLS, tab uintptr, argc int32, args, pRowid uintptr) int32 {
+	t := getObject(tab).(*rtreeTable)
+	c := t.conn(tls)
+	old := argv(args, 0)
+	hasOld := Xsqlite3_value_type(tls, old) != sqliteNull
+	if argc == 1 {
+		return vtabResult(tls, tab, t.delete(c, Xsqlite3_value_int64(tls, old)))
+	}
+
+	cell := rtreeCell{box: make([]float64, 2*t.nDim)}
+	for j := range cell.box {
+		v := argv(args, 3+j)
+		switch {
+		case t.i32:
+			cell.box[j] = float64(Xsqlite3_value_int(tls, v))
+		case j%2 == 0:
+			cell.box[j] = rtreeValueDown(Xsqlite3_value_double(tls, v))
+		default:
+			cell.box[j] = rtreeValueUp(Xsqlite3_value_double(tls, v))
+		}
+	}
+	for j := 0; j < len(cell.box); j += 2 {
+		if cell.box[j] > cell.box[j+1] {
+			vtabError(tls, tab, fmt.Sprintf("rtree constraint failed: %s.(%s<=%s)", t.name, t.cols[j+1], t.cols[j+2]))
+			return sqliteConstraint
+		}
+	}
+
+	haveID := false
+	if v := argv(args, 2); Xsqlite3_value_type(tls, v) != sqliteNull {
+		cell.id = Xsqlite3_value_int64(tls, v)
+		haveID = true
+		if !hasOld || Xsqlite3_value_int64(tls, old) != cell.id {
+			row, err := c.queryRow("SELECT 1 FROM "+t.shadow("rowid")+" WHERE rowid = ?", cell.id)
+			if err != nil {
+				return vtabError(tls, tab, err.Error())
+			}
+
+			if row != nil {
+				if Xsqlite3_vtab_on_conflict(tls, t.db) != sqliteReplace {
+					vtabError(tls, tab, fmt.Sprintf("UNIQUE constraint failed: %s.%s", t.name, t.cols[0]))
+					return sqliteConstraint
+				}
+
+				if err := t.delete(c, cell.id); err != nil {
+					return vtabError(tls, tab, err.Error())
+				}
+			}
+		}
+	}
+	if hasOld {
+		if err := t.delete(c, Xsqlite3_value_int64(tls, old)); err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+	}
+	if !haveID {
+		if err := c.exec("INSERT INTO " + t.shadow("rowid") + " VALUES(NULL, NULL)"); err != nil {
+			return vtabError(tls, tab, err.Error())
+		}
+
+		cell.id = Xsqlite3_last_insert_rowid(tls, t.db)
+	}
+	if err := t.insert(c, cell); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	*(*int64)(unsafe.Pointer(pRowid)) = cell.id
+	return sqliteOK
+}
+
+// rtreenode(nDim, data) returns the cells of a node blob as text, like
+//
+//	{1 0 10 0 10} {2 5 15 5 15}
+func rtreenodeFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	nDim := int(Xsqlite3_value_int(tls, argv(args, 0)))
+	if nDim < 1 || nDim > rtreeMaxDimensions {
+		resultError(tls, ctx, "rtreenode: invalid number of dimensions")
+		return
+	}
+
+	b := valueBlob(tls, argv(args, 1))
+	t := &rtreeTable{nDim: nDim}
+	n, _, err := t.decodeNode(0, b)
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return
+	}
+
+	var a []string
+	for _, v := range n.cells {
+		s := fmt.Sprint(v.id)
+		for _, x := range v.box {
+			s += fmt.Sprintf(" %g", x)
+		}
+		a = append(a, "{"+s+"}")
+	}
+	resultText(tls, ctx, strings.Join(a, " "))
+}
+
+// rtreedepth(data) returns the tree depth stored in the root node blob.
+func rtreedepthFunc(tls TLS, ctx uintptr, argc int32, args uintptr) {
+	b := valueBlob(tls, argv(args, 0))
+	if len(b) < 2 {
+		resultError(tls, ctx, "Invalid argument to rtreedepth()")
+		return
+	}
+
+	Xsqlite3_result_int(tls, ctx, int32(binary.BigEndian.Uint16(b)))
+}
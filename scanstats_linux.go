@@ -0,0 +1,449 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// Per-loop statistics of SQL statements.
+//
+//	.scanstats on|off
+//	.profile on|off|FILE
+//
+// SQLite is built without SQLITE_ENABLE_STMT_SCANSTATUS so the statistics
+// are collected by sqlite3VdbeExec itself: while a statement run by the shell
+// is profiled, it counts and times every opcode it executes. After the
+// statement finishes, its loops are found in its EXPLAIN listing and matched
+// to the lines of its EXPLAIN QUERY PLAN.
+//
+// For every loop .scanstats prints how many times it was started (nLoop), the
+// rows it visited (nVisit), the rows per start, a guess of the rows per start
+// and the time spent in the loop, inner loops included. Without
+// SQLITE_ENABLE_STMT_SCANSTATUS the estimates of the query planner are not
+// available, the guess is a heuristic of the shell: the row counts of
+// sqlite_stat1, if any, assuming 1048576 rows per table otherwise, divided by
+// fixed factors for the terms the loop uses.
+//
+// .profile writes the same statistics as one JSON object per statement to
+// the output of the shell or, with FILE, appends them to FILE.
+
+// Opcodes, see mkopcodeh.tcl in the SQLite sources.
+var (
+	opLoopHeads = map[string]bool{
+		"Last": true, "NotExists": true, "Rewind": true, "SeekGE": true, "SeekGT": true,
+		"SeekLE": true, "SeekLT": true, "SeekRowid": true, "VFilter": true,
+	}
+	opLoopTails = map[string]bool{"Next": true, "Prev": true, "VNext": true}
+)
+
+// vdbeProfiling makes sqlite3VdbeExec call vdbeProfileOp for every opcode.
+var vdbeProfiling bool
+
+// opProfile holds the executions and the time in nanoseconds of every
+// opcode of a program.
+type opProfile struct {
+	n     []uint64
+	nanos []int64
+}
+
+func (p *opProfile) count(pc int) uint64 {
+	if pc < 0 || pc >= len(p.n) {
+		return 0
+	}
+
+	return p.n[pc]
+}
+
+func (p *opProfile) time(from, to int) (r int64) {
+	for i := from; i <= to && i < len(p.nanos); i++ {
+		r += p.nanos[i]
+	}
+	return r
+}
+
+var (
+	opProfiles = map[uintptr]*opProfile{} // By aOp.
+	opLast     *opProfile
+	opLastPC   int
+	opLastTime time.Time
+)
+
+// profileOuts are the .profile outputs by ShellState. A nil file means the
+// output of the shell.
+var profileOuts = map[uintptr]*os.File{}
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "profile",
+		abbrev: 4,
+		usage:  "on|off|FILE",
+		help:   "Write the scanstats of each statement as JSON to stdout or FILE",
+		run: func(s *shell, args []string) error {
+			if len(args) != 1 {
+				return errUsage
+			}
+
+			if f := profileOuts[s.p]; f != nil {
+				f.Close()
+			}
+			delete(profileOuts, s.p)
+			switch args[0] {
+			case "off":
+				// Nothing to do.
+			case "on":
+				profileOuts[s.p] = nil
+			default:
+				f, err := os.OpenFile(args[0], os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0666)
+				if err != nil {
+					return err
+				}
+
+				profileOuts[s.p] = f
+			}
+			return nil
+		},
+	})
+}
+
+// vdbeProfileEnter is called when sqlite3VdbeExec starts or resumes running
+// a program.
+func vdbeProfileEnter() { opLast = nil }
+
+// vdbeProfileOp is called by sqlite3VdbeExec before executing the opcode at
+// pOp of the program aOp.
+func vdbeProfileOp(aOp, pOp uintptr) {
+	now := time.Now()
+	if opLast != nil {
+		opLast.nanos[opLastPC] += int64(now.Sub(opLastTime))
+	}
+
+	pc := int((pOp - aOp) / unsafe.Sizeof(SVdbeOp{}))
+	p := opProfiles[aOp]
+	if p == nil {
+		p = &opProfile{}
+		opProfiles[aOp] = p
+	}
+	if pc >= len(p.n) {
+		n := make([]uint64, 2*pc+16)
+		copy(n, p.n)
+		p.n = n
+		t := make([]int64, len(n))
+		copy(t, p.nanos)
+		p.nanos = t
+	}
+	p.n[pc]++
+	opLast, opLastPC, opLastTime = p, pc, now
+}
+
+// scanstatsEnabled reports whether the statements run by the shell p are
+// profiled.
+func scanstatsEnabled(p uintptr) bool {
+	_, ok := profileOuts[p]
+	return (*SShellState)(unsafe.Pointer(p)).XscanstatsOn != 0 || ok
+}
+
+// scanstatsBegin is called before the shell p steps a statement.
+func scanstatsBegin(p uintptr) {
+	vdbeProfiling = p != 0 && scanstatsEnabled(p)
+	opProfiles = map[uintptr]*opProfile{}
+	opLast = nil
+}
+
+type scanLoop struct {
+	ID      int      `json:"id"`
+	Detail  string   `json:"detail"`
+	Loops   uint64   `json:"loops"`
+	Visits  uint64   `json:"visits"`
+	Rows    float64  `json:"rows_per_loop"`
+	Guess   *float64 `json:"guess_rows_per_loop"` // nil if unknown.
+	Time    float64  `json:"time_ms"`
+	virtual bool
+	table   string
+	index   string // "" if the table is scanned.
+	from    int    // First opcode.
+	to      int    // Last opcode.
+	body    int    // First opcode of the loop body, -1 for single lookups.
+}
+
+type scanStats struct {
+	SQL           string     `json:"sql"`
+	Time          float64    `json:"time_ms"`
+	VMSteps       int32      `json:"vm_steps"`
+	FullscanSteps int32      `json:"fullscan_steps"`
+	Sorts         int32      `json:"sorts"`
+	Autoindexes   int32      `json:"autoindexes"`
+	Loops         []scanLoop `json:"loops"`
+}
+
+// displayScanstats writes the statistics of the statement just run by the
+// shell p.
+func displayScanstats(tls TLS, db, p uintptr) {
+	vdbeProfiling = false
+	s := &shell{tls, p}
+	pStmt := s.state().XpStmt
+	profiles := opProfiles
+	opProfiles = map[uintptr]*opProfile{}
+	if pStmt == 0 {
+		return
+	}
+
+	prof := profiles[(*SVdbe)(unsafe.Pointer(pStmt)).XaOp]
+	if prof == nil {
+		prof = &opProfile{}
+	}
+	st := &scanStats{
+		SQL:           strings.TrimSpace(goString(Xsqlite3_sql(tls, pStmt))),
+		Time:          float64(prof.time(0, len(prof.nanos))) / 1e6,
+		FullscanSteps: Xsqlite3_stmt_status(tls, pStmt, 1, 0),
+		Sorts:         Xsqlite3_stmt_status(tls, pStmt, 2, 0),
+		Autoindexes:   Xsqlite3_stmt_status(tls, pStmt, 3, 0),
+		VMSteps:       Xsqlite3_stmt_status(tls, pStmt, 4, 0),
+		Loops:         []scanLoop{},
+	}
+	if !strings.HasPrefix(strings.ToUpper(st.SQL), "EXPLAIN") {
+		// The statement may not compile again, like CREATE TABLE, and then
+		// it has no loops.
+		st.loops(&sqlConn{tls, db}, prof)
+	}
+
+	if s.state().XscanstatsOn != 0 {
+		st.print(s)
+	}
+	f, ok := profileOuts[p]
+	if !ok {
+		return
+	}
+
+	b, err := json.Marshal(st)
+	if err != nil {
+		s.eprintf("Error: %v\n", err)
+		return
+	}
+
+	b = append(b, '\n')
+	if f == nil {
+		s.printf("%s", b)
+		return
+	}
+
+	if _, err := f.Write(b); err != nil {
+		s.eprintf("Error: %v\n", err)
+	}
+}
+
+func (st *scanStats) print(s *shell) {
+	s.printf("-------- scanstats --------\n")
+	for _, v := range st.Loops {
+		s.printf("Loop %2d: %s\n", v.ID, v.Detail)
+		guess := "?"
+		if v.Guess != nil {
+			guess = strconv.FormatFloat(*v.Guess, 'g', 6, 64)
+		}
+		s.printf("         nLoop=%-8d nVisit=%-8d rows/loop=%-8.6g guessRow/Loop=%-8s time=%.3fms\n",
+			v.Loops, v.Visits, v.Rows, guess, v.Time)
+	}
+	s.printf("---------------------------\n")
+}
+
+// loops fills st.Loops from the program of st.SQL and its profile.
+func (st *scanStats) loops(c *sqlConn, prof *opProfile) {
+	prog, err := c.query("EXPLAIN " + st.SQL)
+	if err != nil {
+		return
+	}
+
+	plan, err := queryPlan(c, st.SQL)
+	if err != nil {
+		return
+	}
+
+	roots := newSchemaRoots(c)
+
+	// Find the loops of the program.
+	type cursor struct {
+		table, index string
+		virtual      bool
+		heads        []int
+		lookup       int
+	}
+	cursors := map[int64]*cursor{}
+	cursorOf := func(n int64) *cursor {
+		if cursors[n] == nil {
+			cursors[n] = &cursor{lookup: -1}
+		}
+		return cursors[n]
+	}
+	var loops []*scanLoop
+	for _, v := range prog {
+		pc, op, p1, p2, p3 := int(v[0].(int64)), v[1].(string), v[2].(int64), v[3].(int64), v[4].(int64)
+		switch {
+		case op == "OpenRead" || op == "OpenWrite" || op == "ReopenIdx":
+			table, index := roots.lookup(p3, p2)
+			cursors[p1] = &cursor{table: table, index: index, lookup: -1}
+		case op == "OpenAutoindex":
+			cursors[p1] = &cursor{index: "AUTOMATIC", lookup: -1}
+		case op == "VOpen":
+			cursors[p1] = &cursor{virtual: true, lookup: -1}
+		case opLoopHeads[op]:
+			c := cursorOf(p1)
+			c.heads = append(c.heads, pc)
+			if op == "SeekRowid" || op == "NotExists" {
+				c.lookup = pc
+			}
+		case opLoopTails[op]:
+			c := cursorOf(p1)
+			l := &scanLoop{virtual: c.virtual, table: c.table, index: c.index, from: pc, to: pc, body: int(p2)}
+			for _, h := range c.heads {
+				l.Loops += prof.count(h)
+				if h < l.from {
+					l.from = h
+				}
+			}
+			l.Visits = prof.count(l.body)
+			c.heads, c.lookup = nil, -2
+			loops = append(loops, l)
+		}
+	}
+	for _, c := range cursors {
+		if c.lookup >= 0 {
+			loops = append(loops, &scanLoop{table: c.table, index: c.index, from: c.lookup, to: c.lookup, body: -1,
+				Loops: prof.count(c.lookup), Visits: prof.count(c.lookup + 1)})
+		}
+	}
+
+	sort.Slice(loops, func(i, j int) bool { return loops[i].from < loops[j].from })
+
+	// Match the loops to the query plan.
+	stat := scanstatsStat1(c)
+	used := map[*scanLoop]bool{}
+	for _, r := range plan {
+		m := eqpLoopRe.FindStringSubmatch(r.detail)
+		if m == nil {
+			continue
+		}
+
+		table, rest := m[2], m[3]
+		index := ""
+		switch {
+		case strings.Contains(rest, "AUTOMATIC"):
+			index = "AUTOMATIC"
+		case strings.Contains(rest, " INDEX "):
+			if m := eqpIndexRe.FindStringSubmatch(rest); m != nil {
+				index = m[1]
+			}
+		}
+		virtual := strings.Contains(rest, "VIRTUAL TABLE")
+		var l *scanLoop
+		for _, v := range loops {
+			if used[v] || v.virtual != virtual {
+				continue
+			}
+
+			if virtual || index == "AUTOMATIC" && v.index == index ||
+				strings.EqualFold(v.table, table) && strings.EqualFold(v.index, index) {
+				l = v
+				break
+			}
+		}
+		if l == nil {
+			continue
+		}
+
+		used[l] = true
+		l.ID = len(st.Loops) + 1
+		l.Detail = r.detail
+		if l.Loops != 0 {
+			l.Rows = float64(l.Visits) / float64(l.Loops)
+		}
+		l.Time = float64(prof.time(l.from, l.to)) / 1e6
+		if !virtual {
+			guess := scanstatsGuess(stat, table, index, rest)
+			l.Guess = &guess
+		}
+		st.Loops = append(st.Loops, *l)
+	}
+}
+
+var (
+	eqpLoopRe  = regexp.MustCompile(`^(SCAN|SEARCH) (?:TABLE|SUBQUERY) (\S+)(?: AS \S+)?(.*)$`)
+	eqpIndexRe = regexp.MustCompile(` INDEX ([^\s(]\S*)`)
+	eqpTermsRe = regexp.MustCompile(`\((.*)\)$`)
+)
+
+// scanstatsStat1 returns the numbers of the stat column of sqlite_stat1 by
+// lower case table and index name.
+func scanstatsStat1(c *sqlConn) map[string][]float64 {
+	r := map[string][]float64{}
+	rows, err := c.query("SELECT tbl, idx, stat FROM main.sqlite_stat1")
+	if err != nil {
+		return r
+	}
+
+	for _, v := range rows {
+		var a []float64
+		stat, _ := v[2].(string)
+		for _, f := range strings.Fields(stat) {
+			n, err := strconv.ParseFloat(f, 64)
+			if err != nil {
+				break
+			}
+
+			a = append(a, n)
+		}
+		if len(a) == 0 {
+			continue
+		}
+
+		tbl, _ := v[0].(string)
+		r[strings.ToLower(tbl)] = a[:1]
+		if idx, ok := v[1].(string); ok {
+			r[strings.ToLower(idx)] = a
+		}
+	}
+	return r
+}
+
+// scanstatsGuess returns a guess of the rows of a loop over table using index
+// with the query plan details rest. It is not the estimate of the planner.
+func scanstatsGuess(stat map[string][]float64, table, index, rest string) float64 {
+	n := float64(1 << 20)
+	if v := stat[strings.ToLower(table)]; v != nil {
+		n = v[0]
+	}
+	if !strings.HasPrefix(strings.TrimSpace(rest), "USING") {
+		return n
+	}
+
+	eq, ranges := 0, 0
+	if m := eqpTermsRe.FindStringSubmatch(rest); m != nil {
+		for _, v := range strings.Split(m[1], " AND ") {
+			if strings.ContainsAny(v, "<>") {
+				ranges++
+				continue
+			}
+
+			eq++
+		}
+	}
+	est := n
+	switch {
+	case strings.Contains(rest, "INTEGER PRIMARY KEY") && eq != 0:
+		est = 1
+	case eq != 0:
+		if v := stat[strings.ToLower(index)]; len(v) > eq {
+			est = v[eq]
+			break
+		}
+
+		est = math.Min(n, 10*math.Pow(0.5, float64(eq-1)))
+	}
+	est /= math.Pow(4, float64(ranges))
+	return math.Max(est, 1)
+}
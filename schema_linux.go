@@ -0,0 +1,305 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+)
+
+// Entity-relationship diagrams of the schema.
+//
+//	.schema ?--indent? --dot|--mermaid ?LIKE-PATTERN?
+//
+// With --dot or --mermaid, .schema writes a Graphviz DOT digraph or a
+// Mermaid erDiagram of the tables whose name is LIKE the pattern, of all
+// databases, instead of their CREATE statements. Every table lists its
+// columns, their declared types and the PK and FK markers, and every foreign
+// key is an edge from the child to the parent table. Foreign keys to tables
+// which are not in the diagram are left out.
+//
+// Mermaid only accepts words as names and types, other characters are
+// replaced by underscores and names made the same get a number appended.
+
+type erdColumn struct {
+	name    string
+	typ     string
+	notNull bool
+	pk      int
+	fk      bool
+}
+
+type erdForeignKey struct {
+	parent string // Key of the parent table.
+	from   []string
+	to     []string // Empty if the foreign key references the primary key.
+}
+
+type erdTable struct {
+	key     string // The name, qualified by the schema if not main.
+	columns []*erdColumn
+	fkeys   []*erdForeignKey
+}
+
+func (t *erdTable) column(name string) int {
+	for i, v := range t.columns {
+		if strings.EqualFold(v.name, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// pkColumns returns the primary key columns of t in key order.
+func (t *erdTable) pkColumns() []string {
+	var r []string
+	for n := 1; ; n++ {
+		found := false
+		for _, v := range t.columns {
+			if v.pk == n {
+				r = append(r, v.name)
+				found = true
+			}
+		}
+		if !found {
+			return r
+		}
+	}
+}
+
+// schemaCommand runs .schema if it uses --dot or --mermaid. It returns the
+// do_meta_command result and whether it did.
+func schemaCommand(tls TLS, p uintptr, argc int32, args uintptr) (int32, bool) {
+	a := make([]string, argc-1)
+	for i := range a {
+		a[i] = goString(argv(args, i+1))
+	}
+	var formats, patterns []string
+	for _, v := range a {
+		switch v {
+		case "-dot", "--dot", "-mermaid", "--mermaid":
+			formats = append(formats, strings.TrimLeft(v, "-"))
+		case "-indent", "--indent":
+			// No effect on diagrams.
+		default:
+			patterns = append(patterns, v)
+		}
+	}
+	if len(formats) == 0 {
+		return 0, false
+	}
+
+	s := &shell{tls, p}
+	if len(formats) > 1 || len(patterns) > 1 {
+		s.eprintf("Usage: .schema --dot|--mermaid ?LIKE-PATTERN?\n")
+		return 1, true
+	}
+
+	like := "%"
+	if len(patterns) != 0 {
+		like = patterns[0]
+	}
+	tables, err := erdTables(s.conn(), like)
+	if err != nil {
+		s.eprintf("Error: %v\n", err)
+		return 1, true
+	}
+
+	switch formats[0] {
+	case "dot":
+		erdDot(s, tables)
+	default:
+		erdMermaid(s, tables)
+	}
+	return 0, true
+}
+
+// erdTables returns the tables of all databases whose name is LIKE like.
+func erdTables(c *sqlConn, like string) ([]*erdTable, error) {
+	dbs, err := c.query("SELECT name FROM pragma_database_list ORDER BY seq")
+	if err != nil {
+		return nil, err
+	}
+
+	var r []*erdTable
+	for _, db := range dbs {
+		schema := db[0].(string)
+		names, err := c.query(fmt.Sprintf("SELECT name FROM %s.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%%' AND name LIKE ? ORDER BY name", sqlQuoteID(schema)), like)
+		if err != nil {
+			return nil, err
+		}
+
+		qualify := func(name string) string {
+			if schema == "main" {
+				return name
+			}
+
+			return schema + "." + name
+		}
+		for _, v := range names {
+			name := v[0].(string)
+			t := &erdTable{key: qualify(name)}
+			cols, err := c.query("SELECT name, type, \"notnull\", pk FROM pragma_table_info(?, ?) ORDER BY cid", name, schema)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, v := range cols {
+				t.columns = append(t.columns, &erdColumn{name: v[0].(string), typ: fmt.Sprint(v[1]), notNull: v[2] != int64(0), pk: int(v[3].(int64))})
+			}
+			fkeys, err := c.query("SELECT id, \"table\", \"from\", \"to\" FROM pragma_foreign_key_list(?, ?) ORDER BY id, seq", name, schema)
+			if err != nil {
+				return nil, err
+			}
+
+			var fk *erdForeignKey
+			id := int64(-1)
+			for _, v := range fkeys {
+				if v[0].(int64) != id {
+					id = v[0].(int64)
+					fk = &erdForeignKey{parent: qualify(v[1].(string))}
+					t.fkeys = append(t.fkeys, fk)
+				}
+				fk.from = append(fk.from, v[2].(string))
+				if to, ok := v[3].(string); ok {
+					fk.to = append(fk.to, to)
+				}
+				if i := t.column(v[2].(string)); i >= 0 {
+					t.columns[i].fk = true
+				}
+			}
+			r = append(r, t)
+		}
+	}
+	return r, nil
+}
+
+func erdKeys(c *erdColumn) string {
+	var a []string
+	if c.pk != 0 {
+		a = append(a, "PK")
+	}
+	if c.fk {
+		a = append(a, "FK")
+	}
+	return strings.Join(a, ", ")
+}
+
+// erdParents maps the keys of tables to the tables.
+func erdParents(tables []*erdTable) map[string]*erdTable {
+	m := map[string]*erdTable{}
+	for _, t := range tables {
+		m[strings.ToLower(t.key)] = t
+	}
+	return m
+}
+
+func dotID(s string) string {
+	return `"` + strings.Replace(strings.Replace(s, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+}
+
+func erdDot(s *shell, tables []*erdTable) {
+	s.printf("digraph schema {\n  rankdir=LR;\n  node [shape=plaintext];\n")
+	for _, t := range tables {
+		s.printf("  %s [label=<\n    <table border=\"0\" cellborder=\"1\" cellspacing=\"0\">\n", dotID(t.key))
+		s.printf("      <tr><td colspan=\"3\" bgcolor=\"lightgrey\"><b>%s</b></td></tr>\n", html.EscapeString(t.key))
+		for i, c := range t.columns {
+			s.printf("      <tr><td port=\"c%d\" align=\"left\">%s</td><td align=\"left\">%s</td><td>%s</td></tr>\n", i, html.EscapeString(c.name), html.EscapeString(c.typ), erdKeys(c))
+		}
+		s.printf("    </table>>];\n")
+	}
+	parents := erdParents(tables)
+	for _, t := range tables {
+		for _, fk := range t.fkeys {
+			p := parents[strings.ToLower(fk.parent)]
+			if p == nil {
+				continue
+			}
+
+			to := fk.to
+			if len(to) == 0 {
+				to = p.pkColumns()
+			}
+			from, head := "", ""
+			if i := t.column(fk.from[0]); i >= 0 {
+				from = fmt.Sprintf(":c%d", i)
+			}
+			if len(to) != 0 {
+				if i := p.column(to[0]); i >= 0 {
+					head = fmt.Sprintf(":c%d", i)
+				}
+			}
+			s.printf("  %s%s -> %s%s;\n", dotID(t.key), from, dotID(p.key), head)
+		}
+	}
+	s.printf("}\n")
+}
+
+var mermaidRe = regexp.MustCompile(`[^A-Za-z0-9_]+`)
+
+// mermaidWord replaces the characters Mermaid does not accept in names by
+// underscores.
+func mermaidWord(s, empty string) string {
+	if s = mermaidRe.ReplaceAllString(s, "_"); s == "" {
+		return empty
+	}
+
+	return s
+}
+
+// mermaidNames maps the tables to unique Mermaid names, tables whose names
+// differ only in the replaced characters get a number appended.
+func mermaidNames(tables []*erdTable) map[*erdTable]string {
+	m := map[*erdTable]string{}
+	used := map[string]bool{}
+	for _, t := range tables {
+		w := mermaidWord(t.key, "_")
+		for n := 2; used[w]; n++ {
+			w = fmt.Sprintf("%s_%d", mermaidWord(t.key, "_"), n)
+		}
+		used[w] = true
+		m[t] = w
+	}
+	return m
+}
+
+// mermaidLabel returns s as a quoted Mermaid label. Mermaid has no escapes
+// in quotes, quotes are written as the #quot; entity.
+func mermaidLabel(s string) string {
+	s = strings.Replace(s, `"`, "#quot;", -1)
+	return `"` + strings.Join(strings.Fields(s), " ") + `"`
+}
+
+func erdMermaid(s *shell, tables []*erdTable) {
+	s.printf("erDiagram\n")
+	names := mermaidNames(tables)
+	for _, t := range tables {
+		s.printf("    %s {\n", names[t])
+		for _, c := range t.columns {
+			s.printf("        %s %s", mermaidWord(c.typ, "ANY"), mermaidWord(c.name, "_"))
+			if k := erdKeys(c); k != "" {
+				s.printf(" %s", k)
+			}
+			s.printf("\n")
+		}
+		s.printf("    }\n")
+	}
+	parents := erdParents(tables)
+	for _, t := range tables {
+		for _, fk := range t.fkeys {
+			p := parents[strings.ToLower(fk.parent)]
+			if p == nil {
+				continue
+			}
+
+			// The parent is optional if a column of the foreign key can be NULL.
+			parent := "||"
+			for _, v := range fk.from {
+				if i := t.column(v); i < 0 || !t.columns[i].notNull {
+					parent = "|o"
+				}
+			}
+			s.printf("    %s %s--o{ %s : %s\n", names[p], parent, names[t], mermaidLabel(strings.Join(fk.from, ", ")))
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Table-valued utility functions.
+//
+//	generate_series(START, STOP [, STEP])	value
+//	split(TEXT [, SEP])			value, ord
+//	regexp_matches(TEXT, RE)		value, start, len, groups
+//	date_series(START, STOP [, INTERVAL])	value
+//
+// generate_series returns the integers from START to STOP, both included,
+// STEP, default 1, apart. A negative STEP produces the values in descending
+// order. Constraints on value and ORDER BY value are handled without
+// generating the skipped values.
+//
+// split returns the parts of TEXT separated by SEP, default ',', and their
+// 1-based position. An empty SEP splits TEXT into characters.
+//
+// regexp_matches returns the non-overlapping matches of the RE2 pattern RE
+// in TEXT, their position and length in characters, usable with substr, and
+// the JSON array of the capture groups.
+//
+// date_series returns the dates, or date times if START has a time, from
+// START to STOP INTERVAL apart. INTERVAL is like a date and time function
+// modifier, '1 day' by default, '-2 hours', '1 month' or '15 minutes'.
+//
+// The result of all functions is empty if an argument is NULL.
+
+func init() {
+	RegisterModule("generate_series", seriesModule{})
+	RegisterModule("split", &tvfModule{
+		schema:   "CREATE TABLE x(value, ord, text HIDDEN, sep HIDDEN)",
+		nOut:     2,
+		defaults: []interface{}{nil, ","},
+		rows:     splitRows,
+	})
+	RegisterModule("regexp_matches", &tvfModule{
+		schema:   "CREATE TABLE x(value, start, len, groups, text HIDDEN, re HIDDEN)",
+		nOut:     4,
+		defaults: []interface{}{nil, nil},
+		rows:     regexpMatchesRows,
+	})
+	RegisterModule("date_series", &tvfModule{
+		schema:   "CREATE TABLE x(value, start HIDDEN, stop HIDDEN, interval HIDDEN)",
+		nOut:     1,
+		defaults: []interface{}{nil, nil, "1 day"},
+		rows:     dateSeriesRows,
+	})
+}
+
+// tvfModule is a table-valued function with the output columns followed by
+// the hidden argument columns. Arguments with a nil default are required, a
+// plan without them produces no rows.
+type tvfModule struct {
+	schema   string
+	nOut     int
+	defaults []interface{}
+	// rows returns the iterator of the rows for args. It returns nil at
+	// the end.
+	rows func(args []interface{}) (func() []interface{}, error)
+}
+
+func (m *tvfModule) Connect(args []string) (string, VTab, error) { return m.schema, m, nil }
+
+// BestIndex uses equality constraints on the argument columns. Bit i of
+// idxNum is set if argument i is in Filter's args.
+func (m *tvfModule) BestIndex(info *IndexInfo) error {
+	var usable, unusable uint
+	cons := make([]int, len(m.defaults))
+	for i, c := range info.Constraints {
+		j := c.Column - m.nOut
+		if j < 0 || c.Op != IndexConstraintEQ {
+			continue
+		}
+
+		switch {
+		case c.Usable:
+			usable |= 1 << uint(j)
+			cons[j] = i
+		default:
+			unusable |= 1 << uint(j)
+		}
+	}
+	n := 0
+	for j := range m.defaults {
+		if usable&(1<<uint(j)) != 0 {
+			n++
+			info.Constraints[cons[j]].ArgvIndex = n
+			info.Constraints[cons[j]].Omit = true
+		}
+	}
+	info.IdxNum = int(usable)
+	info.EstimatedCost = 1000
+	info.EstimatedRows = 1000
+	if unusable&^usable != 0 {
+		// Prefer plans providing all arguments.
+		info.EstimatedCost = math.MaxInt32
+	}
+	return nil
+}
+
+func (m *tvfModule) Open() (VCursor, error) { return &tvfCursor{rows: m.args}, nil }
+
+func (m *tvfModule) Disconnect() error { return nil }
+
+func (m *tvfModule) Destroy() error { return nil }
+
+// args returns the iterator of the rows for the args passed to Filter.
+func (m *tvfModule) args(idxNum int, idxStr string, args []interface{}) (func() []interface{}, error) {
+	a := append([]interface{}(nil), m.defaults...)
+	for j := range a {
+		if idxNum&(1<<uint(j)) != 0 {
+			a[j] = args[0]
+			args = args[1:]
+		}
+	}
+	for _, v := range a {
+		if v == nil {
+			return sliceRows(nil), nil
+		}
+	}
+	next, err := m.rows(a)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() []interface{} {
+		if row := next(); row != nil {
+			return append(row, a...)
+		}
+
+		return nil
+	}, nil
+}
+
+// tvfCursor iterates the rows returned by a function.
+type tvfCursor struct {
+	rows  func(idxNum int, idxStr string, args []interface{}) (func() []interface{}, error)
+	next  func() []interface{}
+	row   []interface{}
+	rowid int64
+}
+
+func (c *tvfCursor) Filter(idxNum int, idxStr string, args []interface{}) (err error) {
+	if c.next, err = c.rows(idxNum, idxStr, args); err != nil {
+		return err
+	}
+
+	c.rowid = 0
+	return c.Next()
+}
+
+func (c *tvfCursor) Next() error {
+	c.row = c.next()
+	c.rowid++
+	return nil
+}
+
+func (c *tvfCursor) EOF() bool { return c.row == nil }
+
+func (c *tvfCursor) Column(i int) (interface{}, error) { return c.row[i], nil }
+
+func (c *tvfCursor) Rowid() (int64, error) { return c.rowid, nil }
+
+func (c *tvfCursor) Close() error { return nil }
+
+// sliceRows returns the iterator of rows.
+func sliceRows(rows [][]interface{}) func() []interface{} {
+	return func() []interface{} {
+		if len(rows) == 0 {
+			return nil
+		}
+
+		r := rows[0]
+		rows = rows[1:]
+		return r
+	}
+}
+
+// tvfText returns the text of a non NULL argument.
+func tvfText(v interface{}) string {
+	switch x := v.(type) {
+	case []byte:
+		return string(x)
+	case string:
+		return x
+	}
+	return fmt.Sprint(v)
+}
+
+func splitRows(args []interface{}) (func() []interface{}, error) {
+	text := tvfText(args[0])
+	var parts []string
+	switch {
+	case tvfText(args[1]) == "":
+		for _, r := range text {
+			parts = append(parts, string(r))
+		}
+	default:
+		parts = strings.Split(text, tvfText(args[1]))
+	}
+	var rows [][]interface{}
+	for i, v := range parts {
+		rows = append(rows, []interface{}{v, int64(i + 1)})
+	}
+	return sliceRows(rows), nil
+}
+
+func regexpMatchesRows(args []interface{}) (func() []interface{}, error) {
+	re, err := regexp.Compile(tvfText(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	text := tvfText(args[0])
+	var rows [][]interface{}
+	for _, m := range re.FindAllStringSubmatchIndex(text, -1) {
+		var groups []string
+		for i := 2; i < len(m); i += 2 {
+			switch {
+			case m[i] < 0:
+				groups = append(groups, "null")
+			default:
+				groups = append(groups, jsonQuote(text[m[i]:m[i+1]]))
+			}
+		}
+		start := utf8.RuneCountInString(text[:m[0]]) + 1
+		rows = append(rows, []interface{}{
+			text[m[0]:m[1]],
+			int64(start),
+			int64(utf8.RuneCountInString(text[m[0]:m[1]])),
+			"[" + strings.Join(groups, ",") + "]",
+		})
+	}
+	return sliceRows(rows), nil
+}
+
+// Layouts of the START and STOP arguments of date_series.
+var dateSeriesLayouts = []string{
+	"2006-01-02",
+	"2006-01-02 15:04",
+	"2006-01-02 15:04:05",
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04",
+	"2006-01-02T15:04:05",
+	"2006-01-02T15:04:05.999999999",
+}
+
+func parseDate(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	for _, v := range dateSeriesLayouts {
+		if t, err := time.Parse(v, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("date_series: invalid date: %s", s)
+}
+
+// dateInterval is a date_series INTERVAL.
+type dateInterval struct {
+	years, months, days int
+	d                   time.Duration
+}
+
+func parseDateInterval(s string) (dateInterval, error) {
+	var r dateInterval
+	f := strings.Fields(s)
+	if len(f) != 2 {
+		return r, fmt.Errorf("date_series: invalid interval: %s", s)
+	}
+
+	n, err := strconv.Atoi(strings.TrimPrefix(f[0], "+"))
+	if err != nil {
+		return r, fmt.Errorf("date_series: invalid interval: %s", s)
+	}
+
+	switch strings.TrimSuffix(strings.ToLower(f[1]), "s") {
+	case "year":
+		r.years = n
+	case "month":
+		r.months = n
+	case "day":
+		r.days = n
+	case "hour":
+		r.d = time.Duration(n) * time.Hour
+	case "minute":
+		r.d = time.Duration(n) * time.Minute
+	case "second":
+		r.d = time.Duration(n) * time.Second
+	default:
+		return r, fmt.Errorf("date_series: invalid interval: %s", s)
+	}
+	if n == 0 {
+		return r, fmt.Errorf("date_series: zero interval")
+	}
+
+	return r, nil
+}
+
+// add returns t plus k intervals. Like the date and time functions, adding
+// months to the end of a month may overflow into the next one.
+func (i dateInterval) add(t time.Time, k int) time.Time {
+	return t.AddDate(k*i.years, k*i.months, k*i.days).Add(time.Duration(k) * i.d)
+}
+
+func (i dateInterval) negative() bool { return i.years < 0 || i.months < 0 || i.days < 0 || i.d < 0 }
+
+func dateSeriesRows(args []interface{}) (func() []interface{}, error) {
+	start, err := parseDate(tvfText(args[0]))
+	if err != nil {
+		return nil, err
+	}
+
+	stop, err := parseDate(tvfText(args[1]))
+	if err != nil {
+		return nil, err
+	}
+
+	interval, err := parseDateInterval(tvfText(args[2]))
+	if err != nil {
+		return nil, err
+	}
+
+	layout := "2006-01-02"
+	if len(strings.TrimSpace(tvfText(args[0]))) > len(layout) || interval.d != 0 {
+		layout = "2006-01-02 15:04:05"
+	}
+	k := 0
+	return func() []interface{} {
+		t := interval.add(start, k)
+		if interval.negative() && t.Before(stop) || !interval.negative() && t.After(stop) {
+			return nil
+		}
+
+		k++
+		return []interface{}{t.Format(layout)}
+	}, nil
+}
+
+// seriesModule is generate_series.
+type seriesModule struct{}
+
+// Columns of generate_series.
+const (
+	seriesColumnValue = iota
+	seriesColumnStart
+	seriesColumnStop
+	seriesColumnStep
+)
+
+// idxNum flags of generate_series, the arguments are in this order.
+const (
+	seriesStart = 1 << iota
+	seriesStop
+	seriesStep
+	seriesLower     // value >= argument
+	seriesLowerExcl // value > argument
+	seriesUpper     // value <= argument
+	seriesUpperExcl // value < argument
+	seriesEqual     // value = argument
+	seriesDesc      // ORDER BY value DESC
+	seriesOrdered   // ORDER BY value consumed
+)
+
+var seriesValueOps = map[int]int{
+	IndexConstraintGE: seriesLower,
+	IndexConstraintGT: seriesLowerExcl,
+	IndexConstraintLE: seriesUpper,
+	IndexConstraintLT: seriesUpperExcl,
+	IndexConstraintEQ: seriesEqual,
+}
+
+func (seriesModule) Connect(args []string) (string, VTab, error) {
+	return "CREATE TABLE x(value, start HIDDEN, stop HIDDEN, step HIDDEN)", seriesModule{}, nil
+}
+
+// BestIndex passes the start, stop and step arguments and at most one
+// constraint of every kind on value, see the series* idxNum flags.
+func (seriesModule) BestIndex(info *IndexInfo) error {
+	cons := map[int]int{}
+	var unusable int
+	for i, c := range info.Constraints {
+		var flag int
+		switch {
+		case c.Column == seriesColumnValue:
+			flag = seriesValueOps[c.Op]
+		case c.Column >= seriesColumnStart && c.Op == IndexConstraintEQ:
+			flag = seriesStart << uint(c.Column-seriesColumnStart)
+		}
+		switch {
+		case flag == 0:
+			continue
+		case !c.Usable:
+			unusable |= flag
+			continue
+		}
+
+		if _, ok := cons[flag]; !ok {
+			cons[flag] = i
+		}
+	}
+	n := 0
+	for flag := seriesStart; flag <= seriesEqual; flag <<= 1 {
+		if i, ok := cons[flag]; ok {
+			n++
+			info.IdxNum |= flag
+			info.Constraints[i].ArgvIndex = n
+			info.Constraints[i].Omit = flag <= seriesStep
+		}
+	}
+	switch {
+	case info.IdxNum&(seriesStart|seriesStop) == seriesStart|seriesStop:
+		info.EstimatedCost = 2
+		info.EstimatedRows = 1000
+		if info.IdxNum&(seriesLower|seriesLowerExcl|seriesUpper|seriesUpperExcl) != 0 {
+			info.EstimatedRows /= 2
+		}
+		if info.IdxNum&seriesEqual != 0 {
+			info.EstimatedRows = 1
+		}
+	default:
+		info.EstimatedCost = math.MaxInt32
+		info.EstimatedRows = math.MaxInt32
+	}
+	if unusable&(seriesStart|seriesStop|seriesStep)&^info.IdxNum != 0 {
+		// Prefer plans providing all arguments.
+		info.EstimatedCost = math.MaxInt32
+	}
+	if len(info.OrderBy) == 1 && info.OrderBy[0].Column == seriesColumnValue {
+		info.IdxNum |= seriesOrdered
+		if info.OrderBy[0].Desc {
+			info.IdxNum |= seriesDesc
+		}
+		info.OrderByConsumed = true
+	}
+	return nil
+}
+
+func (seriesModule) Open() (VCursor, error) { return &tvfCursor{rows: seriesRows}, nil }
+
+func (seriesModule) Disconnect() error { return nil }
+
+func (seriesModule) Destroy() error { return nil }
+
+// seriesInt converts an argument of generate_series to an integer, rounding
+// towards -Inf, or +Inf if up is true.
+func seriesInt(v interface{}, up bool) (int64, bool) {
+	var f float64
+	switch x := v.(type) {
+	case int64:
+		return x, true
+	case float64:
+		f = x
+	case string:
+		if n, err := strconv.ParseInt(strings.TrimSpace(x), 10, 64); err == nil {
+			return n, true
+		}
+
+		var err error
+		if f, err = strconv.ParseFloat(strings.TrimSpace(x), 64); err != nil {
+			return 0, false
+		}
+	default:
+		return 0, false
+	}
+	switch {
+	case math.IsNaN(f):
+		return 0, false
+	case up:
+		f = math.Ceil(f)
+	default:
+		f = math.Floor(f)
+	}
+	switch {
+	case f >= math.MaxInt64:
+		return math.MaxInt64, true
+	case f <= math.MinInt64:
+		return math.MinInt64, true
+	}
+	return int64(f), true
+}
+
+func seriesRows(idxNum int, idxStr string, args []interface{}) (func() []interface{}, error) {
+	empty := func() []interface{} { return nil }
+	var a [8]interface{}
+	for i := range a {
+		if idxNum&(1<<uint(i)) != 0 {
+			a[i] = args[0]
+			args = args[1:]
+		}
+	}
+	if a[0] == nil || a[1] == nil {
+		return empty, nil
+	}
+
+	start, ok1 := seriesInt(a[0], false)
+	stop, ok2 := seriesInt(a[1], false)
+	step := int64(1)
+	ok3 := true
+	if idxNum&seriesStep != 0 {
+		if a[2] == nil {
+			return empty, nil
+		}
+
+		step, ok3 = seriesInt(a[2], false)
+	}
+	if !ok1 || !ok2 || !ok3 {
+		return empty, nil
+	}
+
+	desc := step < 0
+	if idxNum&seriesOrdered != 0 {
+		desc = idxNum&seriesDesc != 0
+	}
+	if step < 0 {
+		step = -step
+	}
+	if step <= 0 { // 0 or MinInt64
+		step = 1
+	}
+
+	// lo and hi are the bounds of the values, all start + k*step.
+	lo, hi := start, stop
+	for i, v := range a[3:] {
+		flag := seriesLower << uint(i)
+		if idxNum&flag == 0 {
+			continue
+		}
+
+		var n int64
+		var ok bool
+		switch flag {
+		case seriesLower, seriesEqual:
+			n, ok = seriesInt(v, true)
+		case seriesLowerExcl:
+			if n, ok = seriesInt(v, false); ok && n < math.MaxInt64 {
+				n++
+			}
+		case seriesUpper:
+			n, ok = seriesInt(v, false)
+		case seriesUpperExcl:
+			if n, ok = seriesInt(v, true); ok && n > math.MinInt64 {
+				n--
+			}
+		}
+		if !ok {
+			continue
+		}
+
+		if flag&(seriesLower|seriesLowerExcl|seriesEqual) != 0 && n > lo {
+			lo = n
+		}
+		if flag&(seriesUpper|seriesUpperExcl|seriesEqual) != 0 && n < hi {
+			hi = n
+		}
+	}
+	if lo > hi || hi < start {
+		return empty, nil
+	}
+
+	// Align lo up and hi down to the series, computing in uint64 to avoid
+	// overflows.
+	ustep := uint64(step)
+	first := uint64(0)
+	if lo > start {
+		first = (uint64(lo-start) + ustep - 1) / ustep
+	}
+	last := uint64(hi-start) / ustep
+	if first > last {
+		return empty, nil
+	}
+
+	k, end, inc := first, last, uint64(1)
+	if desc {
+		k, end, inc = last, first, ^uint64(0)
+	}
+	done := false
+	return func() []interface{} {
+		if done {
+			return nil
+		}
+
+		v := int64(uint64(start) + k*ustep)
+		done = k == end
+		k += inc
+		return []interface{}{v, a[0], a[1], a[2]}
+	}, nil
+}
@@ -0,0 +1,467 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Sessions record the changes of the tables of a database for .session
+// changeset and patchset, like the session extension of SQLite.
+//
+//	.session open DB NAME
+//	.session ?NAME? attach TABLE|*
+//	.session ?NAME? changeset|patchset FILE
+//	.session ?NAME? enable|indirect ?BOOLEAN?
+//	.session ?NAME? close|isempty
+//	.session list
+//
+// A session records a table with TEMP triggers. The first change of a row
+// saves the original row, or that it did not exist, in a TEMP log table
+// keyed by the PRIMARY KEY. The changeset compares the saved rows with the
+// current ones, in the order the rows were first changed, so a row changed
+// back is not in the changeset. Like in the session extension, tables
+// without a PRIMARY KEY and rows with a NULL in the PRIMARY KEY are not
+// recorded. attach * attaches the tables of DB which exist at that time.
+//
+// Without NAME, the commands use the first session opened.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:   "session",
+		abbrev: 4,
+		usage:  "?NAME? CMD ...",
+		help: `Create or control sessions
+attach TABLE|*        Record the changes of TABLE or of all tables
+changeset FILE        Write the changes as a changeset to FILE
+close                 Close the session
+enable ?BOOLEAN?      Set or query the enable flag
+indirect ?BOOLEAN?    Set or query the indirect flag
+isempty               Query whether the session has recorded changes
+list                  List the sessions
+open DB NAME          Open a session on the database DB
+patchset FILE         Write the changes as a patchset to FILE`,
+		run: sessionCommand,
+	})
+}
+
+// sessions holds the sessions by ShellState, in the order they were opened.
+var sessions = map[uintptr][]*session{}
+
+type session struct {
+	name     string
+	schema   string
+	db       uintptr // *Tsqlite3 the session was opened on.
+	enabled  bool
+	indirect bool
+	tables   []*sessionTable
+}
+
+type sessionTable struct {
+	name string
+	cols []string
+	pk   []int // Position of the column in the PRIMARY KEY, 0 if none.
+}
+
+// log is the TEMP table saving the original rows of t. Its columns are
+// "existed", whether the row existed, "indirect" and c0, c1, ... the
+// columns of t.
+func (s *session) log(t *sessionTable) string { return "temp." + s.logName(t) }
+
+// logName is the unqualified name of the log, the triggers cannot qualify
+// the tables they change.
+func (s *session) logName(t *sessionTable) string {
+	return sqlQuoteID(fmt.Sprintf("session$%s$%s", s.name, t.name))
+}
+
+func (s *session) trigger(t *sessionTable, event string) string {
+	return "temp." + sqlQuoteID(fmt.Sprintf("session$%s$%s$%s", s.name, t.name, event))
+}
+
+var sessionEvents = []string{"before_insert", "after_insert", "delete", "before_update", "after_update"}
+
+func sessionCommand(s *shell, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	a := sessions[s.p]
+	if len(a) != 0 && a[0].db != s.state().Xdb {
+		// The database was closed by .open, with the TEMP tables.
+		a = nil
+		delete(sessions, s.p)
+	}
+	switch args[0] {
+	case "open":
+		if len(args) != 3 {
+			return errUsage
+		}
+
+		for _, v := range a {
+			if v.name == args[2] {
+				return fmt.Errorf("session %s already exists", args[2])
+			}
+		}
+		c := s.conn()
+		row, err := c.queryRow("SELECT name FROM pragma_database_list WHERE name = ? COLLATE NOCASE", args[1])
+		if err != nil {
+			return err
+		}
+
+		if row == nil {
+			return fmt.Errorf("no such database: %s", args[1])
+		}
+
+		sessions[s.p] = append(a, &session{name: args[2], schema: row[0].(string), db: c.db, enabled: true})
+		return nil
+	case "list":
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		for i, v := range a {
+			s.printf("%d %s\n", i, v.name)
+		}
+		return nil
+	}
+
+	if len(a) == 0 {
+		return errors.New("no sessions are open")
+	}
+
+	sess := a[0]
+	for _, v := range a {
+		if v.name == args[0] && len(args) > 1 {
+			sess = v
+			args = args[1:]
+			break
+		}
+	}
+	c := s.conn()
+	switch args[0] {
+	case "attach":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		if args[1] != "*" {
+			return sess.attach(c, args[1])
+		}
+
+		rows, err := c.query(fmt.Sprintf("SELECT name FROM %s.sqlite_master WHERE type = 'table' AND name NOT LIKE 'sqlite_%%' ORDER BY rowid", sqlQuoteID(sess.schema)))
+		if err != nil {
+			return err
+		}
+
+		for _, v := range rows {
+			if err := sess.attach(c, v[0].(string)); err != nil && err != errNoPrimaryKey {
+				return err
+			}
+		}
+		return nil
+	case "changeset", "patchset":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		cs, err := sess.changeset(c, args[0] == "patchset")
+		if err != nil {
+			return err
+		}
+
+		return ioutil.WriteFile(args[1], cs.bytes(), 0666)
+	case "close":
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		err := sess.drop(c)
+		for i, v := range a {
+			if v == sess {
+				a = append(a[:i], a[i+1:]...)
+				break
+			}
+		}
+		sessions[s.p] = a
+		if len(a) == 0 {
+			delete(sessions, s.p)
+		}
+		return err
+	case "enable", "indirect":
+		flag := &sess.enabled
+		if args[0] == "indirect" {
+			flag = &sess.indirect
+		}
+		switch len(args) {
+		case 1:
+		case 2:
+			v := booleanValue(args[1])
+			if v == *flag {
+				break
+			}
+
+			*flag = v
+			for _, t := range sess.tables {
+				if err := sess.createTriggers(c, t); err != nil {
+					return err
+				}
+			}
+		default:
+			return errUsage
+		}
+		n := 0
+		if *flag {
+			n = 1
+		}
+		s.printf("session %s %s flag = %d\n", sess.name, args[0], n)
+		return nil
+	case "isempty":
+		if len(args) != 1 {
+			return errUsage
+		}
+
+		cs, err := sess.changeset(c, false)
+		if err != nil {
+			return err
+		}
+
+		n := 1
+		if len(cs.bytes()) != 0 {
+			n = 0
+		}
+		s.printf("session %s isempty flag = %d\n", sess.name, n)
+		return nil
+	}
+	return errUsage
+}
+
+// booleanValue interprets s like the booleanValue function of the C shell.
+func booleanValue(s string) bool {
+	switch strings.ToLower(s) {
+	case "on", "yes", "true":
+		return true
+	case "off", "no", "false":
+		return false
+	}
+	n := 0
+	fmt.Sscan(s, &n)
+	return n != 0
+}
+
+var errNoPrimaryKey = errors.New("table has no PRIMARY KEY")
+
+// attach starts recording the changes of the table name.
+func (s *session) attach(c *sqlConn, name string) error {
+	for _, v := range s.tables {
+		if strings.EqualFold(v.name, name) {
+			return nil
+		}
+	}
+
+	rows, err := c.query("SELECT name, pk FROM pragma_table_info(?, ?) ORDER BY cid", name, s.schema)
+	if err != nil {
+		return err
+	}
+
+	if len(rows) == 0 {
+		return fmt.Errorf("no such table: %s", name)
+	}
+
+	row, err := c.queryRow(fmt.Sprintf("SELECT name FROM %s.sqlite_master WHERE type = 'table' AND name = ? COLLATE NOCASE", sqlQuoteID(s.schema)), name)
+	if err != nil {
+		return err
+	}
+
+	if row == nil {
+		return fmt.Errorf("%s is not a table", name)
+	}
+
+	t := &sessionTable{name: row[0].(string)}
+	var logCols, key []string
+	for i, v := range rows {
+		t.cols = append(t.cols, v[0].(string))
+		t.pk = append(t.pk, int(v[1].(int64)))
+		logCols = append(logCols, fmt.Sprintf("c%d", i))
+		if t.pk[i] != 0 {
+			key = append(key, logCols[i])
+		}
+	}
+	if len(key) == 0 {
+		return errNoPrimaryKey
+	}
+
+	if err := c.exec(fmt.Sprintf("CREATE TABLE %s(existed, indirect, %s, PRIMARY KEY(%s))", s.log(t), strings.Join(logCols, ", "), strings.Join(key, ", "))); err != nil {
+		return err
+	}
+
+	if err := s.createTriggers(c, t); err != nil {
+		c.exec(fmt.Sprintf("DROP TABLE %s", s.log(t)))
+		return err
+	}
+
+	s.tables = append(s.tables, t)
+	return nil
+}
+
+// createTriggers creates, or creates again after a change of the flags, the
+// triggers recording the changes of t. There are none if the session is
+// disabled.
+func (s *session) createTriggers(c *sqlConn, t *sessionTable) error {
+	for _, v := range sessionEvents {
+		if err := c.exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s", s.trigger(t, v))); err != nil {
+			return err
+		}
+	}
+	if !s.enabled {
+		return nil
+	}
+
+	indirect := 0
+	if s.indirect {
+		indirect = 1
+	}
+	// values returns the values of the columns of the row r, OLD or NEW,
+	// or only of its PRIMARY KEY, and the condition selecting the row
+	// by the PRIMARY KEY.
+	values := func(r string, pkOnly bool) (string, string) {
+		var a, w []string
+		for i, v := range t.cols {
+			if t.pk[i] != 0 {
+				w = append(w, fmt.Sprintf("%s.%s IS NOT NULL", r, sqlQuoteID(v)))
+			}
+			if !pkOnly || t.pk[i] != 0 {
+				a = append(a, fmt.Sprintf("%s.%s", r, sqlQuoteID(v)))
+			}
+		}
+		return strings.Join(a, ", "), strings.Join(w, " AND ")
+	}
+	var pkCols, match []string
+	for i, v := range t.cols {
+		if t.pk[i] != 0 {
+			pkCols = append(pkCols, fmt.Sprintf("c%d", i))
+			match = append(match, fmt.Sprintf("t.%s IS NEW.%[1]s", sqlQuoteID(v)))
+		}
+	}
+	table := sqlQuoteID(s.schema) + "." + sqlQuoteID(t.name)
+	all, _ := values("t", false)
+	newKey, newWhen := values("NEW", true)
+	oldRow, oldWhen := values("OLD", false)
+	for _, v := range []struct{ event, when, sql string }{
+		// An INSERT OR REPLACE replaces the existing row.
+		{"before_insert", "BEFORE INSERT", fmt.Sprintf("INSERT OR IGNORE INTO %s SELECT 1, %d, %s FROM %s AS t WHERE %s",
+			s.logName(t), indirect, all, table, strings.Join(match, " AND ")),
+		},
+		{"after_insert", "AFTER INSERT", fmt.Sprintf("INSERT OR IGNORE INTO %s(existed, indirect, %s) VALUES(0, %d, %s)",
+			s.logName(t), strings.Join(pkCols, ", "), indirect, newKey),
+		},
+		{"delete", "BEFORE DELETE", fmt.Sprintf("INSERT OR IGNORE INTO %s VALUES(1, %d, %s)", s.logName(t), indirect, oldRow)},
+		{"before_update", "BEFORE UPDATE", fmt.Sprintf("INSERT OR IGNORE INTO %s VALUES(1, %d, %s)", s.logName(t), indirect, oldRow)},
+		// An UPDATE of the PRIMARY KEY inserts a row.
+		{"after_update", "AFTER UPDATE", fmt.Sprintf("INSERT OR IGNORE INTO %s(existed, indirect, %s) VALUES(0, %d, %s)",
+			s.logName(t), strings.Join(pkCols, ", "), indirect, newKey),
+		},
+	} {
+		when := newWhen
+		if strings.HasPrefix(v.when, "BEFORE") && v.event != "before_insert" {
+			when = oldWhen
+		}
+		name := sqlQuoteID(fmt.Sprintf("session$%s$%s$%s", s.name, t.name, v.event))
+		if err := c.exec(fmt.Sprintf("CREATE TEMP TRIGGER %s %s ON %s WHEN %s BEGIN %s; END", name, v.when, table, when, v.sql)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// drop drops the triggers and log tables of s.
+func (s *session) drop(c *sqlConn) error {
+	var err error
+	for _, t := range s.tables {
+		for _, v := range sessionEvents {
+			if e := c.exec(fmt.Sprintf("DROP TRIGGER IF EXISTS %s", s.trigger(t, v))); e != nil && err == nil {
+				err = e
+			}
+		}
+		if e := c.exec(fmt.Sprintf("DROP TABLE IF EXISTS %s", s.log(t))); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// changeset returns the changes recorded by s.
+func (s *session) changeset(c *sqlConn, patchset bool) (*changeset, error) {
+	cs := &changeset{patchset: patchset}
+	for _, t := range s.tables {
+		ct := &changeTable{name: t.name, pk: t.pk}
+		var cols, match []string
+		found := ""
+		for i, v := range t.cols {
+			cols = append(cols, "t."+sqlQuoteID(v))
+			if t.pk[i] != 0 {
+				match = append(match, fmt.Sprintf("t.%s IS log.c%d", sqlQuoteID(v), i))
+				if found == "" {
+					// The PRIMARY KEY in the log is not NULL.
+					found = fmt.Sprintf("t.%s IS NOT NULL", sqlQuoteID(v))
+				}
+			}
+		}
+		var logCols []string
+		for i := range t.cols {
+			logCols = append(logCols, fmt.Sprintf("log.c%d", i))
+		}
+		// The current row, if any, follows the columns of the log.
+		rows, err := c.query(fmt.Sprintf("SELECT log.existed, log.indirect, %s, %s, %s FROM %s AS log LEFT JOIN %s.%s AS t ON %s ORDER BY log.rowid",
+			strings.Join(logCols, ", "), found, strings.Join(cols, ", "),
+			s.log(t), sqlQuoteID(s.schema), sqlQuoteID(t.name), strings.Join(match, " AND ")))
+		if err != nil {
+			return nil, err
+		}
+
+		n := len(t.cols)
+		for _, row := range rows {
+			existed := row[0].(int64) != 0
+			exists := row[2+n].(int64) != 0
+			old, cur := row[2:2+n], row[3+n:]
+			ch := &change{indirect: row[1].(int64) != 0}
+			switch {
+			case existed && !exists:
+				ch.op, ch.old = changeDelete, old
+			case !existed && exists:
+				ch.op, ch.new = changeInsert, cur
+			case existed && exists:
+				ch.op = changeUpdate
+				ch.old = make([]interface{}, n)
+				ch.new = make([]interface{}, n)
+				changed := false
+				for i := range cur {
+					switch {
+					case !sameValue(old[i], cur[i]):
+						ch.old[i], ch.new[i] = old[i], cur[i]
+						changed = true
+					case t.pk[i] != 0:
+						ch.old[i], ch.new[i] = old[i], undefined
+					default:
+						ch.old[i], ch.new[i] = undefined, undefined
+					}
+					if patchset && t.pk[i] != 0 {
+						ch.new[i] = cur[i]
+					}
+				}
+				if !changed {
+					continue
+				}
+
+				if patchset {
+					ch.old = nil
+				}
+			default:
+				continue
+			}
+			ct.changes = append(ct.changes, ch)
+		}
+		cs.tables = append(cs.tables, ct)
+	}
+	return cs, nil
+}
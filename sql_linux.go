@@ -0,0 +1,311 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// sqlConn runs SQL statements on a database connection for the hand written
+// parts of the shell. Values are bound and returned as int64, float64,
+// string, []byte or nil.
+type sqlConn struct {
+	tls TLS
+	db  uintptr // *Ssqlite3
+}
+
+type sqlStmt struct {
+	c *sqlConn
+	p uintptr // *Ssqlite3_stmt
+}
+
+func (c *sqlConn) err() error { return errors.New(goString(Xsqlite3_errmsg(c.tls, c.db))) }
+
+// prepare compiles the first statement of sql and binds args to its
+// parameters. The statement is nil if sql contains only white space or
+// comments.
+func (c *sqlConn) prepare(sql string, args ...interface{}) (*sqlStmt, error) {
+	s, _, err := c.prepareTail(sql)
+	if err != nil || s == nil {
+		return s, err
+	}
+
+	if err := s.bind(args...); err != nil {
+		s.close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// prepareTail compiles the first statement of sql and returns the statement
+// and the rest of sql.
+func (c *sqlConn) prepareTail(sql string) (*sqlStmt, string, error) {
+	zSQL := cString(c.tls, sql)
+	if zSQL == 0 {
+		return nil, "", errors.New("out of memory")
+	}
+
+	defer Xsqlite3_free(c.tls, zSQL)
+	pp := cZero(c.tls, 2*ptrSize) // stmt, tail
+	if pp == 0 {
+		return nil, "", errors.New("out of memory")
+	}
+
+	defer Xsqlite3_free(c.tls, pp)
+	if Xsqlite3_prepare_v2(c.tls, c.db, zSQL, -1, pp, pp+ptrSize) != sqliteOK {
+		return nil, "", c.err()
+	}
+
+	tail := sql[argv(pp, 1)-zSQL:]
+	if p := argv(pp, 0); p != 0 {
+		return &sqlStmt{c, p}, tail, nil
+	}
+
+	return nil, tail, nil
+}
+
+// exec executes all statements of sql. args are bound to the parameters of
+// every statement.
+func (c *sqlConn) exec(sql string, args ...interface{}) error {
+	for strings.TrimSpace(sql) != "" {
+		s, tail, err := c.prepareTail(sql)
+		if err != nil {
+			return err
+		}
+
+		sql = tail
+		if s == nil {
+			continue
+		}
+
+		if err = s.bind(args[:min(len(args), s.paramCount())]...); err == nil {
+			for {
+				var ok bool
+				if ok, err = s.step(); !ok || err != nil {
+					break
+				}
+			}
+		}
+		s.close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query returns all rows produced by sql.
+func (c *sqlConn) query(sql string, args ...interface{}) ([][]interface{}, error) {
+	s, err := c.prepare(sql, args...)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	defer s.close()
+	var r [][]interface{}
+	for {
+		ok, err := s.step()
+		if err != nil {
+			return nil, err
+		}
+
+		if !ok {
+			return r, nil
+		}
+
+		r = append(r, s.row())
+	}
+}
+
+// queryRow returns the first row produced by sql or nil if there is none.
+func (c *sqlConn) queryRow(sql string, args ...interface{}) ([]interface{}, error) {
+	s, err := c.prepare(sql, args...)
+	if err != nil || s == nil {
+		return nil, err
+	}
+
+	defer s.close()
+	if ok, err := s.step(); !ok || err != nil {
+		return nil, err
+	}
+
+	return s.row(), nil
+}
+
+func (s *sqlStmt) paramCount() int { return int(Xsqlite3_bind_parameter_count(s.c.tls, s.p)) }
+
+// bind resets s and binds args to its parameters.
+func (s *sqlStmt) bind(args ...interface{}) error {
+	tls := s.c.tls
+	Xsqlite3_reset(tls, s.p)
+	for i, v := range args {
+		var rc int32
+		n := int32(i + 1)
+		switch x := v.(type) {
+		case nil:
+			rc = Xsqlite3_bind_null(tls, s.p, n)
+		case int:
+			rc = Xsqlite3_bind_int64(tls, s.p, n, int64(x))
+		case int64:
+			rc = Xsqlite3_bind_int64(tls, s.p, n, x)
+		case bool:
+			var b int64
+			if x {
+				b = 1
+			}
+			rc = Xsqlite3_bind_int64(tls, s.p, n, b)
+		case float64:
+			rc = Xsqlite3_bind_double(tls, s.p, n, x)
+		case string:
+			p := cString(tls, x)
+			if p == 0 {
+				return errors.New("out of memory")
+			}
+
+			rc = Xsqlite3_bind_text(tls, s.p, n, p, int32(len(x)), cfnFinal(Xsqlite3_free))
+		case []byte:
+			p := cBytes(tls, x)
+			if p == 0 {
+				return errors.New("out of memory")
+			}
+
+			rc = Xsqlite3_bind_blob(tls, s.p, n, p, int32(len(x)), cfnFinal(Xsqlite3_free))
+		default:
+			return fmt.Errorf("cannot bind %T", v)
+		}
+		if rc != sqliteOK {
+			return s.c.err()
+		}
+	}
+	return nil
+}
+
+// step advances s to the next row and reports whether there is one.
+func (s *sqlStmt) step() (bool, error) {
+	switch Xsqlite3_step(s.c.tls, s.p) {
+	case sqliteRow:
+		return true, nil
+	case sqliteDone:
+		return false, nil
+	}
+	return false, s.c.err()
+}
+
+func (s *sqlStmt) columnCount() int { return int(Xsqlite3_column_count(s.c.tls, s.p)) }
+
+func (s *sqlStmt) columnName(i int) string {
+	return goString(Xsqlite3_column_name(s.c.tls, s.p, int32(i)))
+}
+
+// column returns the i-th column of the current row.
+func (s *sqlStmt) column(i int) interface{} {
+	tls := s.c.tls
+	n := int32(i)
+	switch Xsqlite3_column_type(tls, s.p, n) {
+	case sqliteInteger:
+		return Xsqlite3_column_int64(tls, s.p, n)
+	case sqliteFloat:
+		return Xsqlite3_column_double(tls, s.p, n)
+	case sqliteText:
+		p := Xsqlite3_column_text(tls, s.p, n)
+		return string(goBytes(p, int(Xsqlite3_column_bytes(tls, s.p, n))))
+	case sqliteBlob:
+		p := Xsqlite3_column_blob(tls, s.p, n)
+		if b := goBytes(p, int(Xsqlite3_column_bytes(tls, s.p, n))); b != nil {
+			return b
+		}
+
+		return []byte{}
+	}
+	return nil
+}
+
+// row returns all columns of the current row.
+func (s *sqlStmt) row() []interface{} {
+	r := make([]interface{}, s.columnCount())
+	for i := range r {
+		r[i] = s.column(i)
+	}
+	return r
+}
+
+func (s *sqlStmt) close() { Xsqlite3_finalize(s.c.tls, s.p) }
+
+// sqlQuoteID returns s as an SQL identifier.
+func sqlQuoteID(s string) string { return `"` + strings.Replace(s, `"`, `""`, -1) + `"` }
+
+// sqlQuote returns s as an SQL string literal.
+func sqlQuote(s string) string { return "'" + strings.Replace(s, "'", "''", -1) + "'" }
+
+// sqlLiteral returns v, as returned by sqlStmt.column, as an SQL literal.
+func sqlLiteral(v interface{}) string {
+	switch x := v.(type) {
+	case int64:
+		return strconv.FormatInt(x, 10)
+	case float64:
+		switch {
+		case math.IsNaN(x):
+			return "NULL"
+		case math.IsInf(x, 1):
+			return "1e999"
+		case math.IsInf(x, -1):
+			return "-1e999"
+		}
+
+		s := strconv.FormatFloat(x, 'g', -1, 64)
+		if !strings.ContainsAny(s, ".e") {
+			s += ".0"
+		}
+		return s
+	case string:
+		return sqlQuote(x)
+	case []byte:
+		return fmt.Sprintf("X'%x'", x)
+	}
+	return "NULL"
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+func max(a, b int) int {
+	if a > b {
+		return a
+	}
+
+	return b
+}
+
+// openMemory opens a new in-memory database.
+func openMemory(tls TLS) (*sqlConn, error) {
+	zName := cString(tls, ":memory:")
+	pp := cZero(tls, ptrSize)
+	defer func() {
+		Xsqlite3_free(tls, zName)
+		Xsqlite3_free(tls, pp)
+	}()
+	if zName == 0 || pp == 0 {
+		return nil, errors.New("out of memory")
+	}
+
+	c := &sqlConn{tls, 0}
+	rc := Xsqlite3_open(tls, zName, pp)
+	c.db = argv(pp, 0)
+	if rc != sqliteOK {
+		err := c.err()
+		c.close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+func (c *sqlConn) close() { Xsqlite3_close(c.tls, c.db) }
@@ -0,0 +1,490 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Virtual table modules written in Go.
+//
+// Modules registered by RegisterModule, typically from an init function of a
+// file compiled into the shell, are available on every connection the shell
+// opens. The adapter translates the sqlite3_module methods to the Module,
+// VTab and VCursor interfaces and converts values the same way as for Go SQL
+// functions. A panic of a method is an error of the SQL statement.
+
+// Module is a virtual table module. Connect returns the CREATE TABLE
+// statement declaring the columns of the table and the table itself.
+//
+// args[0] is the module name, args[1] the database name, args[2] the table
+// name and the remaining elements are the module arguments.
+//
+// Modules not implementing ModuleCreator are eponymous-only, they exist as
+// a table named after the module and cannot be used in CREATE VIRTUAL TABLE.
+type Module interface {
+	Connect(args []string) (schema string, t VTab, err error)
+}
+
+// ModuleCreator is implemented by modules usable in CREATE VIRTUAL TABLE.
+// Create is called for new tables, Connect for existing ones.
+type ModuleCreator interface {
+	Create(args []string) (schema string, t VTab, err error)
+}
+
+// VTab is a virtual table.
+type VTab interface {
+	// BestIndex chooses a query plan, see xBestIndex.
+	BestIndex(info *IndexInfo) error
+	// Open returns a new cursor.
+	Open() (VCursor, error)
+	// Disconnect releases the table, its content stays.
+	Disconnect() error
+	// Destroy releases the table and drops its content.
+	Destroy() error
+}
+
+// VTabUpdater is implemented by writable virtual tables. The args of Update
+// are those of xUpdate:
+//
+//	DELETE	[rowid]
+//	INSERT	[nil, rowid or nil, column values...]
+//	UPDATE	[old rowid, new rowid, column values...]
+//
+// Update returns the rowid of inserted rows.
+type VTabUpdater interface {
+	Update(args []interface{}) (rowid int64, err error)
+}
+
+// VCursor is a virtual table cursor.
+type VCursor interface {
+	// Filter starts a search using the plan chosen by BestIndex. args
+	// are the values of the constraints with a non zero ArgvIndex.
+	Filter(idxNum int, idxStr string, args []interface{}) error
+	Next() error
+	EOF() bool
+	// Column returns the value of the i-th column of the current row.
+	Column(i int) (interface{}, error)
+	Rowid() (int64, error)
+	Close() error
+}
+
+// Constraint operators of IndexConstraint.
+const (
+	IndexConstraintEQ    = 2
+	IndexConstraintGT    = 4
+	IndexConstraintLE    = 8
+	IndexConstraintLT    = 16
+	IndexConstraintGE    = 32
+	IndexConstraintMatch = 64
+	IndexConstraintLike  = 65
+	IndexConstraintGlob  = 66
+)
+
+// IndexInfo is the Go form of sqlite3_index_info.
+type IndexInfo struct {
+	// Inputs.
+	Constraints []IndexConstraint
+	OrderBy     []IndexOrderBy
+	ColUsed     uint64 // Mask of the columns used by the statement.
+
+	// Outputs.
+	IdxNum          int
+	IdxStr          string
+	OrderByConsumed bool
+	EstimatedCost   float64
+	EstimatedRows   int64
+}
+
+// IndexConstraint is a WHERE clause term of the form "column op expr".
+type IndexConstraint struct {
+	Column int // Column index, -1 for the rowid.
+	Op     int
+	Usable bool
+
+	// Outputs.
+	ArgvIndex int  // If > 0, the value of expr is Filter's args[ArgvIndex-1].
+	Omit      bool // Do not double check the constraint.
+}
+
+// IndexOrderBy is an ORDER BY term.
+type IndexOrderBy struct {
+	Column int
+	Desc   bool
+}
+
+type goModule struct {
+	name string
+	m    Module
+}
+
+var goModules []goModule
+
+// goModuleCreatable and goModuleEponymous adapt the registered modules. The
+// client data of the module is the index in goModules plus one.
+var (
+	goModuleCreatable = Ssqlite3_module{
+		XxCreate:     cfnConnect(goVTabCreate),
+		XxConnect:    cfnConnect(goVTabConnect),
+		XxBestIndex:  cfnVtab2(goVTabBestIndex),
+		XxDisconnect: cfnVtab(goVTabDisconnect),
+		XxDestroy:    cfnVtab(goVTabDestroy),
+		XxOpen:       cfnVtab2(goVTabOpen),
+		XxClose:      cfnVtab(goVTabClose),
+		XxFilter:     cfnFilter(goVTabFilter),
+		XxNext:       cfnVtab(goVTabNext),
+		XxEof:        cfnVtab(goVTabEof),
+		XxColumn:     cfnColumn(goVTabColumn),
+		XxRowid:      cfnVtab2(goVTabRowid),
+		XxUpdate:     cfnUpdate(goVTabUpdate),
+	}
+	goModuleEponymous = Ssqlite3_module{
+		XxConnect:    cfnConnect(goVTabConnect),
+		XxBestIndex:  cfnVtab2(goVTabBestIndex),
+		XxDisconnect: cfnVtab(goVTabDisconnect),
+		XxDestroy:    cfnVtab(goVTabDestroy),
+		XxOpen:       cfnVtab2(goVTabOpen),
+		XxClose:      cfnVtab(goVTabClose),
+		XxFilter:     cfnFilter(goVTabFilter),
+		XxNext:       cfnVtab(goVTabNext),
+		XxEof:        cfnVtab(goVTabEof),
+		XxColumn:     cfnColumn(goVTabColumn),
+		XxRowid:      cfnVtab2(goVTabRowid),
+		XxUpdate:     cfnUpdate(goVTabUpdate),
+	}
+)
+
+// RegisterModule adds the virtual table module m named name.
+func RegisterModule(name string, m Module) {
+	goModules = append(goModules, goModule{name, m})
+}
+
+// Xsqlite3_govtab_init registers the Go virtual table modules with db.
+func Xsqlite3_govtab_init(tls TLS, db, pzErrMsg, pApi uintptr) int32 {
+	for i, v := range goModules {
+		zName := cString(tls, v.name)
+		if zName == 0 {
+			return sqliteNoMem
+		}
+
+		m := &goModuleEponymous
+		if _, ok := v.m.(ModuleCreator); ok {
+			m = &goModuleCreatable
+		}
+		rc := Xsqlite3_create_module(tls, db, zName, uintptr(unsafe.Pointer(m)), uintptr(i+1))
+		Xsqlite3_free(tls, zName)
+		if rc != sqliteOK {
+			return rc
+		}
+	}
+	return sqliteOK
+}
+
+type goVTab struct {
+	VTab
+	name string // Module name.
+}
+
+type goVCursor struct {
+	VCursor
+	tab uintptr
+	err error // A panic of EOF, returned by the next method.
+}
+
+// recoverVTab turns a panic of a Go virtual table method into an SQL error of
+// the table tab.
+func recoverVTab(tls TLS, tab uintptr, rc *int32) {
+	if e := recover(); e != nil {
+		*rc = vtabError(tls, tab, fmt.Sprintf("%s: %v", getObject(tab).(*goVTab).name, e))
+	}
+}
+
+func goVTabCreate(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return goVTabInit(tls, db, pAux, argc, args, ppVtab, pzErr, true)
+}
+
+func goVTabConnect(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr) int32 {
+	return goVTabInit(tls, db, pAux, argc, args, ppVtab, pzErr, false)
+}
+
+func goVTabInit(tls TLS, db, pAux uintptr, argc int32, args, ppVtab, pzErr uintptr, create bool) (rc int32) {
+	m := goModules[pAux-1].m
+	a := make([]string, argc)
+	for i := range a {
+		a[i] = goString(argv(args, i))
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, fmt.Sprintf("%s: %v", a[0], e))
+			rc = sqliteError
+		}
+	}()
+
+	var schema string
+	var t VTab
+	var err error
+	switch {
+	case create:
+		schema, t, err = m.(ModuleCreator).Create(a)
+	default:
+		schema, t, err = m.Connect(a)
+	}
+	if err == nil && t == nil {
+		err = fmt.Errorf("%s: no virtual table", a[0])
+	}
+	if err != nil {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, err.Error())
+		return sqliteError
+	}
+
+	zSchema := cString(tls, schema)
+	if zSchema == 0 {
+		t.Disconnect()
+		return sqliteNoMem
+	}
+
+	rc = Xsqlite3_declare_vtab(tls, db, zSchema)
+	Xsqlite3_free(tls, zSchema)
+	if rc != sqliteOK {
+		*(*uintptr)(unsafe.Pointer(pzErr)) = cString(tls, fmt.Sprintf("%s: %s", a[0], goString(Xsqlite3_errmsg(tls, db))))
+		t.Disconnect()
+		return rc
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab{}))
+	*(*uintptr)(unsafe.Pointer(ppVtab)) = p
+	if p == 0 {
+		t.Disconnect()
+		return sqliteNoMem
+	}
+
+	putObject(p, &goVTab{VTab: t, name: a[0]})
+	return sqliteOK
+}
+
+func vtabResult(tls TLS, tab uintptr, err error) int32 {
+	if err == nil {
+		return sqliteOK
+	}
+
+	return vtabError(tls, tab, err.Error())
+}
+
+func goVTabBestIndex(tls TLS, tab, pIdxInfo uintptr) (rc int32) {
+	defer recoverVTab(tls, tab, &rc)
+
+	t := getObject(tab).(*goVTab)
+	info := (*Ssqlite3_index_info)(unsafe.Pointer(pIdxInfo))
+	x := &IndexInfo{
+		ColUsed:       uint64(info.XcolUsed),
+		EstimatedCost: info.XestimatedCost,
+		EstimatedRows: int64(info.XestimatedRows),
+	}
+	for i := 0; i < int(info.XnConstraint); i++ {
+		c := indexConstraint(info, i)
+		x.Constraints = append(x.Constraints, IndexConstraint{
+			Column: int(c.XiColumn),
+			Op:     int(c.Xop),
+			Usable: c.Xusable != 0,
+		})
+	}
+	for i := 0; i < int(info.XnOrderBy); i++ {
+		o := indexOrderBy(info, i)
+		x.OrderBy = append(x.OrderBy, IndexOrderBy{Column: int(o.XiColumn), Desc: o.Xdesc != 0})
+	}
+	if err := t.BestIndex(x); err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	for i, c := range x.Constraints {
+		if i == int(info.XnConstraint) { // BestIndex appended constraints.
+			break
+		}
+
+		u := indexConstraintUsage(info, i)
+		u.XargvIndex = int32(c.ArgvIndex)
+		u.Xomit = 0
+		if c.Omit {
+			u.Xomit = 1
+		}
+	}
+	info.XidxNum = int32(x.IdxNum)
+	if x.IdxStr != "" {
+		if info.XidxStr = cString(tls, x.IdxStr); info.XidxStr == 0 {
+			return sqliteNoMem
+		}
+
+		info.XneedToFreeIdxStr = 1
+	}
+	info.XorderByConsumed = 0
+	if x.OrderByConsumed {
+		info.XorderByConsumed = 1
+	}
+	info.XestimatedCost = x.EstimatedCost
+	info.XestimatedRows = x.EstimatedRows
+	return sqliteOK
+}
+
+// goVTabFree releases the table tab, also if its Disconnect or Destroy
+// panicked.
+func goVTabFree(tls TLS, tab uintptr, rc *int32) {
+	if e := recover(); e != nil {
+		*rc = sqliteError
+	}
+	deleteObject(tab)
+	Xsqlite3_free(tls, tab)
+}
+
+func goVTabDisconnect(tls TLS, tab uintptr) (rc int32) {
+	defer goVTabFree(tls, tab, &rc)
+
+	if err := getObject(tab).(*goVTab).Disconnect(); err != nil {
+		return sqliteError
+	}
+
+	return sqliteOK
+}
+
+func goVTabDestroy(tls TLS, tab uintptr) (rc int32) {
+	defer goVTabFree(tls, tab, &rc)
+
+	if err := getObject(tab).(*goVTab).Destroy(); err != nil {
+		return sqliteError
+	}
+
+	return sqliteOK
+}
+
+func goVTabOpen(tls TLS, tab, ppCursor uintptr) (rc int32) {
+	defer recoverVTab(tls, tab, &rc)
+
+	c, err := getObject(tab).(*goVTab).Open()
+	if err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	p := cZero(tls, unsafe.Sizeof(Ssqlite3_vtab_cursor{}))
+	*(*uintptr)(unsafe.Pointer(ppCursor)) = p
+	if p == 0 {
+		c.Close()
+		return sqliteNoMem
+	}
+
+	putObject(p, &goVCursor{VCursor: c, tab: tab})
+	return sqliteOK
+}
+
+func goVTabClose(tls TLS, cur uintptr) (rc int32) {
+	c := getObject(cur).(*goVCursor)
+	defer func() {
+		deleteObject(cur)
+		Xsqlite3_free(tls, cur)
+	}()
+	defer recoverVTab(tls, c.tab, &rc)
+
+	return vtabResult(tls, c.tab, c.Close())
+}
+
+func goVTabFilter(tls TLS, cur uintptr, idxNum int32, idxStr uintptr, argc int32, args uintptr) (rc int32) {
+	c := getObject(cur).(*goVCursor)
+	defer recoverVTab(tls, c.tab, &rc)
+
+	c.err = nil
+	a := make([]interface{}, argc)
+	for i := range a {
+		a[i] = goValue(tls, argv(args, i))
+	}
+	return vtabResult(tls, c.tab, c.Filter(int(idxNum), goString(idxStr), a))
+}
+
+func goVTabNext(tls TLS, cur uintptr) (rc int32) {
+	c := getObject(cur).(*goVCursor)
+	defer recoverVTab(tls, c.tab, &rc)
+
+	if c.err != nil {
+		return vtabResult(tls, c.tab, c.err)
+	}
+
+	return vtabResult(tls, c.tab, c.Next())
+}
+
+// goVTabEof cannot return an error. If EOF panics, the cursor is not at EOF
+// and the next method called returns the panic as an error.
+func goVTabEof(tls TLS, cur uintptr) (r int32) {
+	c := getObject(cur).(*goVCursor)
+	defer func() {
+		if e := recover(); e != nil {
+			c.err = fmt.Errorf("%s: %v", getObject(c.tab).(*goVTab).name, e)
+			r = 0
+		}
+	}()
+
+	if c.err == nil && c.EOF() {
+		return 1
+	}
+
+	return 0
+}
+
+func goVTabColumn(tls TLS, cur, ctx uintptr, i int32) (rc int32) {
+	c := getObject(cur).(*goVCursor)
+	defer func() {
+		if e := recover(); e != nil {
+			resultError(tls, ctx, fmt.Sprintf("%s: %v", getObject(c.tab).(*goVTab).name, e))
+			rc = sqliteError
+		}
+	}()
+
+	if c.err != nil {
+		resultError(tls, ctx, c.err.Error())
+		return sqliteError
+	}
+
+	v, err := c.Column(int(i))
+	if err != nil {
+		resultError(tls, ctx, err.Error())
+		return sqliteError
+	}
+
+	resultValue(tls, ctx, v)
+	return sqliteOK
+}
+
+func goVTabRowid(tls TLS, cur, pRowid uintptr) (rc int32) {
+	c := getObject(cur).(*goVCursor)
+	defer recoverVTab(tls, c.tab, &rc)
+
+	if c.err != nil {
+		return vtabResult(tls, c.tab, c.err)
+	}
+
+	rowid, err := c.Rowid()
+	if err != nil {
+		return vtabError(tls, c.tab, err.Error())
+	}
+
+	*(*int64)(unsafe.Pointer(pRowid)) = rowid
+	return sqliteOK
+}
+
+func goVTabUpdate(tls TLS, tab uintptr, argc int32, args, pRowid uintptr) (rc int32) {
+	defer recoverVTab(tls, tab, &rc)
+
+	u, ok := getObject(tab).(*goVTab).VTab.(VTabUpdater)
+	if !ok {
+		return vtabError(tls, tab, "table is read-only")
+	}
+
+	a := make([]interface{}, argc)
+	for i := range a {
+		a[i] = goValue(tls, argv(args, i))
+	}
+	rowid, err := u.Update(a)
+	if err != nil {
+		return vtabError(tls, tab, err.Error())
+	}
+
+	if argc > 1 && a[0] == nil {
+		*(*int64)(unsafe.Pointer(pRowid)) = rowid
+	}
+	return sqliteOK
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"unsafe"
+)
+
+// The WAL file and checkpoints.
+//
+//	.wal info ?DB?
+//	.wal checkpoint ?passive|full|restart|truncate? ?DB?
+//	.wal autocheckpoint ?N?
+//
+// .wal info decodes the header of the WAL file of the database DB, main by
+// default, and lists its frames with their page number, the database size in
+// pages of commit frames, the salt and whether the checksum is valid. Frames
+// after the first invalid one, or after the last commit frame, are not part
+// of the database and are ignored by SQLite.
+//
+// .wal checkpoint runs a checkpoint, passive by default, of DB or of all
+// databases and writes the number of frames in the WAL file and the number of
+// frames checkpointed, like PRAGMA wal_checkpoint. .wal autocheckpoint sets
+// or writes the number of frames which make a commit run a checkpoint.
+
+func init() {
+	metaCommands = append(metaCommands, &metaCommand{
+		name:  "wal",
+		usage: "info|checkpoint|autocheckpoint ...",
+		help: `Inspect the WAL file and run checkpoints
+autocheckpoint ?N?    Set or show the frames that trigger a checkpoint
+checkpoint ?MODE? ?DB?
+  Run a checkpoint, MODE is passive, full, restart or truncate
+info ?DB?             Decode the WAL file header and list its frames`,
+		run: walCommand,
+	})
+}
+
+const (
+	walHeaderSize      = 32
+	walFrameHeaderSize = 24
+	walMagic           = 0x377f0682 // The low bit is set for big endian checksums.
+)
+
+var walCheckpointModes = map[string]int32{"passive": 0, "full": 1, "restart": 2, "truncate": 3}
+
+func walCommand(s *shell, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	c := s.conn()
+	switch cmd, args := args[0], args[1:]; cmd {
+	case "info":
+		if len(args) > 1 {
+			return errUsage
+		}
+
+		db := "main"
+		if len(args) == 1 {
+			db = args[0]
+		}
+		row, err := c.queryRow("SELECT file FROM pragma_database_list WHERE name = ? COLLATE NOCASE", db)
+		if err != nil {
+			return err
+		}
+
+		if row == nil {
+			return fmt.Errorf("no such database: %s", db)
+		}
+
+		if row[0] == "" {
+			return fmt.Errorf("%s is a temporary or in-memory database", db)
+		}
+
+		return walInfo(s, row[0].(string)+"-wal")
+	case "checkpoint":
+		mode := int32(0)
+		db := ""
+		if len(args) != 0 {
+			if v, ok := walCheckpointModes[args[0]]; ok {
+				mode = v
+				args = args[1:]
+			}
+		}
+		switch len(args) {
+		case 0:
+		case 1:
+			db = args[0]
+		default:
+			return errUsage
+		}
+
+		p := cZero(s.tls, 8)
+		if p == 0 {
+			return errors.New("out of memory")
+		}
+
+		defer Xsqlite3_free(s.tls, p)
+		var zDb uintptr
+		if db != "" {
+			if zDb = cString(s.tls, db); zDb == 0 {
+				return errors.New("out of memory")
+			}
+
+			defer Xsqlite3_free(s.tls, zDb)
+		}
+		rc := Xsqlite3_wal_checkpoint_v2(s.tls, c.db, zDb, mode, p, p+4)
+		if rc != sqliteOK && rc != sqliteBusy {
+			return c.err()
+		}
+
+		s.printf("log frames %d, checkpointed frames %d", *(*int32)(unsafe.Pointer(p)), *(*int32)(unsafe.Pointer(p + 4)))
+		if rc == sqliteBusy {
+			s.printf(", busy")
+		}
+		s.printf("\n")
+		return nil
+	case "autocheckpoint":
+		switch len(args) {
+		case 0:
+			row, err := c.queryRow("PRAGMA wal_autocheckpoint")
+			if err != nil {
+				return err
+			}
+
+			s.printf("autocheckpoint %v\n", row[0])
+			return nil
+		case 1:
+			n, err := strconv.Atoi(args[0])
+			if err != nil {
+				return fmt.Errorf("%s: not a number of frames", args[0])
+			}
+
+			if Xsqlite3_wal_autocheckpoint(s.tls, c.db, int32(n)) != sqliteOK {
+				return c.err()
+			}
+
+			return nil
+		}
+	}
+	return errUsage
+}
+
+// walChecksum continues the checksum s0, s1 over b, a multiple of 8 bytes.
+func walChecksum(b []byte, bigEndian bool, s0, s1 uint32) (uint32, uint32) {
+	var order binary.ByteOrder = binary.LittleEndian
+	if bigEndian {
+		order = binary.BigEndian
+	}
+	for i := 0; i+8 <= len(b); i += 8 {
+		s0 += order.Uint32(b[i:]) + s1
+		s1 += order.Uint32(b[i+4:]) + s0
+	}
+	return s0, s1
+}
+
+// walInfo writes the header and the frames of the WAL file name.
+func walInfo(s *shell, name string) error {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return err
+	}
+
+	s.printf("WAL file %s, %d bytes\n", name, len(b))
+	if len(b) < walHeaderSize {
+		s.printf("no header, the WAL file is empty or was reset\n")
+		return nil
+	}
+
+	h := b[:walHeaderSize]
+	magic := binary.BigEndian.Uint32(h)
+	if magic&^1 != walMagic {
+		return fmt.Errorf("%s: bad magic number %#08x", name, magic)
+	}
+
+	bigEndian := magic&1 != 0
+	pageSize := int(binary.BigEndian.Uint32(h[8:]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	salt1, salt2 := binary.BigEndian.Uint32(h[16:]), binary.BigEndian.Uint32(h[20:])
+	s0, s1 := walChecksum(h[:24], bigEndian, 0, 0)
+	headerOK := s0 == binary.BigEndian.Uint32(h[24:]) && s1 == binary.BigEndian.Uint32(h[28:])
+	order := "little endian"
+	if bigEndian {
+		order = "big endian"
+	}
+	s.printf("magic              %#08x (%s checksums)\n", magic, order)
+	s.printf("format version     %d\n", binary.BigEndian.Uint32(h[4:]))
+	s.printf("page size          %d\n", pageSize)
+	s.printf("checkpoint         %d\n", binary.BigEndian.Uint32(h[12:]))
+	s.printf("salt               %#08x %#08x\n", salt1, salt2)
+	s.printf("checksum           %#08x %#08x (%s)\n", binary.BigEndian.Uint32(h[24:]), binary.BigEndian.Uint32(h[28:]), validity(headerOK))
+	if pageSize < 512 || pageSize > 65536 || pageSize&(pageSize-1) != 0 {
+		return fmt.Errorf("%s: bad page size %d", name, pageSize)
+	}
+
+	s.printf("%-7s %-10s %-8s %-8s %-21s %s\n", "frame", "offset", "page", "commit", "salt", "checksum")
+	valid := headerOK
+	frames, lastCommit := 0, 0
+	for off := walHeaderSize; off+walFrameHeaderSize+pageSize <= len(b); off += walFrameHeaderSize + pageSize {
+		frames++
+		f := b[off : off+walFrameHeaderSize]
+		fs1, fs2 := binary.BigEndian.Uint32(f[8:]), binary.BigEndian.Uint32(f[12:])
+		if valid {
+			s0, s1 = walChecksum(f[:8], bigEndian, s0, s1)
+			s0, s1 = walChecksum(b[off+walFrameHeaderSize:off+walFrameHeaderSize+pageSize], bigEndian, s0, s1)
+			valid = fs1 == salt1 && fs2 == salt2 && s0 == binary.BigEndian.Uint32(f[16:]) && s1 == binary.BigEndian.Uint32(f[20:])
+		}
+		commit := ""
+		if n := binary.BigEndian.Uint32(f[4:]); n != 0 {
+			commit = strconv.Itoa(int(n))
+			if valid {
+				lastCommit = frames
+			}
+		}
+		s.printf("%-7d %-10d %-8d %-8s %#08x %#08x  %s\n", frames, off, binary.BigEndian.Uint32(f), commit, fs1, fs2, validity(valid))
+	}
+	if rest := (len(b) - walHeaderSize) % (walFrameHeaderSize + pageSize); rest != 0 {
+		s.printf("%d bytes of a partial frame at the end\n", rest)
+	}
+	s.printf("%d frames, %d committed\n", frames, lastCommit)
+	return nil
+}
+
+func validity(ok bool) string {
+	if ok {
+		return "valid"
+	}
+
+	return "invalid"
+}